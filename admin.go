@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin wraps an admin endpoint so it only runs for requests that
+// carry the admin token as "Authorization: Bearer <token>".
+func (h *Hub) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return h.requireToken("admin", h.cfg.adminToken, next)
+}
+
+// requireIntegration wraps an integration endpoint so it only runs for
+// requests that carry the integration token the same way.
+func (h *Hub) requireIntegration(next http.HandlerFunc) http.HandlerFunc {
+	return h.requireToken("integration", h.cfg.integrationToken, next)
+}
+
+// requireToken wraps next so it only runs for requests that carry want as
+// a bearer token. kind names the token in errors and logs.
+func (h *Hub) requireToken(kind, want string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			warnf("Rejected %s request %s %s from %s", kind, r.Method, r.URL.Path, clientIP(r, h.cfg.trustProxy))
+			http.Error(w, "invalid or missing "+kind+" token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// room returns the named room, or nil if nobody is in it.
+func (h *Hub) room(name string) *Room {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.rooms[name]
+}
+
+// maxContentBodyOverhead is how much larger than -max-message-size a
+// {"content": "..."} body may be, to leave room for the JSON around the
+// content.
+const maxContentBodyOverhead = 64
+
+// readContent decodes a {"content": "..."} body, replying with an error and
+// returning false if it isn't valid. Content is capped at -max-message-size,
+// as over the WebSocket.
+func (h *Hub) readContent(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Content string `json:"content"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.maxMessageSize+maxContentBodyOverhead)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "body must be JSON like {\"content\": \"...\"}", http.StatusBadRequest)
+		return "", false
+	}
+	if strings.TrimSpace(body.Content) == "" {
+		http.Error(w, "content must not be empty", http.StatusBadRequest)
+		return "", false
+	}
+	if int64(len(body.Content)) > h.cfg.maxMessageSize {
+		http.Error(w, fmt.Sprintf("content must be at most %d bytes", h.cfg.maxMessageSize), http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	return body.Content, true
+}
+
+// handleAnnounce posts {"content": "..."} to a room as a system notice.
+func (h *Hub) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	content, ok := h.readContent(w, r)
+	if !ok {
+		return
+	}
+
+	room := h.room(r.PathValue("name"))
+	if room == nil {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	infof("Announcement posted to room %s (%d bytes)", room.name, len(content))
+	room.handleMessage([]byte(content), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAnnounceAll posts {"content": "..."} to every active room as a
+// system notice, and replies with how many rooms it went to as
+// {"rooms": n}. With -redis, only rooms with clients on this instance are
+// reached, though their clients on other instances get it too.
+func (h *Hub) handleAnnounceAll(w http.ResponseWriter, r *http.Request) {
+	content, ok := h.readContent(w, r)
+	if !ok {
+		return
+	}
+
+	rooms := h.roomList()
+	infof("Announcement posted to %d rooms (%d bytes)", len(rooms), len(content))
+	for _, room := range rooms {
+		room.handleMessage([]byte(content), nil)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rooms int `json:"rooms"`
+	}{len(rooms)})
+}
+
+// handlePostMessage posts {"content": "..."} to a room as a chat message
+// from the integration, the way the finance bot posts its replies.
+func (h *Hub) handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	content, ok := h.readContent(w, r)
+	if !ok {
+		return
+	}
+
+	room := h.room(r.PathValue("name"))
+	if room == nil {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+
+	infof("Integration %s posted to room %s (%d bytes)", h.cfg.integrationName, room.name, len(content))
+	room.deliver(Message{Type: msgChat, From: h.cfg.integrationName, Content: content})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// post sends body to path with token as a bearer token, if set, and
+// returns the status and response body.
+func post(t *testing.T, ts *testServer, path, token, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestAnnounce(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.adminToken = "s3cret"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws/lobby?username=alice")
+	bob := ts.join(t, "/ws/other?username=bob")
+
+	if code, body := post(t, ts, "/rooms/lobby/announce", "s3cret", `{"content": "Maintenance at 22:00"}`); code != http.StatusNoContent {
+		t.Fatalf("announce = %d %q, want 204", code, body)
+	}
+	alice.expectContent(msgSystem, "Maintenance at 22:00")
+	bob.expectQuiet("another room's announcement", func(msg Message) bool {
+		return msg.Content == "Maintenance at 22:00"
+	}, 100*time.Millisecond)
+}
+
+func TestAnnounceIsRefused(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.adminToken = "s3cret"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws/lobby?username=alice")
+
+	tests := []struct {
+		name, path, token, body string
+		code                    int
+	}{
+		{"no token", "/rooms/lobby/announce", "", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"wrong token", "/rooms/lobby/announce", "guess", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"missing room", "/rooms/nowhere/announce", "s3cret", `{"content": "hi"}`, http.StatusNotFound},
+		{"not JSON", "/rooms/lobby/announce", "s3cret", "hi", http.StatusBadRequest},
+		{"empty content", "/rooms/lobby/announce", "s3cret", `{"content": "  "}`, http.StatusBadRequest},
+		{"too long", "/rooms/lobby/announce", "s3cret", `{"content": "` + strings.Repeat("x", int(cfg.maxMessageSize)+1) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if code, body := post(t, ts, tt.path, tt.token, tt.body); code != tt.code {
+			t.Errorf("%s: %d %q, want %d", tt.name, code, body, tt.code)
+		}
+	}
+	alice.expectQuiet("a refused announcement", func(msg Message) bool {
+		return msg.Content == "hi" || strings.HasPrefix(msg.Content, "xxx")
+	}, 100*time.Millisecond)
+
+	// Content as long as chat may be is fine, JSON around it and all
+	longest := strings.Repeat("x", int(cfg.maxMessageSize))
+	if code, body := post(t, ts, "/rooms/lobby/announce", "s3cret", `{"content": "`+longest+`"}`); code != http.StatusNoContent {
+		t.Errorf("announcing %d bytes = %d %q, want 204", len(longest), code, body)
+	}
+	alice.expect("the longest announcement", func(msg Message) bool { return msg.Content == longest })
+}
+
+func TestAnnounceIsOffWithoutAToken(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	ts.join(t, "/ws/lobby?username=alice")
+	if code, _ := post(t, ts, "/rooms/lobby/announce", "", `{"content": "hi"}`); code == http.StatusNoContent {
+		t.Error("announce accepted without -admin-token")
+	}
+}
+
+func TestAnnounceAll(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.adminToken = "s3cret"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws/lobby?username=alice")
+	bob := ts.join(t, "/ws/lobby?username=bob")
+	carol := ts.join(t, "/ws/other?username=carol")
+
+	code, body := post(t, ts, "/announce", "s3cret", `{"content": "Maintenance at 22:00"}`)
+	if code != http.StatusOK || strings.TrimSpace(body) != `{"rooms":2}` {
+		t.Fatalf("announce = %d %q, want 200 {\"rooms\":2}", code, body)
+	}
+	for _, c := range []*testClient{alice, bob, carol} {
+		c.expectContent(msgSystem, "Maintenance at 22:00")
+	}
+
+	for _, tt := range []struct {
+		name, token, body string
+		code              int
+	}{
+		{"no token", "", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"wrong token", "guess", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"empty content", "s3cret", `{"content": ""}`, http.StatusBadRequest},
+	} {
+		if code, body := post(t, ts, "/announce", tt.token, tt.body); code != tt.code {
+			t.Errorf("%s: %d %q, want %d", tt.name, code, body, tt.code)
+		}
+	}
+	carol.expectQuiet("a refused announcement", func(msg Message) bool {
+		return msg.Content == "hi"
+	}, 100*time.Millisecond)
+}
+
+func TestPostMessage(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.integrationToken = "hook"
+	cfg.integrationName = "CI"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws/builds?username=alice")
+	bob := ts.join(t, "/ws/other?username=bob")
+
+	if code, body := post(t, ts, "/rooms/builds/messages", "hook", `{"content": "Build #42 passed ✅"}`); code != http.StatusNoContent {
+		t.Fatalf("post = %d %q, want 204", code, body)
+	}
+	alice.expect("the integration's message", isChat("CI", "Build #42 passed ✅"))
+	bob.expectQuiet("another room's message", func(msg Message) bool {
+		return msg.From == "CI"
+	}, 100*time.Millisecond)
+
+	// It is kept as history like any chat message
+	carol := ts.join(t, "/ws/builds?username=carol")
+	if !slices.ContainsFunc(carol.before, isChat("CI", "Build #42 passed ✅")) {
+		t.Errorf("carol's history %+v lacks the integration's message", carol.before)
+	}
+}
+
+func TestPostMessageIsRefused(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.integrationToken = "hook"
+	cfg.adminToken = "s3cret"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws/builds?username=alice")
+
+	tests := []struct {
+		name, path, token, body string
+		code                    int
+	}{
+		{"no token", "/rooms/builds/messages", "", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"wrong token", "/rooms/builds/messages", "guess", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"admin token", "/rooms/builds/messages", "s3cret", `{"content": "hi"}`, http.StatusUnauthorized},
+		{"missing room", "/rooms/nowhere/messages", "hook", `{"content": "hi"}`, http.StatusNotFound},
+		{"not JSON", "/rooms/builds/messages", "hook", "hi", http.StatusBadRequest},
+		{"empty content", "/rooms/builds/messages", "hook", `{"content": "  "}`, http.StatusBadRequest},
+		{"too long", "/rooms/builds/messages", "hook", `{"content": "` + strings.Repeat("x", int(cfg.maxMessageSize)+1) + `"}`, http.StatusRequestEntityTooLarge},
+		{"far too long", "/rooms/builds/messages", "hook", `{"content": "` + strings.Repeat("x", 2*int(cfg.maxMessageSize)) + `"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, body := post(t, ts, tt.path, tt.token, tt.body); code != tt.code {
+			t.Errorf("%s: %d %q, want %d", tt.name, code, body, tt.code)
+		}
+	}
+	if code, _ := post(t, ts, "/rooms/builds/messages", "hook", `{"content": "`+strings.Repeat("x", int(cfg.maxMessageSize))+`"}`); code != http.StatusNoContent {
+		t.Errorf("content of exactly the limit got %d, want 204", code)
+	}
+	alice.expectQuiet("a refused message", func(msg Message) bool {
+		return msg.Content == "hi"
+	}, 100*time.Millisecond)
+}
+
+func TestPostMessageIsOffWithoutAToken(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	ts.join(t, "/ws/builds?username=alice")
+	if code, _ := post(t, ts, "/rooms/builds/messages", "", `{"content": "hi"}`); code == http.StatusNoContent {
+		t.Error("message accepted without -integration-token")
+	}
+}
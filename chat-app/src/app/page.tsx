@@ -5,125 +5,289 @@ import { PaperAirplaneIcon } from '@heroicons/react/24/solid'
 
 interface Message {
   id: number
+  serverId?: number
+  deliveredTo?: string[]
+  reactions?: Record<string, number>
+  myReactions?: string[]
+  replyTo?: number
+  file?: SharedFile
+  preview?: LinkPreview
   username: string
   content: string
-  type: 'message' | 'private' | 'system'
+  type: 'message' | 'private' | 'system' | 'action'
   timestamp: Date
 }
 
+// SharedFile is a file someone sent as a binary frame; url is its download path
+interface SharedFile {
+  url: string
+  name?: string
+  mime: string
+  size: number
+}
+
+// LinkPreview is the server's summary of a page linked in a chat message
+interface LinkPreview {
+  url: string
+  title: string
+  description?: string
+  image?: string
+}
+
+// Envelope is the JSON frame the server sends for every message
+interface Envelope {
+  id?: number
+  type: 'chat' | 'system' | 'private' | 'key' | 'peer-key' | 'sealed' | 'command' | 'username' | 'action' | 'typing' | 'ack' | 'reactions' | 'file' | 'preview' | 'delete' | 'session' | 'clear'
+  from?: string
+  publicKey?: string
+  reactions?: Record<string, number>
+  replyTo?: number
+  file?: { name?: string, mime: string, size: number, sha256?: string }
+  preview?: LinkPreview
+  to?: string
+  content: string
+  ts: string
+}
+
 interface Command {
   name: string
   description: string
 }
 
+// Reactions offered on every message
+const REACTIONS = ['👍', '❤️', '😂']
+
+// How often to tell the room we're typing, and how long an indicator lasts
+const TYPING_INTERVAL_MS = 2000
+const TYPING_TIMEOUT_MS = 4000
+
+// Files bigger than this are uploaded in chunks of this size (see upload.go)
+const CHUNK_SIZE = 64 * 1024
+
+// Must match sessionKeyLabel and endToEndKeyLabel on the server
+const SESSION_KEY_LABEL = 'fastchat session key v1'
+const END_TO_END_KEY_LABEL = 'fastchat end-to-end key v1'
+
+const base64ToBytes = (b64: string) => Uint8Array.from(atob(b64), c => c.charCodeAt(0))
+
+const bytesToBase64 = (bytes: Uint8Array) => btoa(String.fromCharCode(...bytes))
+
+// Must match privateAAD on the server: binds a private message to its sender and recipient
+const privateAAD = (from: string, to: string) => new TextEncoder().encode(`private\0${from}\0${to}`)
+
+// Completes an X25519 key agreement: SHA-256(label || shared secret) is the
+// AES-256 key, exactly as the server derives it. With the server's public key
+// and SESSION_KEY_LABEL that is this session's key; with another user's and
+// END_TO_END_KEY_LABEL it seals private messages only the two of us can read.
+const deriveKey = async (label: string, privateKey: CryptoKey, peerPublicKey: string) => {
+  const peerKey = await crypto.subtle.importKey('raw', base64ToBytes(peerPublicKey), { name: 'X25519' }, false, [])
+  const shared = new Uint8Array(await crypto.subtle.deriveBits({ name: 'X25519', public: peerKey }, privateKey, 256))
+  const labelBytes = new TextEncoder().encode(label)
+  const material = new Uint8Array(labelBytes.length + shared.length)
+  material.set(labelBytes)
+  material.set(shared, labelBytes.length)
+  return new Uint8Array(await crypto.subtle.digest('SHA-256', material))
+}
+
 export default function Chat() {
   const [messages, setMessages] = useState<Message[]>([])
   const [inputMessage, setInputMessage] = useState('')
   const [username, setUsername] = useState('')
   const [ws, setWs] = useState<WebSocket | null>(null)
   const messagesEndRef = useRef<HTMLDivElement>(null)
-  const encryptionKeyRef = useRef<Uint8Array | null>(null)
+  const encryptionKeyRef = useRef<Promise<Uint8Array> | null>(null)
+  const privateKeyRef = useRef<CryptoKey | null>(null)
+  // Callbacks waiting for a user's public key, answering our 'peer-key' requests
+  const peerKeyWaitersRef = useRef<Map<string, ((publicKey: string) => void)[]>>(new Map())
   const [showCommands, setShowCommands] = useState(false)
   const [showUsers, setShowUsers] = useState(false)
   const [connectedUsers, setConnectedUsers] = useState<string[]>([])
+  const [typingUsers, setTypingUsers] = useState<string[]>([])
+  const [replyingTo, setReplyingTo] = useState<Message | null>(null)
+  const typingTimersRef = useRef<Map<string, ReturnType<typeof setTimeout>>>(new Map())
+  const lastTypingSentRef = useRef(0)
+  const usernameRef = useRef('')
 
   useEffect(() => {
     const name = prompt('Enter your username:') || 'Anonymous'
     setUsername(name)
 
-    const websocket = new WebSocket(`ws://localhost:8080/ws?username=${name}`)
-    setWs(websocket)
+    let websocket: WebSocket | null = null
+    let cancelled = false
 
-    websocket.onmessage = async (e) => {
-      console.log("Received raw message:", e.data);
-      
-      if (e.data.startsWith('ENCRYPTION_KEY:')) {
-        const keyBase64 = e.data.replace('ENCRYPTION_KEY:', '').trim()
+    const connect = async () => {
+      // Key agreement: the server answers our public key with its own in the 'key' frame
+      const keyPair = await crypto.subtle.generateKey({ name: 'X25519' }, false, ['deriveBits']) as CryptoKeyPair
+      const publicKey = bytesToBase64(new Uint8Array(await crypto.subtle.exportKey('raw', keyPair.publicKey)))
+      if (cancelled) {
+        return
+      }
+      privateKeyRef.current = keyPair.privateKey
+
+      websocket = new WebSocket(`ws://localhost:8080/ws?username=${encodeURIComponent(name)}&pubkey=${encodeURIComponent(publicKey)}&locale=${encodeURIComponent(navigator.language)}&session=${encodeURIComponent(sessionStorage.getItem('fastchat-session') ?? '')}`)
+      setWs(websocket)
+
+      websocket.onmessage = async (e) => {
+        console.log("Received raw message:", e.data);
+
+        let envelope: Envelope
         try {
-          const binaryStr = window.atob(keyBase64)
-          const key = new Uint8Array(binaryStr.length)
-          for (let i = 0; i < binaryStr.length; i++) {
-            key[i] = binaryStr.charCodeAt(i)
-          }
-          encryptionKeyRef.current = key
-          console.log("Received encryption key, length:", key.length, "bytes")
-          return
+          envelope = JSON.parse(e.data)
         } catch (error) {
-          console.error("Error setting encryption key:", error)
+          console.error("Error parsing message:", error)
           return
         }
-      }
-
-      if (e.data.includes('FinanceBot 🤖:')) {
-        const [botName, ...contentParts] = e.data.split(': ');
-        const newMessage: Message = {
-          id: Date.now(),
-          username: botName,
-          content: contentParts.join(': '),
-          type: 'message' as const,
-          timestamp: new Date()
-        };
-        console.log("Adding bot message:", newMessage);
-        setMessages(prev => [...prev, newMessage]);
-        return;
-      }
 
-      if (e.data.startsWith('USERLIST:')) {
-        const users = e.data.replace('USERLIST:', '').split(',');
-        setConnectedUsers(users);
-        return;
-      }
-
-      try {
-        // Check if it's a private message
-        if (e.data.startsWith('[Private')) {
-          const encryptedPart = e.data.split(': ')[1];
-          const decryptedContent = await decryptMessage(encryptedPart, encryptionKeyRef.current);
-          const newMessage: Message = {
-            id: Date.now(),
-            username: decryptedContent.includes(':') 
-              ? `🔒 ${decryptedContent.split(':')[0]}`
-              : `🔒 ${decryptedContent}`,
-            content: decryptedContent.includes(':') 
-              ? decryptedContent.split(':')[1] 
-              : decryptedContent,
-            type: 'private',
-            timestamp: new Date()
-          };
-          setMessages(prev => [...prev, newMessage]);
-          return;
+        const addMessage = (message: Omit<Message, 'id' | 'timestamp'>) => {
+          setMessages(prev => [...prev, { ...message, id: Date.now(), serverId: envelope.id, timestamp: new Date(envelope.ts) }])
         }
 
-        // Handle other messages
-        const decryptedContent = await decryptMessage(e.data, encryptionKeyRef.current);
-        const newMessage: Message = {
-          id: Date.now(),
-          username: decryptedContent.includes(':') ? decryptedContent.split(':')[0] : decryptedContent,
-          content: decryptedContent.includes(':') ? decryptedContent.split(':')[1] : decryptedContent,
-          type: decryptedContent.includes('[Private]') ? 'private' : 
-                decryptedContent.includes('joined') ? 'system' : 'message',
-          timestamp: new Date()
+        // Acknowledge other people's messages so they know they arrived
+        const acknowledge = () => {
+          if (envelope.id && envelope.from !== usernameRef.current) {
+            websocket?.send(JSON.stringify({ type: 'ack', id: envelope.id }))
+          }
         }
 
-        setMessages(prev => [...prev, newMessage])
+        try {
+          switch (envelope.type) {
+            case 'key':
+              encryptionKeyRef.current = deriveKey(SESSION_KEY_LABEL, keyPair.privateKey, envelope.content)
+              break
+
+            case 'peer-key': {
+              const user = envelope.from ?? ''
+              peerKeyWaitersRef.current.get(user)?.forEach(resolve => resolve(envelope.publicKey ?? ''))
+              peerKeyWaitersRef.current.delete(user)
+              break
+            }
+
+            case 'username':
+              setUsername(envelope.content)
+              usernameRef.current = envelope.content
+              break
+
+            case 'session':
+              // Lets a reload within a couple of minutes pick up where we left off
+              sessionStorage.setItem('fastchat-session', envelope.content)
+              break
+
+            case 'ack':
+              setMessages(prev => prev.map(m => m.serverId === envelope.id && !m.deliveredTo?.includes(envelope.from ?? '')
+                ? { ...m, deliveredTo: [...(m.deliveredTo ?? []), envelope.from ?? ''] }
+                : m))
+              break
+
+            case 'reactions':
+              setMessages(prev => prev.map(m => m.serverId === envelope.id ? { ...m, reactions: envelope.reactions ?? {} } : m))
+              break
+
+            case 'clear':
+              setMessages([])
+              break
+
+            case 'delete':
+              setMessages(prev => prev.filter(m => m.serverId !== envelope.id))
+              break
+
+            case 'preview':
+              setMessages(prev => prev.map(m => m.serverId === envelope.replyTo ? { ...m, preview: envelope.preview } : m))
+              break
+
+            case 'command':
+            case 'chat':
+              addMessage({ username: envelope.from ?? '', content: envelope.content, type: 'message', replyTo: envelope.replyTo })
+              setTypingUsers(prev => prev.filter(u => u !== envelope.from))
+              acknowledge()
+              break
+
+            case 'file':
+              addMessage({
+                username: envelope.from ?? '',
+                content: '',
+                type: 'message',
+                file: { url: envelope.content, name: envelope.file?.name, mime: envelope.file?.mime ?? '', size: envelope.file?.size ?? 0 }
+              })
+              acknowledge()
+              break
+
+            case 'typing': {
+              const user = envelope.from ?? ''
+              setTypingUsers(prev => prev.includes(user) ? prev : [...prev, user])
+              clearTimeout(typingTimersRef.current.get(user))
+              typingTimersRef.current.set(user, setTimeout(() => {
+                setTypingUsers(prev => prev.filter(u => u !== user))
+                typingTimersRef.current.delete(user)
+              }, TYPING_TIMEOUT_MS))
+              break
+            }
 
-        // Handle system messages for user updates
-        if (decryptedContent.includes('joined the chat') || decryptedContent.includes('left the chat')) {
-          // Extract username from system message
-          const user = decryptedContent.split(' ')[0];
-          if (decryptedContent.includes('joined')) {
-            setConnectedUsers(prev => [...new Set([...prev, user])]);
-          } else {
-            setConnectedUsers(prev => prev.filter(u => u !== user));
+            case 'action':
+              addMessage({ username: envelope.from ?? '', content: envelope.content, type: 'action' })
+              acknowledge()
+              break
+
+            case 'private': {
+              const decryptedContent = await decryptMessage(envelope.content, encryptionKeyRef.current, privateAAD(envelope.from ?? '', envelope.to ?? ''))
+              addMessage({ username: `🔒 ${envelope.from} → ${envelope.to?.split(',').join(', ')}`, content: decryptedContent, type: 'private' })
+              break
+            }
+
+            case 'sealed': {
+              // Sealed end to end: the server relays it unopened, with the
+              // public key of the other user to agree the key with
+              const key = deriveKey(END_TO_END_KEY_LABEL, keyPair.privateKey, envelope.publicKey ?? '')
+              const decryptedContent = await decryptMessage(envelope.content, key, privateAAD(envelope.from ?? '', envelope.to ?? ''))
+              addMessage({ username: `🔐 ${envelope.from} → ${envelope.to}`, content: decryptedContent, type: 'private' })
+              break
+            }
+
+            case 'system': {
+              addMessage({ username: 'System', content: envelope.content, type: 'system' })
+
+              // Track connected users from join/leave/rename notices
+              const user = envelope.content.split(' ')[0]
+              const rename = envelope.content.match(/^(\S+) is now known as (\S+)$/)
+              // Match whole notices, since /away messages can contain any text
+              if (/^\S+ joined the chat$/.test(envelope.content)) {
+                setConnectedUsers(prev => [...new Set([...prev, user])])
+              } else if (/^\S+ left the chat$/.test(envelope.content)) {
+                setConnectedUsers(prev => prev.filter(u => u !== user))
+              } else if (rename) {
+                setConnectedUsers(prev => [...new Set(prev.map(u => u === rename[1] ? rename[2] : u))])
+              }
+              break
+            }
           }
+        } catch (error) {
+          console.error("Error processing message:", error);
+        }
+      }
+
+      websocket.onclose = (e) => {
+        // The server explains rejected connections (e.g. an invalid username) in the close reason
+        if (e.reason) {
+          setMessages(prev => [...prev, {
+            id: Date.now(),
+            username: 'System',
+            content: `Disconnected: ${e.reason}`,
+            type: 'system',
+            timestamp: new Date()
+          }])
+        }
+        // 1012 (service restart) asks for a new connection, e.g. because our
+        // key stopped working; the session picks up where this one left off
+        if (e.code === 1012 && !cancelled) {
+          connect()
         }
-      } catch (error) {
-        console.error("Error processing message:", error);
       }
     }
 
+    connect()
+
     return () => {
-      websocket.close()
+      cancelled = true
+      websocket?.close()
     }
   }, [])
 
@@ -131,16 +295,20 @@ export default function Chat() {
     messagesEndRef.current?.scrollIntoView({ behavior: 'smooth' })
   }, [messages])
 
-  const decryptMessage = async (encryptedMsg: string, key: Uint8Array | null) => {
-    if (!key) {
-      console.log('Waiting for encryption key...')
-      return encryptedMsg
+  // Private message content is base64(nonce || ciphertext || tag), AES-256-GCM
+  // under this client's own key, or for sealed messages the end-to-end key,
+  // with privateAAD(from, to) as additional data.
+  // Never show ciphertext if decryption fails.
+  const decryptMessage = async (encryptedMsg: string, keyPromise: Promise<Uint8Array> | null, additionalData: Uint8Array) => {
+    if (!keyPromise) {
+      console.error('Private message arrived before the encryption key')
+      return '[unable to decrypt message]'
     }
 
     try {
       const cryptoKey = await crypto.subtle.importKey(
         "raw",
-        key,
+        await keyPromise,
         {
           name: "AES-GCM",
           length: 256
@@ -158,7 +326,8 @@ export default function Chat() {
       const decrypted = await crypto.subtle.decrypt(
         {
           name: "AES-GCM",
-          iv: nonce
+          iv: nonce,
+          additionalData
         },
         cryptoKey,
         ciphertext
@@ -166,23 +335,258 @@ export default function Chat() {
 
       return new TextDecoder().decode(decrypted)
     } catch (error) {
-      console.log('Message might not be encrypted:', encryptedMsg)
-      return encryptedMsg
+      console.error('Error decrypting private message:', error)
+      return '[unable to decrypt message]'
     }
   }
 
-  const sendMessage = (e: React.FormEvent) => {
+  // Encrypts a private message under keyPromise: this client's own key, when
+  // the server is to seal it again for each recipient and only accepts each
+  // ciphertext once, or the end-to-end key shared with its one recipient.
+  const encryptMessage = async (text: string, keyPromise: Promise<Uint8Array>, additionalData: Uint8Array) => {
+    const cryptoKey = await crypto.subtle.importKey("raw", await keyPromise, { name: "AES-GCM" }, false, ["encrypt"])
+    const nonce = crypto.getRandomValues(new Uint8Array(12))
+    const ciphertext = new Uint8Array(await crypto.subtle.encrypt(
+      { name: "AES-GCM", iv: nonce, additionalData },
+      cryptoKey,
+      new TextEncoder().encode(text)
+    ))
+    const sealed = new Uint8Array(nonce.length + ciphertext.length)
+    sealed.set(nonce)
+    sealed.set(ciphertext, nonce.length)
+    return bytesToBase64(sealed)
+  }
+
+  // Asks the server for a user's public key. Unknown users are reported by
+  // the bot instead, so give up after a while.
+  const requestPeerKey = (socket: WebSocket, user: string) => new Promise<string>((resolve, reject) => {
+    const waiters = peerKeyWaitersRef.current
+    waiters.set(user, [...(waiters.get(user) ?? []), resolve])
+    socket.send(JSON.stringify({ type: 'peer-key', to: user }))
+    setTimeout(() => reject(new Error(`no public key for ${user}`)), 5000)
+  })
+
+  const sendMessage = async (e: React.FormEvent) => {
     e.preventDefault()
     if (inputMessage.trim() && ws) {
-      ws.send(inputMessage)
+      // Private messages are sent encrypted instead of as plain "@user text"
+      // or "/dm user text"
+      const privateMatch = inputMessage.match(/^(?:@|\/(?:dm|msg) +)(\S+) ([\s\S]+)$/i)
+      if (privateMatch && !privateMatch[1].includes(',') && privateKeyRef.current) {
+        // A message to one user is sealed end to end, so the server can't
+        // read it
+        const [, to, text] = privateMatch
+        setInputMessage('')
+        setReplyingTo(null)
+        try {
+          const key = deriveKey(END_TO_END_KEY_LABEL, privateKeyRef.current, await requestPeerKey(ws, to))
+          const content = await encryptMessage(text, key, privateAAD(username, to))
+          ws.send(JSON.stringify({ type: 'sealed', to, content }))
+        } catch (error) {
+          console.error('Error sealing private message:', error)
+        }
+        return
+      } else if (privateMatch && encryptionKeyRef.current) {
+        // Group messages are sealed for the server, which seals each copy
+        // again for its recipient
+        const [, to, text] = privateMatch
+        const content = await encryptMessage(text, encryptionKeyRef.current, privateAAD(username, to))
+        ws.send(JSON.stringify({ type: 'private', to, content }))
+      } else if (replyingTo?.serverId) {
+        // Replies go as a chat frame so they can name the parent message
+        ws.send(JSON.stringify({ type: 'chat', content: inputMessage, replyTo: replyingTo.serverId }))
+      } else {
+        ws.send(inputMessage)
+      }
       setInputMessage('')
+      setReplyingTo(null)
     }
   }
 
+  // Small files are sent as a single binary frame, bigger ones as a
+  // file-begin, numbered chunks and a file-end. Either way the server
+  // answers with a 'file' message linking to the upload, or a notice if it
+  // was refused.
+  const sendFile = async (e: React.ChangeEvent<HTMLInputElement>) => {
+    const file = e.target.files?.[0]
+    e.target.value = ''
+    if (!file || !ws) {
+      return
+    }
+    const data = new Uint8Array(await file.arrayBuffer())
+    if (data.length <= CHUNK_SIZE) {
+      ws.send(data)
+      return
+    }
+
+    const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', data))
+    const sha256 = Array.from(digest, b => b.toString(16).padStart(2, '0')).join('')
+    ws.send(JSON.stringify({ type: 'file-begin', file: { name: file.name, size: data.length, sha256 } }))
+    for (let seq = 0; seq * CHUNK_SIZE < data.length; seq++) {
+      const part = data.subarray(seq * CHUNK_SIZE, (seq + 1) * CHUNK_SIZE)
+      const chunk = new Uint8Array(4 + part.length)
+      new DataView(chunk.buffer).setUint32(0, seq)
+      chunk.set(part, 4)
+      ws.send(chunk)
+    }
+    ws.send(JSON.stringify({ type: 'file-end' }))
+  }
+
+  // Adds our reaction to a message, or takes it back if we already reacted
+  const toggleReaction = (msg: Message, emoji: string) => {
+    if (!ws || !msg.serverId) return
+    const mine = msg.myReactions ?? []
+    const remove = mine.includes(emoji)
+    ws.send(JSON.stringify({ type: remove ? 'unreact' : 'react', id: msg.serverId, emoji }))
+    setMessages(prev => prev.map(m => m.id === msg.id
+      ? { ...m, myReactions: remove ? mine.filter(e => e !== emoji) : [...mine, emoji] }
+      : m))
+  }
+
   const commands: Command[] = [
     {
       name: 'saving',
-      description: '💰 Calculate your 10-year savings potential'
+      description: '💰 Calculate your 10-year savings potential (optionally /saving <amount>)'
+    },
+    {
+      name: 'savinggoal',
+      description: '🎯 Track your progress toward a savings goal: /savinggoal set <target> | add <amount> | reset'
+    },
+    {
+      name: 'compound',
+      description: '📈 Compound growth: /compound <principal> <rate%> <years>'
+    },
+    {
+      name: 'mortgage',
+      description: '🏠 Monthly loan payment: /mortgage <principal> <rate%> <years>'
+    },
+    {
+      name: 'split',
+      description: '🧾 Split a bill: /split <total> <people> [tip <pct>]'
+    },
+    {
+      name: 'vat',
+      description: '🧾 Add VAT to a net amount, or take it out of a gross one with -gross: /vat <amount> [rate%] [-gross]'
+    },
+    {
+      name: 'ephemeral',
+      description: '⏳ Send a message that is deleted after a while: /ephemeral <seconds> <message>'
+    },
+    {
+      name: 'export',
+      description: "📦 Get a link to download this room's recent history"
+    },
+    {
+      name: 'history',
+      description: "📜 Show the room's last messages to you alone: /history [count]"
+    },
+    {
+      name: 'reminder',
+      description: '⏰ Get a private reminder later: /reminder <delay> <message>, e.g. /reminder 10m check the oven'
+    },
+    {
+      name: 'locale',
+      description: '🌐 Choose how numbers are written for you: /locale [locale], e.g. /locale en-US'
+    },
+    {
+      name: 'convert',
+      description: '💱 Convert currency: /convert <amount> <from> <to>'
+    },
+    {
+      name: 'stock',
+      description: '📊 Latest stock price: /stock <symbol>, e.g. /stock AAPL'
+    },
+    {
+      name: 'crypto',
+      description: '🪙 Coin price and 24h change: /crypto <coin> [currency], e.g. /crypto BTC NOK'
+    },
+    {
+      name: 'inflation',
+      description: '📉 Adjust kroner for inflation: /inflation <amount> <fromYear> <toYear>'
+    },
+    {
+      name: 'who',
+      description: '👥 List the users in this room'
+    },
+    {
+      name: 'stats',
+      description: '📈 Show who\'s online, how many rooms are open, messages sent and the server\'s uptime'
+    },
+    {
+      name: 'me',
+      description: '✨ Describe an action: /me <action>'
+    },
+    {
+      name: 'dm',
+      description: '✉️ Send a private message to one or more users: /dm <username>[,<username>...] <message>'
+    },
+    {
+      name: 'nick',
+      description: '🏷️ Change your name: /nick <newname>'
+    },
+    {
+      name: 'roll',
+      description: '🎲 Roll dice: /roll [count]d<sides>, e.g. /roll 2d6'
+    },
+    {
+      name: 'time',
+      description: '🕒 Current time, optionally in a time zone: /time [zone], e.g. /time Europe/Oslo'
+    },
+    {
+      name: 'poll',
+      description: '📊 Start a poll: /poll "<question>" <option> <option>...'
+    },
+    {
+      name: 'vote',
+      description: '🗳️ Vote in the open poll: /vote <number>'
+    },
+    {
+      name: 'results',
+      description: "📋 Show the open poll's results"
+    },
+    {
+      name: 'endpoll',
+      description: '🏁 Close the poll you started'
+    },
+    {
+      name: 'away',
+      description: '💤 Mark yourself as away: /away [message]'
+    },
+    {
+      name: 'back',
+      description: '👋 Mark yourself as back'
+    },
+    {
+      name: 'mute',
+      description: '🔇 Stop seeing messages from a user: /mute <username>'
+    },
+    {
+      name: 'unmute',
+      description: "🔊 See a muted user's messages again: /unmute <username>"
+    },
+    {
+      name: 'block',
+      description: '⛔ Refuse private messages from a user: /block <username>'
+    },
+    {
+      name: 'unblock',
+      description: "✅ Accept a blocked user's private messages again: /unblock <username>"
+    },
+    {
+      name: 'kick',
+      description: '👢 Disconnect a user (moderators only): /kick <username>'
+    },
+    {
+      name: 'ban',
+      description: '🚫 Disconnect and ban a user (moderators only): /ban <username>'
+    },
+    {
+      name: 'clear',
+      description: '🧹 Clear the room\'s history, and with "all" its saved messages (moderators only): /clear [all]'
+    },
+    {
+      name: 'help',
+      description: '📖 List all available commands'
     }
   ]
 
@@ -195,6 +599,12 @@ export default function Chat() {
     
     // Show users when typing '@'
     setShowUsers(value.startsWith('@'))
+
+    // Let the room know we're typing, at most once per interval
+    if (ws && value && !value.startsWith('/') && Date.now() - lastTypingSentRef.current > TYPING_INTERVAL_MS) {
+      lastTypingSentRef.current = Date.now()
+      ws.send(JSON.stringify({ type: 'typing' }))
+    }
   }
 
   return (
@@ -216,6 +626,8 @@ export default function Chat() {
               className={`p-4 rounded-lg ${
                 msg.type === 'system' 
                   ? 'bg-gray-200 text-gray-600' 
+                  : msg.type === 'action'
+                  ? 'bg-white text-gray-600 italic'
                   : msg.type === 'private'
                   ? 'bg-orange-100 text-orange-800'
                   : msg.username === username
@@ -225,24 +637,76 @@ export default function Chat() {
                 msg.type !== 'system' && 'max-w-[80%]'
               }`}
             >
-              {msg.type !== 'system' && (
+              {msg.type !== 'system' && msg.type !== 'action' && (
                 <div className="font-semibold text-sm mb-1">
                   {msg.username}
                 </div>
               )}
-              <div className="break-words">
+              {msg.replyTo && (() => {
+                const parent = messages.find(m => m.serverId === msg.replyTo)
+                return (
+                  <div className="text-xs border-l-2 border-current opacity-75 pl-2 mb-1 truncate">
+                    {parent ? `${parent.username}: ${parent.content}` : 'Reply to an earlier message'}
+                  </div>
+                )
+              })()}
+              <div className="break-words whitespace-pre-line">
                 {msg.content}
               </div>
+              {msg.preview && (
+                <a href={msg.preview.url} target="_blank" rel="noopener noreferrer" className="block mt-2 p-2 rounded border border-current opacity-90">
+                  <div className="font-semibold text-sm">{msg.preview.title}</div>
+                  {msg.preview.description && <div className="text-xs">{msg.preview.description}</div>}
+                </a>
+              )}
+              {msg.file && (
+                <a href={`http://localhost:8080${msg.file.url}`} target="_blank" rel="noopener noreferrer" className="underline">
+                  📎 {msg.file.name ?? msg.file.mime} ({msg.file.size.toLocaleString()} bytes)
+                </a>
+              )}
               <div className="text-xs opacity-75 mt-1">
                 {msg.timestamp.toLocaleTimeString()}
+                {msg.deliveredTo && msg.deliveredTo.length > 0 && ` · ✓ ${msg.deliveredTo.length}`}
               </div>
+              {msg.serverId && (msg.type === 'message' || msg.type === 'action') && (
+                <div className="flex gap-1 mt-2 text-sm">
+                  {REACTIONS.map(emoji => (
+                    <button
+                      key={emoji}
+                      type="button"
+                      onClick={() => toggleReaction(msg, emoji)}
+                      className={`px-2 rounded-full border ${
+                        msg.myReactions?.includes(emoji) ? 'bg-orange-200 border-orange-400' : 'bg-white/50 border-gray-300'
+                      }`}
+                    >
+                      {emoji}{msg.reactions?.[emoji] ? ` ${msg.reactions[emoji]}` : ''}
+                    </button>
+                  ))}
+                  {msg.type === 'message' && (
+                    <button type="button" onClick={() => setReplyingTo(msg)} className="px-2 rounded-full border bg-white/50 border-gray-300">
+                      ↩ Reply
+                    </button>
+                  )}
+                </div>
+              )}
             </div>
           ))}
+          {typingUsers.length > 0 && (
+            <div className="text-sm text-gray-500 italic">
+              {typingUsers.join(', ')} {typingUsers.length === 1 ? 'is' : 'are'} typing…
+            </div>
+          )}
           <div ref={messagesEndRef} />
         </div>
       </div>
 
       <form onSubmit={sendMessage} className="p-4 border-t bg-white relative">
+        {replyingTo && (
+          <div className="max-w-3xl mx-auto mb-2 text-sm text-gray-600 flex justify-between">
+            <span className="truncate">Replying to {replyingTo.username}: {replyingTo.content}</span>
+            <button type="button" onClick={() => setReplyingTo(null)} className="ml-2 text-gray-400">✕</button>
+          </div>
+        )}
         <div className="max-w-3xl mx-auto flex space-x-4">
           <div className="flex-1 relative">
             <input
@@ -292,6 +756,10 @@ export default function Chat() {
               </div>
             )}
           </div>
+          <label className="px-4 py-2 bg-gray-200 text-gray-700 rounded-lg hover:bg-gray-300 cursor-pointer" title="Share a file">
+            📎
+            <input type="file" onChange={sendFile} className="hidden" />
+          </label>
           <button
             type="submit"
             className="px-4 py-2 bg-orange-500 text-white rounded-lg hover:bg-orange-600 focus:outline-none focus:ring-2 focus:ring-orange-500 focus:ring-offset-2"
@@ -1,44 +1,204 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	mathrand "math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+type Client struct {
+	conn       *websocket.Conn
+	hub        *Hub
+	ip         string     // Address the client connected from, see clientIP
+	isMod      bool       // Connected with the moderator token; may /kick and /ban
+	identity   uint64     // Who the client is, kept when it resumes a session; never 0 once connected
+	username   string     // Read with name once the client has joined; /nick changes it
+	nameMu     sync.Mutex // Guards username
+	key        *keyRing   // Each client gets their own encryption keys
+	room       *Room
+	outbox     chan outFrame // Frames waiting for writePump, the connection's only writer
+	done       chan struct{} // Closed when the connection's handler returns
+	evictOnce  sync.Once
+	limiter    *rateLimiter          // Nil when rate limiting is disabled
+	controls   *rateLimiter          // Limits control frames apart from chat; nil when rate limiting is disabled
+	upload     *upload               // Chunked upload in progress; owned by the read loop
+	nonces     *nonceCache[[12]byte] // Nonces of private messages this client has sent under its session key
+	keyErrors  atomic.Int32          // Encryptions and decryptions with key that failed in a row; see keyFailed
+	keys       *keyCache             // Idempotency keys of frames this client has sent; owned by the read loop
+	lastTyping time.Time             // When a typing event from this client was last relayed
+	lastActive atomic.Int64          // When the client last sent a message, in Unix nanoseconds
+	muted      map[string]bool       // Usernames this client doesn't want to hear from; guarded by muteMu
+	muteMu     sync.Mutex
+	blocked    map[string]bool // Usernames whose private messages this client refuses; guarded by blockMu
+	blockMu    sync.Mutex
+	away       bool   // Set by /away until /back or the client's next chat message; guarded by awayMu
+	awayMsg    string // Optional message shown with the away status; guarded by awayMu
+	awayMu     sync.Mutex
+	locale     locale      // How numbers in replies to this client's commands are written; owned by the read loop
+	session    string      // Token the client can resume its session with after a disconnect; see session.go
+	kicked     atomic.Bool // Set when a moderator disconnects the client, whose session then ends
 }
 
-type Client struct {
-	conn     *websocket.Conn
-	username string
-	key      []byte // Each client gets their own encryption key
+// name returns the client's current username.
+func (c *Client) name() string {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	return c.username
+}
+
+// setName changes the client's username. Only the room's run goroutine may
+// call it, so the room's set of names stays in step.
+func (c *Client) setName(name string) {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	c.username = name
+}
+
+// mute stops messages from the named user reaching the client. Mutes last
+// only as long as the connection, or the session if it resumes.
+func (c *Client) mute(name string) {
+	c.muteMu.Lock()
+	defer c.muteMu.Unlock()
+	if c.muted == nil {
+		c.muted = make(map[string]bool)
+	}
+	c.muted[name] = true
+}
+
+// unmute undoes mute, reporting whether the user was muted.
+func (c *Client) unmute(name string) bool {
+	c.muteMu.Lock()
+	defer c.muteMu.Unlock()
+	wasMuted := c.muted[name]
+	delete(c.muted, name)
+	return wasMuted
+}
+
+// hasMuted reports whether the client has muted the named user.
+func (c *Client) hasMuted(name string) bool {
+	c.muteMu.Lock()
+	defer c.muteMu.Unlock()
+	return c.muted[name]
+}
+
+// block stops private messages from the named user reaching the client.
+// Like mutes, blocks last as long as the connection or its session.
+func (c *Client) block(name string) {
+	c.blockMu.Lock()
+	defer c.blockMu.Unlock()
+	if c.blocked == nil {
+		c.blocked = make(map[string]bool)
+	}
+	c.blocked[name] = true
+}
+
+// unblock undoes block, reporting whether the user was blocked.
+func (c *Client) unblock(name string) bool {
+	c.blockMu.Lock()
+	defer c.blockMu.Unlock()
+	wasBlocked := c.blocked[name]
+	delete(c.blocked, name)
+	return wasBlocked
+}
+
+// hasBlocked reports whether the client has blocked the named user.
+func (c *Client) hasBlocked(name string) bool {
+	c.blockMu.Lock()
+	defer c.blockMu.Unlock()
+	return c.blocked[name]
+}
+
+// setAway marks the client as away, with an optional message.
+func (c *Client) setAway(message string) {
+	c.awayMu.Lock()
+	defer c.awayMu.Unlock()
+	c.away, c.awayMsg = true, message
 }
 
-type Room struct {
-	clients map[*Client]bool
-	mutex   sync.Mutex
-	users   map[string]bool // Track connected users
+// clearAway marks the client as present again, reporting whether it was
+// away.
+func (c *Client) clearAway() bool {
+	c.awayMu.Lock()
+	defer c.awayMu.Unlock()
+	wasAway := c.away
+	c.away, c.awayMsg = false, ""
+	return wasAway
+}
+
+// awayStatus returns the client's away message and whether it is away.
+func (c *Client) awayStatus() (string, bool) {
+	c.awayMu.Lock()
+	defer c.awayMu.Unlock()
+	return c.awayMsg, c.away
+}
+
+// idleWarningLead is how long before an idle client is disconnected that it
+// is warned. Short idle timeouts warn halfway instead.
+const idleWarningLead = time.Minute
+
+// touch records that the client just sent something.
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// watchIdle disconnects the client once it has sent nothing for timeout,
+// warning it first. It returns when done is closed.
+func (c *Client) watchIdle(timeout time.Duration, done <-chan struct{}) {
+	warnAt := timeout - min(idleWarningLead, timeout/2)
+	warned := false
+	timer := time.NewTimer(warnAt)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, c.lastActive.Load()))
+		switch {
+		case idle >= timeout:
+			infof("Disconnecting idle client %s from %s", c.name(), c.ip)
+			kick(c, "You were disconnected for being idle.")
+			return
+		case idle >= warnAt:
+			if !warned {
+				c.send(Message{Type: msgSystem, Content: fmt.Sprintf("You have been idle for a while and will be disconnected in %s unless you send something.", max(time.Second, (timeout-idle).Round(time.Second)))})
+				warned = true
+			}
+			timer.Reset(timeout - idle)
+		default:
+			warned = false
+			timer.Reset(warnAt - idle)
+		}
+	}
 }
 
 type Command struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases,omitempty"` // Other names that run the command
+	Description string   `json:"description"`
 }
 
 type CommandResponse struct {
@@ -50,326 +210,964 @@ type CommandResponse struct {
 type Bot struct {
 	name string
 	room *Room
-}
 
-// Create a bot for financial commands
-var financeBot = &Bot{name: "FinanceBot 🤖"}
+	randMu sync.Mutex
+	rand   *mathrand.Rand // Picks random savings amounts; seeded from the clock
+
+	savingsMin, savingsMax int // Range of the monthly amounts picked for savings tips
 
-func init() {
-	mathrand.Seed(time.Now().UnixNano())
+	lang string // Language of the bot's messages; see catalog
+
+	goalsMu sync.Mutex
+	goals   map[uint64]*savingsGoal // Savings goals set with /savinggoal, by client identity
 }
 
-func generateKey() []byte {
-	key := make([]byte, 32) // AES-256 requires 32 bytes
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
-		log.Fatal(err)
+// Default range of the monthly amounts picked for savings tips
+const (
+	defaultSavingsMin = 900
+	defaultSavingsMax = 8000
+)
+
+// Name used by the finance bot in every room unless -bot-name says otherwise
+const defaultBotName = "FinanceBot 🤖"
+
+// calculateSavings projects ten years of saving monthlyAmount kr per month,
+// as a tip in lang with numbers written for loc. A zero amount picks a
+// random monthly amount between minMonthly and maxMonthly, inclusive, from
+// rng.
+func calculateSavings(lang string, loc locale, monthlyAmount, minMonthly, maxMonthly int, rng *mathrand.Rand) string {
+	if monthlyAmount == 0 {
+		monthlyAmount = minMonthly + rng.Intn(maxMonthly-minMonthly+1)
 	}
-	return key
+	yearlyAmount := monthlyAmount * 12
+	tenYearAmount := yearlyAmount * 10
+
+	// Format numbers with thousand separators
+	return translate(lang, "savings.tip",
+		formatNumber(monthlyAmount, loc),
+		formatNumber(tenYearAmount, loc))
 }
 
-func encrypt(text string, key []byte) (string, error) {
-	if len(key) != 32 {
-		return "", fmt.Errorf("invalid key size: must be 32 bytes")
+// formatNumber formats n with its thousands grouped as loc writes them.
+func formatNumber(n int, loc locale) string {
+	u := uint64(n)
+	if n < 0 {
+		u = uint64(-int64(n)) // -math.MinInt64 wraps to itself, which is still 1<<63 as uint64
 	}
 
-	plaintext := []byte(text)
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
+	// Write the digits from the least significant end of a buffer large
+	// enough for any int: 20 digits, 6 separators and a sign
+	var buf [27]byte
+	i := len(buf)
+	for digits := 0; ; digits++ {
+		if digits > 0 && digits%3 == 0 {
+			i--
+			buf[i] = loc.thousands
+		}
+		i--
+		buf[i] = byte('0' + u%10)
+		u /= 10
+		if u == 0 {
+			break
+		}
 	}
+	if n < 0 {
+		i--
+		buf[i] = '-'
+	}
+	return string(buf[i:])
+}
 
-	nonce := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+// formatDecimal formats f with the given number of decimals, grouped and
+// separated as loc writes them, e.g. 1.234.567,90 for nb-NO or 1,234,567.90
+// for en-US. Halves round away from zero at the requested precision.
+func formatDecimal(f float64, decimals int, loc locale) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if decimals < 0 {
+		decimals = 0
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
+	// Round the shortest decimal representation of f rather than f itself,
+	// so 1234567.895 rounds up as written instead of down as stored.
+	digits := strconv.FormatFloat(math.Abs(f), 'f', -1, 64)
+	intPart, fracPart, _ := strings.Cut(digits, ".")
+	roundUp := len(fracPart) > decimals && fracPart[decimals] >= '5'
+	fracPart = (fracPart + strings.Repeat("0", decimals))[:decimals]
+	if roundUp {
+		intPart, fracPart = incrementDecimal(intPart, fracPart)
 	}
 
-	ciphertext := aesgcm.Seal(nonce, nonce, plaintext, nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	result := groupThousands(intPart, loc.thousands)
+	if decimals > 0 {
+		result += string(loc.decimal) + fracPart
+	}
+	if f < 0 && strings.Trim(intPart+fracPart, "0") != "" {
+		result = "-" + result
+	}
+	return result
 }
 
-func decrypt(encrypted string, key []byte) (string, error) {
-	if len(key) != 32 {
-		return "", fmt.Errorf("invalid key size: must be 32 bytes")
+// incrementDecimal adds one unit in the last place to the number
+// intPart.fracPart, both given as plain digit strings.
+func incrementDecimal(intPart, fracPart string) (string, string) {
+	digits := []byte(intPart + fracPart)
+	i := len(digits) - 1
+	for ; i >= 0 && digits[i] == '9'; i-- {
+		digits[i] = '0'
 	}
-
-	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
-	if err != nil {
-		return "", err
+	if i >= 0 {
+		digits[i]++
+	} else {
+		digits = append([]byte{'1'}, digits...)
 	}
+	split := len(digits) - len(fracPart)
+	return string(digits[:split]), string(digits[split:])
+}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
+// groupThousands puts sep between every three digits of an unsigned digit
+// string.
+func groupThousands(str string, sep byte) string {
+	if len(str) <= 3 {
+		return str
 	}
-
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
+	result := make([]byte, 0, len(str)+(len(str)-1)/3)
+	first := len(str) % 3
+	if first == 0 {
+		first = 3
 	}
-
-	nonceSize := 12
-	if len(ciphertext) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
+	result = append(result, str[:first]...)
+	for i := first; i < len(str); i += 3 {
+		result = append(result, sep)
+		result = append(result, str[i:i+3]...)
 	}
+	return string(result)
+}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return "", err
-	}
+// sendBufferSize is how many frames may wait to be written to a client
+// before it counts as too slow and is disconnected.
+const sendBufferSize = 256
+
+// minCompressSize is the smallest frame worth compressing. gorilla/websocket
+// compresses each message on its own (no context takeover), and the deflate
+// overhead makes typical short chat frames slightly larger, not smaller.
+const minCompressSize = 256
 
-	return string(plaintext), nil
+// errSlowClient is returned for writes to a client that was disconnected
+// because its send buffer filled up.
+var errSlowClient = errors.New("client is too slow, send buffer full")
+
+// outFrame is a frame queued for a client. A close frame is written last:
+// writePump closes the connection after it.
+type outFrame struct {
+	data  []byte
+	close bool
 }
 
-func NewRoom() *Room {
-	return &Room{
-		clients: make(map[*Client]bool),
-		users:   make(map[string]bool),
-	}
+// write queues a text frame for the client without waiting for it to be
+// sent, so one slow reader can't hold up the room. A client whose buffer is
+// full is disconnected instead.
+func (c *Client) write(message []byte) error {
+	return c.enqueue(outFrame{data: message})
 }
 
-func calculateSavings() string {
-	monthlyAmount := 900 + mathrand.Intn(7101) // 8000 - 900 + 1 = 7101
-	yearlyAmount := monthlyAmount * 12
-	tenYearAmount := yearlyAmount * 10
+// closeWith sends the client a close frame with the given code and reason
+// once the frames already queued are written, then closes the connection.
+func (c *Client) closeWith(code int, reason string) {
+	c.enqueue(outFrame{data: websocket.FormatCloseMessage(code, reason), close: true})
+}
 
-	// Format numbers with thousand separators
-	return fmt.Sprintf("💰 Financial Tip: If you save %s kr per month, you'll have %s kr in 10 years!",
-		formatNumber(monthlyAmount),
-		formatNumber(tenYearAmount))
+func (c *Client) enqueue(frame outFrame) error {
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case c.outbox <- frame:
+		return nil
+	default:
+		c.evict()
+		return errSlowClient
+	}
 }
 
-func formatNumber(n int) string {
-	// Convert to string and reverse for easier processing
-	str := strconv.Itoa(n)
-	var result []byte
+// evict disconnects a client that isn't reading fast enough. Closing the
+// connection ends its read loop, which removes it from the room.
+func (c *Client) evict() {
+	c.evictOnce.Do(func() {
+		warnf("Disconnecting slow client %s from %s: send buffer full", c.name(), c.ip)
+		metrics.slowClientsEvicted.Add(1)
+		c.conn.Close()
+	})
+}
 
-	for i := len(str) - 1; i >= 0; i-- {
-		if len(result) > 0 && (len(str)-i-1)%3 == 0 {
-			result = append(result, '.')
+// writePump writes queued frames to the connection until done is closed or
+// a write fails. gorilla/websocket allows only one concurrent writer per
+// connection, so nothing else may write data frames. Each write must finish
+// within the write timeout, so a client whose TCP connection has stalled is
+// dropped instead of holding its writer forever.
+func (c *Client) writePump() {
+	timeout := c.hub.cfg.writeTimeout
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.outbox:
+			if frame.close {
+				c.conn.WriteControl(websocket.CloseMessage, frame.data, time.Now().Add(min(timeout, time.Second)))
+				c.conn.Close()
+				return
+			}
+			// Has no effect unless compression was negotiated for this connection
+			c.conn.EnableWriteCompression(len(frame.data) >= minCompressSize)
+			c.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame.data); err != nil {
+				var netErr net.Error
+				switch {
+				case errors.Is(err, net.ErrClosed): // Already closed, e.g. by evict
+				case errors.As(err, &netErr) && netErr.Timeout():
+					warnf("Disconnecting %s: write timed out after %v", c.name(), timeout)
+					metrics.writeTimeouts.Add(1)
+				default:
+					warnf("Write error for %s: %v", c.name(), err)
+				}
+				// Closing the connection ends the client's read loop,
+				// which unregisters it.
+				c.conn.Close()
+				return
+			}
 		}
-		result = append(result, str[i])
 	}
+}
 
-	// Reverse back
-	for i := 0; i < len(result)/2; i++ {
-		result[i], result[len(result)-1-i] = result[len(result)-1-i], result[i]
-	}
+// keepalive pings the client every interval until done is closed. A failed
+// ping closes the connection, which ends the client's read loop.
+func (c *Client) keepalive(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	return string(result)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.rotateIdleKey()
+			// WriteControl may be called concurrently with other writes
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+			if err != nil {
+				warnf("Ping error for %s: %v", c.name(), err)
+				c.conn.Close()
+				return
+			}
+		}
+	}
 }
 
 func (b *Bot) SendMessage(message string) {
 	if b.room != nil {
-		botMessage := fmt.Sprintf("%s: %s", b.name, message)
-		log.Printf("Bot sending message: %s", botMessage)
-		// Send directly to all clients
-		for client := range b.room.clients {
-			err := client.conn.WriteMessage(websocket.TextMessage, []byte(botMessage))
-			if err != nil {
-				log.Printf("Error sending bot message: %v", err)
-			}
-		}
+		debugf("Bot reply in room %s (%d bytes)", b.room.name, len(message))
+		b.room.deliver(Message{Type: msgCommand, From: b.name, Content: message})
 	} else {
-		log.Printf("Error: Bot has no room assigned")
+		errorf("Bot has no room assigned")
 	}
 }
 
-func (room *Room) broadcast(message []byte, sender *Client) {
-	room.mutex.Lock()
-	defer room.mutex.Unlock()
-
-	messageStr := string(message)
-	log.Printf("Broadcasting message: %s", messageStr)
+// sendTo replies to a single client rather than the whole room.
+func (b *Bot) sendTo(client *Client, message string) {
+	client.send(Message{Type: msgCommand, From: b.name, Content: message})
+}
 
-	// Assign room to bot if not set
-	if financeBot.room == nil {
-		log.Printf("Assigning room to bot")
-		financeBot.room = room
+// sendPrivate sends client an encrypted private message from the bot.
+func (b *Bot) sendPrivate(client *Client, message string) error {
+	to := client.name()
+	err := client.sendSealed(Message{Type: msgPrivate, From: b.name, To: to}, message, privateAAD(b.name, to))
+	if err != nil {
+		client.send(Message{Type: msgSystem, Content: translate(b.lang, "private.notEncrypted")})
 	}
+	return err
+}
 
-	// Check if message is a command
-	if strings.HasPrefix(messageStr, "/") {
-		log.Printf("Command detected")
-		command := strings.TrimPrefix(messageStr, "/")
-		command = strings.TrimSpace(command)
-		log.Printf("Processing command: %s", command)
+// handleMessage routes a message from sender: commands go to the bot,
+// "@user text" becomes a private message and anything else is chat for the
+// whole room. A nil sender makes it a system notice.
+func (room *Room) handleMessage(message []byte, sender *Client) {
+	messageStr := string(message)
 
-		switch command {
-		case "saving":
-			log.Printf("Processing saving command")
-			financeBot.SendMessage(calculateSavings())
-			return
-		default:
-			financeBot.SendMessage("Unknown command. Available commands: /saving")
-			return
-		}
+	// Messages without a sender are system notices
+	if sender == nil {
+		debugf("System notice in room %s (%d bytes)", room.name, len(message))
+		room.deliver(Message{Type: msgSystem, Content: messageStr})
+		return
 	}
 
-	// If the message starts with username:, it's a regular message
-	if strings.Contains(messageStr, ": /") {
-		parts := strings.SplitN(messageStr, ": /", 2)
-		if len(parts) == 2 {
-			command := strings.TrimSpace(parts[1])
-			log.Printf("Processing command from chat: %s", command)
+	originalMsg := strings.TrimPrefix(messageStr, sender.name()+": ")
+	if strings.TrimSpace(originalMsg) == "" {
+		sender.send(Message{Type: msgSystem, Content: "Chat messages must not be empty."})
+		return
+	}
 
-			switch command {
-			case "saving":
-				log.Printf("Processing saving command")
-				financeBot.SendMessage(calculateSavings())
-				return
-			default:
-				financeBot.SendMessage("Unknown command. Available commands: /saving")
-				return
-			}
-		}
+	// Only a message that starts with "/" is a command; a slash anywhere
+	// else is just text.
+	if strings.HasPrefix(originalMsg, "/") {
+		room.handleCommand(sender, strings.TrimPrefix(originalMsg, "/"))
+		return
 	}
 
-	// Skip broadcasting if no sender (used for system/bot messages)
-	if sender == nil {
-		log.Printf("Broadcasting system/bot message: %s", messageStr)
-		for client := range room.clients {
-			err := client.conn.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				log.Printf("Error sending system message: %v", err)
-			}
-		}
+	target, text, err := parsePrivate(originalMsg)
+	switch {
+	case err == nil:
+		room.sendPrivate(sender, target, text)
+		return
+	case !errors.Is(err, errNotPrivate):
+		debugf("Malformed private message from %s: %v", sender.name(), err)
+		room.bot.sendTo(sender, translate(room.bot.lang, "private.usage"))
 		return
 	}
 
-	originalMsg := strings.TrimPrefix(messageStr, sender.username+": ")
+	if room.linkBlocked(sender, originalMsg) {
+		return
+	}
 
-	if strings.HasPrefix(originalMsg, "@") {
-		parts := strings.SplitN(originalMsg[1:], " ", 2)
-		if len(parts) == 2 {
-			targetUsername := parts[0]
-			privateMessage := parts[1]
+	room.markBack(sender)
 
-			// Include sender's username in the message before encryption
-			messageWithSender := fmt.Sprintf("%s: %s", sender.username, privateMessage)
+	// Regular messages go to everyone in the room as-is
+	room.deliverFrom(sender, Message{Type: msgChat, From: sender.name(), Content: originalMsg})
+}
 
-			// Encrypt private message with sender's key
-			encryptedMsg, err := encrypt(messageWithSender, sender.key)
-			if err != nil {
-				log.Printf("Encryption error: %v", err)
-				return
-			}
+// errNotPrivate is returned by parsePrivate for lines that aren't meant as
+// private messages at all, as opposed to malformed ones.
+var errNotPrivate = errors.New("not a private message")
 
-			for client := range room.clients {
-				if client.username == targetUsername {
-					// Re-encrypt message with recipient's key
-					reEncryptedMsg, err := encrypt(messageWithSender, client.key)
-					if err != nil {
-						log.Printf("Re-encryption error: %v", err)
-						return
-					}
-
-					client.conn.WriteMessage(websocket.TextMessage,
-						[]byte(fmt.Sprintf("[Private from %s]: %s", sender.username, reEncryptedMsg)))
-					sender.conn.WriteMessage(websocket.TextMessage,
-						[]byte(fmt.Sprintf("[Private to %s]: %s", targetUsername, encryptedMsg)))
-					return
-				}
-			}
-			sender.conn.WriteMessage(websocket.TextMessage,
-				[]byte(fmt.Sprintf("User %s not found", targetUsername)))
-			return
-		}
+// parsePrivate splits "@user text" into its target and text. A line that
+// doesn't start with "@" gets errNotPrivate; one that does but lacks a name
+// or any text to send, such as "@" or "@alice ", is an error of its own, so
+// it isn't sent to the whole room by mistake.
+func parsePrivate(line string) (target, text string, err error) {
+	rest, ok := strings.CutPrefix(line, "@")
+	if !ok {
+		return "", "", errNotPrivate
+	}
+	target, text, _ = strings.Cut(rest, " ")
+	if target == "" {
+		return "", "", errors.New("no recipient after @")
 	}
+	if strings.TrimSpace(text) == "" {
+		return "", "", fmt.Errorf("no message for %s", target)
+	}
+	return target, text, nil
+}
 
-	// For regular messages
-	messageWithUsername := fmt.Sprintf("%s: %s", sender.username, originalMsg)
+// maxRecipients is the most users one private message may go to.
+const maxRecipients = 10
 
-	// Encrypt and then decrypt for each client
-	for client := range room.clients {
-		encryptedMsg, err := encrypt(messageWithUsername, client.key)
-		if err != nil {
-			log.Printf("Encryption error: %v", err)
+// sendPrivate delivers a private message to the named user, or to several
+// named as "alice,bob", and echoes it back to the sender once. Each copy's
+// Content is encrypted with the key of the client receiving it (see
+// msgPrivate), so every side decrypts with its own key. To lists the
+// recipients found; unknown ones are reported to the sender without
+// holding up the rest, as are those who blocked the sender, though
+// without saying why. Both "@user text" and /dm send through it.
+func (room *Room) sendPrivate(sender *Client, to, text string) {
+	names := strings.Split(to, ",")
+	if len(names) > maxRecipients {
+		room.bot.sendTo(sender, translate(room.bot.lang, "private.tooMany", maxRecipients))
+		return
+	}
+
+	clients := make(map[string]*Client)
+	for _, client := range room.snapshot() {
+		clients[client.name()] = client
+	}
+	from := sender.name()
+	var targets []*Client
+	var found, unknown, withheld []string
+	for _, name := range names {
+		if name == "" || slices.Contains(found, name) || slices.Contains(unknown, name) || slices.Contains(withheld, name) {
 			continue
 		}
+		switch target := clients[name]; {
+		case target == nil:
+			unknown = append(unknown, name)
+		case target.hasBlocked(from):
+			withheld = append(withheld, name)
+		default:
+			targets = append(targets, target)
+			found = append(found, name)
+		}
+	}
+	if len(unknown) == 1 {
+		room.bot.sendTo(sender, translate(room.bot.lang, "user.notFound", unknown[0]))
+	} else if len(unknown) > 1 {
+		room.bot.sendTo(sender, translate(room.bot.lang, "users.notFound", strings.Join(unknown, ", ")))
+	}
+	// The sender is told a message was withheld, but not that it was
+	// because the recipient blocked them
+	if len(withheld) > 0 {
+		room.bot.sendTo(sender, translate(room.bot.lang, "private.undelivered", strings.Join(withheld, ", ")))
+	}
+	if len(targets) == 0 {
+		return
+	}
 
-		// Decrypt the message before sending
-		decryptedMsg, err := decrypt(encryptedMsg, client.key)
-		if err != nil {
-			log.Printf("Decryption error: %v", err)
+	recipients := strings.Join(found, ",")
+	aad := privateAAD(from, recipients)
+	msg := Message{Type: msgPrivate, From: from, To: recipients}
+	var failed []string
+	for _, target := range targets {
+		// A target that muted the sender doesn't get the message, but the
+		// sender isn't told, just as with muted chat
+		if target.hasMuted(from) {
 			continue
 		}
+		if target.sendSealed(msg, text, aad) != nil {
+			target.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "private.notEncryptedFrom", from)})
+			failed = append(failed, target.name())
+		}
+	}
+	if len(failed) > 0 {
+		room.bot.sendTo(sender, translate(room.bot.lang, "private.undelivered", strings.Join(failed, ", ")))
+	}
+	if len(failed) == len(targets) {
+		return
+	}
+	if sender.sendSealed(msg, text, aad) != nil {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "private.ownCopy")})
+	}
 
-		err = client.conn.WriteMessage(websocket.TextMessage, []byte(decryptedMsg))
-		if err != nil {
-			log.Printf("Write error: %v", err)
-			client.conn.Close()
-			delete(room.clients, client)
+	for _, target := range targets {
+		if message, away := target.awayStatus(); away {
+			sender.send(Message{Type: msgSystem, Content: awayText(room.bot.lang, target.name(), message)})
 		}
 	}
 }
 
-func handleConnections(room *Room, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// receivePrivate opens a private message the sender encrypted under its own
+// session key and relays it with sendPrivate. Each ciphertext is accepted
+// only once, so captured messages can't be replayed.
+func (room *Room) receivePrivate(sender *Client, targetUsername, encrypted string) {
+	text, err := sender.open(encrypted, privateAAD(sender.name(), targetUsername))
 	if err != nil {
-		log.Printf("Upgrade error: %v", err)
+		warnf("Rejected private message from %s: %v", sender.name(), err)
+		// A replay is someone resending a captured ciphertext, not a key
+		// going bad, so it counts apart from encryption errors
+		if errors.Is(err, errReplay) {
+			metrics.replaysRejected.Add(1)
+			sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "private.replay")})
+			return
+		}
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "private.unverified")})
+		sender.keyFailed()
+		return
+	}
+	sender.keyErrors.Store(0)
+	room.sendPrivate(sender, targetUsername, text)
+}
+
+// receiveSealed relays a private message the sender sealed end to end, under
+// a key agreed with the recipient's public key (see deriveEndToEndKey). The
+// server doesn't have that key, so it passes the ciphertext on unopened and
+// checks only its form. Sealed messages go to one user in the room, and
+// blocks and mutes apply as for other private messages. Each copy carries
+// the public key its receiver agrees the key with: the sender's for the
+// recipient, the recipient's for the sender's echo. Each ciphertext is
+// relayed only once per sender public key, whichever connection sends it.
+func (room *Room) receiveSealed(sender *Client, to, sealed string) {
+	if strings.Contains(to, ",") {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "sealed.oneUser")})
+		return
+	}
+	nonce, ok := sealedNonce(sealed)
+	if !ok {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "sealed.invalid")})
+		return
+	}
+	from := sender.name()
+	target := room.clientNamed(to)
+	switch {
+	case target == nil:
+		room.bot.sendTo(sender, translate(room.bot.lang, "user.notFound", to))
+		return
+	case target.hasBlocked(from):
+		room.bot.sendTo(sender, translate(room.bot.lang, "private.undelivered", to))
+		return
+	}
+	// The hub, not the connection, remembers what was relayed, so someone
+	// joining later under the sender's name and public key can't replay a
+	// captured ciphertext either
+	if !sender.hub.sealed.add(sealedID{sender: sender.publicKey(), nonce: nonce}) {
+		warnf("Rejected a replayed sealed message from %s", from)
+		metrics.replaysRejected.Add(1)
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "private.replay")})
 		return
 	}
 
+	msg := Message{Type: msgSealed, From: from, To: to, Content: sealed}
+	if !target.hasMuted(from) {
+		msg.PublicKey = sender.publicKey()
+		target.send(msg)
+	}
+	msg.PublicKey = target.publicKey()
+	sender.send(msg)
+	if message, away := target.awayStatus(); away {
+		sender.send(Message{Type: msgSystem, Content: awayText(room.bot.lang, to, message)})
+	}
+}
+
+// sendPeerKey answers a msgPeerKey request with the public key of the user
+// named to, which sender needs to seal private messages to them.
+func (room *Room) sendPeerKey(sender *Client, to string) {
+	target := room.clientNamed(to)
+	if target == nil {
+		room.bot.sendTo(sender, translate(room.bot.lang, "user.notFound", to))
+		return
+	}
+	sender.send(Message{Type: msgPeerKey, From: to, PublicKey: target.publicKey()})
+}
+
+// maxUsernameLength is the longest username accepted, in runes.
+const maxUsernameLength = 32
+
+// validateUsername rejects names that can't be safely embedded in the
+// "username: message" wire format or addressed with @username.
+func validateUsername(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid username: must not be empty")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("invalid username: not valid UTF-8")
+	}
+	if utf8.RuneCountInString(name) > maxUsernameLength {
+		return fmt.Errorf("invalid username: longer than %d characters", maxUsernameLength)
+	}
+	for _, r := range name {
+		switch {
+		case r == ':' || r == '/' || r == '@' || r == ',':
+			return fmt.Errorf("invalid username: must not contain %q", r)
+		case unicode.IsSpace(r) || unicode.IsControl(r):
+			return fmt.Errorf("invalid username: must not contain whitespace or control characters")
+		}
+	}
+	return nil
+}
+
+// validateBotName checks a name for the finance bot. Unlike usernames it
+// may contain spaces, as the default does, but it must show up as something.
+func validateBotName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("must not be blank")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("not valid UTF-8")
+	}
+	if utf8.RuneCountInString(name) > maxUsernameLength {
+		return fmt.Errorf("longer than %d characters", maxUsernameLength)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("must not contain control characters")
+	}
+	return nil
+}
+
+func handleConnections(hub *Hub, roomName string, w http.ResponseWriter, r *http.Request) {
+	// Turn away banned and over-limit addresses before upgrading
+	ip := clientIP(r, hub.cfg.trustProxy)
+	if hub.isBanned(ip) {
+		warnf("Rejecting connection from banned address %s", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if hub.isBannedName(r.URL.Query().Get("username")) {
+		warnf("Rejecting connection from %s: username is banned", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !hub.acquireIP(ip) {
+		warnf("Rejecting connection from %s: too many connections", ip)
+		http.Error(w, "Too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	defer hub.releaseIP(ip)
+
+	seated := hub.acquireSeat(roomName)
+	if seated {
+		defer hub.releaseSeat(roomName)
+	}
+
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		warnf("Upgrade error: %v", err)
+		return
+	}
+	hub.conns.Add(1)
+	defer hub.conns.Done()
+
+	// A full room is refused after the upgrade, so browsers can show why
+	if !seated {
+		infof("Rejecting connection from %s: room %s is full", ip, roomName)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "room is full"),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	// A bug handling one client's messages must not take the server down.
+	// The deferred cleanup below has already removed the client from its
+	// room by the time this runs.
+	defer func() {
+		if p := recover(); p != nil {
+			errorf("Recovered from panic handling %s: %v\n%s", r.URL.Query().Get("username"), p, debug.Stack())
+			conn.Close()
+		}
+	}()
+
 	username := r.URL.Query().Get("username")
 	if username == "" {
 		username = "Anonymous"
 	}
 
-	// Generate unique encryption key for this client
-	clientKey := generateKey()
+	// Names are used as message prefixes and @mention targets, so reject any
+	// that could forge another sender or the command syntax.
+	if err := validateUsername(username); err != nil {
+		infof("Rejecting connection from %s: %v", ip, err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	// Agree on this client's encryption key
+	clientKey, serverPublicKey, err := newKeyRing(r.URL.Query().Get("pubkey"), hub.now())
+	if err != nil {
+		infof("Rejecting connection from %s: key agreement failed: %v", ip, err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "key agreement failed: send an X25519 public key as ?pubkey="),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
 
 	client := &Client{
 		conn:     conn,
+		hub:      hub,
+		ip:       ip,
+		isMod:    hub.isModerator(r.URL.Query().Get("mod_token")),
 		username: username,
 		key:      clientKey,
+		nonces:   newNonceCache[[12]byte](nonceCacheSize),
+		keys:     newKeyCache(maxIdempotencyKeys),
+		locale:   defaultLocale,
+		outbox:   make(chan outFrame, sendBufferSize+hub.cfg.historySize),
+		done:     make(chan struct{}),
+	}
+	if hub.cfg.rateLimit > 0 {
+		client.limiter = newRateLimiter(hub.cfg.rateLimit, hub.cfg.rateBurst, hub.now())
+		client.controls = newControlLimiter(hub.cfg, hub.now())
+	}
+	// Browsers pass their language here; locales we don't know keep the default
+	if loc, ok := findLocale(r.URL.Query().Get("locale")); ok {
+		client.locale = loc
 	}
+	// A client resuming its session is who it was before, whatever it asked for
+	resumed := hub.sessions.take(r.URL.Query().Get("session"), roomName, hub.now())
+	if resumed != nil {
+		client.resume(resumed)
+	} else {
+		client.identity = hub.identities.Add(1)
+	}
+	if client.session, err = newSessionToken(); err != nil {
+		errorf("Creating a session for %s: %v", ip, err)
+	}
+	go client.writePump()
+	defer close(client.done)
 
-	room.mutex.Lock()
-	room.clients[client] = true
-	room.users[client.username] = true
-	room.mutex.Unlock()
+	// Complete the handshake before joining the room, so the client can
+	// derive its key before any private message arrives
+	client.send(Message{Type: msgKey, Content: serverPublicKey})
 
-	// Send the client their encryption key
-	keyBase64 := base64.StdEncoding.EncodeToString(clientKey)
-	client.conn.WriteMessage(websocket.TextMessage,
-		[]byte(fmt.Sprintf("ENCRYPTION_KEY:%s", keyBase64)))
+	room := hub.join(roomName, client, resumed)
+	metrics.connectedClients.Add(1)
+	hub.connected.Add(1)
+	username = client.name()
 
-	log.Printf("New client connected: %s", username)
-	room.broadcast([]byte(fmt.Sprintf("%s joined the chat", username)), client)
+	// Runs exactly once however the read loop ends. The leave notice is sent
+	// after the client is removed and without any lock held.
+	defer func() {
+		room.abandonUpload(client)
+		hub.leave(client)
+		metrics.connectedClients.Add(-1)
+		hub.connected.Add(-1)
+		conn.Close()
+		infof("Client disconnected: %s from %s (room %s)", username, ip, room.name)
+		room.handleMessage([]byte(fmt.Sprintf("%s left the chat", username)), nil)
+	}()
+
+	// gorilla closes the connection with 1009 (message too big) and fails
+	// the read when a message exceeds the limit. Files may be larger than
+	// text messages, which are checked again below.
+	conn.SetReadLimit(max(hub.cfg.maxMessageSize, hub.cfg.maxFileSize))
+
+	// Drop clients that stop answering pings. Any pong pushes the read
+	// deadline forward; a missed one makes ReadMessage fail.
+	conn.SetReadDeadline(time.Now().Add(hub.cfg.pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(hub.cfg.pongTimeout))
+	})
+	// A client's own pings show it's alive too. Answer them as gorilla's
+	// default handler does; a failed pong surfaces as a read error.
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(hub.cfg.pongTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	})
+	go client.keepalive(hub.cfg.pingInterval, client.done)
+	if hub.cfg.idleTimeout > 0 {
+		client.touch()
+		go client.watchIdle(hub.cfg.idleTimeout, client.done)
+	}
+
+	// Tell the client which name it ended up with, since duplicates are renamed
+	client.send(Message{Type: msgUsername, Content: username})
+	if client.session != "" {
+		client.send(Message{Type: msgSession, Content: client.session})
+	}
+
+	if motd := hub.motdText(); motd != "" {
+		client.send(Message{Type: msgSystem, Content: motd})
+	}
+
+	infof("New client connected: %s from %s (room %s)", username, ip, room.name)
+	room.handleMessage([]byte(fmt.Sprintf("%s joined the chat", username)), nil)
+	// Reminders that fell due while a resumed client was away
+	hub.deliverReminders(reminderKey{identity: client.identity, room: room.name})
 
 	for {
-		_, msg, err := conn.ReadMessage()
+		msgType, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Read error: %v", err)
-			room.mutex.Lock()
-			delete(room.clients, client)
-			delete(room.users, client.username)
-			room.mutex.Unlock()
-			conn.Close()
+			// Closing normally or by navigating away is how clients leave;
+			// any other close, such as the connection dropping without a
+			// close frame (1006), is worth a warning
+			switch {
+			case websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+				warnf("Unexpected close from %s: %v", username, err)
+			case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+				debugf("%s closed the connection: %v", username, err)
+			default:
+				debugf("Read error: %v", err)
+			}
 			break
 		}
+		username = client.name() // /nick may have changed it
+
+		// Control frames never reach here: gorilla answers pings and
+		// reports close frames as errors. Anything else but text and
+		// binary isn't content.
+		if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
+			debugf("Ignoring frame of type %d from %s", msgType, username)
+			continue
+		}
+		client.touch()
+
+		// With file sharing on the read limit is the file size limit, so
+		// text messages need checking here.
+		if msgType == websocket.TextMessage && int64(len(msg)) > hub.cfg.maxMessageSize {
+			warnf("Dropping oversized message from %s (%d bytes)", username, len(msg))
+			client.send(Message{Type: msgSystem, Content: "Your message is too long and was not delivered."})
+			continue
+		}
+
+		// Chunks of an upload aren't messages; the upload's declared size
+		// limits them instead of the rate limiter. Once the upload has
+		// failed that limit is gone, so its chunks are charged like messages
+		if msgType == websocket.BinaryMessage && client.upload != nil && !client.upload.failed {
+			room.receiveChunk(client, msg)
+			continue
+		}
+
+		var frame Message
+		var isFrame bool
+		if msgType == websocket.TextMessage {
+			frame, isFrame = parseFrame(msg)
+		}
+
+		// Acks, typing events and reactions have a budget of their own, so
+		// a joiner acking replayed history can still chat straight away
+		if isFrame && isControlFrame(frame.Type) {
+			if client.controls != nil && !client.controls.allow(hub.now()) {
+				warnf("Control frame limit exceeded by %s, dropping %s frame", username, frame.Type)
+				continue
+			}
+		} else if client.limiter != nil && !client.limiter.allow(hub.now()) {
+			warnf("Rate limit exceeded by %s, dropping message", username)
+			client.send(Message{Type: msgSystem, Content: "You're sending messages too fast. Your message was not delivered."})
+			continue
+		}
 
+		if msgType == websocket.BinaryMessage {
+			if client.upload != nil {
+				continue // A chunk of the failed upload
+			}
+			debugf("File from %s in room %s (%d bytes)", username, room.name, len(msg))
+			room.shareFile(client, msg)
+			continue
+		}
+
+		if isFrame {
+			if client.isRepeat(frame, hub.now()) {
+				continue
+			}
+			debugf("%s frame from %s in room %s (%d bytes)", frame.Type, username, room.name, len(msg))
+			room.handleFrame(client, frame)
+			continue
+		}
+
+		// Never log what users write, only that they wrote something
+		debugf("Message from %s in room %s (%d bytes)", username, room.name, len(msg))
 		message := fmt.Sprintf("%s: %s", username, string(msg))
-		log.Printf("Message received: %s", message)
-		room.broadcast([]byte(message), client)
+		room.handleMessage([]byte(message), client)
+	}
+}
+
+// newMux routes the server's endpoints to hub. Optional endpoints are only
+// routed when their flags enable them.
+func newMux(hub *Hub) *http.ServeMux {
+	cfg := hub.cfg
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleConnections(hub, defaultRoom, w, r)
+	})
+	mux.HandleFunc("/ws/{room}", func(w http.ResponseWriter, r *http.Request) {
+		handleConnections(hub, r.PathValue("room"), w, r)
+	})
+
+	if hub.files != nil {
+		mux.HandleFunc("GET /files/{id}", hub.handleFile)
 	}
+
+	mux.HandleFunc("GET /export/{token}", hub.handleExport)
+	mux.HandleFunc("/healthz", hub.handleHealthz)
+	mux.HandleFunc("/readyz", hub.handleReadyz)
+	if cfg.adminToken != "" {
+		mux.HandleFunc("POST /rooms/{name}/announce", hub.requireAdmin(hub.handleAnnounce))
+		mux.HandleFunc("POST /announce", hub.requireAdmin(hub.handleAnnounceAll))
+	}
+	if cfg.integrationToken != "" {
+		mux.HandleFunc("POST /rooms/{name}/messages", hub.requireIntegration(hub.handlePostMessage))
+	}
+	if cfg.metrics {
+		mux.Handle("/metrics", metrics)
+	}
+
+	mux.Handle("/", http.FileServer(http.Dir(".")))
+	return mux
 }
 
 func main() {
-	room := NewRoom()
+	cfg, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	minLogLevel.Store(int32(cfg.logLevel))
+	hub := NewHub(cfg)
+	if cfg.db != "" {
+		store, err := openSQLStore(cfg.db)
+		if err != nil {
+			log.Fatalf("Cannot open database %s: %v", cfg.db, err)
+		}
+		defer store.Close()
+		hub.store = store
+	}
+	if cfg.profanityList != "" {
+		filter, err := loadProfanityList(cfg.profanityList)
+		if err != nil {
+			log.Fatalf("Cannot load profanity list: %v", err)
+		}
+		infof("Loaded %d words from profanity list %s", len(filter.words), cfg.profanityList)
+		hub.filter = filter
+	}
+	if cfg.motdFile != "" {
+		if err := hub.reloadMOTD(); err != nil {
+			log.Fatalf("Cannot load message of the day: %v", err)
+		}
+	}
+	if cfg.redisAddr != "" {
+		fanout, err := newRedisFanout(cfg.redisAddr, hub.deliverRemote)
+		if err != nil {
+			log.Fatalf("Cannot connect to Redis at %s: %v", cfg.redisAddr, err)
+		}
+		defer fanout.Close()
+		hub.fanout = fanout
+	}
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		handleConnections(room, w, r)
-	})
+	// Listen before serving so a busy port fails with a clear message
+	listener, err := net.Listen("tcp", cfg.addr)
+	if err != nil {
+		log.Fatalf("Cannot listen on %s: %v (is another instance running? choose another address with -addr, $CHATTADDR or $PORT)", cfg.addr, err)
+	}
+
+	server := &http.Server{Handler: newMux(hub)}
+	go func() {
+		var err error
+		if cfg.useTLS() {
+			err = server.ServeTLS(listener, cfg.tlsCert, cfg.tlsKey)
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	hub.ready.Store(true)
+	if cfg.useTLS() {
+		fmt.Printf("Server listening on %s (wss)\n", listener.Addr())
+	} else {
+		fmt.Printf("Server listening on %s (ws)\n", listener.Addr())
+	}
 
-	http.Handle("/", http.FileServer(http.Dir(".")))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	fmt.Println("Server starting at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if hub.webhook != nil {
+		go hub.webhook.run(ctx)
+	}
+
+	if cfg.motdFile != "" {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		defer signal.Stop(hangups)
+		go hub.watchMOTD(ctx, hangups)
+	}
+
+	if cfg.tipInterval > 0 {
+		ticker := time.NewTicker(cfg.tipInterval)
+		defer ticker.Stop()
+		go hub.postTips(ctx, ticker.C)
+	}
+
+	<-ctx.Done()
+
+	infof("Shutting down")
+	hub.ready.Store(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new connections first; WebSocket connections are
+	// hijacked, so the hub closes those itself.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errorf("HTTP shutdown error: %v", err)
+	}
+	hub.shutdown(shutdownCtx)
 }
@@ -0,0 +1,1495 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout bounds how long a test waits for a frame that should arrive.
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	// Every join and leave is logged; tests that check logs capture them
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig returns the default config with rate limiting off, since many
+// tests send in bursts.
+func testConfig(t testing.TB) config {
+	t.Helper()
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.rateLimit = 0
+	return cfg
+}
+
+// testServer serves a hub's routes over HTTP for the length of a test.
+type testServer struct {
+	*httptest.Server
+	hub *Hub
+}
+
+// newTestServer starts a server for a new hub with cfg. The setup functions
+// run before it starts serving, e.g. to replace the hub's clock.
+func newTestServer(t testing.TB, cfg config, setup ...func(*Hub)) *testServer {
+	t.Helper()
+	hub := NewHub(cfg)
+	for _, f := range setup {
+		f(hub)
+	}
+	srv := httptest.NewServer(newMux(hub))
+	t.Cleanup(srv.Close)
+	return &testServer{Server: srv, hub: hub}
+}
+
+// wsURL returns the WebSocket URL of path on the server.
+func (ts *testServer) wsURL(path string) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + path
+}
+
+// testClient is a WebSocket client that does the key agreement and decrypts
+// the private messages it receives.
+type testClient struct {
+	t      testing.TB
+	conn   *websocket.Conn
+	name   string       // The username the server assigned
+	before []Message    // Frames received before the client's own join notice
+	frames chan Message // Frames received since, with private messages decrypted
+	err    error        // Why reading stopped; set before frames is closed
+
+	private *ecdh.PrivateKey
+	keyMu   sync.Mutex
+	key     []byte // Current session key; a later msgKey frame replaces it
+}
+
+// undecryptable replaces the Content of private messages a test client
+// can't open.
+const undecryptable = "[undecryptable]"
+
+// connect opens a WebSocket to path, e.g. "/ws/lobby?username=alice", with
+// a fresh public key added to the query. It doesn't wait to join.
+func (ts *testServer) connect(t testing.TB, path string, header http.Header) (*testClient, *http.Response, error) {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts.connectWithKey(t, path, private, header)
+}
+
+// connectWithKey is connect with the given key pair in place of a fresh one.
+func (ts *testServer) connectWithKey(t testing.TB, path string, private *ecdh.PrivateKey, header http.Header) (*testClient, *http.Response, error) {
+	t.Helper()
+	conn, resp, err := ts.dial(t, path, private, websocket.DefaultDialer, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	c := &testClient{t: t, conn: conn, private: private, frames: make(chan Message, 4096)}
+	go c.readLoop()
+	return c, resp, nil
+}
+
+// dial opens a WebSocket to path with dialer, adding private's public key
+// to the query. The connection is closed when the test ends.
+func (ts *testServer) dial(t testing.TB, path string, private *ecdh.PrivateKey, dialer *websocket.Dialer, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	path += sep + "pubkey=" + url.QueryEscape(base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+
+	conn, resp, err := dialer.Dial(ts.wsURL(path), header)
+	if err != nil {
+		return nil, resp, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp, nil
+}
+
+// join connects to path and waits until the client has joined its room.
+func (ts *testServer) join(t testing.TB, path string) *testClient {
+	t.Helper()
+	c, _, err := ts.connect(t, path, nil)
+	if err != nil {
+		t.Fatalf("Connecting to %s: %v", path, err)
+	}
+	c.waitJoined()
+	return c
+}
+
+// waitJoined waits for the client's own join notice, keeping the frames
+// before it in before.
+func (c *testClient) waitJoined() {
+	c.t.Helper()
+	for {
+		msg := c.next()
+		if msg.Type == msgUsername {
+			c.name = msg.Content
+		}
+		if msg.Type == msgSystem && c.name != "" && msg.Content == c.name+" joined the chat" {
+			return
+		}
+		c.before = append(c.before, msg)
+	}
+}
+
+func (c *testClient) readLoop() {
+	defer close(c.frames)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.err = err
+			return
+		}
+		switch msg.Type {
+		case msgKey:
+			c.agree(msg.Content)
+		case msgPrivate:
+			text, err := decrypt(msg.Content, c.sessionKey(), privateAAD(msg.From, msg.To), nil)
+			if err != nil {
+				text = undecryptable
+			}
+			msg.Content = text
+		}
+		c.frames <- msg
+	}
+}
+
+// agree derives the session key from the server's base64 public key.
+func (c *testClient) agree(serverPublicKey string) {
+	peer, err := parsePublicKey(serverPublicKey)
+	if err == nil {
+		var key []byte
+		if key, err = deriveSessionKey(c.private, peer); err == nil {
+			c.keyMu.Lock()
+			c.key = key
+			c.keyMu.Unlock()
+			return
+		}
+	}
+	c.t.Errorf("Key agreement failed: %v", err)
+}
+
+func (c *testClient) sessionKey() []byte {
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	return c.key
+}
+
+// next returns the next frame, failing the test if none arrives in time.
+func (c *testClient) next() Message {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.frames:
+		if !ok {
+			c.t.Fatalf("%s: connection closed while waiting for a frame: %v", c.name, c.err)
+		}
+		return msg
+	case <-time.After(testTimeout):
+		c.t.Fatalf("%s: timed out waiting for a frame", c.name)
+		return Message{}
+	}
+}
+
+// expect skips frames until one matches, failing the test if none does in
+// time. desc describes the frame wanted.
+func (c *testClient) expect(desc string, match func(Message) bool) Message {
+	c.t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("%s: connection closed while waiting for %s: %v", c.name, desc, c.err)
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-deadline:
+			c.t.Fatalf("%s: timed out waiting for %s", c.name, desc)
+		}
+	}
+}
+
+// expectContent waits for a frame of the given type whose Content contains
+// text.
+func (c *testClient) expectContent(typ, text string) Message {
+	c.t.Helper()
+	return c.expect(typ+" frame containing "+text, func(msg Message) bool {
+		return msg.Type == typ && strings.Contains(msg.Content, text)
+	})
+}
+
+// expectNoneBefore skips frames until one matches until, failing the test
+// if a frame matching unwanted comes first. Frames to a room arrive in the
+// order the room sends them, so a frame sent after an action marks the
+// point by which the action's frames would have arrived.
+func (c *testClient) expectNoneBefore(desc string, unwanted, until func(Message) bool) {
+	c.t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("%s: connection closed while waiting: %v", c.name, c.err)
+			}
+			if unwanted(msg) {
+				c.t.Fatalf("%s: got %s: %+v", c.name, desc, msg)
+			}
+			if until(msg) {
+				return
+			}
+		case <-deadline:
+			c.t.Fatalf("%s: timed out", c.name)
+		}
+	}
+}
+
+// expectQuiet fails the test if a frame matching unwanted arrives within
+// wait. Use it where no later frame can mark the point to stop, such as
+// across rooms.
+func (c *testClient) expectQuiet(desc string, unwanted func(Message) bool, wait time.Duration) {
+	c.t.Helper()
+	deadline := time.After(wait)
+	for {
+		select {
+		case msg, ok := <-c.frames:
+			if !ok {
+				return
+			}
+			if unwanted(msg) {
+				c.t.Fatalf("%s: got %s: %+v", c.name, desc, msg)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// expectClosed waits for the server to close the connection and returns
+// the error reading stopped with.
+func (c *testClient) expectClosed() error {
+	c.t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if !ok {
+				return c.err
+			}
+		case <-deadline:
+			c.t.Fatalf("%s: connection still open", c.name)
+		}
+	}
+}
+
+// say sends a plain text frame, as typed into the chat box.
+func (c *testClient) say(text string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		c.t.Fatalf("%s: %v", c.name, err)
+	}
+}
+
+// sendFrame sends msg as a structured JSON frame.
+func (c *testClient) sendFrame(msg Message) {
+	c.t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("%s: %v", c.name, err)
+	}
+}
+
+// sealFor encrypts text as a private message from the client to the given
+// recipients, as browsers do.
+func (c *testClient) sealFor(to, text string) string {
+	c.t.Helper()
+	sealed, err := encrypt(text, c.sessionKey(), privateAAD(c.name, to))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return sealed
+}
+
+// leave closes the connection cleanly.
+func (c *testClient) leave() {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+// closeWith closes the connection with the given close code and reason.
+func (c *testClient) closeWith(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.conn.Close()
+}
+
+// isChat matches the chat message text from the named user.
+func isChat(from, text string) func(Message) bool {
+	return func(msg Message) bool {
+		return msg.Type == msgChat && msg.From == from && msg.Content == text
+	}
+}
+
+// isCloseError reports whether err is a close frame with the given code.
+func isCloseError(err error, code int) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) && closeErr.Code == code
+}
+
+// room returns the hub's open room with the given name.
+func (ts *testServer) room(t testing.TB, name string) *Room {
+	t.Helper()
+	ts.hub.mutex.Lock()
+	room := ts.hub.rooms[name]
+	ts.hub.mutex.Unlock()
+	if room == nil {
+		t.Fatalf("no room %s", name)
+	}
+	return room
+}
+
+// serverClient returns the hub's side of the named user's connection to a
+// room.
+func (ts *testServer) serverClient(t testing.TB, roomName, username string) *Client {
+	t.Helper()
+	for _, client := range ts.room(t, roomName).snapshot() {
+		if client.name() == username {
+			return client
+		}
+	}
+	t.Fatalf("no user %s in room %s", username, roomName)
+	return nil
+}
+
+// sessionToken returns the session token the client was sent on joining.
+func (c *testClient) sessionToken() string {
+	c.t.Helper()
+	for _, msg := range c.before {
+		if msg.Type == msgSession {
+			return msg.Content
+		}
+	}
+	c.t.Fatalf("%s: no session token", c.name)
+	return ""
+}
+
+// disconnect drops the client's connection, waits for the server to keep
+// its session, and returns the session's token.
+func (ts *testServer) disconnect(t testing.TB, c *testClient) string {
+	t.Helper()
+	token := c.sessionToken()
+	c.conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		ts.hub.sessions.mutex.Lock()
+		_, kept := ts.hub.sessions.sessions[token]
+		ts.hub.sessions.mutex.Unlock()
+		if kept {
+			return token
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s's session never kept", c.name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// reconnect drops the client's connection and resumes its session on a
+// new one to the same room, at path.
+func (ts *testServer) reconnect(t testing.TB, c *testClient, path string) *testClient {
+	t.Helper()
+	token := ts.disconnect(t, c)
+	return ts.join(t, path+"&session="+token)
+}
+
+// fakeClock is a clock that only moves when a test advances it. Install it
+// with h.now = clock.now, and h.afterFunc = clock.afterFunc for timers.
+type fakeClock struct {
+	mutex  sync.Mutex
+	t      time.Time
+	timers []*fakeTimer // Scheduled and not yet run or stopped
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+// advance moves the clock on by d and runs the timers that fall due, in
+// the order they do.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	c.t = c.t.Add(d)
+	var due []*fakeTimer
+	kept := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.t) {
+			kept = append(kept, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = kept
+	c.mutex.Unlock()
+
+	slices.SortStableFunc(due, func(a, b *fakeTimer) int { return a.at.Compare(b.at) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// afterFunc schedules f to run once the clock has been advanced by d.
+func (c *fakeClock) afterFunc(d time.Duration, f func()) timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, at: c.t.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// pending returns how many timers are waiting to run.
+func (c *fakeClock) pending() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+// fakeTimer is a function scheduled on a fakeClock.
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	i := slices.Index(t.clock.timers, t)
+	if i < 0 {
+		return false
+	}
+	t.clock.timers = slices.Delete(t.clock.timers, i, i+1)
+	return true
+}
+
+func TestConcurrentWritesToOneClient(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	client := ts.serverClient(t, defaultRoom, "alice")
+
+	const writers, each = 20, 10
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range each {
+				if err := client.send(Message{Type: msgSystem, Content: fmt.Sprintf("notice %d-%d", w, i)}); err != nil {
+					t.Errorf("send: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for len(seen) < writers*each {
+		msg := alice.next()
+		if !strings.HasPrefix(msg.Content, "notice ") {
+			continue
+		}
+		if seen[msg.Content] {
+			t.Fatalf("%q received twice", msg.Content)
+		}
+		seen[msg.Content] = true
+	}
+}
+
+func TestLeaveNotice(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		leave func(*testClient)
+	}{
+		{"close frame", (*testClient).leave},
+		{"dropped connection", func(c *testClient) { c.conn.Close() }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, testConfig(t))
+			alice := ts.join(t, "/ws?username=alice")
+			bob := ts.join(t, "/ws?username=bob")
+			carol := ts.join(t, "/ws?username=carol")
+
+			tt.leave(bob)
+			alice.expectContent(msgSystem, "bob left the chat")
+			carol.expectContent(msgSystem, "bob left the chat")
+		})
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"alice", true},
+		{"Ørjan", true},
+		{"alice-2_x.y", true},
+		{strings.Repeat("a", maxUsernameLength), true},
+		{"", false},
+		{strings.Repeat("a", maxUsernameLength+1), false},
+		{"bob: /saving", false},
+		{"bob:", false},
+		{"/saving", false},
+		{"a/b", false},
+		{"@alice", false},
+		{"alice,bob", false},
+		{"alice bob", false},
+		{"alice\nbob: hi", false},
+		{"\xff", false},
+	}
+	for _, tt := range tests {
+		if err := validateUsername(tt.name); (err == nil) != tt.valid {
+			t.Errorf("validateUsername(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestForgingUsernamesAreRefused(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	for _, name := range []string{"bob: /saving", "/saving", "alice: hi"} {
+		c, _, err := ts.connect(t, "/ws?username="+url.QueryEscape(name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.expectClosed(); !isCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("joining as %q: got %v, want a policy violation close", name, err)
+		}
+	}
+}
+
+func TestChatCantForgeACommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	mallory := ts.join(t, "/ws?username=mallory")
+
+	// The server used to strip "<name>: " off the line it built, so text
+	// starting with another user's prefix could reach the command path
+	mallory.say("alice: /saving")
+	mallory.say("done")
+	alice.expectNoneBefore("a bot reply", func(msg Message) bool {
+		return msg.Type == msgCommand
+	}, isChat("mallory", "done"))
+}
+
+func TestOnlyLeadingSlashIsACommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("hello /not a command")
+	bob.expect("the text as chat", isChat("alice", "hello /not a command"))
+
+	alice.say("alice: /saving")
+	bob.expect("the text as chat", isChat("alice", "alice: /saving"))
+
+	alice.say("/saving 5000")
+	bob.expectContent(msgCommand, "If you save 5.000 kr per month")
+}
+
+func TestClientsThatDontAnswerPingsAreDropped(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.pingInterval = 20 * time.Millisecond
+	cfg.pongTimeout = 100 * time.Millisecond
+	ts := newTestServer(t, cfg)
+	alive := ts.join(t, "/ws?username=alive")
+
+	// A client whose connection has died: it reads, so the server's pings
+	// arrive, but never answers them
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, _, err := ts.dial(t, "/ws?username=dead", private, websocket.DefaultDialer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pings := make(chan struct{}, 1)
+	dead.SetPingHandler(func(string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := dead.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-pings:
+	case <-time.After(testTimeout):
+		t.Fatal("no ping within the ping interval")
+	}
+	alive.expectContent(msgSystem, "dead left the chat")
+
+	// The client answering pings outlives several pong timeouts
+	time.Sleep(3 * cfg.pongTimeout)
+	alive.say("still here")
+	alive.expect("its own message", isChat("alive", "still here"))
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	pool := writeSelfSignedCert(t, certFile, keyFile)
+
+	cfg, err := parseFlags([]string{"-tls-cert", certFile, "-tls-key", keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.useTLS() {
+		t.Fatal("useTLS is false with a certificate and key")
+	}
+	cfg.rateLimit = 0
+
+	// Serve as main does
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newMux(NewHub(cfg))}
+	go server.ServeTLS(listener, cfg.tlsCert, cfg.tlsKey)
+	t.Cleanup(func() { server.Close() })
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	pubkey := url.QueryEscape(base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+	conn, _, err := dialer.Dial("wss://"+listener.Addr().String()+"/ws?username=alice&pubkey="+pubkey, nil)
+	if err != nil {
+		t.Fatalf("wss handshake: %v", err)
+	}
+	defer conn.Close()
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != msgKey {
+		t.Fatalf("first frame over wss = %+v, %v; want the key frame", msg, err)
+	}
+
+	// A plain ws:// client can't talk to a TLS server
+	if _, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/ws?pubkey="+pubkey, nil); err == nil {
+		t.Error("ws:// handshake with a TLS server succeeded")
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key as PEM
+// files, returning a pool trusting it.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func TestOversizedMessagesAreRejected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.maxMessageSize = 64
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	// The limit applies to the raw frame, before "alice: " is added
+	fits := strings.Repeat("a", 64)
+	alice.say(fits)
+	bob.expect("the message at the limit", isChat("alice", fits))
+
+	alice.say(strings.Repeat("a", 65))
+	if err := alice.expectClosed(); !isCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("oversized message: connection ended with %v, want a message too big close", err)
+	}
+	bob.expectNoneBefore("the oversized message", func(msg Message) bool {
+		return msg.Type == msgChat && msg.From == "alice"
+	}, func(msg Message) bool {
+		return msg.Content == "alice left the chat"
+	})
+}
+
+func TestOversizedTextIsRefusedWithFileSharing(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.maxMessageSize = 64
+	cfg.maxFileSize = 1024
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+
+	// Files may be larger than text messages, so the connection stays open
+	alice.say(strings.Repeat("a", 65))
+	alice.expectContent(msgSystem, "Your message is too long and was not delivered.")
+	alice.say("short")
+	alice.expect("a message within the limit", isChat("alice", "short"))
+
+	// Binary frames are capped by the file size limit instead
+	alice.sendBinary(bytes.Repeat([]byte("a"), 1024))
+	if msg := alice.expect("a file bigger than -max-message-size", isFile); msg.File.Size != 1024 {
+		t.Errorf("shared file = %+v, want 1024 bytes", msg.File)
+	}
+	alice.sendBinary(bytes.Repeat([]byte("a"), 1025))
+	if err := alice.expectClosed(); !isCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("oversized file: connection ended with %v, want a message too big close", err)
+	}
+}
+
+// isPrivate matches the private message text from one user to the others.
+func isPrivate(from, to, text string) func(Message) bool {
+	return func(msg Message) bool {
+		return msg.Type == msgPrivate && msg.From == from && msg.To == to && msg.Content == text
+	}
+}
+
+func TestPrivateMessagesAreReadable(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	// Typed as "@user text" the server reads the text, as with chat
+	alice.say("@bob meet at noon")
+	bob.expect("the private message, decrypted", isPrivate("alice", "bob", "meet at noon"))
+	alice.expect("the echo, decrypted", isPrivate("alice", "bob", "meet at noon"))
+
+	// Sent encrypted under the sender's own key
+	alice.sendFrame(Message{Type: msgPrivate, To: "bob", Content: alice.sealFor("bob", "bring snacks")})
+	bob.expect("the private message, decrypted", isPrivate("alice", "bob", "bring snacks"))
+	alice.expect("the echo, decrypted", isPrivate("alice", "bob", "bring snacks"))
+
+	alice.say("public")
+	carol.expectNoneBefore("a private message", func(msg Message) bool {
+		return msg.Type == msgPrivate
+	}, isChat("alice", "public"))
+}
+
+func TestPrivateMessageToUnknownUser(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("@nobody hello")
+	alice.expectContent(msgCommand, "⚠️ User nobody not found")
+}
+
+func TestParsePrivate(t *testing.T) {
+	tests := []struct {
+		line, target, text string
+		err                bool
+	}{
+		{"@bob hi", "bob", "hi", false},
+		{"@bob,carol lunch?", "bob,carol", "lunch?", false},
+		{"@Ørjan  two spaces", "Ørjan", " two spaces", false},
+		{"@", "", "", true},
+		{"@ hi", "", "", true},
+		{"@alice", "", "", true},
+		{"@alice ", "", "", true},
+		{"@alice \t ", "", "", true},
+	}
+	for _, tt := range tests {
+		target, text, err := parsePrivate(tt.line)
+		if target != tt.target || text != tt.text || (err != nil) != tt.err || errors.Is(err, errNotPrivate) {
+			t.Errorf("parsePrivate(%q) = %q, %q, %v", tt.line, target, text, err)
+		}
+	}
+	for _, line := range []string{"", "hi @bob", " @bob hi", "bob: @alice hi"} {
+		if _, _, err := parsePrivate(line); !errors.Is(err, errNotPrivate) {
+			t.Errorf("parsePrivate(%q): %v, want errNotPrivate", line, err)
+		}
+	}
+}
+
+func FuzzParsePrivate(f *testing.F) {
+	for _, seed := range []string{
+		"@bob hi",
+		"@bob,carol lunch?",
+		"@Ørjan hei på deg",
+		"@日本語 こんにちは",
+		"@alice ",
+		"@alice",
+		"@",
+		"@ ",
+		"",
+		"@-1 -9223372036854775808",
+		"@bob \xff",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		target, text, err := parsePrivate(line)
+		if err != nil {
+			if target != "" || text != "" {
+				t.Fatalf("parsePrivate(%q) failed with %v but returned %q, %q", line, err, target, text)
+			}
+			if errors.Is(err, errNotPrivate) != !strings.HasPrefix(line, "@") {
+				t.Fatalf("parsePrivate(%q): %v", line, err)
+			}
+			return
+		}
+		// The line is rebuilt exactly from its parts, so nothing is lost
+		// or attributed to the wrong user
+		if line != "@"+target+" "+text {
+			t.Fatalf("parsePrivate(%q) = %q, %q", line, target, text)
+		}
+		if target == "" || strings.Contains(target, " ") || strings.TrimSpace(text) == "" {
+			t.Fatalf("parsePrivate(%q) accepted %q, %q", line, target, text)
+		}
+	})
+}
+
+func TestMalformedPrivateMessageIsNotChat(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	for _, line := range []string{"@", "@bob ", "@bob"} {
+		alice.say(line)
+		alice.expectContent(msgCommand, "⚠️ Usage: @<username>")
+	}
+	alice.say("done")
+	bob.expectNoneBefore("a malformed private message", func(msg Message) bool {
+		return msg.From == "alice" && strings.HasPrefix(msg.Content, "@")
+	}, isChat("alice", "done"))
+}
+
+func TestGroupPrivateMessage(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+	dave := ts.join(t, "/ws?username=dave")
+
+	// Each recipient decrypts its copy with its own key, and the sender
+	// gets one echo listing them all as confirmation
+	for _, line := range []string{"@bob,carol lunch?", "/dm bob,carol lunch?"} {
+		alice.say(line)
+		bob.expect("the group message", isPrivate("alice", "bob,carol", "lunch?"))
+		carol.expect("the group message", isPrivate("alice", "bob,carol", "lunch?"))
+		alice.expect("the confirmation", isPrivate("alice", "bob,carol", "lunch?"))
+		alice.say("public")
+		alice.expectNoneBefore("a second confirmation", func(msg Message) bool {
+			return msg.Type == msgPrivate
+		}, isChat("alice", "public"))
+		dave.expectNoneBefore("the group message", func(msg Message) bool {
+			return msg.Type == msgPrivate
+		}, isChat("alice", "public"))
+	}
+
+	// An unknown recipient is reported without holding up the others
+	alice.say("@bob,nobody,bob lunch?")
+	alice.expectContent(msgCommand, "⚠️ User nobody not found")
+	bob.expect("the message", isPrivate("alice", "bob", "lunch?"))
+	alice.expect("the confirmation", isPrivate("alice", "bob", "lunch?"))
+
+	alice.say("@nobody,noone lunch?")
+	alice.expectContent(msgCommand, "⚠️ Users nobody, noone not found")
+	alice.say("@a,b,c,d,e,f,g,h,i,j,k lunch?")
+	alice.expectContent(msgCommand, "⚠️ Private messages can go to at most 10 users at once.")
+	alice.say("public")
+	alice.expectNoneBefore("a confirmation", func(msg Message) bool {
+		return msg.Type == msgPrivate
+	}, isChat("alice", "public"))
+}
+
+func TestCalculateSavingsWithFixedSeed(t *testing.T) {
+	rng := mathrand.New(mathrand.NewSource(42))
+	for _, want := range []string{
+		"💰 Financial Tip: If you save 2.294 kr per month, you'll have 275.280 kr in 10 years!",
+		"💰 Financial Tip: If you save 7.028 kr per month, you'll have 843.360 kr in 10 years!",
+		"💰 Financial Tip: If you save 7.979 kr per month, you'll have 957.480 kr in 10 years!",
+	} {
+		if got := calculateSavings(defaultLang, defaultLocale, 0, defaultSavingsMin, defaultSavingsMax, rng); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCalculateSavingsWithAmountIgnoresRandomness(t *testing.T) {
+	want := "💰 Financial Tip: If you save 5.000 kr per month, you'll have 600.000 kr in 10 years!"
+	for seed := range int64(3) {
+		rng := mathrand.New(mathrand.NewSource(seed))
+		if got := calculateSavings(defaultLang, defaultLocale, 5000, defaultSavingsMin, defaultSavingsMax, rng); got != want {
+			t.Errorf("seed %d: got %q, want %q", seed, got, want)
+		}
+	}
+}
+
+func TestCalculateSavingsStaysInRange(t *testing.T) {
+	rng := mathrand.New(mathrand.NewSource(1))
+	seen := map[string]bool{}
+	for range 200 {
+		tip := calculateSavings(defaultLang, defaultLocale, 0, 1000, 1002, rng)
+		monthly, _, _ := strings.Cut(strings.TrimPrefix(tip, "💰 Financial Tip: If you save "), " kr")
+		switch monthly {
+		case "1.000", "1.001", "1.002":
+			seen[monthly] = true
+		default:
+			t.Fatalf("tip outside 1.000-1.002 kr: %q", tip)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("only saw %v in 200 tips", seen)
+	}
+}
+
+func TestBotUsesTheConfiguredSavingsRange(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.savingsMin, cfg.savingsMax = 250, 250
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/saving")
+	alice.expectContent(msgCommand, "If you save 250 kr per month, you'll have 30.000 kr in 10 years!")
+}
+
+func TestFormatDecimal(t *testing.T) {
+	enUS, _ := findLocale("en-US")
+	tests := []struct {
+		f        float64
+		decimals int
+		want     string
+	}{
+		{1234567.895, 2, "1.234.567,90"},
+		{1234567.894, 2, "1.234.567,89"},
+		{1234567.5, 0, "1.234.568"},
+		{0.005, 2, "0,01"},
+		{0.004, 2, "0,00"},
+		{999.995, 2, "1.000,00"},
+		{-1234.565, 2, "-1.234,57"},
+		{-0.001, 2, "0,00"},
+		{12, 3, "12,000"},
+		{0, 2, "0,00"},
+		{1e15, 2, "1.000.000.000.000.000,00"},
+		{1.5, -1, "2"},
+		{math.NaN(), 2, "NaN"},
+		{math.Inf(1), 2, "+Inf"},
+	}
+	for _, tt := range tests {
+		if got := formatDecimal(tt.f, tt.decimals, defaultLocale); got != tt.want {
+			t.Errorf("formatDecimal(%v, %d) = %q, want %q", tt.f, tt.decimals, got, tt.want)
+		}
+	}
+	if got, want := formatDecimal(1234567.895, 2, enUS), "1,234,567.90"; got != want {
+		t.Errorf("formatDecimal(1234567.895, 2) for en-US = %q, want %q", got, want)
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	enUS, _ := findLocale("en-US")
+	// The extremes of int depend on the platform
+	maxInt, minInt, minIntUS := "2.147.483.647", "-2.147.483.648", "-2,147,483,648"
+	if strconv.IntSize == 64 {
+		maxInt, minInt, minIntUS = "9.223.372.036.854.775.807", "-9.223.372.036.854.775.808", "-9,223,372,036,854,775,808"
+	}
+	tests := []struct {
+		n    int
+		loc  locale
+		want string
+	}{
+		{0, defaultLocale, "0"},
+		{7, defaultLocale, "7"},
+		{-7, defaultLocale, "-7"},
+		{999, defaultLocale, "999"},
+		{1000, defaultLocale, "1.000"},
+		{-1000, defaultLocale, "-1.000"},
+		{999999, defaultLocale, "999.999"},
+		{1234567890, defaultLocale, "1.234.567.890"},
+		{1234567890, enUS, "1,234,567,890"},
+		{math.MaxInt, defaultLocale, maxInt},
+		{math.MinInt, defaultLocale, minInt},
+		{math.MinInt, enUS, minIntUS},
+	}
+	for _, tt := range tests {
+		if got := formatNumber(tt.n, tt.loc); got != tt.want {
+			t.Errorf("formatNumber(%d) for %s = %q, want %q", tt.n, tt.loc.name, got, tt.want)
+		}
+		// Integers format the same either way
+		if f := float64(tt.n); f > -1e15 && f < 1e15 {
+			if got := formatDecimal(float64(tt.n), 0, tt.loc); got != tt.want {
+				t.Errorf("formatDecimal(%d, 0) for %s = %q, want %q", tt.n, tt.loc.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func FuzzFormatNumber(f *testing.F) {
+	for _, seed := range []int64{0, 1, -1, 999, 1000, -1000, 1234567890, math.MaxInt32, math.MinInt32, math.MaxInt64, math.MaxInt64 - 1, math.MinInt64, math.MinInt64 + 1} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, n int64) {
+		if n > math.MaxInt || n < math.MinInt {
+			return
+		}
+		for _, loc := range locales {
+			got := formatNumber(int(n), loc)
+			// Without its separators it is the plain number, and those
+			// separate every three digits from the right
+			digits := strings.TrimPrefix(got, "-")
+			for i := len(digits) - 4; i >= 0; i -= 4 {
+				if digits[i] != loc.thousands {
+					t.Fatalf("formatNumber(%d) for %s = %q, want a separator at %d", n, loc.name, got, i)
+				}
+			}
+			if plain := strings.ReplaceAll(got, string(loc.thousands), ""); plain != strconv.FormatInt(n, 10) {
+				t.Fatalf("formatNumber(%d) for %s = %q", n, loc.name, got)
+			}
+		}
+	})
+}
+
+// BenchmarkFormatNumber measures formatting the amounts finance replies
+// are full of, as whole kroner and with øre.
+func BenchmarkFormatNumber(b *testing.B) {
+	numbers := []int{1234567890, -42, 999999}
+	b.Run("int", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, n := range numbers {
+				formatNumber(n, defaultLocale)
+			}
+		}
+	})
+	b.Run("decimal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, n := range numbers {
+				formatDecimal(float64(n)+0.5, 2, defaultLocale)
+			}
+		}
+	})
+}
+
+func TestFormattingByLocale(t *testing.T) {
+	for _, tt := range []struct {
+		locale          string
+		number, decimal string
+	}{
+		{"nb-NO", "-1.234.567", "1.234.567,89"},
+		{"en-US", "-1,234,567", "1,234,567.89"},
+		{"en-GB", "-1,234,567", "1,234,567.89"},
+		{"de-DE", "-1.234.567", "1.234.567,89"},
+	} {
+		loc, ok := findLocale(tt.locale)
+		if !ok {
+			t.Fatalf("no locale %s", tt.locale)
+		}
+		if got := formatNumber(-1234567, loc); got != tt.number {
+			t.Errorf("formatNumber(-1234567) for %s = %q, want %q", tt.locale, got, tt.number)
+		}
+		if got := formatDecimal(1234567.891, 2, loc); got != tt.decimal {
+			t.Errorf("formatDecimal(1234567.891, 2) for %s = %q, want %q", tt.locale, got, tt.decimal)
+		}
+	}
+}
+
+func TestIdleClientsAreWarnedThenDisconnected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.idleTimeout = 300 * time.Millisecond
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.expectContent(msgSystem, "You have been idle for a while and will be disconnected in ")
+	// Bob speaks up so he outlives alice and sees her leave
+	bob.say("still here")
+	alice.expect("bob's message", isChat("bob", "still here"))
+	alice.expectContent(msgSystem, "You were disconnected for being idle.")
+	if err := alice.expectClosed(); !isCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("connection ended with %v, want a policy violation close", err)
+	}
+	bob.expectContent(msgSystem, "alice left the chat")
+}
+
+func TestActiveClientsStayConnected(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.idleTimeout = 300 * time.Millisecond
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+
+	for i := range 10 {
+		text := fmt.Sprint("still here ", i)
+		alice.say(text)
+		alice.expect("her own message", isChat("alice", text))
+		time.Sleep(cfg.idleTimeout / 6)
+	}
+	alice.say("done")
+	alice.expectNoneBefore("being disconnected", func(msg Message) bool {
+		return strings.Contains(msg.Content, "disconnected for being idle")
+	}, isChat("alice", "done"))
+}
+
+// countingConn counts the bytes read from a connection, as they arrive on
+// the wire.
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// compressionDialer returns a dialer that asks for permessage-deflate and
+// counts the bytes it reads into read.
+func compressionDialer(read *atomic.Int64) *websocket.Dialer {
+	return &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, read: read}, nil
+		},
+	}
+}
+
+// BenchmarkCompression reports the bytes one reader receives per message,
+// with and without -compression, for chat alone and for chat with a /help
+// reply in every ten messages.
+func BenchmarkCompression(b *testing.B) {
+	for _, traffic := range []string{"chat", "chat+help"} {
+		for _, compression := range []bool{false, true} {
+			b.Run(fmt.Sprintf("traffic=%s/compression=%v", traffic, compression), func(b *testing.B) {
+				benchmarkCompression(b, traffic == "chat+help", compression)
+			})
+		}
+	}
+}
+
+func benchmarkCompression(b *testing.B, help, compression bool) {
+	cfg := testConfig(b)
+	cfg.compression = compression
+	ts := newTestServer(b, cfg)
+
+	var read atomic.Int64
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, _, err := ts.dial(b, "/ws?username=reader", private, compressionDialer(&read), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	got := make(chan struct{}, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if bytes.Contains(data, []byte(`"from":"alice"`)) || bytes.Contains(data, []byte(`"type":"command"`)) {
+				got <- struct{}{}
+			}
+		}
+	}()
+	deadline := time.Now().Add(testTimeout)
+	for ts.hub.roomCount() == 0 || len(ts.room(b, defaultRoom).snapshot()) == 0 {
+		if time.Now().After(deadline) {
+			b.Fatal("timed out waiting for the reader to join")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	room := ts.room(b, defaultRoom)
+
+	chat := Message{Type: msgChat, From: "alice", Content: "Has anyone tried the new pizza place downtown? Thinking of going for lunch."}
+	reply := Message{Type: msgCommand, From: defaultBotName, Content: helpText(defaultLang, defaultBotName)}
+	b.ResetTimer()
+	start := read.Load()
+	for i := range b.N {
+		if help && i%10 == 9 {
+			room.deliver(reply)
+		} else {
+			room.deliver(chat)
+		}
+		<-got
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(read.Load()-start)/float64(b.N), "wire-B/msg")
+}
+
+func TestCompressedConnectionsRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.compression = true
+	ts := newTestServer(t, cfg)
+	bob := ts.join(t, "/ws?username=bob")
+
+	var read atomic.Int64
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, resp, err := ts.dial(t, "/ws?username=alice", private, compressionDialer(&read), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("compression not negotiated: %q", ext)
+	}
+	bob.expectContent(msgSystem, "alice joined the chat")
+
+	long := strings.Repeat("compress me please, ", 50)
+	for _, text := range []string{"short", long, "æøå 🎉"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		bob.expect(fmt.Sprintf("%.20q unchanged", text), isChat("alice", text))
+	}
+
+	// alice reads what bob sends, decompressed, with fewer bytes on the wire
+	bob.say(long)
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	before := read.Load()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg Message
+		if json.Unmarshal(data, &msg) == nil && isChat("bob", long)(msg) {
+			if wire := read.Load() - before; wire >= int64(len(data)) {
+				t.Errorf("%d bytes on the wire for a %d byte frame", wire, len(data))
+			}
+			return
+		}
+	}
+}
+
+func TestCompressionIsOptional(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.compression = true
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	long := strings.Repeat("not compressed, ", 50)
+	alice.say(long)
+	bob.expect("the long message", isChat("alice", long))
+}
+
+func TestStalledClientsAreEvicted(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	bob := ts.join(t, "/ws?username=bob")
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connects and then never reads
+	if _, _, err := ts.dial(t, "/ws?username=stalled", private, websocket.DefaultDialer, nil); err != nil {
+		t.Fatal(err)
+	}
+	bob.expectContent(msgSystem, "stalled joined the chat")
+	evicted := metrics.slowClientsEvicted.Load()
+
+	// Enough to fill the socket buffers and then the stalled client's
+	// outbox, in batches that bob reads before the next
+	room := ts.room(t, defaultRoom)
+	big := strings.Repeat("x", 64<<10)
+	left := false
+	for i := range 600 {
+		room.deliver(Message{Type: msgChat, From: "alice", Content: big})
+		if i%100 == 99 {
+			for range 100 {
+				bob.expect("a big message", func(msg Message) bool {
+					left = left || msg.Content == "stalled left the chat"
+					return isChat("alice", big)(msg)
+				})
+			}
+		}
+	}
+
+	if !left {
+		bob.expectContent(msgSystem, "stalled left the chat")
+	}
+	if metrics.slowClientsEvicted.Load() <= evicted {
+		t.Error("eviction not counted")
+	}
+	bob.say("still here")
+	bob.expect("his own message", isChat("bob", "still here"))
+}
+
+// stallingListener hands out connections that can be made to stall: once
+// stalled, a write hangs until its deadline and then fails the way a write
+// to a peer that stopped reading does.
+type stallingListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns map[string]*stallingConn // By remote address
+}
+
+func (l *stallingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &stallingConn{Conn: conn}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[string]*stallingConn)
+	}
+	l.conns[conn.RemoteAddr().String()] = c
+	return c, nil
+}
+
+// stall makes the server's end of c's connection stall.
+func (l *stallingListener) stall(t *testing.T, c *testClient) {
+	t.Helper()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	conn := l.conns[c.conn.LocalAddr().String()]
+	if conn == nil {
+		t.Fatalf("no connection from %s", c.name)
+	}
+	conn.stalled.Store(true)
+}
+
+type stallingConn struct {
+	net.Conn
+	stalled  atomic.Bool
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (c *stallingConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *stallingConn) Write(p []byte) (int, error) {
+	if !c.stalled.Load() {
+		return c.Conn.Write(p)
+	}
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+	time.Sleep(time.Until(deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestWriteTimeoutRemovesTheClient(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.writeTimeout = 50 * time.Millisecond
+	hub := NewHub(cfg)
+	srv := httptest.NewUnstartedServer(newMux(hub))
+	listener := &stallingListener{Listener: srv.Listener}
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+	ts := &testServer{Server: srv, hub: hub}
+
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	alice.expectContent(msgSystem, "bob joined the chat")
+	timeouts := metrics.writeTimeouts.Load()
+
+	listener.stall(t, alice)
+	start := time.Now()
+	bob.say("are you there?")
+	bob.expectContent(msgSystem, "alice left the chat")
+	if elapsed := time.Since(start); elapsed < cfg.writeTimeout {
+		t.Errorf("alice was removed after %v, before the write timed out", elapsed)
+	}
+	if metrics.writeTimeouts.Load() <= timeouts {
+		t.Error("write timeout not counted")
+	}
+	alice.expectClosed()
+
+	bob.say("still here")
+	bob.expect("his own message", isChat("bob", "still here"))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CryptoProvider looks up cryptocurrency prices. Price returns what one coin
+// is worth in currency and its percent change over the last 24 hours.
+type CryptoProvider interface {
+	Price(coin, currency string) (price, change24h float64, err error)
+}
+
+var (
+	// errUnknownCoin is returned by a CryptoProvider that has no price for
+	// the requested coin.
+	errUnknownCoin = errors.New("unknown coin")
+
+	// errRateLimited is returned when a lookup would exceed the upstream's
+	// request budget.
+	errRateLimited = errors.New("too many lookups")
+)
+
+// defaultCoinsURL serves CoinGecko's simple price API.
+const defaultCoinsURL = "https://api.coingecko.com/api/v3/simple/price"
+
+// Coin prices are cached for a minute, and at most one uncached lookup is
+// made every two seconds with bursts of five, well inside CoinGecko's
+// free-tier limit even with several rooms asking.
+const (
+	coinCacheTTL    = time.Minute
+	coinLookupRate  = 0.5
+	coinLookupBurst = 5
+)
+
+// coinIDs maps the ticker codes people type to CoinGecko's coin IDs.
+var coinIDs = map[string]string{
+	"BTC":  "bitcoin",
+	"ETH":  "ethereum",
+	"USDT": "tether",
+	"BNB":  "binancecoin",
+	"SOL":  "solana",
+	"USDC": "usd-coin",
+	"XRP":  "ripple",
+	"ADA":  "cardano",
+	"DOGE": "dogecoin",
+	"TRX":  "tron",
+	"DOT":  "polkadot",
+	"LTC":  "litecoin",
+	"AVAX": "avalanche-2",
+	"LINK": "chainlink",
+	"XLM":  "stellar",
+	"XMR":  "monero",
+}
+
+// httpCryptoProvider fetches prices from a CoinGecko-compatible HTTP API.
+// Prices are cached for a while and uncached lookups are rate-limited, so
+// a busy room can't get the server blocked upstream.
+type httpCryptoProvider struct {
+	client  *http.Client
+	baseURL string
+	now     func() time.Time
+
+	mutex   sync.Mutex
+	limiter *rateLimiter
+	prices  map[string]cachedCoinPrice // Keyed by coin and currency
+}
+
+type cachedCoinPrice struct {
+	price, change float64
+	fetched       time.Time
+}
+
+func newHTTPCryptoProvider(baseURL string) *httpCryptoProvider {
+	return &httpCryptoProvider{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		baseURL: baseURL,
+		now:     time.Now,
+		limiter: newRateLimiter(coinLookupRate, coinLookupBurst, time.Now()),
+		prices:  make(map[string]cachedCoinPrice),
+	}
+}
+
+func (p *httpCryptoProvider) Price(coin, currency string) (float64, float64, error) {
+	id, ok := coinIDs[coin]
+	if !ok {
+		return 0, 0, errUnknownCoin
+	}
+	key := coin + "/" + currency
+
+	p.mutex.Lock()
+	cached, ok := p.prices[key]
+	if ok && p.now().Sub(cached.fetched) < coinCacheTTL {
+		p.mutex.Unlock()
+		return cached.price, cached.change, nil
+	}
+	allowed := p.limiter.allow(p.now())
+	p.mutex.Unlock()
+	if !allowed {
+		return 0, 0, errRateLimited
+	}
+
+	price, change, err := p.fetch(id, strings.ToLower(currency))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for k, c := range p.prices {
+		if p.now().Sub(c.fetched) >= coinCacheTTL {
+			delete(p.prices, k)
+		}
+	}
+	p.prices[key] = cachedCoinPrice{price: price, change: change, fetched: p.now()}
+	return price, change, nil
+}
+
+// fetch asks the upstream for the price of the coin with the given
+// CoinGecko ID in the lowercase currency.
+func (p *httpCryptoProvider) fetch(id, currency string) (float64, float64, error) {
+	query := url.Values{"ids": {id}, "vs_currencies": {currency}, "include_24hr_change": {"true"}}
+	resp, err := p.client.Get(p.baseURL + "?" + query.Encode())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return 0, 0, errRateLimited
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("price lookup failed: %s", resp.Status)
+	}
+
+	var body map[string]map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, 0, fmt.Errorf("price lookup failed: %w", err)
+	}
+	// Currencies the API doesn't quote in are simply left out
+	price, ok := body[id][currency]
+	if !ok {
+		return 0, 0, errUnknownCurrency
+	}
+	return price, body[id][currency+"_24h_change"], nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCoins is a CryptoProvider with fixed prices and 24h changes keyed
+// "COIN/CURRENCY". With err set every lookup fails with it.
+type fakeCoins struct {
+	prices map[string][2]float64
+	err    error
+}
+
+func (f fakeCoins) Price(coin, currency string) (float64, float64, error) {
+	if f.err != nil {
+		return 0, 0, f.err
+	}
+	p, ok := f.prices[coin+"/"+currency]
+	if !ok {
+		if _, known := f.prices[coin+"/NOK"]; known {
+			return 0, 0, errUnknownCurrency
+		}
+		return 0, 0, errUnknownCoin
+	}
+	return p[0], p[1], nil
+}
+
+func TestCryptoCommand(t *testing.T) {
+	coins := fakeCoins{prices: map[string][2]float64{
+		"BTC/NOK":  {712345.678, 2.345},
+		"BTC/USD":  {67000, -0.8},
+		"ETH/NOK":  {35000, 0},
+		"DOGE/NOK": {1.5, -0.004},
+	}}
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"BTC", "🪙 BTC: 712.345,68 NOK (+2,35% 24h)"},
+		{"btc nok", "🪙 BTC: 712.345,68 NOK (+2,35% 24h)"},
+		{"BTC USD", "🪙 BTC: 67.000,00 USD (-0,80% 24h)"},
+		{"ETH", "🪙 ETH: 35.000,00 NOK (+0,00% 24h)"},
+		// A fall too small to show isn't shown as -0,00
+		{"DOGE", "🪙 DOGE: 1,50 NOK (+0,00% 24h)"},
+		{"BTC SEK", "⚠️ I don't have a BTC price in SEK."},
+		{"FOO", "⚠️ I don't know the coin FOO."},
+		{"", "⚠️ Usage: /crypto <coin> [currency]"},
+		{"BTC NOK USD", "⚠️ Usage: /crypto <coin> [currency]"},
+		{"B$C", `⚠️ Invalid coin "B$C"`},
+		{"BTC KRONER", `⚠️ Invalid currency "KRONER"`},
+	}
+	for _, tt := range tests {
+		if got := cryptoCommand(defaultLang, strings.Fields(tt.args), coins, defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/crypto %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+
+	enUS, _ := findLocale("en-US")
+	if got, want := cryptoCommand(defaultLang, []string{"BTC"}, coins, enUS), "🪙 BTC: 712,345.68 NOK (+2.35% 24h)"; got != want {
+		t.Errorf("/crypto in en-US = %q, want %q", got, want)
+	}
+
+	limited := fakeCoins{err: errRateLimited}
+	if got := cryptoCommand(defaultLang, []string{"BTC"}, limited, defaultLocale); !strings.Contains(got, "Too many price lookups") {
+		t.Errorf("/crypto while rate-limited = %q", got)
+	}
+	down := fakeCoins{err: errors.New("connection refused")}
+	if got := cryptoCommand(defaultLang, []string{"BTC"}, down, defaultLocale); !strings.Contains(got, "Coin prices are unavailable") {
+		t.Errorf("/crypto with the provider down = %q", got)
+	}
+}
+
+func TestCryptoCommandInARoom(t *testing.T) {
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.coins = fakeCoins{prices: map[string][2]float64{"ETH/EUR": {3100.5, -4.25}}}
+	})
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/crypto eth eur")
+	alice.expectContent(msgCommand, "🪙 ETH: 3.100,50 EUR (-4,25% 24h)")
+}
+
+func TestHTTPCryptoProvider(t *testing.T) {
+	var lookups atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		id, currency := r.URL.Query().Get("ids"), r.URL.Query().Get("vs_currencies")
+		switch {
+		case id == "monero":
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case id == "litecoin":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case currency == "sek":
+			fmt.Fprintf(w, `{%q:{}}`, id)
+		default:
+			fmt.Fprintf(w, `{%q:{%q:712345.67,%q:-1.5}}`, id, currency, currency+"_24h_change")
+		}
+	}))
+	defer srv.Close()
+	clock := newFakeClock()
+	p := newHTTPCryptoProvider(srv.URL)
+	p.now = clock.now
+	p.limiter = newRateLimiter(coinLookupRate, coinLookupBurst, clock.now())
+
+	if price, change, err := p.Price("BTC", "NOK"); err != nil || price != 712345.67 || change != -1.5 {
+		t.Errorf("Price(BTC, NOK) = %v, %v, %v; want 712345.67, -1.5", price, change, err)
+	}
+	if _, _, err := p.Price("FOO", "NOK"); !errors.Is(err, errUnknownCoin) {
+		t.Errorf("Price(FOO, NOK): %v, want errUnknownCoin", err)
+	}
+	if _, _, err := p.Price("BTC", "SEK"); !errors.Is(err, errUnknownCurrency) {
+		t.Errorf("Price(BTC, SEK): %v, want errUnknownCurrency", err)
+	}
+	if _, _, err := p.Price("XMR", "NOK"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Price(XMR, NOK) with the upstream refusing: %v, want errRateLimited", err)
+	}
+	if _, _, err := p.Price("LTC", "NOK"); err == nil || errors.Is(err, errUnknownCoin) {
+		t.Errorf("Price(LTC, NOK): %v, want a lookup failure", err)
+	}
+	if n := lookups.Load(); n != 4 {
+		t.Fatalf("%d upstream lookups, want 4: unknown coins shouldn't be asked about", n)
+	}
+
+	// A cached price doesn't count against the budget...
+	p.Price("BTC", "NOK")
+	if n := lookups.Load(); n != 4 {
+		t.Errorf("a cached price was fetched again: %d lookups", n)
+	}
+	// ...but with the burst spent, uncached ones are refused until the
+	// budget refills
+	if _, _, err := p.Price("ETH", "NOK"); err != nil {
+		t.Fatalf("Price(ETH, NOK) within the burst: %v", err)
+	}
+	if _, _, err := p.Price("SOL", "NOK"); !errors.Is(err, errRateLimited) {
+		t.Errorf("Price(SOL, NOK) past the burst: %v, want errRateLimited", err)
+	}
+	clock.advance(2 * time.Second)
+	if _, _, err := p.Price("SOL", "NOK"); err != nil {
+		t.Errorf("Price(SOL, NOK) once the budget refilled: %v", err)
+	}
+
+	// The cache expires
+	clock.advance(coinCacheTTL)
+	before := lookups.Load()
+	p.Price("BTC", "NOK")
+	if lookups.Load() != before+1 {
+		t.Error("an expired price wasn't fetched again")
+	}
+}
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	cmdSaving   = "saving"
+	cmdCompound = "compound"
+	cmdGoal     = "savinggoal"
+	cmdConvert  = "convert"
+	cmdMortgage = "mortgage"
+	cmdWho      = "who"
+	cmdHelp     = "help"
+	cmdMe       = "me"
+	cmdNick     = "nick"
+	cmdMute     = "mute"
+	cmdUnmute   = "unmute"
+	cmdKick     = "kick"
+	cmdBan      = "ban"
+	cmdRoll     = "roll"
+	cmdTime     = "time"
+	cmdPoll     = "poll"
+	cmdVote     = "vote"
+	cmdResults  = "results"
+	cmdEndPoll  = "endpoll"
+	cmdAway     = "away"
+	cmdBack     = "back"
+	cmdStock    = "stock"
+	cmdCrypto   = "crypto"
+	cmdInflate  = "inflation"
+	cmdSplit    = "split"
+	cmdVAT      = "vat"
+	cmdReminder = "reminder"
+	cmdLocale   = "locale"
+	cmdExport   = "export"
+	cmdHistory  = "history"
+	cmdEphem    = "ephemeral"
+	cmdClear    = "clear"
+	cmdStats    = "stats"
+	cmdDM       = "dm"
+	cmdBlock    = "block"
+	cmdUnblock  = "unblock"
+)
+
+// CommandHandler runs a command sent by sender in room. A non-empty result
+// is posted to the room by the bot; handlers that reply some other way
+// return "".
+type CommandHandler func(args []string, room *Room, sender *Client) string
+
+// commands is the registry of bot commands, in the order /help lists them.
+// handleCommand dispatches through commandHandlers, filled by the same
+// RegisterCommand calls, so the two can't drift.
+var (
+	commands        []Command
+	commandHandlers = make(map[string]CommandHandler)
+)
+
+// RegisterCommand adds a command to the registry. It panics if the name or
+// an alias is already taken, since that is a programming error.
+func RegisterCommand(cmd Command, h CommandHandler) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if isCommand(resolveCommand(name)) {
+			panic("command registered twice: /" + name)
+		}
+	}
+	commands = append(commands, cmd)
+	commandHandlers[cmd.Name] = h
+}
+
+func init() {
+	RegisterCommand(Command{Name: cmdSaving, Aliases: []string{"save", "savings"}, Description: "💰 Calculate your 10-year savings potential (optionally for a given monthly amount)"},
+		func(args []string, room *Room, sender *Client) string {
+			return room.bot.savingCommand(args, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdGoal, Aliases: []string{"goal"}, Description: "🎯 Track your progress toward a savings goal: /savinggoal set <target> | add <amount> | reset"},
+		func(args []string, room *Room, sender *Client) string {
+			// A goal is the sender's own business, so only they see it
+			room.bot.sendTo(sender, room.bot.goalCommand(sender, args, sender.locale))
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdCompound, Description: "📈 Compound growth: /compound <principal> <rate%> <years>"},
+		func(args []string, room *Room, sender *Client) string {
+			return compoundCommand(room.bot.lang, args, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdMortgage, Aliases: []string{"loan"}, Description: "🏠 Monthly loan payment: /mortgage <principal> <rate%> <years>"},
+		func(args []string, room *Room, sender *Client) string {
+			return mortgageCommand(room.bot.lang, args, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdSplit, Description: "🧾 Split a bill: /split <total> <people> [tip <pct>]"},
+		func(args []string, room *Room, sender *Client) string {
+			return splitCommand(room.bot.lang, args, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdVAT, Description: "🧾 Add VAT to a net amount, or take it out of a gross one with -gross: /vat <amount> [rate%] [-gross]"},
+		func(args []string, room *Room, sender *Client) string {
+			return vatCommand(room.bot.lang, args, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdConvert, Aliases: []string{"fx"}, Description: "💱 Convert currency: /convert <amount> <from> <to>"},
+		func(args []string, room *Room, sender *Client) string {
+			return convertCommand(room.bot.lang, args, room.rates, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdStock, Description: "📊 Latest stock price: /stock <symbol>, e.g. /stock AAPL"},
+		func(args []string, room *Room, sender *Client) string {
+			return stockCommand(room.bot.lang, args, room.quotes, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdCrypto, Description: "🪙 Coin price and 24h change: /crypto <coin> [currency], e.g. /crypto BTC NOK"},
+		func(args []string, room *Room, sender *Client) string {
+			return cryptoCommand(room.bot.lang, args, room.coins, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdInflate, Description: "📉 Adjust kroner for inflation: /inflation <amount> <fromYear> <toYear>"},
+		func(args []string, room *Room, sender *Client) string {
+			return inflationCommand(room.bot.lang, args, norwayCPI, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdWho, Aliases: []string{"online"}, Description: "👥 List the users in this room"},
+		func(args []string, room *Room, sender *Client) string { return room.whoText(room.bot.lang) })
+	RegisterCommand(Command{Name: cmdStats, Description: "📈 Show who's online, how many rooms are open, messages sent and the server's uptime"},
+		func(args []string, room *Room, sender *Client) string {
+			return room.statsText(room.bot.lang, sender.hub, sender.locale)
+		})
+	RegisterCommand(Command{Name: cmdMe, Description: "✨ Describe an action: /me <action>"},
+		func(args []string, room *Room, sender *Client) string { room.meCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdDM, Aliases: []string{"msg"}, Description: "✉️ Send a private message to one or more users: /dm <username>[,<username>...] <message>"},
+		func(args []string, room *Room, sender *Client) string { room.dmCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdNick, Description: "🏷️ Change your name: /nick <newname>"},
+		func(args []string, room *Room, sender *Client) string { room.nickCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdRoll, Aliases: []string{"dice"}, Description: "🎲 Roll dice: /roll [count]d<sides>, e.g. /roll 2d6"},
+		func(args []string, room *Room, sender *Client) string {
+			return room.bot.rollCommand(sender.name(), args)
+		})
+	RegisterCommand(Command{Name: cmdTime, Description: "🕒 Current time, optionally in a time zone: /time [zone], e.g. /time Europe/Oslo"},
+		func(args []string, room *Room, sender *Client) string {
+			return timeCommand(room.bot.lang, args, room.now())
+		})
+	RegisterCommand(Command{Name: cmdPoll, Description: `📊 Start a poll: /poll "<question>" <option> <option>...`},
+		func(args []string, room *Room, sender *Client) string {
+			room.pollCommand(sender, strings.Join(args, " "))
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdVote, Description: "🗳️ Vote in the open poll: /vote <number>"},
+		func(args []string, room *Room, sender *Client) string { room.voteCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdResults, Description: "📋 Show the open poll's results"},
+		func(args []string, room *Room, sender *Client) string { return room.resultsText() })
+	RegisterCommand(Command{Name: cmdEndPoll, Description: "🏁 Close the poll you started"},
+		func(args []string, room *Room, sender *Client) string { room.endPollCommand(sender); return "" })
+	RegisterCommand(Command{Name: cmdEphem, Description: "⏳ Send a message that is deleted after a while: /ephemeral <seconds> <message>"},
+		func(args []string, room *Room, sender *Client) string { room.ephemeralCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdExport, Description: "📦 Get a link to download this room's recent history"},
+		func(args []string, room *Room, sender *Client) string { room.exportCommand(sender); return "" })
+	RegisterCommand(Command{Name: cmdHistory, Description: "📜 Show the room's last messages to you alone: /history [count]"},
+		func(args []string, room *Room, sender *Client) string { room.historyCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdReminder, Aliases: []string{"remind"}, Description: "⏰ Get a private reminder later: /reminder <delay> <message>, e.g. /reminder 10m check the oven"},
+		func(args []string, room *Room, sender *Client) string { room.reminderCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdLocale, Description: "🌐 Choose how numbers are written for you: /locale [locale], e.g. /locale en-US"},
+		func(args []string, room *Room, sender *Client) string { localeCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdAway, Description: "💤 Mark yourself as away: /away [message]"},
+		func(args []string, room *Room, sender *Client) string { room.awayCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdBack, Description: "👋 Mark yourself as back"},
+		func(args []string, room *Room, sender *Client) string {
+			if !room.markBack(sender) {
+				sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "back.notAway")})
+			}
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdMute, Description: "🔇 Stop seeing messages from a user: /mute <username>"},
+		func(args []string, room *Room, sender *Client) string {
+			muteCommand(room.bot.lang, sender, args)
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdUnmute, Description: "🔊 See a muted user's messages again: /unmute <username>"},
+		func(args []string, room *Room, sender *Client) string {
+			unmuteCommand(room.bot.lang, sender, args)
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdBlock, Description: "⛔ Refuse private messages from a user: /block <username>"},
+		func(args []string, room *Room, sender *Client) string {
+			blockCommand(room.bot.lang, sender, args)
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdUnblock, Description: "✅ Accept a blocked user's private messages again: /unblock <username>"},
+		func(args []string, room *Room, sender *Client) string {
+			unblockCommand(room.bot.lang, sender, args)
+			return ""
+		})
+	RegisterCommand(Command{Name: cmdKick, Description: "👢 Disconnect a user (moderators only): /kick <username>"},
+		func(args []string, room *Room, sender *Client) string { room.kickCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdBan, Description: "🚫 Disconnect and ban a user (moderators only): /ban <username>"},
+		func(args []string, room *Room, sender *Client) string { room.banCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdClear, Description: "🧹 Clear the room's history, and with \"all\" its saved messages (moderators only): /clear [all]"},
+		func(args []string, room *Room, sender *Client) string { room.clearCommand(sender, args); return "" })
+	RegisterCommand(Command{Name: cmdHelp, Aliases: []string{"?", "h"}, Description: "📖 List all available commands"},
+		func(args []string, room *Room, sender *Client) string {
+			return helpText(room.bot.lang, room.bot.name)
+		})
+}
+
+// handleCommand runs a command line (without its leading "/") sent by sender
+// in the room. The first word is the command name, the rest are its
+// arguments.
+func (room *Room) handleCommand(sender *Client, input string) {
+	command, args := parseCommand(input)
+	command = resolveCommand(command)
+	debugf("Processing command %q with %d arguments in room %s", command, len(args), room.name)
+	metrics.commandProcessed(command)
+
+	handler := commandHandlers[command]
+	if handler == nil {
+		if suggestion := suggestCommand(command); suggestion != "" {
+			room.bot.SendMessage(translate(room.bot.lang, "command.suggest", command, suggestion))
+			return
+		}
+		room.bot.SendMessage(translate(room.bot.lang, "command.unknown"))
+		return
+	}
+	if reply := handler(args, room, sender); reply != "" {
+		room.bot.SendMessage(reply)
+	}
+}
+
+// isCommand reports whether name is a registered command.
+func isCommand(name string) bool {
+	return commandHandlers[name] != nil
+}
+
+// resolveCommand returns the registered name of a command typed as name,
+// ignoring case and accepting aliases. Unknown names are returned lowercased.
+func resolveCommand(name string) string {
+	name = strings.ToLower(name)
+	for _, cmd := range commands {
+		if cmd.Name == name || slices.Contains(cmd.Aliases, name) {
+			return cmd.Name
+		}
+	}
+	return name
+}
+
+// maxSuggestDistance is the most edits a mistyped command may be from a
+// real one for it to be suggested.
+const maxSuggestDistance = 2
+
+// suggestCommand returns the registered command whose name or alias is
+// closest to the unknown name, or "" if none is close enough to be a typo.
+func suggestCommand(name string) string {
+	best, bestDistance := "", maxSuggestDistance+1
+	length := utf8.RuneCountInString(name)
+	for _, cmd := range commands {
+		for _, candidate := range append([]string{cmd.Name}, cmd.Aliases...) {
+			// Names differing in length by more than the allowed edits
+			// can't be close, and long ones are costly to compare
+			if diff := length - utf8.RuneCountInString(candidate); diff > maxSuggestDistance || -diff > maxSuggestDistance {
+				continue
+			}
+			d := editDistance(name, candidate)
+			// Very short names are within a couple of edits of anything
+			if d < bestDistance && d < length && d < utf8.RuneCountInString(candidate) {
+				best, bestDistance = cmd.Name, d
+			}
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b: the
+// fewest single-rune insertions, deletions and substitutions turning one
+// into the other.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// helpText lists every registered command with its aliases and description,
+// in lang where the catalog has a translation, under a header naming the
+// bot.
+func helpText(lang, botName string) string {
+	var b strings.Builder
+	b.WriteString(translate(lang, "help.header", botName))
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "\n/%s", cmd.Name)
+		for _, alias := range cmd.Aliases {
+			fmt.Fprintf(&b, ", /%s", alias)
+		}
+		description, ok := catalogMessage(lang, "help."+cmd.Name)
+		if !ok {
+			description = cmd.Description
+		}
+		fmt.Fprintf(&b, " - %s", description)
+	}
+	return b.String()
+}
+
+// parseCommand splits a command line into its name and arguments.
+func parseCommand(input string) (string, []string) {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+func (b *Bot) savingCommand(args []string, loc locale) string {
+	monthly := 0
+	if len(args) > 0 {
+		var err error
+		monthly, err = parseAmount(b.lang, loc, args[0])
+		if err != nil {
+			return translate(b.lang, "saving.usage", err)
+		}
+	}
+
+	// mathrand.Rand isn't safe for concurrent use
+	b.randMu.Lock()
+	defer b.randMu.Unlock()
+	return calculateSavings(b.lang, loc, monthly, b.savingsMin, b.savingsMax, b.rand)
+}
+
+// maxAmount bounds user-supplied kroner amounts so projections can't overflow.
+const maxAmount = 1_000_000_000
+
+// parseAmount parses a whole, positive kroner amount, explaining any
+// problem in lang with numbers written for loc.
+func parseAmount(lang string, loc locale, arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		return 0, errors.New(translate(lang, "amount.invalid", arg))
+	}
+	if n > maxAmount {
+		return 0, errors.New(translate(lang, "amount.tooLarge", arg, formatNumber(maxAmount, loc)))
+	}
+	return n, nil
+}
+
+func compoundCommand(lang string, args []string, loc locale) string {
+	usage := translate(lang, "compound.usage")
+	if len(args) != 3 {
+		return "⚠️ " + usage
+	}
+
+	principal, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || math.IsNaN(principal) || principal <= 0 || principal > maxAmount {
+		return translate(lang, "principal.invalid", args[0], usage)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(args[1], "%"), 64)
+	if err != nil || math.IsNaN(rate) || rate < 0 || rate > maxCompoundRate {
+		return translate(lang, "rate.invalid", args[1], maxCompoundRate, usage)
+	}
+	years, err := strconv.Atoi(args[2])
+	if err != nil || years <= 0 || years > maxCompoundYears {
+		return translate(lang, "years.invalid", args[2], maxCompoundYears, usage)
+	}
+
+	return calculateCompound(lang, principal, rate, years, loc)
+}
+
+func mortgageCommand(lang string, args []string, loc locale) string {
+	usage := translate(lang, "mortgage.usage")
+	if len(args) != 3 {
+		return "⚠️ " + usage
+	}
+
+	principal, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || math.IsNaN(principal) || principal <= 0 || principal > maxAmount {
+		return translate(lang, "principal.invalid", args[0], usage)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(args[1], "%"), 64)
+	if err != nil || math.IsNaN(rate) || rate < 0 || rate > maxMortgageRate {
+		return translate(lang, "rate.invalid", args[1], maxMortgageRate, usage)
+	}
+	years, err := strconv.Atoi(args[2])
+	if err != nil || years <= 0 || years > maxMortgageYears {
+		return translate(lang, "years.invalid", args[2], maxMortgageYears, usage)
+	}
+
+	monthly, interest := calculateAnnuity(principal, rate, years)
+	return translate(lang, "mortgage.result",
+		formatDecimal(principal, 0, loc),
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		years,
+		formatDecimal(monthly, 2, loc),
+		formatDecimal(interest, 2, loc))
+}
+
+func splitCommand(lang string, args []string, loc locale) string {
+	usage := translate(lang, "split.usage")
+	if len(args) != 2 && (len(args) != 4 || strings.ToLower(args[2]) != "tip") {
+		return "⚠️ " + usage
+	}
+
+	total, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || math.IsNaN(total) || total <= 0 || total > maxAmount {
+		return translate(lang, "total.invalid", args[0], usage)
+	}
+	people, err := strconv.Atoi(args[1])
+	if err != nil || people <= 0 || people > maxSplitPeople {
+		return translate(lang, "people.invalid", args[1], maxSplitPeople, usage)
+	}
+	tip := 0.0
+	if len(args) == 4 {
+		tip, err = strconv.ParseFloat(strings.TrimSuffix(args[3], "%"), 64)
+		if err != nil || math.IsNaN(tip) || tip < 0 || tip > maxTipPct {
+			return translate(lang, "tip.invalid", args[3], maxTipPct, usage)
+		}
+	}
+
+	total *= 1 + tip/100
+	shares := splitBill(total, people)
+
+	// Shares differ by at most one øre, so describe them as at most two groups
+	var parts []string
+	for i := 0; i < len(shares); {
+		j := i
+		for j < len(shares) && shares[j] == shares[i] {
+			j++
+		}
+		parts = append(parts, fmt.Sprintf("%d × %s kr", j-i, formatDecimal(shares[i], 2, loc)))
+		i = j
+	}
+
+	withTip := ""
+	if tip > 0 {
+		withTip = translate(lang, "split.tip", strconv.FormatFloat(tip, 'f', -1, 64))
+	}
+	return translate(lang, "split.result", formatDecimal(total, 2, loc), withTip, people, strings.Join(parts, translate(lang, "list.and")))
+}
+
+func vatCommand(lang string, args []string, loc locale) string {
+	usage := translate(lang, "vat.usage")
+	gross := false
+	var rest []string
+	for _, arg := range args {
+		if strings.EqualFold(arg, "-gross") {
+			gross = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	if len(rest) < 1 || len(rest) > 2 {
+		return "⚠️ " + usage
+	}
+
+	amount, err := strconv.ParseFloat(rest[0], 64)
+	if err != nil || math.IsNaN(amount) || amount <= 0 || amount > maxAmount {
+		return translate(lang, "amount.invalidUsage", rest[0], usage)
+	}
+	rate := float64(defaultVATRate)
+	if len(rest) == 2 {
+		rate, err = strconv.ParseFloat(strings.TrimSuffix(rest[1], "%"), 64)
+		if err != nil || math.IsNaN(rate) || rate < 0 || rate > maxVATRate {
+			return translate(lang, "rate.invalid", rest[1], maxVATRate, usage)
+		}
+	}
+	ratePct := strconv.FormatFloat(rate, 'f', -1, 64)
+
+	if gross {
+		net, vat := extractVAT(amount, rate)
+		return translate(lang, "vat.gross",
+			formatDecimal(amount, 2, loc), ratePct, formatDecimal(net, 2, loc), formatDecimal(vat, 2, loc))
+	}
+	vat, total := addVAT(amount, rate)
+	return translate(lang, "vat.net",
+		formatDecimal(amount, 2, loc), ratePct, formatDecimal(vat, 2, loc), formatDecimal(total, 2, loc))
+}
+
+func convertCommand(lang string, args []string, rates RateProvider, loc locale) string {
+	usage := translate(lang, "convert.usage")
+	if len(args) != 3 {
+		return "⚠️ " + usage
+	}
+
+	amount, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || math.IsNaN(amount) || amount <= 0 || amount > maxAmount {
+		return translate(lang, "amount.invalidUsage", args[0], usage)
+	}
+	from, to := strings.ToUpper(args[1]), strings.ToUpper(args[2])
+	for _, code := range []string{from, to} {
+		if !isCurrencyCode(code) {
+			return translate(lang, "currency.invalid", code, usage)
+		}
+	}
+
+	rate, err := rates.Rate(from, to)
+	if errors.Is(err, errUnknownCurrency) {
+		return translate(lang, "rate.unknown", from, to)
+	}
+	if err != nil {
+		errorf("Rate lookup %s/%s failed: %v", from, to, err)
+		return translate(lang, "rates.unavailable")
+	}
+
+	return translate(lang, "convert.result", formatDecimal(amount, 2, loc), from, formatDecimal(amount*rate, 2, loc), to)
+}
+
+func stockCommand(lang string, args []string, quotes QuoteProvider, loc locale) string {
+	usage := translate(lang, "stock.usage")
+	if len(args) != 1 {
+		return "⚠️ " + usage
+	}
+	symbol := strings.ToUpper(args[0])
+	if !isTickerSymbol(symbol) {
+		return translate(lang, "symbol.invalid", args[0], usage)
+	}
+
+	price, currency, err := quotes.Quote(symbol)
+	if errors.Is(err, errUnknownSymbol) {
+		return translate(lang, "quote.unknown", symbol)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		warnf("Quote lookup %s timed out: %v", symbol, err)
+		return translate(lang, "quotes.timeout")
+	}
+	if err != nil {
+		errorf("Quote lookup %s failed: %v", symbol, err)
+		return translate(lang, "quotes.unavailable")
+	}
+
+	return translate(lang, "stock.result", symbol, formatDecimal(price, 2, loc), currency)
+}
+
+func cryptoCommand(lang string, args []string, coins CryptoProvider, loc locale) string {
+	usage := translate(lang, "crypto.usage")
+	if len(args) < 1 || len(args) > 2 {
+		return "⚠️ " + usage
+	}
+	coin, currency := strings.ToUpper(args[0]), "NOK"
+	if len(args) == 2 {
+		currency = strings.ToUpper(args[1])
+	}
+	if !isTickerSymbol(coin) {
+		return translate(lang, "coin.invalid", args[0], usage)
+	}
+	if !isCurrencyCode(currency) {
+		return translate(lang, "currency.invalid", currency, usage)
+	}
+
+	price, change, err := coins.Price(coin, currency)
+	switch {
+	case errors.Is(err, errUnknownCoin):
+		return translate(lang, "coin.unknown", coin)
+	case errors.Is(err, errUnknownCurrency):
+		return translate(lang, "coin.noPrice", coin, currency)
+	case errors.Is(err, errRateLimited):
+		return translate(lang, "coins.rateLimited")
+	case err != nil:
+		errorf("Price lookup %s/%s failed: %v", coin, currency, err)
+		return translate(lang, "coins.unavailable")
+	}
+
+	return translate(lang, "crypto.result", coin, formatDecimal(price, 2, loc), currency, formatChange(change, loc))
+}
+
+// formatChange formats a percent change with two decimals and an explicit
+// sign, e.g. +2,35 or -0,80 for nb-NO.
+func formatChange(change float64, loc locale) string {
+	s := formatDecimal(change, 2, loc)
+	if !strings.HasPrefix(s, "-") {
+		s = "+" + s
+	}
+	return s
+}
+
+// isTickerSymbol reports whether symbol looks like an exchange ticker, such
+// as AAPL, BRK-B or EQNR.OL.
+func isTickerSymbol(symbol string) bool {
+	if symbol == "" || len(symbol) > 12 {
+		return false
+	}
+	for _, r := range symbol {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '.' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isCurrencyCode reports whether code looks like an ISO 4217 code.
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// maxDice and maxSides bound /roll so replies stay short.
+const (
+	maxDice  = 100
+	maxSides = 1000
+)
+
+// rollCommand rolls dice written as NdM, N dice with M sides each, and
+// reports each roll and the total. A bare /roll rolls one six-sided die.
+func (b *Bot) rollCommand(name string, args []string) string {
+	usage := translate(b.lang, "roll.usage")
+	if len(args) > 1 {
+		return "⚠️ " + usage
+	}
+	notation := "1d6"
+	if len(args) == 1 {
+		notation = args[0]
+	}
+	count, sides, err := parseDice(b.lang, notation)
+	if err != nil {
+		return fmt.Sprintf("⚠️ %v. %s", err, usage)
+	}
+
+	rolls := make([]string, count)
+	total := 0
+	// mathrand.Rand isn't safe for concurrent use
+	b.randMu.Lock()
+	for i := range rolls {
+		roll := b.rand.Intn(sides) + 1
+		rolls[i] = strconv.Itoa(roll)
+		total += roll
+	}
+	b.randMu.Unlock()
+
+	if count == 1 {
+		return translate(b.lang, "roll.one", name, count, sides, total)
+	}
+	return translate(b.lang, "roll.many", name, count, sides, strings.Join(rolls, " + "), total)
+}
+
+// parseDice parses dice notation such as "2d6" or "d20", explaining any
+// problem in lang. The count defaults to 1.
+func parseDice(lang, notation string) (count, sides int, err error) {
+	countStr, sidesStr, ok := strings.Cut(strings.ToLower(notation), "d")
+	if !ok {
+		return 0, 0, errors.New(translate(lang, "dice.invalid", notation))
+	}
+	count = 1
+	if countStr != "" {
+		if count, err = strconv.Atoi(countStr); err != nil || count < 1 || count > maxDice {
+			return 0, 0, errors.New(translate(lang, "dice.count", notation, maxDice))
+		}
+	}
+	if sides, err = strconv.Atoi(sidesStr); err != nil || sides < 2 || sides > maxSides {
+		return 0, 0, errors.New(translate(lang, "dice.sides", notation, maxSides))
+	}
+	return count, sides, nil
+}
+
+// timeCommand reports now in the IANA time zone named in args, or in the
+// server's local zone.
+func timeCommand(lang string, args []string, now time.Time) string {
+	usage := translate(lang, "time.usage")
+	if len(args) > 1 {
+		return "⚠️ " + usage
+	}
+	loc, zone := time.Local, translate(lang, "time.server")
+	if len(args) == 1 {
+		var err error
+		if loc, err = time.LoadLocation(args[0]); err != nil {
+			return translate(lang, "zone.unknown", args[0], usage)
+		}
+		zone = loc.String()
+	}
+	return translate(lang, "time.result", now.In(loc).Format(translate(lang, "time.layout")), zone)
+}
+
+// meCommand broadcasts an action line such as "* alice waves". Unlike the
+// other commands the reply comes from the sender, not the bot.
+func (room *Room) meCommand(sender *Client, args []string) {
+	if len(args) == 0 {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "me.usage")})
+		return
+	}
+	if room.linkBlocked(sender, strings.Join(args, " ")) {
+		return
+	}
+	room.markBack(sender)
+	name := sender.name()
+	action := fmt.Sprintf("* %s %s", name, strings.Join(args, " "))
+	room.deliverFrom(sender, Message{Type: msgAction, From: name, Content: action})
+}
+
+// dmCommand sends a private message, like "@user message" but harder to
+// send by accident.
+func (room *Room) dmCommand(sender *Client, args []string) {
+	if len(args) < 2 {
+		room.bot.sendTo(sender, "⚠️ "+translate(room.bot.lang, "dm.usage"))
+		return
+	}
+	room.sendPrivate(sender, args[0], strings.Join(args[1:], " "))
+}
+
+// nickCommand renames the sender, applying the same rules as joining, and
+// announces the new name to the room.
+func (room *Room) nickCommand(sender *Client, args []string) {
+	if len(args) != 1 {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "nick.usage")})
+		return
+	}
+	oldName, newName := sender.name(), args[0]
+	if newName == oldName {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "nick.same", newName)})
+		return
+	}
+	if err := validateUsername(newName); err != nil {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "nick.invalid", err)})
+		return
+	}
+	if sender.hub.isBannedName(newName) {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "nick.banned", newName)})
+		return
+	}
+	if err := room.rename(sender, newName); err != nil {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "nick.invalid", err)})
+		return
+	}
+
+	infof("Client renamed: %s is now %s (room %s)", oldName, newName, room.name)
+	sender.send(Message{Type: msgUsername, Content: newName})
+	// Stays in English: the web client follows renames by matching it, as
+	// it does the join and leave notices
+	room.handleMessage([]byte(fmt.Sprintf("%s is now known as %s", oldName, newName)), nil)
+}
+
+// awayCommand marks the sender as away until they chat again or use /back.
+// Private messages to them get their away message as an automatic reply.
+func (room *Room) awayCommand(sender *Client, args []string) {
+	message := strings.Join(args, " ")
+	if room.linkBlocked(sender, message) {
+		return
+	}
+	if room.filter != nil {
+		message = room.filter.mask(message)
+	}
+	sender.setAway(message)
+	room.handleMessage([]byte(awayText(room.bot.lang, sender.name(), message)), nil)
+}
+
+// markBack clears the sender's away status and tells the room, reporting
+// whether they were away.
+func (room *Room) markBack(sender *Client) bool {
+	if !sender.clearAway() {
+		return false
+	}
+	room.handleMessage([]byte(translate(room.bot.lang, "away.back", sender.name())), nil)
+	return true
+}
+
+// awayText describes an away user in lang, with their message if they left
+// one.
+func awayText(lang, name, message string) string {
+	if message == "" {
+		return translate(lang, "away.set", name)
+	}
+	return translate(lang, "away.setWith", name, message)
+}
+
+// muteCommand hides the named user's chat, actions and private messages
+// from the sender, replying in lang. Only the sender is told; the muted user
+// isn't.
+func muteCommand(lang string, sender *Client, args []string) {
+	if len(args) != 1 {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "mute.usage")})
+		return
+	}
+	name := args[0]
+	if name == sender.name() {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "mute.self")})
+		return
+	}
+	sender.mute(name)
+	sender.send(Message{Type: msgSystem, Content: translate(lang, "mute.done", name, name)})
+}
+
+// unmuteCommand lets the named user's messages through to the sender again.
+func unmuteCommand(lang string, sender *Client, args []string) {
+	if len(args) != 1 {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "unmute.usage")})
+		return
+	}
+	if !sender.unmute(args[0]) {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "unmute.notMuted", args[0])})
+		return
+	}
+	sender.send(Message{Type: msgSystem, Content: translate(lang, "unmute.done", args[0])})
+}
+
+// blockCommand refuses private messages from the named user to the sender.
+// Unlike /mute it leaves their chat visible, and their private messages are
+// reported to them as undelivered rather than dropped silently.
+func blockCommand(lang string, sender *Client, args []string) {
+	if len(args) != 1 {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "block.usage")})
+		return
+	}
+	name := args[0]
+	if name == sender.name() {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "block.self")})
+		return
+	}
+	sender.block(name)
+	sender.send(Message{Type: msgSystem, Content: translate(lang, "block.done", name, name)})
+}
+
+// unblockCommand lets the named user's private messages through to the
+// sender again.
+func unblockCommand(lang string, sender *Client, args []string) {
+	if len(args) != 1 {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "unblock.usage")})
+		return
+	}
+	if !sender.unblock(args[0]) {
+		sender.send(Message{Type: msgSystem, Content: translate(lang, "unblock.notBlocked", args[0])})
+		return
+	}
+	sender.send(Message{Type: msgSystem, Content: translate(lang, "unblock.done", args[0])})
+}
+
+// whoText lists the sorted, de-duplicated usernames currently in the room,
+// noting who is away, in lang.
+func (room *Room) whoText(lang string) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, client := range room.snapshot() {
+		name := client.name()
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if message, away := client.awayStatus(); away && message != "" {
+			name = translate(lang, "who.awayWith", name, message)
+		} else if away {
+			name = translate(lang, "who.away", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return translate(lang, "who.result", len(names), strings.Join(names, ", "))
+}
+
+// statsText summarizes the room and the server: clients in the room, open
+// rooms, messages sent since the server started and its uptime. Everything
+// comes from counters, so it stays cheap however busy the server is.
+func (room *Room) statsText(lang string, hub *Hub, loc locale) string {
+	uptime := hub.now().Sub(hub.started).Round(time.Second)
+	return translate(lang, "stats.result",
+		formatNumber(len(room.snapshot()), loc),
+		formatNumber(hub.roomCount(), loc),
+		formatNumber(int(metrics.messagesBroadcast.Load()), loc),
+		uptime)
+}
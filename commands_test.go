@@ -0,0 +1,997 @@
+package main
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHelpText(t *testing.T) {
+	lines := strings.Split(helpText(defaultLang, "FinanceBot"), "\n")
+	if want := "Commands FinanceBot can help with:"; lines[0] != want {
+		t.Errorf("header = %q, want %q", lines[0], want)
+	}
+	if got, want := len(lines)-1, len(commands); got != want {
+		t.Fatalf("%d command lines, want one for each of the %d commands", got, want)
+	}
+	for i, cmd := range commands {
+		if !strings.HasPrefix(lines[i+1], "/"+cmd.Name) || !strings.HasSuffix(lines[i+1], " - "+cmd.Description) {
+			t.Errorf("line for /%s = %q", cmd.Name, lines[i+1])
+		}
+	}
+	if want := "/saving, /save, /savings - "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("first command line = %q, want the aliases listed as %q", lines[1], want)
+	}
+}
+
+func TestHelpCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/help")
+	reply := alice.expectContent(msgCommand, "can help with:")
+	if reply.Content != helpText(defaultLang, defaultBotName) {
+		t.Errorf("/help replied %q", reply.Content)
+	}
+	if reply.From != defaultBotName {
+		t.Errorf("reply from %q, want the bot", reply.From)
+	}
+}
+
+func TestCustomBotName(t *testing.T) {
+	cfg, err := parseFlags([]string{"-bot-name", "Penny 💰"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.rateLimit = 0
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws/other?username=bob")
+
+	alice.say("/saving 5000")
+	if reply := alice.expectContent(msgCommand, "If you save 5.000 kr"); reply.From != "Penny 💰" {
+		t.Errorf("reply from %q, want Penny 💰", reply.From)
+	}
+	bob.say("/help")
+	reply := bob.expectContent(msgCommand, "can help with:")
+	if want := "Commands Penny 💰 can help with:"; !strings.HasPrefix(reply.Content, want) || reply.From != "Penny 💰" {
+		t.Errorf("/help in another room = %q from %q, want %q from Penny 💰", reply.Content, reply.From, want)
+	}
+	bob.say("/reminder 50ms stretch")
+	bob.expect("the reminder from Penny", isPrivate("Penny 💰", "bob", "⏰ Reminder: stretch"))
+}
+
+func TestBotNameFlag(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"  ", "-bot-name: must not be blank"},
+		{strings.Repeat("b", maxUsernameLength+1), "-bot-name: longer than 32 characters"},
+		{"Bot\nName", "-bot-name: must not contain control characters"},
+		{"Bot\xff", "-bot-name: not valid UTF-8"},
+	} {
+		if _, err := parseFlags([]string{"-bot-name", tt.name}); err == nil || err.Error() != tt.want {
+			t.Errorf("-bot-name %q: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// formatVerb matches the fmt verbs in a catalog message.
+var formatVerb = regexp.MustCompile(`%[-+# 0]*[0-9]*(\.[0-9]+)?[a-zA-Z%]`)
+
+func TestCatalogIsTranslated(t *testing.T) {
+	for key, en := range catalog[defaultLang] {
+		no, ok := catalog["no"][key]
+		if !ok {
+			t.Errorf("%q has no Norwegian translation", key)
+			continue
+		}
+		if got, want := formatVerb.FindAllString(no, -1), formatVerb.FindAllString(en, -1); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%q takes %v in Norwegian but %v in English", key, got, want)
+		}
+	}
+	// Command descriptions are the only Norwegian messages English takes
+	// from the command registry instead
+	for key := range catalog["no"] {
+		if _, ok := catalog[defaultLang][key]; ok {
+			continue
+		}
+		if name, ok := strings.CutPrefix(key, "help."); !ok || !isCommand(name) {
+			t.Errorf("%q is only in Norwegian", key)
+		}
+	}
+	// Only replies made of names, numbers and codes read the same in both
+	for key, en := range catalog[defaultLang] {
+		switch key {
+		case "convert.result", "stock.result", "time.result":
+			continue
+		}
+		if catalog["no"][key] == en {
+			t.Errorf("%q is the same in Norwegian as in English", key)
+		}
+	}
+}
+
+func TestCommandRepliesAreTranslated(t *testing.T) {
+	now := time.Date(2026, time.October, 16, 12, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name   string
+		reply  func(lang string) string
+		en, no string
+	}{
+		{"saving", func(lang string) string {
+			bot := NewRoom("test").bot
+			bot.lang = lang
+			return bot.savingCommand([]string{"1000"}, defaultLocale)
+		}, "💰 Financial Tip: If you save 1.000 kr per month", "💰 Sparetips: Sparer du 1.000 kr i måneden"},
+		{"savinggoal", func(lang string) string {
+			bot := NewRoom("test").bot
+			bot.lang = lang
+			alice := newOfflineClient("alice")
+			alice.identity = 1
+			bot.goalCommand(alice, strings.Fields("set 1000"), defaultLocale)
+			return bot.goalCommand(alice, strings.Fields("add 250"), defaultLocale)
+		}, "🎯 alice has saved 250 of 1.000 kr (25%), 750 kr to go", "🎯 alice har spart 250 av 1.000 kr (25%), 750 kr igjen"},
+		{"compound", func(lang string) string { return compoundCommand(lang, strings.Fields("1000 5 10"), defaultLocale) },
+			"📈 1.000 kr at 5% per year grows to", "📈 1.000 kr med 5% rente i året vokser til"},
+		{"mortgage", func(lang string) string { return mortgageCommand(lang, strings.Fields("100000 5 10"), defaultLocale) },
+			"🏠 A 100.000 kr loan at 5% over 10 years costs", "🏠 Et lån på 100.000 kr med 5% rente over 10 år koster"},
+		{"split", func(lang string) string { return splitCommand(lang, strings.Fields("100 3 tip 10"), defaultLocale) },
+			"🧾 110,00 kr (including a 10% tip) split 3 ways: 2 × 36,67 kr and 1 × 36,66 kr",
+			"🧾 110,00 kr (inkludert 10% tips) delt på 3: 2 × 36,67 kr og 1 × 36,66 kr"},
+		{"vat", func(lang string) string { return vatCommand(lang, []string{"100"}, defaultLocale) },
+			"🧾 100,00 kr + 25% VAT (25,00 kr) = 125,00 kr", "🧾 100,00 kr + 25% mva. (25,00 kr) = 125,00 kr"},
+		{"vat gross", func(lang string) string { return vatCommand(lang, strings.Fields("125 -gross"), defaultLocale) },
+			"🧾 125,00 kr including 25% VAT is 100,00 kr net + 25,00 kr VAT", "🧾 125,00 kr inkludert 25% mva. er 100,00 kr netto + 25,00 kr mva."},
+		{"convert", func(lang string) string {
+			return convertCommand(lang, strings.Fields("10 USD NOK"), fakeRates{rates: map[string]float64{"USD/NOK": 10}}, defaultLocale)
+		}, "💱 10,00 USD = 100,00 NOK", "💱 10,00 USD = 100,00 NOK"},
+		{"stock", func(lang string) string {
+			return stockCommand(lang, []string{"EQNR.OL"}, &fakeQuotes{prices: map[string]float64{"EQNR.OL": 280.5}}, defaultLocale)
+		}, "📊 EQNR.OL: 280,50 NOK", "📊 EQNR.OL: 280,50 NOK"},
+		{"crypto", func(lang string) string {
+			return cryptoCommand(lang, []string{"BTC"}, fakeCoins{prices: map[string][2]float64{"BTC/NOK": {700000, 2.5}}}, defaultLocale)
+		}, "🪙 BTC: 700.000,00 NOK (+2,50% 24h)", "🪙 BTC: 700.000,00 NOK (+2,50% siste døgn)"},
+		{"inflation", func(lang string) string {
+			return inflationCommand(lang, strings.Fields("100 2000 2020"), testCPI, defaultLocale)
+		}, "📉 100,00 kr in 2000 is worth about 200,00 kr in 2020 (+100,00%)", "📉 100,00 kr i 2000 er verdt omtrent 200,00 kr i 2020 (+100,00%)"},
+		{"time", func(lang string) string { return timeCommand(lang, []string{"UTC"}, now) },
+			"🕒 Friday 16 October 2026, 12:30 UTC (UTC)", "🕒 16.10.2026 kl. 12:30 UTC (UTC)"},
+		{"roll", func(lang string) string {
+			bot := NewRoom("test").bot
+			bot.lang = lang
+			return bot.rollCommand("alice", []string{"2d6"})
+		}, "🎲 alice rolled 2d6: ", "🎲 alice kastet 2d6: "},
+	} {
+		if got := tt.reply(defaultLang); !strings.HasPrefix(got, tt.en) {
+			t.Errorf("%s in English = %q, want prefix %q", tt.name, got, tt.en)
+		}
+		if got := tt.reply("no"); !strings.HasPrefix(got, tt.no) {
+			t.Errorf("%s in Norwegian = %q, want prefix %q", tt.name, got, tt.no)
+		}
+	}
+}
+
+func TestCommandErrorsAreTranslated(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		reply  func(lang string) string
+		en, no string
+	}{
+		{"compound usage", func(lang string) string { return compoundCommand(lang, nil, defaultLocale) },
+			"⚠️ Usage: /compound <principal> <rate%> <years>", "⚠️ Bruk: /compound <beløp> <rente%> <år>"},
+		{"mortgage rate", func(lang string) string { return mortgageCommand(lang, strings.Fields("1000 999 10"), defaultLocale) },
+			`⚠️ Invalid rate "999": must be between 0 and 100%.`, `⚠️ Ugyldig rente "999": må være mellom 0 og 100%.`},
+		{"split people", func(lang string) string { return splitCommand(lang, strings.Fields("100 0"), defaultLocale) },
+			`⚠️ Invalid number of people "0"`, `⚠️ Ugyldig antall personer "0"`},
+		{"vat amount", func(lang string) string { return vatCommand(lang, []string{"x"}, defaultLocale) },
+			`⚠️ Invalid amount "x". Usage: /vat`, `⚠️ Ugyldig beløp "x". Bruk: /vat`},
+		{"convert currency", func(lang string) string {
+			return convertCommand(lang, strings.Fields("100 US NOK"), fakeRates{}, defaultLocale)
+		}, `⚠️ Invalid currency "US": use a three-letter code like NOK.`, `⚠️ Ugyldig valuta "US": bruk en kode på tre bokstaver, som NOK.`},
+		{"stock symbol", func(lang string) string { return stockCommand(lang, []string{"$$$"}, &fakeQuotes{}, defaultLocale) },
+			`⚠️ Invalid symbol "$$$". Usage: /stock`, `⚠️ Ugyldig ticker "$$$". Bruk: /stock`},
+		{"crypto coin", func(lang string) string { return cryptoCommand(lang, []string{"DOGE"}, fakeCoins{}, defaultLocale) },
+			"⚠️ I don't know the coin DOGE.", "⚠️ Jeg kjenner ikke mynten DOGE."},
+		{"inflation range", func(lang string) string {
+			return inflationCommand(lang, strings.Fields("100 1900 2024"), testCPI, defaultLocale)
+		}, "⚠️ I only have prices for", "⚠️ Jeg har bare priser fra"},
+		{"time zone", func(lang string) string { return timeCommand(lang, []string{"Mars/Olympus"}, time.Now()) },
+			`⚠️ Unknown time zone "Mars/Olympus". Usage: /time`, `⚠️ Ukjent tidssone "Mars/Olympus". Bruk: /time`},
+		{"roll dice", func(lang string) string {
+			bot := NewRoom("test").bot
+			bot.lang = lang
+			return bot.rollCommand("alice", []string{"0d6"})
+		}, `⚠️ invalid dice "0d6": the count must be between 1 and 100. Usage: /roll`, `⚠️ ugyldige terninger "0d6": antallet må være mellom 1 og 100. Bruk: /roll`},
+	} {
+		if got := tt.reply(defaultLang); !strings.HasPrefix(got, tt.en) {
+			t.Errorf("%s in English = %q, want prefix %q", tt.name, got, tt.en)
+		}
+		if got := tt.reply("no"); !strings.HasPrefix(got, tt.no) {
+			t.Errorf("%s in Norwegian = %q, want prefix %q", tt.name, got, tt.no)
+		}
+	}
+}
+
+func TestBotRepliesInTheConfiguredLanguage(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.lang = "no"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/split 100")
+	alice.expectContent(msgCommand, "⚠️ Bruk: /split <totalt> <personer> [tip <prosent>], f.eks. /split 1200 4 tip 10")
+	alice.say("/time Mars/Olympus")
+	alice.expectContent(msgCommand, `⚠️ Ukjent tidssone "Mars/Olympus". Bruk: /time [sone]`)
+
+	// Replies that need a room, and the bot's private notes, too
+	alice.say("/away lunsj")
+	alice.say("/who")
+	alice.expectContent(msgCommand, "👥 1 pålogget: alice (borte: lunsj)")
+	alice.say("/stats")
+	alice.expectContent(msgCommand, "📈 Pålogget her: 1 · Åpne rom: 1 · Sendte meldinger:")
+	alice.say(`/poll "Lunsj?" Pizza Sushi`)
+	alice.expectContent(msgCommand, "📊 Lunsj?\n1. Pizza: 0 stemmer\n2. Sushi: 0 stemmer\nStartet av alice. Stem med /vote <nummer>.")
+	alice.say("/vote 1")
+	alice.say("/results")
+	alice.expectContent(msgCommand, "📊 Lunsj?\n1. Pizza: 1 stemme (100%)\n2. Sushi: 0 stemmer")
+	alice.say("/endpoll")
+	alice.expectContent(msgCommand, "Avstemningen er avsluttet.\n📊 Lunsj?")
+	alice.say("/history")
+	alice.expectContent(msgCommand, "📜 De siste")
+	alice.say("/reminder 10m sjekk ovnen")
+	alice.expectContent(msgCommand, "⏰ Jeg minner deg på det om 10m0s.")
+	alice.say("/dm bob hei")
+	alice.expectContent(msgCommand, "⚠️ Fant ikke brukeren bob")
+	alice.sendFrame(Message{Type: msgChat, Content: "svar", ReplyTo: 999})
+	alice.expectContent(msgCommand, "Meldingen du svarte på er for gammel eller finnes ikke, så svaret ditt ble ikke levert.")
+
+	// The server's own notices, as well as the bot's replies
+	alice.say("/back")
+	alice.expectContent(msgSystem, "alice er tilbake")
+	alice.say("/nick alice")
+	alice.expectContent(msgSystem, "Du heter allerede alice.")
+	alice.say("/mute alice")
+	alice.expectContent(msgSystem, "Du kan ikke dempe deg selv.")
+	alice.say("/block bob")
+	alice.expectContent(msgSystem, "Blokkerte private meldinger fra bob. Bruk /unblock bob for å angre.")
+	alice.say("/kick bob")
+	alice.expectContent(msgSystem, "Bare moderatorer kan bruke /kick.")
+	alice.say("/export")
+	alice.expectContent(msgSystem, "📦 Last ned rommets siste")
+}
+
+func TestUnknownCommandSuggestsHelp(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/xyzzy")
+	alice.expectContent(msgCommand, "Unknown command. Type /help")
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"saving", "saving", 0},
+		{"", "help", 4},
+		{"savng", "saving", 1},
+		{"saivng", "saving", 2},
+		{"kitten", "sitting", 3},
+		{"sparing", "spåring", 1},
+		{"help", "", 4},
+	} {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestCommand(t *testing.T) {
+	for _, tt := range []struct{ typed, want string }{
+		{"savng", cmdSaving},
+		{"helo", cmdHelp},
+		{"mortage", cmdMortgage},
+		{"sav", cmdSaving},    // one edit from the alias /save
+		{"lone", cmdMortgage}, // one edit from the alias /loan
+		{"xyzzy", ""},
+		{"quantumleap", ""},
+		{"x", ""},
+	} {
+		if got := suggestCommand(tt.typed); got != tt.want {
+			t.Errorf("suggestCommand(%q) = %q, want %q", tt.typed, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownCommandSuggestsAClosePick(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/savng 5000")
+	alice.expectContent(msgCommand, "Unknown command /savng. Did you mean /saving?")
+	alice.say("/quantumleap")
+	reply := alice.expectContent(msgCommand, "Unknown command")
+	if strings.Contains(reply.Content, "Did you mean") {
+		t.Errorf("suggested something for a far-off command: %q", reply.Content)
+	}
+}
+
+func TestSavingCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"5000"}, "If you save 5.000 kr per month, you'll have 600.000 kr in 10 years!"},
+		{[]string{"1"}, "If you save 1 kr per month, you'll have 120 kr in 10 years!"},
+		{[]string{"5000", "extra"}, "If you save 5.000 kr per month"},
+		{[]string{"abc"}, `⚠️ invalid amount "abc": must be a positive whole number. Usage: /saving [monthly amount]`},
+		{[]string{"-100"}, `invalid amount "-100": must be a positive whole number`},
+		{[]string{"0"}, `invalid amount "0"`},
+		{[]string{"12.5"}, `invalid amount "12.5"`},
+		{[]string{"2000000000"}, `amount "2000000000" is too large (max 1.000.000.000)`},
+	}
+	bot := NewRoom("test").bot
+	for _, tt := range tests {
+		if got := bot.savingCommand(tt.args, defaultLocale); !strings.Contains(got, tt.want) {
+			t.Errorf("/saving %s = %q, want it to contain %q", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+}
+
+func TestSavingCommandWithoutAmountIsRandom(t *testing.T) {
+	bot := NewRoom("test").bot
+	if got := bot.savingCommand(nil, defaultLocale); !strings.HasPrefix(got, "💰 Financial Tip: If you save ") {
+		t.Errorf("/saving = %q", got)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		input, name string
+		args        []string
+	}{
+		{"saving", "saving", nil},
+		{"saving 5000", "saving", []string{"5000"}},
+		{"  saving   5000  ", "saving", []string{"5000"}},
+		{"compound 10000 5 20", "compound", []string{"10000", "5", "20"}},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		name, args := parseCommand(tt.input)
+		if name != tt.name || strings.Join(args, "|") != strings.Join(tt.args, "|") {
+			t.Errorf("parseCommand(%q) = %q, %q; want %q, %q", tt.input, name, args, tt.name, tt.args)
+		}
+	}
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{
+		"saving 5000",
+		"saving -100",
+		"saving 9223372036854775807",
+		"saving 9223372036854775808",
+		"saving -9223372036854775808",
+		"compound 10000 5% 20",
+		"nick Ørjan",
+		"dm 日本語 こんにちは",
+		"  ",
+		"",
+		"\u00a0saving\u2003 5000",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		name, args := parseCommand(input)
+		if name == "" {
+			if len(args) != 0 || strings.TrimSpace(input) != "" {
+				t.Fatalf("parseCommand(%q) = %q, %q", input, name, args)
+			}
+			return
+		}
+		// Every field comes back in order, without the spacing between them
+		fields := append([]string{name}, args...)
+		if !reflect.DeepEqual(fields, strings.Fields(input)) {
+			t.Fatalf("parseCommand(%q) = %q, %q", input, name, args)
+		}
+
+		// Amounts parsed from the arguments are always in range
+		for _, arg := range args {
+			if n, err := parseAmount(defaultLang, defaultLocale, arg); err == nil && (n <= 0 || n > maxAmount) {
+				t.Fatalf("parseAmount(%q) = %d", arg, n)
+			}
+		}
+	})
+}
+
+func TestResolveCommand(t *testing.T) {
+	for _, tt := range []struct{ typed, want string }{
+		{"saving", cmdSaving},
+		{"Saving", cmdSaving},
+		{"SAVE", cmdSaving},
+		{"savings", cmdSaving},
+		{"?", cmdHelp},
+		{"H", cmdHelp},
+		{"loan", cmdMortgage},
+		{"Xyzzy", "xyzzy"},
+	} {
+		if got := resolveCommand(tt.typed); got != tt.want {
+			t.Errorf("resolveCommand(%q) = %q, want %q", tt.typed, got, tt.want)
+		}
+	}
+}
+
+func TestCommandAliasesAndCase(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	const want = "If you save 5.000 kr per month, you'll have 600.000 kr in 10 years!"
+	for _, input := range []string{"/saving 5000", "/Saving 5000", "/SAVE 5000", "/savings 5000"} {
+		alice.say(input)
+		alice.expectContent(msgCommand, want)
+	}
+	for _, input := range []string{"/?", "/H", "/Help"} {
+		alice.say(input)
+		if reply := alice.expectContent(msgCommand, "can help with:"); reply.Content != helpText(defaultLang, defaultBotName) {
+			t.Errorf("%s replied %q", input, reply.Content)
+		}
+	}
+
+	// Only the command's name is folded; a zone name is case-sensitive
+	alice.say("/TIME Europe/Oslo")
+	alice.expectContent(msgCommand, "(Europe/Oslo)")
+	alice.say("/time europe/oslo")
+	alice.expectContent(msgCommand, `Unknown time zone "europe/oslo"`)
+}
+
+func TestCompoundCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"10000 5 20", "grows to 26.533 kr in 20 years"},
+		{"10000 5% 20", "grows to 26.533 kr in 20 years"},
+		{"1000 2.5 2", "at 2.5% per year grows to 1.051 kr"},
+		{"", "⚠️ Usage: /compound"},
+		{"10000 5", "⚠️ Usage: /compound"},
+		{"-10000 5 20", `Invalid principal "-10000"`},
+		{"NaN 5 20", `Invalid principal "NaN"`},
+		{"10000 -5 20", `Invalid rate "-5"`},
+		{"10000 101 20", `Invalid rate "101"`},
+		{"10000 5 0", `Invalid years "0"`},
+		{"10000 5 101", `Invalid years "101": must be between 1 and 100`},
+		{"10000 5 2.5", `Invalid years "2.5"`},
+	}
+	for _, tt := range tests {
+		if got := compoundCommand(defaultLang, strings.Fields(tt.args), defaultLocale); !strings.Contains(got, tt.want) {
+			t.Errorf("/compound %s = %q, want it to contain %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"100 3", "🧾 100,00 kr split 3 ways: 1 × 33,34 kr and 2 × 33,33 kr"},
+		{"1200 4", "🧾 1.200,00 kr split 4 ways: 4 × 300,00 kr"},
+		{"1000 4 tip 10", "🧾 1.100,00 kr (including a 10% tip) split 4 ways: 4 × 275,00 kr"},
+		{"100 3 TIP 12.5%", "🧾 112,50 kr (including a 12.5% tip) split 3 ways: 3 × 37,50 kr"},
+		{"100 3 tip 0", "🧾 100,00 kr split 3 ways: 1 × 33,34 kr and 2 × 33,33 kr"},
+		{"100", "⚠️ Usage: /split"},
+		{"100 3 tip", "⚠️ Usage: /split"},
+		{"100 3 extra 10", "⚠️ Usage: /split"},
+		{"0 3", `⚠️ Invalid total "0"`},
+		{"100 0", `⚠️ Invalid number of people "0": must be between 1 and 100.`},
+		{"100 -2", `⚠️ Invalid number of people "-2"`},
+		{"100 101", `⚠️ Invalid number of people "101"`},
+		{"100 2.5", `⚠️ Invalid number of people "2.5"`},
+		{"100 3 tip -5", `⚠️ Invalid tip "-5": must be between 0 and 100%.`},
+	}
+	for _, tt := range tests {
+		if got := splitCommand(defaultLang, strings.Fields(tt.args), defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/split %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestVATCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"1000", "🧾 1.000,00 kr + 25% VAT (250,00 kr) = 1.250,00 kr"},
+		{"1000 15", "🧾 1.000,00 kr + 15% VAT (150,00 kr) = 1.150,00 kr"},
+		{"99.90 12%", "🧾 99,90 kr + 12% VAT (11,99 kr) = 111,89 kr"},
+		{"1000 0", "🧾 1.000,00 kr + 0% VAT (0,00 kr) = 1.000,00 kr"},
+		{"1250 -gross", "🧾 1.250,00 kr including 25% VAT is 1.000,00 kr net + 250,00 kr VAT"},
+		{"-gross 1150 15%", "🧾 1.150,00 kr including 15% VAT is 1.000,00 kr net + 150,00 kr VAT"},
+		{"100 -GROSS", "🧾 100,00 kr including 25% VAT is 80,00 kr net + 20,00 kr VAT"},
+		{"", "⚠️ Usage: /vat"},
+		{"-gross", "⚠️ Usage: /vat"},
+		{"1000 25 extra", "⚠️ Usage: /vat"},
+		{"0", `⚠️ Invalid amount "0"`},
+		{"1000 101", `⚠️ Invalid rate "101": must be between 0 and 100%.`},
+		{"1000 -5", `⚠️ Invalid rate "-5"`},
+		{"1000 high", `⚠️ Invalid rate "high"`},
+	}
+	for _, tt := range tests {
+		if got := vatCommand(defaultLang, strings.Fields(tt.args), defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/vat %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWhoCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	carol := ts.join(t, "/ws?username=carol")
+	ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+	ts.join(t, "/ws/other?username=dave")
+
+	carol.say("/who")
+	carol.expectContent(msgCommand, "👥 3 online: alice, bob, carol")
+}
+
+func TestMortgageCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"3000000 5 25", "🏠 A 3.000.000 kr loan at 5% over 25 years costs 17.537,70 kr per month (2.261.310,37 kr in interest)"},
+		{"120000 0 10", "🏠 A 120.000 kr loan at 0% over 10 years costs 1.000,00 kr per month (0,00 kr in interest)"},
+		{"3000000 5", "⚠️ Usage: /mortgage"},
+		{"0 5 25", `⚠️ Invalid principal "0"`},
+		{"3000000 -1 25", `⚠️ Invalid rate "-1"`},
+		{"3000000 5 51", `⚠️ Invalid years "51": must be between 1 and 50`},
+	}
+	for _, tt := range tests {
+		if got := mortgageCommand(defaultLang, strings.Fields(tt.args), defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/mortgage %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// Commands are registered once for the whole test binary: a server's
+// connection handlers outlive the test that started them, so taking a
+// command back out would race with their reads.
+func init() {
+	RegisterCommand(Command{Name: "echo", Aliases: []string{"repeat"}, Description: "🔁 Echo the arguments"},
+		func(args []string, room *Room, sender *Client) string {
+			if len(args) == 0 {
+				sender.send(Message{Type: msgSystem, Content: "Usage: /echo <text>"})
+				return ""
+			}
+			return fmt.Sprintf("%s in %s said %s", sender.name(), room.name, strings.Join(args, " "))
+		})
+	RegisterCommand(Command{Name: "boom", Description: "Panics"},
+		func(args []string, room *Room, sender *Client) string { panic("boom") })
+}
+
+func TestCustomCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/echo Hello there")
+	bob.expectContent(msgCommand, "alice in general said Hello there")
+	bob.say("/Repeat hi")
+	alice.expectContent(msgCommand, "bob in general said hi")
+	bob.expectContent(msgCommand, "bob in general said hi")
+
+	// A handler returning "" has replied some other way, or not at all
+	alice.say("/echo")
+	alice.expectContent(msgSystem, "Usage: /echo <text>")
+	bob.say("done")
+	bob.expectNoneBefore("an empty bot reply", func(msg Message) bool { return msg.Type == msgCommand }, isChat("bob", "done"))
+
+	alice.say("/help")
+	alice.expectContent(msgCommand, "/echo, /repeat - 🔁 Echo the arguments")
+}
+
+func TestRegisterCommandRefusesTakenNames(t *testing.T) {
+	nop := func(args []string, room *Room, sender *Client) string { return "" }
+	for _, cmd := range []Command{
+		{Name: cmdHelp},
+		{Name: "Help"},
+		{Name: "fresh", Aliases: []string{"save"}},
+		{Name: "fresh", Aliases: []string{"?"}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registered %+v over an existing command", cmd)
+				}
+			}()
+			RegisterCommand(cmd, nop)
+		}()
+	}
+	if isCommand("fresh") {
+		t.Error("a refused command was registered anyway")
+	}
+}
+
+func TestPanickingCommandOnlyDropsItsClient(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/boom")
+	alice.expectClosed()
+	bob.expectContent(msgSystem, "alice left the chat")
+
+	// The server still serves the others, and new clients
+	bob.say("still here")
+	bob.expect("its own message", isChat("bob", "still here"))
+	carol := ts.join(t, "/ws?username=carol")
+	bob.say("hi carol")
+	carol.expect("bob's message", isChat("bob", "hi carol"))
+}
+
+func TestMeCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/me dances")
+	msg := bob.expect("the action", func(msg Message) bool { return msg.Type == msgAction })
+	if msg.Content != "* alice dances" || msg.From != "alice" {
+		t.Errorf("/me dances sent %+v, want \"* alice dances\" from alice", msg)
+	}
+
+	alice.say("/me")
+	alice.expectContent(msgSystem, "Usage: /me <action>")
+}
+
+func TestDMCommandSendsLikeAt(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	// Both deliver the same frames, to bob and echoed to alice
+	var delivered, echoed []Message
+	for _, line := range []string{"/dm bob meet at noon", "@bob meet at noon"} {
+		alice.say(line)
+		msg := bob.expect("the private message from "+line, isPrivate("alice", "bob", "meet at noon"))
+		msg.ID, msg.TS = 0, time.Time{}
+		delivered = append(delivered, msg)
+		msg = alice.expect("the echo of "+line, isPrivate("alice", "bob", "meet at noon"))
+		msg.ID, msg.TS = 0, time.Time{}
+		echoed = append(echoed, msg)
+	}
+	if !reflect.DeepEqual(delivered[0], delivered[1]) {
+		t.Errorf("/dm delivered %+v, @ delivered %+v", delivered[0], delivered[1])
+	}
+	if !reflect.DeepEqual(echoed[0], echoed[1]) {
+		t.Errorf("/dm echoed %+v, @ echoed %+v", echoed[0], echoed[1])
+	}
+	alice.say("public")
+	carol.expectNoneBefore("a private message", func(msg Message) bool {
+		return msg.Type == msgPrivate
+	}, isChat("alice", "public"))
+
+	for _, tt := range []struct{ input, want string }{
+		{"/dm nobody hello", "⚠️ User nobody not found"},
+		{"/dm bob", "⚠️ Usage: /dm <username>[,<username>...] <message>"},
+		{"/dm", "⚠️ Usage: /dm <username>[,<username>...] <message>"},
+		{"@nobody hello", "⚠️ User nobody not found"},
+	} {
+		alice.say(tt.input)
+		alice.expectContent(msgCommand, tt.want)
+	}
+}
+
+func TestNickCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/nick alicia")
+	alice.expect("the new name", func(msg Message) bool { return msg.Type == msgUsername && msg.Content == "alicia" })
+	bob.expectContent(msgSystem, "alice is now known as alicia")
+	alice.say("hi")
+	bob.expect("chat under the new name", isChat("alicia", "hi"))
+
+	alice.say("/nick bob")
+	alice.expectContent(msgSystem, "Can't change your name: the name bob is already taken")
+
+	alice.say("/nick bob:/saving")
+	alice.expectContent(msgSystem, `Can't change your name: invalid username: must not contain ':'`)
+
+	alice.say("/nick alicia")
+	alice.expectContent(msgSystem, "You are already known as alicia.")
+
+	alice.say("/nick")
+	alice.expectContent(msgSystem, "Usage: /nick <newname>")
+
+	// The old name is free again
+	carol := ts.join(t, "/ws?username=alice")
+	if carol.name != "alice" {
+		t.Errorf("joined as %q after alice was renamed, want alice", carol.name)
+	}
+}
+
+func TestMuteCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	alice.say("/mute bob")
+	alice.expectContent(msgSystem, "Muted bob. Use /unmute bob to undo.")
+
+	bob.say("can anyone hear me?")
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: bob.sealFor("alice", "psst")})
+	bob.expect("the echo of his private message", isPrivate("bob", "alice", "psst"))
+	carol.say("I can")
+	alice.expectNoneBefore("a muted user's message", func(msg Message) bool { return msg.From == "bob" }, isChat("carol", "I can"))
+	carol.expect("bob's message", isChat("bob", "can anyone hear me?"))
+	bob.expectQuiet("being told he's muted", func(msg Message) bool {
+		return strings.Contains(msg.Content, "mute")
+	}, 100*time.Millisecond)
+
+	alice.say("/unmute bob")
+	alice.expectContent(msgSystem, "Unmuted bob.")
+	bob.say("how about now?")
+	alice.expect("bob's message after unmuting", isChat("bob", "how about now?"))
+}
+
+func TestMuteCommandErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	for _, tt := range []struct{ input, want string }{
+		{"/mute", "Usage: /mute <username>"},
+		{"/mute bob carol", "Usage: /mute <username>"},
+		{"/mute alice", "You can't mute yourself."},
+		{"/unmute", "Usage: /unmute <username>"},
+		{"/unmute bob", "bob isn't muted."},
+	} {
+		alice.say(tt.input)
+		alice.expectContent(msgSystem, tt.want)
+	}
+}
+
+func TestBlockCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	alice.say("/block bob")
+	alice.expectContent(msgSystem, "Blocked private messages from bob. Use /unblock bob to undo.")
+
+	// bob is told his message wasn't delivered, but not why, and gets no
+	// echo; alice sees nothing of it
+	isWithheld := func(msg Message) bool {
+		return msg.Type == msgCommand && msg.Content == "⚠️ Your message could not be delivered to alice."
+	}
+	bob.say("@alice psst")
+	bob.expect("the neutral notice", isWithheld)
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: bob.sealFor("alice", "psst")})
+	bob.expect("the neutral notice", isWithheld)
+	bob.say("/dm alice,carol psst")
+	bob.expect("the neutral notice", isWithheld)
+	carol.expect("the message to her", isPrivate("bob", "carol", "psst"))
+	bob.expect("the echo to carol only", isPrivate("bob", "carol", "psst"))
+	bob.say("still here")
+	alice.expectNoneBefore("a blocked user's private message", func(msg Message) bool {
+		return msg.Type == msgPrivate
+	}, isChat("bob", "still here"))
+	bob.expectNoneBefore("being told he's blocked", func(msg Message) bool {
+		return msg.Type == msgPrivate && msg.To == "alice" || strings.Contains(msg.Content, "block")
+	}, isChat("bob", "still here"))
+
+	// Blocking is one way
+	alice.say("@bob sorry")
+	bob.expect("alice's private message", isPrivate("alice", "bob", "sorry"))
+
+	alice.say("/unblock bob")
+	alice.expectContent(msgSystem, "Unblocked bob.")
+	bob.say("@alice psst")
+	alice.expect("bob's private message after unblocking", isPrivate("bob", "alice", "psst"))
+}
+
+func TestBlockCommandErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	for _, tt := range []struct{ input, want string }{
+		{"/block", "Usage: /block <username>"},
+		{"/block bob carol", "Usage: /block <username>"},
+		{"/block alice", "You can't block yourself."},
+		{"/unblock", "Usage: /unblock <username>"},
+		{"/unblock bob", "bob isn't blocked."},
+	} {
+		alice.say(tt.input)
+		alice.expectContent(msgSystem, tt.want)
+	}
+}
+
+func TestAwayCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/away lunch")
+	bob.expectContent(msgSystem, "alice is away: lunch")
+	bob.say("/who")
+	bob.expectContent(msgCommand, "👥 2 online: alice (away: lunch), bob")
+
+	// Private messages get the away message as an automatic reply
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: bob.sealFor("alice", "are you there?")})
+	alice.expect("the private message", isPrivate("bob", "alice", "are you there?"))
+	bob.expectContent(msgSystem, "alice is away: lunch")
+
+	// Chatting again marks her back
+	alice.say("back now")
+	bob.expectContent(msgSystem, "alice is back")
+	bob.expect("her message", isChat("alice", "back now"))
+	alice.say("/back")
+	alice.expectContent(msgSystem, "You aren't away.")
+
+	alice.say("/away")
+	bob.expectContent(msgSystem, "alice is away")
+	bob.say("/who")
+	bob.expectContent(msgCommand, "👥 2 online: alice (away), bob")
+	alice.say("/back")
+	bob.expectContent(msgSystem, "alice is back")
+	bob.say("/who")
+	bob.expectContent(msgCommand, "👥 2 online: alice, bob")
+}
+
+func TestParseDice(t *testing.T) {
+	tests := []struct {
+		notation     string
+		count, sides int
+		err          string
+	}{
+		{"2d6", 2, 6, ""},
+		{"d20", 1, 20, ""},
+		{"3D4", 3, 4, ""},
+		{"100d1000", 100, 1000, ""},
+		{"6", 0, 0, `invalid dice "6"`},
+		{"0d6", 0, 0, "the count must be between 1 and 100"},
+		{"101d6", 0, 0, "the count must be between 1 and 100"},
+		{"xd6", 0, 0, "the count must be between 1 and 100"},
+		{"2d1", 0, 0, "dice must have between 2 and 1000 sides"},
+		{"2d1001", 0, 0, "dice must have between 2 and 1000 sides"},
+		{"2d", 0, 0, "dice must have between 2 and 1000 sides"},
+		{"-2d6", 0, 0, "the count must be between 1 and 100"},
+	}
+	for _, tt := range tests {
+		count, sides, err := parseDice(defaultLang, tt.notation)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseDice(%q) error = %v, want %q", tt.notation, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || count != tt.count || sides != tt.sides {
+			t.Errorf("parseDice(%q) = %d, %d, %v; want %d, %d", tt.notation, count, sides, err, tt.count, tt.sides)
+		}
+	}
+}
+
+func TestRollCommandWithFixedSeed(t *testing.T) {
+	bot := NewRoom("test").bot
+	bot.rand = mathrand.New(mathrand.NewSource(1))
+	for _, tt := range []struct{ args, want string }{
+		{"", "🎲 alice rolled 1d6: 6"},
+		{"2d6", "🎲 alice rolled 2d6: 4 + 6 = 10"},
+		{"d20", "🎲 alice rolled 1d20: 20"},
+		{"3D4", "🎲 alice rolled 3d4: 2 + 3 + 2 = 7"},
+		{"2d6 2d6", "⚠️ Usage: /roll [count]d<sides>"},
+		{"0d6", `⚠️ invalid dice "0d6": the count must be between 1 and 100. Usage: /roll`},
+	} {
+		if got := bot.rollCommand("alice", strings.Fields(tt.args)); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/roll %s = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRollsStayInRange(t *testing.T) {
+	bot := NewRoom("test").bot
+	seen := make(map[int]bool)
+	for range 1000 {
+		reply := bot.rollCommand("alice", []string{"1d6"})
+		var roll int
+		if _, err := fmt.Sscanf(reply, "🎲 alice rolled 1d6: %d", &roll); err != nil || roll < 1 || roll > 6 {
+			t.Fatalf("/roll 1d6 = %q", reply)
+		}
+		seen[roll] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("1000 rolls of 1d6 gave only %v", seen)
+	}
+}
+
+func TestTimeCommand(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "🕒 " + now.Local().Format("Monday 2 January 2006, 15:04 MST") + " (server time)"},
+		{[]string{"UTC"}, "🕒 Monday 15 January 2024, 12:30 UTC (UTC)"},
+		{[]string{"Europe/Oslo"}, "🕒 Monday 15 January 2024, 13:30 CET (Europe/Oslo)"},
+		{[]string{"America/New_York"}, "🕒 Monday 15 January 2024, 07:30 EST (America/New_York)"},
+		{[]string{"Mars/Olympus"}, `⚠️ Unknown time zone "Mars/Olympus". Usage: /time [zone]`},
+		{[]string{"UTC", "Europe/Oslo"}, "⚠️ Usage: /time [zone]"},
+	}
+	for _, tt := range tests {
+		if got := timeCommand(defaultLang, tt.args, now); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/time %s = %q, want %q", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+
+	// Summer time follows the date asked about, not the server's
+	if got, want := timeCommand(defaultLang, []string{"Europe/Oslo"}, now.AddDate(0, 6, 0)), "🕒 Monday 15 July 2024, 14:30 CEST"; !strings.HasPrefix(got, want) {
+		t.Errorf("/time Europe/Oslo in July = %q, want %q", got, want)
+	}
+}
+
+func TestTimeCommandUsesTheHubsClock(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/time UTC")
+	alice.expectContent(msgCommand, "🕒 Friday 17 May 2024, 12:00 UTC (UTC)")
+	clock.advance(90 * time.Minute)
+	alice.say("/time Asia/Tokyo")
+	alice.expectContent(msgCommand, "🕒 Friday 17 May 2024, 22:30 JST (Asia/Tokyo)")
+}
+
+// statsReply matches a /stats reply, capturing the messages sent.
+var statsReply = regexp.MustCompile(`^📈 Online here: (\d+) · Open rooms: (\d+) · Messages sent: ([\d.]+) · Uptime: (\S+)$`)
+
+// stats runs /stats as c and returns the fields of the reply.
+func stats(t *testing.T, c *testClient) (online, rooms string, sent int, uptime string) {
+	t.Helper()
+	c.say("/stats")
+	reply := c.expectContent(msgCommand, "📈 Online here: ")
+	m := statsReply.FindStringSubmatch(reply.Content)
+	if m == nil {
+		t.Fatalf("/stats replied %q", reply.Content)
+	}
+	sent, _ = strconv.Atoi(strings.ReplaceAll(m[3], ".", ""))
+	return m[1], m[2], sent, m[4]
+}
+
+func TestStatsCommand(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.now = clock.now
+		h.started = clock.now()
+	})
+	alice := ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+	ts.join(t, "/ws/other?username=carol")
+
+	online, rooms, sent, uptime := stats(t, alice)
+	if online != "2" || rooms != "2" || uptime != "0s" {
+		t.Errorf("/stats reported %s online, %s rooms and %s uptime; want 2, 2 and 0s", online, rooms, uptime)
+	}
+
+	alice.say("hello")
+	alice.expect("her message", isChat("alice", "hello"))
+	clock.advance(90*time.Minute + 5*time.Second)
+	_, _, sentAfter, uptime := stats(t, alice)
+	if sentAfter <= sent {
+		t.Errorf("messages sent went from %d to %d after alice chatted", sent, sentAfter)
+	}
+	if uptime != "1h30m5s" {
+		t.Errorf("uptime %s after 90m5s", uptime)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// config holds the server settings that can be changed from the command line.
+type config struct {
+	addr           string   // Listen address
+	tlsCert        string   // TLS certificate file; serves wss:// when set with tlsKey
+	tlsKey         string   // TLS private key file
+	allowedOrigins []string // Origins allowed to open WebSockets; empty allows all
+	trustProxy     bool     // Take client IPs from X-Forwarded-For
+	maxConnsPerIP  int      // Concurrent connections allowed from one IP; 0 means unlimited
+	maxRoomSize    int      // Clients allowed in each room at a time; 0 means unlimited
+	bannedIPs      []string // IPs whose connections are refused
+
+	rateLimit float64 // Messages per second each client may send; 0 disables limiting
+	rateBurst int     // Messages a client may send in a burst above rateLimit
+
+	maxMessageSize int64  // Largest text frame in bytes; binary frames may reach max(maxMessageSize, maxFileSize)
+	compression    bool   // Offer permessage-deflate to clients that support it
+	readBuffer     int    // Size of each connection's read buffer in bytes
+	writeBuffer    int    // Size of each connection's write buffer in bytes
+	historySize    int    // Recent messages replayed to clients joining a room; 0 disables
+	db             string // SQLite database for persisting history; empty keeps it in memory
+	redisAddr      string // Redis server shared by several instances; empty runs standalone
+	metrics        bool   // Serve Prometheus metrics at /metrics
+	profanityList  string // File of words masked in chat; empty disables the filter
+	motd           string // Sent to each client as it joins; empty sends nothing
+	motdFile       string // File the message of the day is read from, reloaded on SIGHUP
+	blockLinks     bool   // Refuse chat messages that contain links
+	unfurl         bool   // Post previews of links shared in chat
+	webhookURL     string // Receives a POST for every public message; empty disables
+	adminToken     string // Bearer token for the admin endpoints; empty disables them
+	modToken       string // Connecting with ?mod_token= set to this makes a client a moderator; empty disables moderation
+
+	integrationToken string // Bearer token for POST /rooms/{name}/messages; empty disables it
+	integrationName  string // Who messages posted by integrations appear to come from
+
+	maxFileSize   int64         // Largest file clients may share in one frame in bytes; 0 disables file sharing
+	maxUploadSize int64         // Largest file clients may share in chunks in bytes; 0 disables chunked uploads
+	fileTTL       time.Duration // How long shared files can be downloaded
+
+	pingInterval    time.Duration // How often each client is pinged
+	pongTimeout     time.Duration // How long to wait for any pong before dropping the client
+	writeTimeout    time.Duration // How long a single write to a client may take before it is dropped
+	idleTimeout     time.Duration // How long a client may send nothing before it is disconnected; 0 disables
+	shutdownTimeout time.Duration // How long to wait for clients to disconnect on shutdown
+
+	tipInterval time.Duration // How often the finance bot posts a tip to each room; 0 disables
+	savingsMin  int           // Smallest monthly amount picked for savings tips
+	savingsMax  int           // Largest monthly amount picked for savings tips
+	botName     string        // Name the finance bot's replies appear to come from
+
+	lang string // Language of the finance bot's messages
+
+	keyRotateMessages int           // Private messages after which a client's key is replaced; 0 disables
+	keyRotateInterval time.Duration // Age at which a client's key is replaced; 0 disables
+
+	logLevel logLevel // Least severe level that is logged
+}
+
+// Bounds on -read-buffer and -write-buffer. Every connection holds one of
+// each, so the upper bound keeps a full server's buffers within reason.
+const (
+	minBufferSize = 256
+	maxBufferSize = 1 << 20
+)
+
+// parseFlags builds the server config from command-line arguments.
+func parseFlags(args []string) (config, error) {
+	var cfg config
+
+	fs := flag.NewFlagSet("gofast", flag.ContinueOnError)
+	fs.StringVar(&cfg.addr, "addr", defaultAddr, "listen address (overrides $CHATTADDR and $PORT)")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", "", "TLS certificate file (requires -tls-key)")
+	fs.StringVar(&cfg.tlsKey, "tls-key", "", "TLS private key file (requires -tls-cert)")
+	origins := fs.String("allowed-origins", "", "comma-separated origins allowed to connect, e.g. https://chat.example.com (default: allow all)")
+	fs.BoolVar(&cfg.trustProxy, "trust-proxy", false, "take client IPs from X-Forwarded-For; only enable behind a reverse proxy that sets it")
+	fs.IntVar(&cfg.maxConnsPerIP, "max-conns-per-ip", 0, "concurrent connections allowed from one IP address (0 means unlimited). Behind a reverse proxy, set -trust-proxy too, or every client counts as the proxy's IP")
+	fs.IntVar(&cfg.maxRoomSize, "max-room-size", 0, "clients allowed in each room at a time; more are turned away with \"room is full\" (0 means unlimited)")
+	banned := fs.String("banned-ips", "", "comma-separated IP addresses whose connections are refused")
+	fs.Float64Var(&cfg.rateLimit, "rate-limit", 5, "messages per second each client may send (0 disables rate limiting)")
+	fs.IntVar(&cfg.rateBurst, "rate-burst", 10, "messages a client may send in a quick burst")
+	fs.Int64Var(&cfg.maxMessageSize, "max-message-size", 4096, "largest WebSocket text frame in bytes, and largest announcement or posted message; bigger text frames close the connection, or get a notice if -max-file-size is larger. Binary frames (files and upload chunks) are capped by the larger of this and -max-file-size")
+	fs.Int64Var(&cfg.maxFileSize, "max-file-size", 0, "largest file in bytes clients may share by sending a binary frame (0 disables file sharing)")
+	fs.Int64Var(&cfg.maxUploadSize, "max-upload-size", 0, "largest file in bytes clients may share in chunks with file-begin and file-end (0 disables chunked uploads; requires -max-file-size)")
+	fs.DurationVar(&cfg.fileTTL, "file-ttl", time.Hour, "how long shared files can be downloaded from /files/{id}")
+	fs.IntVar(&cfg.readBuffer, "read-buffer", 1024, fmt.Sprintf("size in bytes of each connection's read buffer (%d to %d); larger buffers take fewer reads for big messages but cost that much memory per client", minBufferSize, maxBufferSize))
+	fs.IntVar(&cfg.writeBuffer, "write-buffer", 1024, fmt.Sprintf("size in bytes of each connection's write buffer (%d to %d); larger buffers send big messages in fewer writes but cost that much memory per client", minBufferSize, maxBufferSize))
+	fs.BoolVar(&cfg.compression, "compression", false, "compress messages (permessage-deflate) for clients that support it")
+	fs.IntVar(&cfg.historySize, "history-size", 50, "recent public messages replayed to clients joining a room (0 disables history)")
+	fs.StringVar(&cfg.db, "db", "", "SQLite database file for persisting chat history across restarts (requires a build with -tags sqlite)")
+	fs.StringVar(&cfg.redisAddr, "redis", "", "Redis address (host:port) for sharing rooms between several server instances (default: standalone)")
+	fs.StringVar(&cfg.profanityList, "profanity-list", "", "file of words, one per line, to mask in chat messages (default: no filtering)")
+	fs.StringVar(&cfg.motd, "motd", "", "message of the day sent privately to each client as it joins (default: none)")
+	fs.StringVar(&cfg.motdFile, "motd-file", "", "file holding the message of the day, reread on SIGHUP (instead of -motd)")
+	fs.BoolVar(&cfg.blockLinks, "block-links", false, "refuse chat messages that contain links, with a notice to the sender")
+	fs.BoolVar(&cfg.unfurl, "unfurl", false, "fetch the title and description of links shared in chat and post a preview (the server makes outbound requests; internal addresses are refused)")
+	fs.StringVar(&cfg.webhookURL, "webhook", "", "URL that receives a JSON POST for every public message (default: disabled)")
+	fs.BoolVar(&cfg.metrics, "metrics", false, "serve Prometheus metrics at /metrics")
+	fs.StringVar(&cfg.adminToken, "admin-token", "", "shared secret enabling the admin endpoints, POST /rooms/{name}/announce and POST /announce (default: disabled)")
+	fs.StringVar(&cfg.integrationToken, "integration-token", "", "shared secret enabling POST /rooms/{name}/messages for bots and integrations (default: disabled)")
+	fs.StringVar(&cfg.integrationName, "integration-name", "integration", "name that messages posted to /rooms/{name}/messages appear to come from")
+	fs.StringVar(&cfg.modToken, "mod-token", "", "shared secret that clients pass as ?mod_token= to use /kick and /ban (default: no moderators)")
+	fs.DurationVar(&cfg.pingInterval, "ping-interval", 30*time.Second, "interval between keepalive pings")
+	fs.DurationVar(&cfg.pongTimeout, "pong-timeout", 60*time.Second, "disconnect clients that haven't answered a ping within this time")
+	fs.DurationVar(&cfg.writeTimeout, "write-timeout", 10*time.Second, "disconnect clients when sending them a message takes longer than this")
+	fs.DurationVar(&cfg.idleTimeout, "idle-timeout", 0, "disconnect clients that send nothing for this long, after a warning (0 disables)")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 10*time.Second, "time to let clients disconnect on shutdown before closing them")
+	fs.DurationVar(&cfg.tipInterval, "tip-interval", 30*time.Minute, "how often the finance bot posts a savings tip to each room (0 disables tips)")
+	fs.IntVar(&cfg.savingsMin, "savings-min", defaultSavingsMin, "smallest monthly amount the finance bot picks for savings tips and /saving")
+	fs.IntVar(&cfg.savingsMax, "savings-max", defaultSavingsMax, "largest monthly amount the finance bot picks for savings tips and /saving")
+	fs.IntVar(&cfg.keyRotateMessages, "key-rotate-messages", 0, "agree a new encryption key with a client after this many private messages to or from it under that key; end-to-end sealed messages don't count (0 disables)")
+	fs.DurationVar(&cfg.keyRotateInterval, "key-rotate-interval", 0, "agree a new encryption key with a client once its key is this old (0 disables)")
+	fs.StringVar(&cfg.botName, "bot-name", defaultBotName, "name the finance bot's replies and tips appear to come from")
+	fs.StringVar(&cfg.lang, "lang", defaultLang, "language of the finance bot's messages: en or no")
+	level := fs.String("log-level", "info", "least severe messages to log: debug, info, warn or error (message content is only logged at debug)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	addrSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "addr" {
+			addrSet = true
+		}
+	})
+	cfg.addr = resolveAddr(cfg.addr, addrSet, os.Getenv)
+
+	cfg.allowedOrigins = splitList(*origins)
+	for _, ip := range splitList(*banned) {
+		if net.ParseIP(ip) == nil {
+			return cfg, fmt.Errorf("-banned-ips: %q is not an IP address", ip)
+		}
+		cfg.bannedIPs = append(cfg.bannedIPs, normalizeIP(ip))
+	}
+
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		return cfg, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if cfg.maxConnsPerIP < 0 {
+		return cfg, fmt.Errorf("-max-conns-per-ip must not be negative")
+	}
+	if cfg.maxRoomSize < 0 {
+		return cfg, fmt.Errorf("-max-room-size must not be negative")
+	}
+	if cfg.rateLimit < 0 {
+		return cfg, fmt.Errorf("-rate-limit must not be negative")
+	}
+	if cfg.rateLimit > 0 && cfg.rateBurst < 1 {
+		return cfg, fmt.Errorf("-rate-burst must be at least 1")
+	}
+	if cfg.maxMessageSize <= 0 {
+		return cfg, fmt.Errorf("-max-message-size must be positive")
+	}
+	if cfg.readBuffer < minBufferSize || cfg.readBuffer > maxBufferSize {
+		return cfg, fmt.Errorf("-read-buffer must be between %d and %d", minBufferSize, maxBufferSize)
+	}
+	if cfg.writeBuffer < minBufferSize || cfg.writeBuffer > maxBufferSize {
+		return cfg, fmt.Errorf("-write-buffer must be between %d and %d", minBufferSize, maxBufferSize)
+	}
+	if cfg.maxFileSize < 0 {
+		return cfg, fmt.Errorf("-max-file-size must not be negative")
+	}
+	if cfg.maxFileSize > fileStoreCapacity {
+		return cfg, fmt.Errorf("-max-file-size must be at most %d", fileStoreCapacity)
+	}
+	if cfg.maxUploadSize < 0 {
+		return cfg, fmt.Errorf("-max-upload-size must not be negative")
+	}
+	if cfg.maxUploadSize > 0 && cfg.maxFileSize == 0 {
+		return cfg, fmt.Errorf("-max-upload-size requires -max-file-size")
+	}
+	if cfg.maxUploadSize > fileStoreCapacity {
+		return cfg, fmt.Errorf("-max-upload-size must be at most %d", fileStoreCapacity)
+	}
+	if cfg.fileTTL <= 0 {
+		return cfg, fmt.Errorf("-file-ttl must be positive")
+	}
+	if cfg.webhookURL != "" {
+		if u, err := url.Parse(cfg.webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("-webhook must be an http or https URL")
+		}
+	}
+	if err := validateUsername(cfg.integrationName); err != nil || cfg.integrationName == "" {
+		return cfg, fmt.Errorf("-integration-name must be a valid, non-empty username")
+	}
+	if cfg.historySize < 0 {
+		return cfg, fmt.Errorf("-history-size must not be negative")
+	}
+	if cfg.pingInterval <= 0 {
+		return cfg, fmt.Errorf("-ping-interval must be positive")
+	}
+	if cfg.pongTimeout <= cfg.pingInterval {
+		return cfg, fmt.Errorf("-pong-timeout must be longer than -ping-interval")
+	}
+	if cfg.writeTimeout <= 0 {
+		return cfg, fmt.Errorf("-write-timeout must be positive")
+	}
+	if cfg.idleTimeout < 0 {
+		return cfg, fmt.Errorf("-idle-timeout must not be negative")
+	}
+	if cfg.motd != "" && cfg.motdFile != "" {
+		return cfg, fmt.Errorf("-motd and -motd-file cannot be used together")
+	}
+	if cfg.tipInterval < 0 {
+		return cfg, fmt.Errorf("-tip-interval must not be negative")
+	}
+	if cfg.savingsMin <= 0 || cfg.savingsMax <= 0 {
+		return cfg, fmt.Errorf("-savings-min and -savings-max must be positive")
+	}
+	if cfg.savingsMin > cfg.savingsMax {
+		return cfg, fmt.Errorf("-savings-min must not be greater than -savings-max")
+	}
+	if cfg.savingsMax > maxAmount {
+		return cfg, fmt.Errorf("-savings-max must be at most %d", maxAmount)
+	}
+	if cfg.keyRotateMessages < 0 {
+		return cfg, fmt.Errorf("-key-rotate-messages must not be negative")
+	}
+	if cfg.keyRotateInterval < 0 {
+		return cfg, fmt.Errorf("-key-rotate-interval must not be negative")
+	}
+	if err := validateBotName(cfg.botName); err != nil {
+		return cfg, fmt.Errorf("-bot-name: %v", err)
+	}
+	if _, ok := catalog[cfg.lang]; !ok {
+		return cfg, fmt.Errorf("-lang must be en or no")
+	}
+	var err error
+	if cfg.logLevel, err = parseLogLevel(*level); err != nil {
+		return cfg, fmt.Errorf("-log-level: %v", err)
+	}
+	return cfg, nil
+}
+
+// useTLS reports whether the server should serve wss:// instead of ws://.
+func (cfg config) useTLS() bool {
+	return cfg.tlsCert != "" && cfg.tlsKey != ""
+}
+
+const defaultAddr = ":8080"
+
+// resolveAddr picks the listen address: an explicit -addr flag wins, then
+// $CHATTADDR, then $PORT, then the default.
+func resolveAddr(flagAddr string, flagSet bool, getenv func(string) string) string {
+	if flagSet {
+		return flagAddr
+	}
+	if addr := getenv("CHATTADDR"); addr != "" {
+		return addr
+	}
+	if port := getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return defaultAddr
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,113 @@
+package main
+
+import "testing"
+
+func TestResolveAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		flagAddr string
+		flagSet  bool
+		env      map[string]string
+		want     string
+	}{
+		{"default", defaultAddr, false, nil, ":8080"},
+		{"PORT", defaultAddr, false, map[string]string{"PORT": "9000"}, ":9000"},
+		{"CHATTADDR", defaultAddr, false, map[string]string{"CHATTADDR": "127.0.0.1:7000"}, "127.0.0.1:7000"},
+		{"CHATTADDR over PORT", defaultAddr, false, map[string]string{"CHATTADDR": "127.0.0.1:7000", "PORT": "9000"}, "127.0.0.1:7000"},
+		{"flag over env", ":6000", true, map[string]string{"CHATTADDR": "127.0.0.1:7000", "PORT": "9000"}, ":6000"},
+		{"flag set to the default", defaultAddr, true, map[string]string{"PORT": "9000"}, ":8080"},
+	}
+	for _, tt := range tests {
+		getenv := func(key string) string { return tt.env[key] }
+		if got := resolveAddr(tt.flagAddr, tt.flagSet, getenv); got != tt.want {
+			t.Errorf("%s: resolveAddr = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFlagsAddr(t *testing.T) {
+	t.Setenv("CHATTADDR", "")
+	t.Setenv("PORT", "9000")
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.addr != ":9000" {
+		t.Errorf("addr = %q with $PORT set, want :9000", cfg.addr)
+	}
+
+	cfg, err = parseFlags([]string{"-addr", ":6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.addr != ":6000" {
+		t.Errorf("addr = %q with -addr set, want :6000", cfg.addr)
+	}
+}
+
+func TestTLSFlagsMustBeGivenTogether(t *testing.T) {
+	for _, args := range [][]string{{"-tls-cert", "cert.pem"}, {"-tls-key", "key.pem"}} {
+		if _, err := parseFlags(args); err == nil {
+			t.Errorf("parseFlags(%q) accepted half a TLS configuration", args)
+		}
+	}
+}
+
+func TestSavingsRangeFlags(t *testing.T) {
+	cfg, err := parseFlags([]string{"-savings-min", "500", "-savings-max", "1500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.savingsMin != 500 || cfg.savingsMax != 1500 {
+		t.Errorf("savings range = %d-%d, want 500-1500", cfg.savingsMin, cfg.savingsMax)
+	}
+	if _, err := parseFlags([]string{"-savings-min", "700", "-savings-max", "700"}); err != nil {
+		t.Errorf("a range of one amount was refused: %v", err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-savings-min", "0"}, "-savings-min and -savings-max must be positive"},
+		{[]string{"-savings-max", "-5"}, "-savings-min and -savings-max must be positive"},
+		{[]string{"-savings-min", "2000", "-savings-max", "1000"}, "-savings-min must not be greater than -savings-max"},
+		{[]string{"-savings-max", "2000000000"}, "-savings-max must be at most 1000000000"},
+	} {
+		if _, err := parseFlags(tt.args); err == nil || err.Error() != tt.want {
+			t.Errorf("parseFlags(%q) = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestBufferFlagsSizeTheUpgrader(t *testing.T) {
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := NewHub(cfg).upgrader; u.ReadBufferSize != 1024 || u.WriteBufferSize != 1024 {
+		t.Errorf("default buffers = %d/%d, want 1024/1024", u.ReadBufferSize, u.WriteBufferSize)
+	}
+
+	cfg, err = parseFlags([]string{"-read-buffer", "4096", "-write-buffer", "65536"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := NewHub(cfg).upgrader; u.ReadBufferSize != 4096 || u.WriteBufferSize != 65536 {
+		t.Errorf("buffers = %d/%d, want 4096/65536", u.ReadBufferSize, u.WriteBufferSize)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-read-buffer", "255"}, "-read-buffer must be between 256 and 1048576"},
+		{[]string{"-read-buffer", "2000000"}, "-read-buffer must be between 256 and 1048576"},
+		{[]string{"-write-buffer", "0"}, "-write-buffer must be between 256 and 1048576"},
+		{[]string{"-write-buffer", "1048577"}, "-write-buffer must be between 256 and 1048576"},
+	} {
+		if _, err := parseFlags(tt.args); err == nil || err.Error() != tt.want {
+			t.Errorf("parseFlags(%q) = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
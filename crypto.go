@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Session keys are agreed with X25519: the client sends its public key when
+// connecting, the server answers with a fresh public key of its own in the
+// msgKey frame, and both sides hash the shared secret into an AES-256 key.
+// The key itself never crosses the wire.
+//
+// Session keys are not end-to-end encryption. Each is shared between one
+// client and the server, which opens every msgPrivate message and seals it
+// again for each recipient, so the server can read those. Private messages
+// to a single user can instead be sealed end to end as msgSealed: the
+// sender looks up the recipient's public key with msgPeerKey, both clients
+// hash their own X25519 shared secret into a key with deriveEndToEndKey,
+// and the server only relays the ciphertext (see receiveSealed). It never
+// has either client's private key, so it can't open them. It does hand out
+// the public keys, so clients that want to rule out a server swapping in
+// its own should compare them out of band.
+
+// sessionKeyLabel and endToEndKeyLabel are mixed into the key derivation so
+// a shared secret can't be reused as a key in some other protocol, and the
+// two kinds of key never coincide.
+const (
+	sessionKeyLabel  = "fastchat session key v1"
+	endToEndKeyLabel = "fastchat end-to-end key v1"
+)
+
+// agreeKey performs the server side of the handshake with the client's
+// X25519 public key. It returns the session key and the server's base64
+// public key to send back to the client. Each call uses a fresh server key
+// pair, so agreeing again with the same client gives a new session key.
+func agreeKey(peer *ecdh.PublicKey) (key []byte, serverPublicKey string, err error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err = deriveSessionKey(private, peer)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()), nil
+}
+
+// parsePublicKey decodes a client's base64 X25519 public key.
+func parsePublicKey(clientPublicKey string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(clientPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return peer, nil
+}
+
+// deriveSessionKey hashes the X25519 shared secret into a 32-byte AES key.
+// Both sides of the handshake run the same derivation.
+func deriveSessionKey(private *ecdh.PrivateKey, peer *ecdh.PublicKey) ([]byte, error) {
+	return deriveKey(sessionKeyLabel, private, peer)
+}
+
+// deriveEndToEndKey hashes the X25519 shared secret of two clients into the
+// 32-byte AES key that seals their msgSealed messages. Each client runs it
+// with its own private key and the other's public key, and both get the
+// same key. Only clients can: the server has neither private key.
+func deriveEndToEndKey(private *ecdh.PrivateKey, peer *ecdh.PublicKey) ([]byte, error) {
+	return deriveKey(endToEndKeyLabel, private, peer)
+}
+
+// deriveKey hashes label and the X25519 shared secret into a 32-byte key.
+func deriveKey(label string, private *ecdh.PrivateKey, peer *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte(label))
+	h.Write(shared)
+	return h.Sum(nil), nil
+}
+
+// Errors returned by encrypt and decrypt. Callers can tell them apart with
+// errors.Is.
+var (
+	errInvalidKeySize     = errors.New("invalid key size: must be 32 bytes")
+	errBadEncoding        = errors.New("ciphertext is not valid base64")
+	errCiphertextTooShort = errors.New("ciphertext too short")
+	errAuthFailed         = errors.New("message authentication failed")
+	errReplay             = errors.New("replayed ciphertext")
+)
+
+// encrypt seals text with AES-256-GCM under key. The additional data aad is
+// authenticated but not encrypted; decrypt must be given the same aad.
+func encrypt(text string, key []byte, aad []byte) (string, error) {
+	if len(key) != 32 {
+		return "", errInvalidKeySize
+	}
+
+	plaintext := []byte(text)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := aesgcm.Seal(nonce, nonce, plaintext, aad)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt opens a ciphertext produced by encrypt. It fails if the ciphertext
+// was tampered with or aad differs from the one it was sealed with. If seen
+// is non-nil, a ciphertext whose nonce is already in it is rejected with
+// errReplay.
+func decrypt(encrypted string, key []byte, aad []byte, seen *nonceCache[[12]byte]) (string, error) {
+	if len(key) != 32 {
+		return "", errInvalidKeySize
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadEncoding, err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	// Even an empty message carries a nonce and an authentication tag
+	nonceSize := aesgcm.NonceSize()
+	if len(ciphertext) < nonceSize+aesgcm.Overhead() {
+		return "", errCiphertextTooShort
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return "", errAuthFailed
+	}
+
+	// Only record nonces of authentic ciphertexts, so forged messages can't
+	// push real nonces out of the cache.
+	if seen != nil && !seen.add([12]byte(nonce)) {
+		return "", errReplay
+	}
+
+	return string(plaintext), nil
+}
+
+// sealedNonce returns the nonce of content if it has the form of a
+// ciphertext from encrypt: base64 of at least a nonce and an authentication
+// tag. Whether it is authentic only someone with the key can tell.
+func sealedNonce(content string) (nonce [12]byte, ok bool) {
+	raw, err := base64.StdEncoding.DecodeString(content)
+	if err != nil || len(raw) < 12+16 {
+		return nonce, false
+	}
+	return [12]byte(raw), true
+}
+
+// privateAAD binds a private message ciphertext to its sender and recipient,
+// so it can't be replayed as a message between other users. Usernames can't
+// contain control characters, so NUL separates the fields unambiguously.
+func privateAAD(from, to string) []byte {
+	return []byte("private\x00" + from + "\x00" + to)
+}
+
+// maxEncryptionFailures is how many encryptions or decryptions for one
+// client may fail in a row before it is disconnected to agree a new key.
+const maxEncryptionFailures = 3
+
+// keyRing holds the keys agreed with one client. With -key-rotate-messages
+// or -key-rotate-interval set, the server agrees a new key with the
+// client's public key once the current one has been used for that many
+// private messages or that long, and sends the client its new public key in
+// another msgKey frame. The client may already have sent messages under
+// the old key, so that one is still accepted until the client first uses
+// the new one. Only what goes through the session key counts toward
+// rotation: private messages the server relays and the bot's private
+// notes. Messages sealed end to end never touch it (see receiveSealed).
+type keyRing struct {
+	mutex    sync.Mutex      // Held while sealing and queueing a frame, so frames and new keys reach the client in order
+	peer     *ecdh.PublicKey // The client's public key, which every new key is agreed with
+	current  []byte
+	previous []byte    // Key before the last rotation; nil once the client has used current
+	uses     int       // Private messages sealed or opened under current
+	since    time.Time // When current was agreed
+}
+
+// newKeyRing performs the handshake with the client's base64 X25519 public
+// key. It returns the client's keys and the server's base64 public key to
+// send back in the msgKey frame.
+func newKeyRing(clientPublicKey string, now time.Time) (*keyRing, string, error) {
+	peer, err := parsePublicKey(clientPublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	key, serverPublicKey, err := agreeKey(peer)
+	if err != nil {
+		return nil, "", err
+	}
+	return &keyRing{peer: peer, current: key, since: now}, serverPublicKey, nil
+}
+
+// publicKey returns the client's base64 X25519 public key, which other
+// clients agree end-to-end keys with.
+func (c *Client) publicKey() string {
+	return base64.StdEncoding.EncodeToString(c.key.peer.Bytes())
+}
+
+// sendSealed sends msg to the client with text encrypted under its current
+// key as Content, counting a failure against the key (see keyFailed).
+func (c *Client) sendSealed(msg Message, text string, aad []byte) error {
+	c.key.mutex.Lock()
+	defer c.key.mutex.Unlock()
+	content, err := encrypt(text, c.key.current, aad)
+	if err != nil {
+		errorf("Encrypting for %s: %v", c.name(), err)
+		c.keyFailed()
+		return err
+	}
+	c.keyErrors.Store(0)
+	msg.Content = content
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	c.key.uses++
+	c.rotateKeyIfDue()
+	return nil
+}
+
+// open decrypts a private message the client encrypted under its current
+// key, or under the previous one if the client hasn't yet switched. Only
+// messages under the current key count toward its next rotation.
+func (c *Client) open(encrypted string, aad []byte) (string, error) {
+	c.key.mutex.Lock()
+	defer c.key.mutex.Unlock()
+	text, err := decrypt(encrypted, c.key.current, aad, c.nonces)
+	if errors.Is(err, errAuthFailed) && c.key.previous != nil {
+		return decrypt(encrypted, c.key.previous, aad, c.nonces)
+	}
+	if err != nil {
+		return "", err
+	}
+	c.key.previous = nil
+	c.key.uses++
+	c.rotateKeyIfDue()
+	return text, nil
+}
+
+// rotateKeyIfDue agrees a new key with the client once the current one has
+// been used for -key-rotate-messages messages or is -key-rotate-interval
+// old. It waits until the client has used the current key, since rotating
+// again before then would drop a key the client may still be sending
+// under. The caller must hold the key ring's mutex.
+func (c *Client) rotateKeyIfDue() {
+	cfg := c.hub.cfg
+	now := c.hub.now()
+	due := (cfg.keyRotateMessages > 0 && c.key.uses >= cfg.keyRotateMessages) ||
+		(cfg.keyRotateInterval > 0 && now.Sub(c.key.since) >= cfg.keyRotateInterval)
+	if !due || c.key.previous != nil {
+		return
+	}
+
+	key, serverPublicKey, err := agreeKey(c.key.peer)
+	if err != nil {
+		errorf("Rotating the key of %s: %v", c.name(), err)
+		return
+	}
+	// Queue the new public key before using the new key, so the client
+	// switches keys exactly where the server did
+	if err := c.send(Message{Type: msgKey, Content: serverPublicKey}); err != nil {
+		return
+	}
+	debugf("Rotated the key of %s after %d messages", c.name(), c.key.uses)
+	c.key.previous, c.key.current = c.key.current, key
+	c.key.uses, c.key.since = 0, now
+}
+
+// rotateIdleKey rotates the client's key if it is due by age, for clients
+// that haven't sent or received a private message in a while.
+func (c *Client) rotateIdleKey() {
+	c.key.mutex.Lock()
+	defer c.key.mutex.Unlock()
+	c.rotateKeyIfDue()
+}
+
+// keyFailed counts an encryption or decryption with the client's key that
+// failed. Once maxEncryptionFailures happen in a row the key is taken to be
+// broken, and the client is disconnected with CloseServiceRestart, telling
+// it to reconnect with a new key. Its session lets it pick up where it left
+// off.
+func (c *Client) keyFailed() {
+	metrics.encryptionErrors.Add(1)
+	if c.keyErrors.Add(1) >= maxEncryptionFailures {
+		warnf("Disconnecting %s after %d encryption failures in a row", c.name(), maxEncryptionFailures)
+		c.closeWith(websocket.CloseServiceRestart, "encryption failed; reconnect for a new key")
+	}
+}
+
+// nonceCacheSize is how many recent nonces are remembered per client.
+const nonceCacheSize = 1024
+
+// sealedNonceCacheSize is how many recent sealed messages the hub remembers,
+// across all senders.
+const sealedNonceCacheSize = 1 << 14
+
+// sealedID identifies a sealed message by the nonce it was sealed with and
+// the base64 public key of the sender it was relayed from. Only the holder
+// of that key's private key could have sealed it for its recipient.
+type sealedID struct {
+	sender string
+	nonce  [12]byte
+}
+
+// nonceCache remembers the most recent GCM nonces seen, so a captured
+// ciphertext can't be submitted again: those of one client's session key as
+// [12]byte, or the hub's sealedIDs. Once full, the oldest nonce is
+// forgotten first.
+type nonceCache[K comparable] struct {
+	mutex sync.Mutex
+	seen  map[K]bool
+	order []K // Ring buffer of the nonces in seen, oldest at next
+	next  int
+}
+
+func newNonceCache[K comparable](size int) *nonceCache[K] {
+	return &nonceCache[K]{
+		seen:  make(map[K]bool, size),
+		order: make([]K, 0, size),
+	}
+}
+
+// add records nonce and reports whether it was new.
+func (c *nonceCache[K]) add(nonce K) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.seen[nonce] {
+		return false
+	}
+	if len(c.order) < cap(c.order) {
+		c.order = append(c.order, nonce)
+	} else {
+		delete(c.seen, c.order[c.next])
+		c.order[c.next] = nonce
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.seen[nonce] = true
+	return true
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newClientKey returns a fresh X25519 key pair as a browser would make it.
+func newClientKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestKeyAgreement(t *testing.T) {
+	client := newClientKey(t)
+	serverKey, serverPublicKey, err := agreeKey(client.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := parsePublicKey(serverPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := deriveSessionKey(client, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKey, serverKey) || len(clientKey) != 32 {
+		t.Fatalf("client derived %x, server %x", clientKey, serverKey)
+	}
+
+	again, _, err := agreeKey(client.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, serverKey) {
+		t.Error("agreeing again with the same client gave the same key")
+	}
+}
+
+func TestEavesdropperCantDecrypt(t *testing.T) {
+	client := newClientKey(t)
+	key, serverPublicKey, err := agreeKey(client.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := privateAAD("alice", "bob")
+	captured, err := encrypt("meet at noon", key, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone watching the connection sees both public keys and the
+	// ciphertext, but holds neither private key
+	serverPeer, err := parsePublicKey(serverPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observer := newClientKey(t)
+	for _, peer := range []*ecdh.PublicKey{client.PublicKey(), serverPeer} {
+		guess, err := deriveSessionKey(observer, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decrypt(captured, guess, aad, nil); !errors.Is(err, errAuthFailed) {
+			t.Errorf("decrypting with a key derived from the public keys: %v, want errAuthFailed", err)
+		}
+	}
+}
+
+// sealTo looks up the recipient's public key and seals text to them end to
+// end, as browsers do.
+func (c *testClient) sealTo(to, text string) string {
+	c.t.Helper()
+	c.sendFrame(Message{Type: msgPeerKey, To: to})
+	reply := c.expect(to+"'s public key", func(msg Message) bool { return msg.Type == msgPeerKey && msg.From == to })
+	return sealEndToEnd(c.t, c.private, reply.PublicKey, text, privateAAD(c.name, to))
+}
+
+// sealEndToEnd encrypts text under the key private agrees with the base64
+// public key peer.
+func sealEndToEnd(t testing.TB, private *ecdh.PrivateKey, peer, text string, aad []byte) string {
+	t.Helper()
+	key := endToEndKey(t, private, peer)
+	sealed, err := encrypt(text, key, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// endToEndKey derives the key private agrees with the base64 public key
+// peer.
+func endToEndKey(t testing.TB, private *ecdh.PrivateKey, peer string) []byte {
+	t.Helper()
+	public, err := parsePublicKey(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := deriveEndToEndKey(private, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// isSealed matches a sealed private message from one user to another.
+func isSealed(from, to string) func(Message) bool {
+	return func(msg Message) bool { return msg.Type == msgSealed && msg.From == from && msg.To == to }
+}
+
+func TestEndToEndKeyAgreement(t *testing.T) {
+	alice, bob := newClientKey(t), newClientKey(t)
+	forBob, err := deriveEndToEndKey(alice, bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forAlice, err := deriveEndToEndKey(bob, alice.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forBob, forAlice) || len(forBob) != 32 {
+		t.Fatalf("alice derived %x, bob %x", forBob, forAlice)
+	}
+	session, err := deriveSessionKey(alice, bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(session, forBob) {
+		t.Error("end-to-end and session keys from the same key pairs are the same")
+	}
+}
+
+func TestServerCantDecryptSealedPrivateMessages(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	captured := alice.sealTo("bob", "meet at noon")
+	alice.sendFrame(Message{Type: msgSealed, To: "bob", Content: captured})
+
+	// The ciphertext arrives as sent, with the key to open it with
+	aad := privateAAD("alice", "bob")
+	for _, tt := range []struct {
+		c    *testClient
+		peer *testClient
+	}{{bob, alice}, {alice, bob}} {
+		msg := tt.c.expect("the sealed message", isSealed("alice", "bob"))
+		if msg.Content != captured {
+			t.Fatalf("%s got %q, want the ciphertext as sent", tt.c.name, msg.Content)
+		}
+		if want := base64.StdEncoding.EncodeToString(tt.peer.private.PublicKey().Bytes()); msg.PublicKey != want {
+			t.Fatalf("%s was given public key %s, want %s's", tt.c.name, msg.PublicKey, tt.peer.name)
+		}
+		text, err := decrypt(msg.Content, endToEndKey(t, tt.c.private, msg.PublicKey), aad, nil)
+		if err != nil || text != "meet at noon" {
+			t.Errorf("%s decrypted %q, %v", tt.c.name, text, err)
+		}
+	}
+	carol.expectQuiet("someone else's sealed message", func(msg Message) bool { return msg.Type == msgSealed }, 100*time.Millisecond)
+
+	// None of the keys the server holds opens it, nor does one it could
+	// derive from the public keys it hands out
+	var keys [][]byte
+	for _, client := range ts.room(t, defaultRoom).snapshot() {
+		client.key.mutex.Lock()
+		keys = append(keys, client.key.current)
+		if client.key.previous != nil {
+			keys = append(keys, client.key.previous)
+		}
+		client.key.mutex.Unlock()
+	}
+	server := newClientKey(t)
+	for _, c := range []*testClient{alice, bob} {
+		keys = append(keys, endToEndKey(t, server, base64.StdEncoding.EncodeToString(c.private.PublicKey().Bytes())))
+	}
+	for _, key := range keys {
+		if _, err := decrypt(captured, key, aad, nil); !errors.Is(err, errAuthFailed) {
+			t.Errorf("decrypting with a key the server has: %v, want errAuthFailed", err)
+		}
+	}
+}
+
+func TestSealedPrivateMessageErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+	sealed := alice.sealTo("bob", "hi")
+
+	alice.sendFrame(Message{Type: msgPeerKey, To: "dave"})
+	alice.expectContent(msgCommand, "⚠️ User dave not found")
+	alice.sendFrame(Message{Type: msgSealed, To: "dave", Content: sealed})
+	alice.expectContent(msgCommand, "⚠️ User dave not found")
+	alice.sendFrame(Message{Type: msgSealed, To: "bob,carol", Content: sealed})
+	alice.expectContent(msgSystem, "End-to-end private messages go to one user at a time.")
+	alice.sendFrame(Message{Type: msgSealed, To: "bob", Content: "hi"})
+	alice.expectContent(msgSystem, "Your private message is not a valid ciphertext and was not delivered.")
+	alice.sendFrame(Message{Type: msgSealed, To: "bob", Content: base64.StdEncoding.EncodeToString([]byte("too short"))})
+	alice.expectContent(msgSystem, "Your private message is not a valid ciphertext and was not delivered.")
+
+	// Blocks and mutes apply as to other private messages
+	carol.say("/block alice")
+	carol.expectContent(msgSystem, "Blocked private messages from alice.")
+	alice.sendFrame(Message{Type: msgSealed, To: "carol", Content: alice.sealTo("carol", "hi")})
+	alice.expectContent(msgCommand, "⚠️ Your message could not be delivered to carol.")
+	bob.say("/mute alice")
+	bob.expectContent(msgSystem, "Muted alice.")
+	alice.sendFrame(Message{Type: msgSealed, To: "bob", Content: sealed})
+	alice.expect("her echo", isSealed("alice", "bob"))
+	bob.say("still here")
+	bob.expectNoneBefore("a sealed message from a muted user", isSealed("alice", "bob"), isChat("bob", "still here"))
+	carol.expectNoneBefore("a sealed message from a blocked user", isSealed("alice", "carol"), isChat("bob", "still here"))
+}
+
+func TestParsePublicKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(newClientKey(t).PublicKey().Bytes())
+	if _, err := parsePublicKey(valid); err != nil {
+		t.Errorf("valid key: %v", err)
+	}
+	for _, key := range []string{
+		"",
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("too short")),
+		base64.StdEncoding.EncodeToString(make([]byte, 33)),
+	} {
+		if _, err := parsePublicKey(key); err == nil {
+			t.Errorf("parsePublicKey(%q) accepted it", key)
+		}
+	}
+}
+
+func TestConnectingWithoutAPublicKeyIsRefused(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	for _, query := range []string{"", "&pubkey=", "&pubkey=bm90IGEga2V5"} {
+		conn, _, err := websocket.DefaultDialer.Dial(ts.wsURL("/ws?username=alice"+query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _, err = conn.ReadMessage()
+		if !isCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("pubkey %q: got %v, want a policy violation close", query, err)
+		}
+	}
+}
+
+func TestHandshakeOverTheConnection(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	if len(alice.before) == 0 || alice.before[0].Type != msgKey {
+		t.Fatalf("first frame %+v, want the key frame", alice.before)
+	}
+	if alice.sessionKey() == nil {
+		t.Fatal("no session key after the key frame")
+	}
+
+	// The server opens what the client sealed, so both hold the same key
+	alice.sendFrame(Message{Type: msgPrivate, To: "alice", Content: alice.sealFor("alice", "note to self")})
+	alice.expect("the decrypted echo", isPrivate("alice", "alice", "note to self"))
+}
+
+// testKey returns a fixed-length key filled with b.
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestPrivateAADBindsSenderAndRecipient(t *testing.T) {
+	key := testKey(1)
+	sealed, err := encrypt("meet at noon", key, privateAAD("alice", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := decrypt(sealed, key, privateAAD("alice", "bob"), nil); err != nil || text != "meet at noon" {
+		t.Fatalf("opening with the same AAD = %q, %v", text, err)
+	}
+	for _, aad := range [][]byte{
+		privateAAD("alice", "carol"),
+		privateAAD("bob", "alice"),
+		privateAAD("mallory", "bob"),
+		privateAAD("alice", "bob,carol"),
+		privateAAD("alice\x00bob", ""),
+		nil,
+	} {
+		if _, err := decrypt(sealed, key, aad, nil); !errors.Is(err, errAuthFailed) {
+			t.Errorf("opening with AAD %q: %v, want errAuthFailed", aad, err)
+		}
+	}
+}
+
+func TestPrivateMessageForAnotherRecipientIsRejected(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	ts.join(t, "/ws?username=carol")
+
+	// Sealed for bob but addressed to carol
+	alice.sendFrame(Message{Type: msgPrivate, To: "carol", Content: alice.sealFor("bob", "for bob only")})
+	alice.expectContent(msgSystem, "could not be verified and was not delivered")
+
+	alice.sendFrame(Message{Type: msgPrivate, To: "bob", Content: alice.sealFor("bob", "for bob only")})
+	bob.expect("the correctly addressed message", isPrivate("alice", "bob", "for bob only"))
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache[[12]byte](2)
+	a, b, d := [12]byte{1}, [12]byte{2}, [12]byte{3}
+	if !c.add(a) || !c.add(b) {
+		t.Fatal("new nonces rejected")
+	}
+	if c.add(a) || c.add(b) {
+		t.Fatal("repeated nonce accepted")
+	}
+	// A full cache forgets its oldest nonce first
+	if !c.add(d) {
+		t.Fatal("new nonce rejected")
+	}
+	if !c.add(a) {
+		t.Error("oldest nonce still remembered in a full cache")
+	}
+	if c.add(d) {
+		t.Error("newest nonce forgotten")
+	}
+}
+
+func TestReplayedPrivateMessageIsRejected(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	frame := Message{Type: msgPrivate, To: "bob", Content: alice.sealFor("bob", "pay 100 kr")}
+	alice.sendFrame(frame)
+	bob.expect("the first copy", isPrivate("alice", "bob", "pay 100 kr"))
+
+	encryptionErrors, replays := metrics.encryptionErrors.Load(), metrics.replaysRejected.Load()
+	alice.sendFrame(frame)
+	alice.expectContent(msgSystem, "That private message was already delivered.")
+	if got := metrics.replaysRejected.Load(); got != replays+1 {
+		t.Errorf("replays rejected went from %d to %d", replays, got)
+	}
+	if got := metrics.encryptionErrors.Load(); got != encryptionErrors {
+		t.Errorf("a replay counted as an encryption error: %d to %d", encryptionErrors, got)
+	}
+	alice.say("done")
+	bob.expectNoneBefore("the replayed copy", isPrivate("alice", "bob", "pay 100 kr"), isChat("alice", "done"))
+}
+
+func TestSealedMessageCantBeReplayedAfterReconnecting(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	frame := Message{Type: msgSealed, To: "bob", Content: alice.sealTo("bob", "pay 100 kr")}
+	alice.sendFrame(frame)
+	bob.expect("the first copy", isSealed("alice", "bob"))
+
+	// Once alice has left, mallory takes her name and her public key, which
+	// the server hands out, and resends what she captured. bob would open it
+	// as from alice, so the server must not relay it
+	alice.leave()
+	bob.expectContent(msgSystem, "alice left the chat")
+	mallory, _, err := ts.connectWithKey(t, "/ws?username=alice", alice.private, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory.waitJoined()
+	replays := metrics.replaysRejected.Load()
+	mallory.sendFrame(frame)
+	mallory.expectContent(msgSystem, "That private message was already delivered.")
+	if got := metrics.replaysRejected.Load(); got != replays+1 {
+		t.Errorf("replays rejected went from %d to %d", replays, got)
+	}
+	mallory.say("done")
+	bob.expectNoneBefore("the replayed copy", isSealed("alice", "bob"), isChat("alice", "done"))
+
+	// A new message under the same key still goes through
+	mallory.sendFrame(Message{Type: msgSealed, To: "bob", Content: mallory.sealTo("bob", "hi")})
+	bob.expect("the new message", isSealed("alice", "bob"))
+}
+
+// tamper decodes a ciphertext, lets f change its bytes and encodes it again.
+func tamper(t *testing.T, sealed string, f func([]byte) []byte) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(f(raw))
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, aad := testKey(1), privateAAD("alice", "bob")
+	large := string(bytes.Repeat([]byte("0123456789abcdef"), 1<<16))
+	nonUTF8 := "\xff\xfe\x00valid\xc3\x28"
+
+	tests := []struct {
+		name string
+		text string
+		// Changes the sealed text and the key and AAD it is opened with
+		open    func(t *testing.T, sealed string) (string, []byte, []byte)
+		wantErr error
+	}{
+		{name: "round trip", text: "hello"},
+		{name: "empty", text: ""},
+		{name: "large", text: large},
+		{name: "non-UTF-8", text: nonUTF8},
+		{
+			name: "wrong key", text: "hello", wantErr: errAuthFailed,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) { return sealed, testKey(2), aad },
+		},
+		{
+			name: "short key", text: "hello", wantErr: errInvalidKeySize,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) { return sealed, key[:16], aad },
+		},
+		{
+			name: "tampered ciphertext", text: "hello", wantErr: errAuthFailed,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return tamper(t, sealed, func(b []byte) []byte { b[12] ^= 1; return b }), key, aad
+			},
+		},
+		{
+			name: "tampered nonce", text: "hello", wantErr: errAuthFailed,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return tamper(t, sealed, func(b []byte) []byte { b[0] ^= 1; return b }), key, aad
+			},
+		},
+		{
+			name: "tampered tag", text: "hello", wantErr: errAuthFailed,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return tamper(t, sealed, func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), key, aad
+			},
+		},
+		{
+			name: "tampered AAD", text: "hello", wantErr: errAuthFailed,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return sealed, key, privateAAD("alice", "mallory")
+			},
+		},
+		{
+			name: "truncated to the nonce", text: "hello", wantErr: errCiphertextTooShort,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return tamper(t, sealed, func(b []byte) []byte { return b[:12] }), key, aad
+			},
+		},
+		{
+			name: "missing tag", text: "", wantErr: errCiphertextTooShort,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return tamper(t, sealed, func(b []byte) []byte { return b[:len(b)-1] }), key, aad
+			},
+		},
+		{
+			name: "truncated tag", text: "hello", wantErr: errAuthFailed,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) {
+				return tamper(t, sealed, func(b []byte) []byte { return b[:len(b)-1] }), key, aad
+			},
+		},
+		{
+			name: "empty input", text: "hello", wantErr: errCiphertextTooShort,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) { return "", key, aad },
+		},
+		{
+			name: "truncated base64", text: "hello", wantErr: errBadEncoding,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) { return sealed[:len(sealed)-1], key, aad },
+		},
+		{
+			name: "not base64", text: "hello", wantErr: errBadEncoding,
+			open: func(t *testing.T, sealed string) (string, []byte, []byte) { return "!!!!", key, aad },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := encrypt(tt.text, key, aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			openKey, openAAD := key, aad
+			if tt.open != nil {
+				sealed, openKey, openAAD = tt.open(t, sealed)
+			}
+			text, err := decrypt(sealed, openKey, openAAD, nil)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("decrypt: %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tt.text {
+				t.Errorf("decrypted %d bytes, want the %d encrypted", len(text), len(tt.text))
+			}
+		})
+	}
+}
+
+func TestEncryptRejectsShortKey(t *testing.T) {
+	if _, err := encrypt("hello", make([]byte, 16), nil); !errors.Is(err, errInvalidKeySize) {
+		t.Errorf("encrypt with a 16-byte key: %v, want errInvalidKeySize", err)
+	}
+}
+
+func TestEncryptUsesFreshNonces(t *testing.T) {
+	key := testKey(1)
+	a, err := encrypt("hello", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encrypt("hello", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("encrypting the same text twice gave the same ciphertext")
+	}
+}
+
+func TestDecryptRejectsReplay(t *testing.T) {
+	key, seen := testKey(1), newNonceCache[[12]byte](nonceCacheSize)
+	sealed, err := encrypt("hello", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(sealed, key, nil, seen); err != nil {
+		t.Fatalf("first decrypt: %v", err)
+	}
+	if _, err := decrypt(sealed, key, nil, seen); !errors.Is(err, errReplay) {
+		t.Errorf("second decrypt: %v, want errReplay", err)
+	}
+
+	// A forged ciphertext doesn't use up its nonce, so the real message
+	// with that nonce still opens
+	genuine, err := encrypt("hello again", key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := tamper(t, genuine, func(b []byte) []byte { b[len(b)-1] ^= 1; return b })
+	if _, err := decrypt(forged, key, nil, seen); !errors.Is(err, errAuthFailed) {
+		t.Fatalf("forged: %v, want errAuthFailed", err)
+	}
+	if _, err := decrypt(genuine, key, nil, seen); err != nil {
+		t.Errorf("real message after a forgery with its nonce: %v", err)
+	}
+}
+
+func FuzzDecrypt(f *testing.F) {
+	key := bytes.Repeat([]byte{7}, 32)
+	aad := privateAAD("alice", "bob")
+	valid, err := encrypt("hello bob", key, aad)
+	if err != nil {
+		f.Fatal(err)
+	}
+	empty, err := encrypt("", key, aad)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid, aad)
+	f.Add(empty, aad)
+	f.Add(valid, privateAAD("bob", "alice"))
+	f.Add(valid[:len(valid)-4], aad)
+	f.Add("", []byte(nil))
+	f.Add("not base64!", aad)
+	f.Add(base64.StdEncoding.EncodeToString(make([]byte, 27)), aad)
+	f.Add(base64.StdEncoding.EncodeToString(make([]byte, 28)), aad)
+
+	f.Fuzz(func(t *testing.T, encrypted string, aad []byte) {
+		seen := newNonceCache[[12]byte](4)
+		text, err := decrypt(encrypted, key, aad, seen)
+		if err != nil {
+			if text != "" {
+				t.Fatalf("decrypt failed with %v but returned %q", err, text)
+			}
+			for _, want := range []error{errBadEncoding, errCiphertextTooShort, errAuthFailed} {
+				if errors.Is(err, want) {
+					return
+				}
+			}
+			t.Fatalf("decrypt(%q) failed with unexpected error %v", encrypted, err)
+		}
+
+		// Only something sealed under key with this aad opens, and only once
+		if _, err := decrypt(encrypted, key, append(aad, 0), nil); !errors.Is(err, errAuthFailed) {
+			t.Fatalf("decrypt(%q) with other additional data: %v, want errAuthFailed", encrypted, err)
+		}
+		if _, err := decrypt(encrypted, key, aad, seen); !errors.Is(err, errReplay) {
+			t.Fatalf("decrypting %q twice: %v, want errReplay", encrypted, err)
+		}
+		// What opens seals again to something that opens to the same text
+		resealed, err := encrypt(text, key, aad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, err := decrypt(resealed, key, aad, nil); err != nil || again != text {
+			t.Fatalf("round trip of %q gave %q, %v", text, again, err)
+		}
+	})
+}
+
+// breakKey replaces the server's key for the named user with one encrypt
+// rejects, so every message sealed for them fails.
+func breakKey(t *testing.T, ts *testServer, username string) {
+	t.Helper()
+	c := ts.serverClient(t, defaultRoom, username)
+	c.key.mutex.Lock()
+	c.key.current = []byte("short")
+	c.key.mutex.Unlock()
+}
+
+func TestEncryptionFailuresAreReported(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	// The recipient is told it missed a message, and the sender that it
+	// wasn't delivered
+	breakKey(t, ts, "bob")
+	alice.say("@bob,carol lunch?")
+	bob.expectContent(msgSystem, "A private message from alice could not be encrypted for you and was not delivered.")
+	alice.expectContent(msgCommand, "⚠️ Your message could not be delivered to bob.")
+	carol.expect("her copy", isPrivate("alice", "bob,carol", "lunch?"))
+	alice.expect("the echo", isPrivate("alice", "bob,carol", "lunch?"))
+
+	// As is a sender whose own copy can't be sealed
+	breakKey(t, ts, "alice")
+	alice.say("@carol lunch?")
+	carol.expect("her copy", isPrivate("alice", "carol", "lunch?"))
+	alice.expectContent(msgSystem, "Your private message was delivered, but your own copy could not be encrypted.")
+
+	// And a client the bot can't seal a message for
+	breakKey(t, ts, "carol")
+	if err := ts.room(t, defaultRoom).bot.sendPrivate(ts.serverClient(t, defaultRoom, "carol"), "psst"); err == nil {
+		t.Error("bot sealed a message with a broken key")
+	}
+	carol.expectContent(msgSystem, "A private message to you could not be encrypted and was not delivered.")
+}
+
+func TestRepeatedEncryptionFailuresAskForANewKey(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	breakKey(t, ts, "bob")
+	for range maxEncryptionFailures {
+		alice.say("@bob lunch?")
+		alice.expectContent(msgCommand, "⚠️ Your message could not be delivered to bob.")
+	}
+	if err := bob.expectClosed(); !isCloseError(err, websocket.CloseServiceRestart) {
+		t.Fatalf("bob closed with %v, want CloseServiceRestart", err)
+	}
+
+	// Resuming the session agrees a new key that works
+	bob = ts.join(t, "/ws?username=bob&session="+ts.disconnect(t, bob))
+	alice.say("@bob lunch?")
+	bob.expect("the message under the new key", isPrivate("alice", "bob", "lunch?"))
+
+	// Messages the server can't open count too
+	for range maxEncryptionFailures {
+		alice.sendFrame(Message{Type: msgPrivate, To: "bob", Content: alice.sealFor("carol", "lunch?")})
+		alice.expectContent(msgSystem, "could not be verified and was not delivered")
+	}
+	if err := alice.expectClosed(); !isCloseError(err, websocket.CloseServiceRestart) {
+		t.Fatalf("alice closed with %v, want CloseServiceRestart", err)
+	}
+}
+
+func isKey(msg Message) bool { return msg.Type == msgKey }
+
+func TestKeyRotatesAfterNMessages(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.keyRotateMessages = 3
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	// The new key follows the third message, which still decrypts with the
+	// first
+	first := bob.sessionKey()
+	for _, text := range []string{"one", "two", "three"} {
+		alice.say("@bob " + text)
+		bob.expectNoneBefore("a new key", isKey, isPrivate("alice", "bob", text))
+	}
+	bob.expect("the new key", isKey)
+	if bytes.Equal(first, bob.sessionKey()) {
+		t.Fatal("new key frame didn't change the key")
+	}
+
+	// A message bob sealed before seeing the new key is still accepted, and
+	// its echo decrypts with the new one
+	inFlight, err := encrypt("sent before the switch", first, privateAAD("bob", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := encrypt("sent much later", first, privateAAD("bob", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: inFlight})
+	alice.expect("the in-flight message", isPrivate("bob", "alice", "sent before the switch"))
+	bob.expect("the echo under the new key", isPrivate("bob", "alice", "sent before the switch"))
+
+	// Once bob uses the new key, the old one is refused
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: bob.sealFor("alice", "under the new key")})
+	alice.expect("the message under the new key", isPrivate("bob", "alice", "under the new key"))
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: stale})
+	bob.expectContent(msgSystem, "could not be verified and was not delivered")
+}
+
+func TestKeyWaitsForTheClientBeforeRotatingAgain(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.keyRotateMessages = 1
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	first := bob.sessionKey()
+	alice.say("@bob one")
+	bob.expect("the message", isPrivate("alice", "bob", "one"))
+	bob.expect("the new key", isKey)
+
+	// Messages bob sealed under the old key neither count toward the new
+	// key nor, while bob may still be using the old one, rotate it again
+	for _, text := range []string{"two", "three"} {
+		inFlight, err := encrypt(text, first, privateAAD("bob", "alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: inFlight})
+		bob.expectNoneBefore("another new key", isKey, isPrivate("bob", "alice", text))
+	}
+
+	// Once bob uses the new key, rotation carries on
+	bob.sendFrame(Message{Type: msgPrivate, To: "alice", Content: bob.sealFor("alice", "four")})
+	bob.expect("the next key", isKey)
+}
+
+func TestSealedMessagesDontCountTowardRotation(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.keyRotateMessages = 1
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	for _, text := range []string{"one", "two"} {
+		alice.sendFrame(Message{Type: msgSealed, To: "bob", Content: alice.sealTo("bob", text)})
+		bob.expectNoneBefore("a new key", isKey, isSealed("alice", "bob"))
+	}
+	alice.say("@bob three")
+	bob.expect("the message under the session key", isPrivate("alice", "bob", "three"))
+	bob.expect("the new key", isKey)
+}
+
+func TestKeyRotatesOnceOld(t *testing.T) {
+	clock := newFakeClock()
+	cfg := testConfig(t)
+	cfg.keyRotateInterval = time.Hour
+	ts := newTestServer(t, cfg, func(h *Hub) { h.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	first := bob.sessionKey()
+	alice.say("@bob early")
+	bob.expect("the first message", isPrivate("alice", "bob", "early"))
+	alice.say("public")
+	bob.expectNoneBefore("a new key", isKey, isChat("alice", "public"))
+
+	// The key is replaced on its first use once old, or by the keepalive
+	// if that comes first
+	clock.advance(time.Hour)
+	alice.say("@bob late")
+	bob.expect("the new key", isKey)
+	if bytes.Equal(first, bob.sessionKey()) {
+		t.Fatal("new key frame didn't change the key")
+	}
+	alice.say("@bob later")
+	bob.expect("the message under the new key", isPrivate("alice", "bob", "later"))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds for /ephemeral, in seconds.
+const maxEphemeralSeconds = 24 * 60 * 60
+
+// ephemeralCommand sends a chat message that is deleted again after the
+// given number of seconds, e.g. "/ephemeral 30 the door code is 1234".
+func (room *Room) ephemeralCommand(sender *Client, args []string) {
+	usage := translate(room.bot.lang, "ephemeral.usage")
+	if len(args) < 2 {
+		room.bot.sendTo(sender, "⚠️ "+usage)
+		return
+	}
+	seconds, err := strconv.Atoi(args[0])
+	if err != nil || seconds <= 0 || seconds > maxEphemeralSeconds {
+		room.bot.sendTo(sender, translate(room.bot.lang, "ephemeral.invalid", args[0], maxEphemeralSeconds, usage))
+		return
+	}
+
+	content := strings.Join(args[1:], " ")
+	if room.linkBlocked(sender, content) {
+		return
+	}
+	room.markBack(sender)
+	room.deliverFrom(sender, Message{Type: msgChat, From: sender.name(), Content: content, TTL: seconds})
+}
+
+// expireAfter deletes message id once ttl has passed.
+func (room *Room) expireAfter(id uint64, ttl time.Duration) {
+	room.expiringMu.Lock()
+	defer room.expiringMu.Unlock()
+	if room.expiring == nil {
+		room.expiring = make(map[uint64]timer)
+	}
+	room.expiring[id] = room.afterFunc(ttl, func() { room.expire(id) })
+}
+
+// expire tells every client, here and on other instances, to delete message
+// id, and has run drop it from the room's history.
+func (room *Room) expire(id uint64) {
+	room.expiringMu.Lock()
+	delete(room.expiring, id)
+	room.expiringMu.Unlock()
+
+	data, err := json.Marshal(Message{Type: msgDelete, ID: id, TS: room.now().UTC()})
+	if err != nil {
+		errorf("Marshal error: %v", err)
+		return
+	}
+	if room.fanout != nil {
+		if err := room.fanout.Publish(room.name, outbound{data: data}); err != nil {
+			errorf("Publishing deletion in room %s: %v", room.name, err)
+		}
+	}
+	select {
+	case room.deletions <- deletion{id: id, data: data}:
+	case <-room.done:
+	}
+}
+
+// stopExpiring cancels the deletions still pending once the room has
+// stopped. Its history goes with it, and ephemeral messages are never
+// saved, so there is nothing left to delete.
+func (room *Room) stopExpiring() {
+	room.expiringMu.Lock()
+	defer room.expiringMu.Unlock()
+	for id, timer := range room.expiring {
+		timer.Stop()
+		delete(room.expiring, id)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func isDelete(id uint64) func(Message) bool {
+	return func(msg Message) bool { return msg.Type == msgDelete && msg.ID == id }
+}
+
+func TestEphemeralMessageIsDeleted(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.now = clock.now
+		h.afterFunc = clock.afterFunc
+	})
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/ephemeral 30 the door code is 1234")
+	msg := bob.expect("the ephemeral message", isChat("alice", "the door code is 1234"))
+	if msg.TTL != 30 || msg.ID == 0 {
+		t.Fatalf("got %+v, want a message with an ID and a TTL of 30", msg)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for clock.pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no deletion scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Nothing that outlives the message may copy it
+	room := ts.hub.room(defaultRoom)
+	for _, m := range room.historyMessages() {
+		if m.ID == msg.ID {
+			t.Errorf("history for /history and /export has the ephemeral message %+v", m)
+		}
+	}
+	alice.say("/history")
+	if reply := alice.expectContent(msgCommand, "📜"); strings.Contains(reply.Content, "1234") {
+		t.Errorf("/history showed the ephemeral message: %q", reply.Content)
+	}
+
+	clock.advance(29 * time.Second)
+	alice.say("not yet")
+	bob.expectNoneBefore("an early deletion", isDelete(msg.ID), isChat("alice", "not yet"))
+	clock.advance(time.Second)
+	bob.expect("the deletion", isDelete(msg.ID))
+	alice.expect("the deletion", isDelete(msg.ID))
+
+	// Clients joining later don't see it
+	carol := ts.join(t, "/ws?username=carol")
+	for _, m := range carol.before {
+		if m.ID == msg.ID {
+			t.Errorf("carol was sent the expired message %+v", m)
+		}
+	}
+}
+
+func TestEphemeralCommandErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	for _, tt := range []struct{ input, want string }{
+		{"/ephemeral", "⚠️ Usage: /ephemeral <seconds> <message>"},
+		{"/ephemeral 30", "⚠️ Usage: /ephemeral <seconds> <message>"},
+		{"/ephemeral soon hi", `⚠️ Invalid time "soon": must be between 1 and 86400 seconds.`},
+		{"/ephemeral 0 hi", `⚠️ Invalid time "0"`},
+		{"/ephemeral 86401 hi", `⚠️ Invalid time "86401"`},
+	} {
+		alice.say(tt.input)
+		alice.expectContent(msgCommand, tt.want)
+	}
+}
+
+func TestEphemeralTimersStopWithTheRoom(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	room := ts.hub.room(defaultRoom)
+
+	alice.say("/ephemeral 3600 gone in an hour")
+	alice.expect("her message", isChat("alice", "gone in an hour"))
+	room.expiringMu.Lock()
+	pending := len(room.expiring)
+	room.expiringMu.Unlock()
+	if pending != 1 {
+		t.Fatalf("%d deletions pending, want 1", pending)
+	}
+
+	alice.leave()
+	select {
+	case <-room.done:
+	case <-time.After(testTimeout):
+		t.Fatal("the room didn't stop after its last client left")
+	}
+	room.expiringMu.Lock()
+	defer room.expiringMu.Unlock()
+	if len(room.expiring) != 0 {
+		t.Errorf("%d deletions still pending after the room stopped", len(room.expiring))
+	}
+}
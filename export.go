@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on /export. An export is a copy of the room's history taken when
+// the command runs, so pending exports are capped to bound their memory.
+const (
+	exportTTL  = 15 * time.Minute
+	maxExports = 256
+)
+
+var errTooManyExports = errors.New("too many exports pending")
+
+// exportStore keeps room history exports until their links expire. A link's
+// token is its only credential, so anyone it is shared with can download
+// the export.
+type exportStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mutex   sync.Mutex
+	exports map[string]*roomExport
+}
+
+// roomExport is a room's public history as it was when /export ran.
+type roomExport struct {
+	room     string
+	messages []Message
+	expires  time.Time
+}
+
+func newExportStore(ttl time.Duration) *exportStore {
+	return &exportStore{ttl: ttl, now: time.Now, exports: make(map[string]*roomExport)}
+}
+
+// put keeps messages from the named room and returns the random token they
+// can be downloaded by.
+func (s *exportStore) put(roomName string, messages []Message) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	for t, e := range s.exports {
+		if !now.Before(e.expires) {
+			delete(s.exports, t)
+		}
+	}
+	if len(s.exports) >= maxExports {
+		return "", errTooManyExports
+	}
+	s.exports[token] = &roomExport{room: roomName, messages: messages, expires: now.Add(s.ttl)}
+	return token, nil
+}
+
+// get returns the export with the given token, unless it doesn't exist or
+// has expired.
+func (s *exportStore) get(token string) (*roomExport, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.exports[token]
+	if !ok || !s.now().Before(e.expires) {
+		return nil, false
+	}
+	return e, true
+}
+
+// historyMessages returns the room's kept history, oldest first, leaving
+// out anything private. Ephemeral messages are left out too, since a copy
+// in an export or a /history reply would outlive their deletion.
+func (room *Room) historyMessages() []Message {
+	reply := make(chan [][]byte, 1)
+	var frames [][]byte
+	select {
+	case room.histories <- reply:
+		frames = <-reply
+	case <-room.done:
+		return nil
+	}
+
+	messages := make([]Message, 0, len(frames))
+	for _, frame := range frames {
+		var msg Message
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			errorf("Decoding history of room %s: %v", room.name, err)
+			continue
+		}
+		if msg.Type == msgPrivate || msg.TTL > 0 {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// historyLine writes msg as one line of plain text, e.g.
+// "[2024-05-01 12:00:00] alice: hi".
+func historyLine(msg Message) string {
+	line := fmt.Sprintf("[%s] ", msg.TS.Format(time.DateTime))
+	// Action lines already name who acted, e.g. "* alice waves"
+	if msg.From != "" && msg.Type != msgAction {
+		line += msg.From + ": "
+	}
+	return line + msg.Content
+}
+
+// exportCommand sends sender a link to download the room's recent history.
+func (room *Room) exportCommand(sender *Client) {
+	messages := room.historyMessages()
+	if len(messages) == 0 {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "export.empty")})
+		return
+	}
+
+	token, err := sender.hub.exports.put(room.name, messages)
+	if errors.Is(err, errTooManyExports) {
+		warnf("Too many exports pending, refusing one from %s", sender.name())
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "export.busy")})
+		return
+	}
+	if err != nil {
+		errorf("Exporting room %s: %v", room.name, err)
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "export.failed")})
+		return
+	}
+
+	infof("%s exported %d messages from room %s", sender.name(), len(messages), room.name)
+	sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "export.ready", len(messages), exportTTL, token, token)})
+}
+
+// handleExport serves an export as a JSON array of messages, or as plain
+// text lines with ?format=text.
+func (h *Hub) handleExport(w http.ResponseWriter, r *http.Request) {
+	e, ok := h.exports.get(r.PathValue("token"))
+	if !ok {
+		http.Error(w, "no such export, or it has expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.room+".json"))
+		if err := json.NewEncoder(w).Encode(e.messages); err != nil {
+			debugf("Writing export of room %s: %v", e.room, err)
+		}
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.room+".txt"))
+		var b strings.Builder
+		for _, msg := range e.messages {
+			if msg.Type == msgPreview {
+				continue
+			}
+			b.WriteString(historyLine(msg))
+			b.WriteByte('\n')
+		}
+		w.Write([]byte(b.String()))
+	default:
+		http.Error(w, `format must be "json" or "text"`, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportPath matches the JSON download link in a /export reply.
+var exportPath = regexp.MustCompile(`/export/[0-9a-f]{32}`)
+
+// exportLink runs /export as c and returns the path of the JSON download.
+func exportLink(t *testing.T, c *testClient) string {
+	t.Helper()
+	c.say("/export")
+	reply := c.expectContent(msgSystem, "📦 Download this room's last ")
+	path := exportPath.FindString(reply.Content)
+	if path == "" {
+		t.Fatalf("no export link in %q", reply.Content)
+	}
+	return path
+}
+
+func TestExport(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("hello")
+	alice.say("@bob just between us")
+	alice.say("/me waves")
+	bob.expect("alice's action", func(msg Message) bool { return msg.Type == msgAction })
+	path := exportLink(t, bob)
+
+	resp, body := download(t, ts, path)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" ||
+		resp.Header.Get("Content-Disposition") != `attachment; filename="general.json"` || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("JSON export got %s with headers %v", resp.Status, resp.Header)
+	}
+	var messages []Message
+	if err := json.Unmarshal(body, &messages); err != nil {
+		t.Fatalf("export %q: %v", body, err)
+	}
+	var chat []string
+	for _, msg := range messages {
+		if msg.Type == msgPrivate || strings.Contains(msg.Content, "just between us") {
+			t.Errorf("export has the private message %+v", msg)
+		}
+		if msg.Type == msgChat || msg.Type == msgAction {
+			chat = append(chat, msg.Content)
+		}
+	}
+	if got := strings.Join(chat, "|"); got != "hello|* alice waves" {
+		t.Errorf("exported chat %q, want alice's message and action", got)
+	}
+
+	resp, body = download(t, ts, path+"?format=text")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("text export got %s with headers %v", resp.Status, resp.Header)
+	}
+	text := string(body)
+	if !regexp.MustCompile(`(?m)^\[\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\] alice: hello$`).MatchString(text) ||
+		!strings.Contains(text, "] * alice waves\n") || strings.Contains(text, "just between us") {
+		t.Errorf("text export:\n%s", text)
+	}
+
+	if resp, _ := download(t, ts, path+"?format=xml"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown format got %s, want 400", resp.Status)
+	}
+	if resp, _ := download(t, ts, "/export/0123456789abcdef0123456789abcdef"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown token got %s, want 404", resp.Status)
+	}
+}
+
+func TestExportExpires(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.exports.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("hello")
+	path := exportLink(t, alice)
+
+	clock.advance(exportTTL - time.Second)
+	if resp, _ := download(t, ts, path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("download within the TTL got %s", resp.Status)
+	}
+	clock.advance(time.Second)
+	if resp, _ := download(t, ts, path); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download after the TTL got %s, want 404", resp.Status)
+	}
+}
+
+func TestExportStoreIsCapped(t *testing.T) {
+	clock := newFakeClock()
+	s := newExportStore(time.Minute)
+	s.now = clock.now
+
+	for range maxExports {
+		if _, err := s.put(defaultRoom, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.put(defaultRoom, nil); !errors.Is(err, errTooManyExports) {
+		t.Errorf("put past the cap: %v, want errTooManyExports", err)
+	}
+	// Expired exports make room for new ones
+	clock.advance(time.Minute)
+	if _, err := s.put(defaultRoom, nil); err != nil {
+		t.Errorf("put after the others expired: %v", err)
+	}
+	if len(s.exports) != 1 {
+		t.Errorf("%d exports kept, want only the new one", len(s.exports))
+	}
+}
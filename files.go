@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// allowedFileTypes are the content types, as sniffed by
+// http.DetectContentType, of files clients may share. Anything that could
+// run in a browser, such as HTML or SVG, is left out.
+var allowedFileTypes = map[string]bool{
+	"image/png":                 true,
+	"image/jpeg":                true,
+	"image/gif":                 true,
+	"image/webp":                true,
+	"application/pdf":           true,
+	"application/zip":           true,
+	"text/plain; charset=utf-8": true,
+}
+
+// fileStoreCapacity bounds the bytes held by the file store, counting
+// uploads still in progress. Once full, new files are refused until old
+// ones expire.
+const fileStoreCapacity = 256 << 20
+
+// maxConcurrentUploads bounds the chunked uploads in progress across the
+// server.
+const maxConcurrentUploads = 16
+
+var (
+	errFileTooLarge   = errors.New("file too large")
+	errFileStoreFull  = errors.New("file storage full")
+	errTooManyUploads = errors.New("too many uploads in progress")
+)
+
+// fileStore keeps shared files in memory until they expire. Files live on
+// the instance they were sent to, so with -redis a link only works when the
+// downloader reaches the same instance.
+type fileStore struct {
+	maxSize   int64         // Largest file accepted in a single frame
+	maxUpload int64         // Largest file accepted in chunks; 0 disables chunked uploads
+	ttl       time.Duration // How long a file can be downloaded
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	files    map[string]*storedFile
+	size     int64 // Total bytes held
+	reserved int64 // Bytes set aside for uploads in progress
+	uploads  int   // Uploads in progress
+}
+
+type storedFile struct {
+	data    []byte
+	mime    string
+	added   time.Time
+	expires time.Time
+}
+
+func newFileStore(maxSize, maxUpload int64, ttl time.Duration) *fileStore {
+	return &fileStore{
+		maxSize:   maxSize,
+		maxUpload: maxUpload,
+		ttl:       ttl,
+		now:       time.Now,
+		files:     make(map[string]*storedFile),
+	}
+}
+
+// put stores data and returns the random ID it can be downloaded by.
+func (s *fileStore) put(data []byte, mime string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	s.expire(now)
+	if s.size+s.reserved+int64(len(data)) > fileStoreCapacity {
+		return "", errFileStoreFull
+	}
+	s.files[id] = &storedFile{data: data, mime: mime, added: now, expires: now.Add(s.ttl)}
+	s.size += int64(len(data))
+	return id, nil
+}
+
+// reserve sets aside room for an upload of n bytes, so uploads in progress
+// can't together outgrow the store. Every successful reserve must be
+// followed by a release once the upload ends, before the file is put.
+func (s *fileStore) reserve(n int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(s.now())
+	if s.uploads >= maxConcurrentUploads {
+		return errTooManyUploads
+	}
+	if s.size+s.reserved+n > fileStoreCapacity {
+		return errFileStoreFull
+	}
+	s.reserved += n
+	s.uploads++
+	return nil
+}
+
+// release gives back the n bytes reserved for an upload that has ended.
+func (s *fileStore) release(n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reserved -= n
+	s.uploads--
+}
+
+// expire drops files that can no longer be downloaded. The caller must hold
+// the mutex.
+func (s *fileStore) expire(now time.Time) {
+	for id, f := range s.files {
+		if !now.Before(f.expires) {
+			s.size -= int64(len(f.data))
+			delete(s.files, id)
+		}
+	}
+}
+
+// get returns the file with the given ID, unless it doesn't exist or has
+// expired.
+func (s *fileStore) get(id string) (*storedFile, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[id]
+	if !ok || !s.now().Before(f.expires) {
+		return nil, false
+	}
+	return f, true
+}
+
+// shareFile stores a file sent by sender as a binary frame and tells the
+// room where to download it.
+func (room *Room) shareFile(sender *Client, data []byte) {
+	if room.files == nil {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "files.disabled")})
+		return
+	}
+
+	if int64(len(data)) > room.files.maxSize {
+		room.refuseFile(sender, len(data), errFileTooLarge)
+		return
+	}
+	room.storeFile(sender, data, FileInfo{})
+}
+
+// storeFile sniffs, stores and announces a file from sender.
+func (room *Room) storeFile(sender *Client, data []byte, info FileInfo) {
+	mime := http.DetectContentType(data)
+	if !allowedFileTypes[mime] {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "files.type", mime)})
+		return
+	}
+
+	id, err := room.files.put(data, mime)
+	if err != nil {
+		room.refuseFile(sender, len(data), err)
+		return
+	}
+
+	infof("%s shared a %s file in room %s (%d bytes)", sender.name(), mime, room.name, len(data))
+	info.MIME, info.Size = mime, int64(len(data))
+	room.deliverFrom(sender, Message{
+		Type:    msgFile,
+		From:    sender.name(),
+		Content: "/files/" + id,
+		File:    &info,
+	})
+}
+
+// refuseFile tells sender why their file of size bytes wasn't shared.
+func (room *Room) refuseFile(sender *Client, size int, err error) {
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "files.tooLarge", formatNumber(int(room.files.maxSize), sender.locale))})
+	case errors.Is(err, errFileStoreFull):
+		warnf("File storage full, refusing %d bytes from %s", size, sender.name())
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "files.full")})
+	case errors.Is(err, errTooManyUploads):
+		warnf("Too many uploads in progress, refusing one from %s", sender.name())
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "files.busy")})
+	default:
+		errorf("Storing file from %s: %v", sender.name(), err)
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "files.failed")})
+	}
+}
+
+// handleFile serves a shared file. Anything but an image is sent as a
+// download rather than shown, and the type is never re-sniffed.
+func (h *Hub) handleFile(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.files.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "no such file, or it has expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", f.mime)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if !strings.HasPrefix(f.mime, "image/") {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	http.ServeContent(w, r, "", f.added, bytes.NewReader(f.data))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pngHeader is enough of a PNG for http.DetectContentType to sniff it.
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// fileConfig is a test config with file sharing on for files up to 1 KB.
+func fileConfig(t *testing.T) config {
+	cfg := testConfig(t)
+	cfg.maxFileSize = 1024
+	return cfg
+}
+
+// sendBinary sends data as a binary frame.
+func (c *testClient) sendBinary(data []byte) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		c.t.Fatalf("%s: %v", c.name, err)
+	}
+}
+
+// download fetches a shared file from ts by the path in a msgFile.
+func download(t *testing.T, ts *testServer, path string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func isFile(msg Message) bool { return msg.Type == msgFile }
+
+func TestShareAndDownloadFile(t *testing.T) {
+	ts := newTestServer(t, fileConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	image := []byte(pngHeader + strings.Repeat("\x00\x01\x02", 100))
+	alice.sendBinary(image)
+	msg := bob.expect("the shared file", isFile)
+	if msg.From != "alice" || !strings.HasPrefix(msg.Content, "/files/") || msg.File == nil {
+		t.Fatalf("got %+v, want a file from alice", msg)
+	}
+	if msg.File.MIME != "image/png" || msg.File.Size != int64(len(image)) {
+		t.Errorf("file info = %+v, want a %d byte image/png", msg.File, len(image))
+	}
+	alice.expect("her own file", isFile)
+
+	resp, body := download(t, ts, msg.Content)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, image) {
+		t.Fatalf("download got %s and %d bytes, want the %d bytes sent", resp.Status, len(body), len(image))
+	}
+	for header, want := range map[string]string{
+		"Content-Type":            "image/png",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Content-Disposition":     "", // Images are shown inline
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// Anything else is a download
+	alice.sendBinary([]byte("just some notes\n"))
+	msg = bob.expect("the shared text file", isFile)
+	resp, body = download(t, ts, msg.Content)
+	if string(body) != "just some notes\n" || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" || resp.Header.Get("Content-Disposition") != "attachment" {
+		t.Errorf("text download got %q with headers %v", body, resp.Header)
+	}
+}
+
+func TestFilesAreRefused(t *testing.T) {
+	ts := newTestServer(t, fileConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	for _, tt := range []struct {
+		data []byte
+		want string
+	}{
+		{[]byte(pngHeader + strings.Repeat("x", 2000)), "Files sent in one frame can be at most 1.024 bytes."},
+		{[]byte("<!DOCTYPE html><script>alert(1)</script>"), "Files of type text/html; charset=utf-8 can't be shared."},
+		{[]byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), "Files of type text/xml; charset=utf-8 can't be shared."},
+	} {
+		alice.sendBinary(tt.data)
+		alice.expectContent(msgSystem, tt.want)
+	}
+	alice.say("done")
+	bob.expectNoneBefore("a refused file", isFile, isChat("alice", "done"))
+
+	if resp, _ := download(t, ts, "/files/0123456789abcdef0123456789abcdef"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown file got %s, want 404", resp.Status)
+	}
+}
+
+func TestFileSharingIsOffByDefault(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.sendBinary([]byte(pngHeader))
+	alice.expectContent(msgSystem, "File sharing is disabled on this server.")
+	if resp, _ := download(t, ts, "/files/0123456789abcdef0123456789abcdef"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/files without file sharing got %s, want 404", resp.Status)
+	}
+}
+
+func TestSharedFilesExpire(t *testing.T) {
+	clock := newFakeClock()
+	cfg := fileConfig(t)
+	cfg.fileTTL = time.Hour
+	ts := newTestServer(t, cfg, func(h *Hub) { h.files.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.sendBinary([]byte("notes"))
+	path := alice.expect("her file", isFile).Content
+
+	clock.advance(59 * time.Minute)
+	if resp, _ := download(t, ts, path); resp.StatusCode != http.StatusOK {
+		t.Fatalf("download within the TTL got %s", resp.Status)
+	}
+	clock.advance(time.Minute)
+	if resp, _ := download(t, ts, path); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download after the TTL got %s, want 404", resp.Status)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	clock := newFakeClock()
+	s := newFileStore(1024, 0, time.Minute)
+	s.now = clock.now
+
+	id, err := s.put([]byte("hello"), "text/plain; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := s.get(id); !ok || string(f.data) != "hello" {
+		t.Fatalf("get(%q) = %+v, %v", id, f, ok)
+	}
+	other, _ := s.put([]byte("world"), "text/plain; charset=utf-8")
+	if other == id || len(id) != 32 {
+		t.Errorf("IDs %q and %q, want two different 32-digit IDs", id, other)
+	}
+	if s.size != 10 {
+		t.Errorf("size = %d, want 10", s.size)
+	}
+
+	// The store won't grow past its capacity...
+	if err := s.reserve(fileStoreCapacity - 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.put([]byte("!"), "text/plain; charset=utf-8"); !errors.Is(err, errFileStoreFull) {
+		t.Errorf("put into a full store: %v, want errFileStoreFull", err)
+	}
+	s.release(fileStoreCapacity - 10)
+
+	// ... and expired files give their room back
+	clock.advance(time.Minute)
+	if _, ok := s.get(id); ok {
+		t.Error("got an expired file")
+	}
+	if _, err := s.put([]byte("again"), "text/plain; charset=utf-8"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.files) != 1 || s.size != 5 {
+		t.Errorf("%d files of %d bytes after expiry, want 1 of 5", len(s.files), s.size)
+	}
+}
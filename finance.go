@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// Bounds for /compound so the projection stays within int range.
+const (
+	maxCompoundRate  = 100
+	maxCompoundYears = 100
+)
+
+// Bounds for /mortgage.
+const (
+	maxMortgageRate  = 100
+	maxMortgageYears = 50
+)
+
+// Bounds for /split.
+const (
+	maxSplitPeople = 100
+	maxTipPct      = 100
+)
+
+// Norway's standard VAT rate, the default for /vat, and the highest rate
+// /vat accepts.
+const (
+	defaultVATRate = 25
+	maxVATRate     = 100
+)
+
+// calculateCompound reports the future value of principal compounded once a
+// year at ratePct percent for the given number of years, in lang with
+// numbers written for loc.
+func calculateCompound(lang string, principal float64, ratePct float64, years int, loc locale) string {
+	futureValue := principal * math.Pow(1+ratePct/100, float64(years))
+	if futureValue >= math.MaxInt64 {
+		return translate(lang, "compound.tooLarge")
+	}
+
+	return translate(lang, "compound.result",
+		formatNumber(int(math.Round(principal)), loc),
+		strconv.FormatFloat(ratePct, 'f', -1, 64),
+		formatNumber(int(math.Round(futureValue)), loc),
+		years,
+		formatNumber(int(math.Round(futureValue-principal)), loc))
+}
+
+// calculateAnnuity returns the fixed monthly payment that repays principal
+// over years at annualRatePct percent interest, compounded monthly, and the
+// total interest paid over the life of the loan.
+func calculateAnnuity(principal, annualRatePct float64, years int) (monthly, totalInterest float64) {
+	months := float64(years * 12)
+	if annualRatePct == 0 {
+		return principal / months, 0
+	}
+
+	r := annualRatePct / 100 / 12
+	monthly = principal * r / (1 - math.Pow(1+r, -months))
+	return monthly, monthly*months - principal
+}
+
+// splitBill divides total kroner between people, to the øre. The øre that
+// don't divide evenly go one each to the first shares, so the shares always
+// add up to the rounded total, e.g. 100 between 3 is 33,34 + 33,33 + 33,33.
+func splitBill(total float64, people int) []float64 {
+	if people <= 0 {
+		return nil
+	}
+	ore := int64(math.Round(total * 100))
+	each, remainder := ore/int64(people), ore%int64(people)
+
+	shares := make([]float64, people)
+	for i := range shares {
+		share := each
+		if int64(i) < remainder {
+			share++
+		}
+		shares[i] = float64(share) / 100
+	}
+	return shares
+}
+
+// addVAT returns the VAT on a net amount at ratePct percent and the gross
+// amount including it.
+func addVAT(net, ratePct float64) (vat, gross float64) {
+	vat = net * ratePct / 100
+	return vat, net + vat
+}
+
+// extractVAT splits a gross amount that includes VAT at ratePct percent into
+// its net amount and the VAT.
+func extractVAT(gross, ratePct float64) (net, vat float64) {
+	net = gross / (1 + ratePct/100)
+	return net, gross - net
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCalculateCompound(t *testing.T) {
+	tests := []struct {
+		principal, rate float64
+		years           int
+		want            string
+	}{
+		{10000, 5, 20, "📈 10.000 kr at 5% per year grows to 26.533 kr in 20 years (16.533 kr in interest)"},
+		{1000, 2.5, 2, "📈 1.000 kr at 2.5% per year grows to 1.051 kr in 2 years (51 kr in interest)"},
+		{1000, 0, 10, "📈 1.000 kr at 0% per year grows to 1.000 kr in 10 years (0 kr in interest)"},
+		{100, 100, 1, "📈 100 kr at 100% per year grows to 200 kr in 1 years (100 kr in interest)"},
+		{maxAmount, maxCompoundRate, maxCompoundYears, "⚠️ That projection is too large to calculate."},
+	}
+	for _, tt := range tests {
+		if got := calculateCompound("en", tt.principal, tt.rate, tt.years, defaultLocale); got != tt.want {
+			t.Errorf("calculateCompound(%v, %v, %d) = %q, want %q", tt.principal, tt.rate, tt.years, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateAnnuity(t *testing.T) {
+	tests := []struct {
+		principal, rate        float64
+		years                  int
+		wantMonthly, wantTotal float64
+	}{
+		// Zero rate: the principal spread evenly over the months
+		{120000, 0, 10, 1000, 0},
+		{100000, 0, 3, 2777.7778, 0},
+		// P·r / (1 − (1+r)^−n) with r the monthly rate and n the months
+		{3000000, 5, 25, 17537.7012, 2261310.3736},
+		{100000, 6, 10, 1110.2050, 33224.6023},
+	}
+	for _, tt := range tests {
+		monthly, interest := calculateAnnuity(tt.principal, tt.rate, tt.years)
+		if math.Abs(monthly-tt.wantMonthly) > 0.0001 || math.Abs(interest-tt.wantTotal) > 0.01 {
+			t.Errorf("calculateAnnuity(%v, %v, %d) = %.4f, %.4f; want %.4f, %.4f",
+				tt.principal, tt.rate, tt.years, monthly, interest, tt.wantMonthly, tt.wantTotal)
+		}
+	}
+}
+
+func TestSplitBill(t *testing.T) {
+	tests := []struct {
+		total  float64
+		people int
+		want   []float64
+	}{
+		{100, 3, []float64{33.34, 33.33, 33.33}},
+		{100, 4, []float64{25, 25, 25, 25}},
+		{0.05, 3, []float64{0.02, 0.02, 0.01}},
+		{10, 1, []float64{10}},
+		{200, 6, []float64{33.34, 33.34, 33.33, 33.33, 33.33, 33.33}},
+		{0.01, 2, []float64{0.01, 0}},
+		{100, 0, nil},
+		{100, -2, nil},
+	}
+	for _, tt := range tests {
+		got := splitBill(tt.total, tt.people)
+		if len(got) != len(tt.want) {
+			t.Errorf("splitBill(%v, %d) = %v, want %v", tt.total, tt.people, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("splitBill(%v, %d) = %v, want %v", tt.total, tt.people, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitBillSharesSumToTheTotal(t *testing.T) {
+	for _, total := range []float64{100, 99.99, 1234.57, 0.07, 1000000.01} {
+		for people := 1; people <= 13; people++ {
+			shares := splitBill(total, people)
+			var sum int64
+			for _, share := range shares {
+				sum += int64(math.Round(share * 100))
+			}
+			if want := int64(math.Round(total * 100)); sum != want {
+				t.Errorf("splitBill(%v, %d) = %v, which sums to %d øre, want %d", total, people, shares, sum, want)
+			}
+			// Nobody pays more than one øre more than anyone else
+			if high, low := shares[0], shares[len(shares)-1]; math.Round((high-low)*100) > 1 {
+				t.Errorf("splitBill(%v, %d) = %v, shares differ by more than one øre", total, people, shares)
+			}
+		}
+	}
+}
+
+func TestVAT(t *testing.T) {
+	tests := []struct {
+		amount, rate float64
+		vat, other   float64
+	}{
+		{1000, 25, 250, 1250},
+		{1000, 15, 150, 1150},
+		{1000, 12, 120, 1120},
+		{1000, 0, 0, 1000},
+	}
+	for _, tt := range tests {
+		vat, gross := addVAT(tt.amount, tt.rate)
+		if math.Abs(vat-tt.vat) > 1e-9 || math.Abs(gross-tt.other) > 1e-9 {
+			t.Errorf("addVAT(%v, %v) = %v, %v; want %v, %v", tt.amount, tt.rate, vat, gross, tt.vat, tt.other)
+		}
+		// Taking the VAT back out of the gross gives the net amount again
+		net, vat := extractVAT(gross, tt.rate)
+		if math.Abs(net-tt.amount) > 1e-9 || math.Abs(vat-tt.vat) > 1e-9 {
+			t.Errorf("extractVAT(%v, %v) = %v, %v; want %v, %v", gross, tt.rate, net, vat, tt.amount, tt.vat)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// healthStatus is the JSON body of /healthz and /readyz.
+type healthStatus struct {
+	Status  string `json:"status"`
+	Clients int64  `json:"clients"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleHealthz answers liveness probes: the process is up and serving
+// HTTP.
+func (h *Hub) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok", Clients: h.connected.Load()})
+}
+
+// handleReadyz answers readiness probes: the listener is serving and the
+// store and Redis, when enabled, are reachable.
+func (h *Hub) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok", Clients: h.connected.Load()}
+	if !h.ready.Load() {
+		status.Status = "not ready"
+		writeHealth(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	if err := h.store.Ping(); err != nil {
+		status.Status, status.Error = "unavailable", "store: "+err.Error()
+		writeHealth(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	if h.fanout != nil {
+		if err := h.fanout.Ping(); err != nil {
+			status.Status, status.Error = "unavailable", "redis: "+err.Error()
+			writeHealth(w, http.StatusServiceUnavailable, status)
+			return
+		}
+	}
+	writeHealth(w, http.StatusOK, status)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
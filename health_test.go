@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// unreachableStore is a store whose database can't be reached.
+type unreachableStore struct{ nopStore }
+
+func (unreachableStore) Ping() error { return errors.New("database is locked") }
+
+// unreachableFanout is a fanout whose Redis server can't be reached.
+type unreachableFanout struct{}
+
+func (unreachableFanout) Publish(string, outbound) error { return nil }
+func (unreachableFanout) Ping() error                    { return errors.New("connection refused") }
+func (unreachableFanout) Instance() uint64               { return 0 }
+func (unreachableFanout) Close() error                   { return nil }
+
+// probe fetches a health endpoint and decodes its status.
+func probe(t *testing.T, ts *testServer, path string) (int, healthStatus) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s Content-Type = %q", path, ct)
+	}
+	var status healthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, status
+}
+
+func TestHealthzCountsClients(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	if code, status := probe(t, ts, "/healthz"); code != http.StatusOK || status != (healthStatus{Status: "ok"}) {
+		t.Errorf("/healthz = %d %+v, want 200 ok with no clients", code, status)
+	}
+
+	ts.join(t, "/ws/books?username=alice")
+	bob := ts.join(t, "/ws/films?username=bob")
+	waitForClients(t, ts, 2)
+
+	bob.leave()
+	waitForClients(t, ts, 1)
+}
+
+// waitForClients waits until /healthz reports n clients.
+func waitForClients(t *testing.T, ts *testServer, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		_, status := probe(t, ts, "/healthz")
+		if status.Clients == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/healthz reports %d clients, want %d", status.Clients, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		ready  bool
+		store  Store
+		fanout Fanout
+		code   int
+		want   healthStatus
+	}{
+		{"not serving yet", false, nopStore{}, nil, http.StatusServiceUnavailable, healthStatus{Status: "not ready"}},
+		{"serving", true, nopStore{}, nil, http.StatusOK, healthStatus{Status: "ok"}},
+		{"store down", true, unreachableStore{}, nil, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: "store: database is locked"}},
+		{"redis down", true, nopStore{}, unreachableFanout{}, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: "redis: connection refused"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, testConfig(t), func(h *Hub) {
+				h.ready.Store(tt.ready)
+				h.store = tt.store
+				h.fanout = tt.fanout
+			})
+			if code, status := probe(t, ts, "/readyz"); code != tt.code || status != tt.want {
+				t.Errorf("/readyz = %d %+v, want %d %+v", code, status, tt.code, tt.want)
+			}
+			// Liveness doesn't depend on any of it
+			if code, _ := probe(t, ts, "/healthz"); code != http.StatusOK {
+				t.Errorf("/healthz = %d, want 200", code)
+			}
+		})
+	}
+}
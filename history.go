@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// history keeps a room's most recent public messages as encoded frames, so
+// they can be replayed to clients that join later. Once full, the oldest
+// message is dropped first. It is owned by the room's run goroutine and is
+// not safe for concurrent use.
+type history struct {
+	entries []historyEntry // Ring buffer, oldest at next once full
+	next    int
+}
+
+type historyEntry struct {
+	id    uint64 // Message ID, or 0 for messages without one
+	frame []byte
+}
+
+// newHistory returns a history holding up to size messages. A size of 0
+// keeps nothing.
+func newHistory(size int) *history {
+	return &history{entries: make([]historyEntry, 0, size)}
+}
+
+func (h *history) add(id uint64, frame []byte) {
+	entry := historyEntry{id: id, frame: frame}
+	switch {
+	case cap(h.entries) == 0:
+	case len(h.entries) < cap(h.entries):
+		h.entries = append(h.entries, entry)
+	default:
+		h.entries[h.next] = entry
+		h.next = (h.next + 1) % len(h.entries)
+	}
+}
+
+// has reports whether the message with the given ID is still kept.
+func (h *history) has(id uint64) bool {
+	if id == 0 {
+		return false
+	}
+	for _, entry := range h.entries {
+		if entry.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops the message with the given ID, if it is still kept.
+func (h *history) remove(id uint64) {
+	if !h.has(id) {
+		return
+	}
+	// Keep the rest oldest first, so the ring starts over at 0
+	kept := make([]historyEntry, 0, cap(h.entries))
+	for _, entry := range h.entries[h.next:] {
+		if entry.id != id {
+			kept = append(kept, entry)
+		}
+	}
+	for _, entry := range h.entries[:h.next] {
+		if entry.id != id {
+			kept = append(kept, entry)
+		}
+	}
+	h.entries, h.next = kept, 0
+}
+
+// clear drops every kept message.
+func (h *history) clear() {
+	h.entries, h.next = h.entries[:0], 0
+}
+
+// all returns the kept messages, oldest first.
+func (h *history) all() [][]byte {
+	all := make([][]byte, 0, len(h.entries))
+	for _, entry := range h.entries[h.next:] {
+		all = append(all, entry.frame)
+	}
+	for _, entry := range h.entries[:h.next] {
+		all = append(all, entry.frame)
+	}
+	return all
+}
+
+// defaultHistoryCount is how many messages /history shows without a count.
+const defaultHistoryCount = 10
+
+// historyCommand sends sender, and only sender, the room's last public
+// messages in one reply, e.g. "/history 20". The count is capped at what
+// the room keeps, -history-size.
+func (room *Room) historyCommand(sender *Client, args []string) {
+	limit := sender.hub.cfg.historySize
+	usage := translate(room.bot.lang, "history.usage", limit)
+	if limit == 0 {
+		room.bot.sendTo(sender, translate(room.bot.lang, "history.off"))
+		return
+	}
+	count := min(defaultHistoryCount, limit)
+	if len(args) > 1 {
+		room.bot.sendTo(sender, "⚠️ "+usage)
+		return
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			room.bot.sendTo(sender, translate(room.bot.lang, "history.invalid", args[0], usage))
+			return
+		}
+		count = min(n, limit)
+	}
+
+	var lines []string
+	for _, msg := range room.historyMessages() {
+		if msg.Type != msgPreview {
+			lines = append(lines, historyLine(msg))
+		}
+	}
+	if len(lines) == 0 {
+		room.bot.sendTo(sender, translate(room.bot.lang, "history.empty"))
+		return
+	}
+	lines = lines[max(0, len(lines)-count):]
+	room.bot.sendTo(sender, translate(room.bot.lang, "history.result", len(lines), strings.Join(lines, "\n")))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// frames returns h's frames as strings, oldest first.
+func frames(h *history) []string {
+	var all []string
+	for _, frame := range h.all() {
+		all = append(all, string(frame))
+	}
+	return all
+}
+
+func TestHistoryKeepsTheNewest(t *testing.T) {
+	h := newHistory(3)
+	for i := 1; i <= 5; i++ {
+		h.add(uint64(i), []byte(fmt.Sprint(i)))
+	}
+	if got, want := fmt.Sprint(frames(h)), "[3 4 5]"; got != want {
+		t.Errorf("history = %s, want %s", got, want)
+	}
+	if h.has(2) || !h.has(3) || h.has(0) {
+		t.Error("has doesn't match the kept messages")
+	}
+
+	none := newHistory(0)
+	none.add(1, []byte("1"))
+	if len(none.all()) != 0 {
+		t.Error("a history of size 0 kept a message")
+	}
+}
+
+func TestLateJoinerGetsPublicHistoryOnly(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("first")
+	alice.say("@bob a secret")
+	alice.say("/me waves")
+	alice.say("second")
+	bob.expect("the last message", isChat("alice", "second"))
+
+	carol := ts.join(t, "/ws?username=carol")
+	var replayed []string
+	for _, msg := range carol.before {
+		if msg.Type == msgPrivate {
+			t.Errorf("private message replayed: %+v", msg)
+		}
+		if msg.Type == msgChat || msg.Type == msgAction {
+			replayed = append(replayed, msg.Content)
+		}
+	}
+	if got, want := fmt.Sprint(replayed), "[first * alice waves second]"; got != want {
+		t.Errorf("replayed %s, want %s", got, want)
+	}
+}
+
+func TestRoomReplaysHistoryOnJoin(t *testing.T) {
+	room := NewRoom("test")
+	room.history = newHistory(2)
+	go room.run()
+	alice := newOfflineClient("alice")
+	joinRoom(t, room, alice)
+	for _, text := range []string{"one", "two", "three"} {
+		room.deliver(Message{Type: msgChat, From: "alice", Content: text})
+		nextFrame(t, alice)
+	}
+
+	bob := newOfflineClient("bob")
+	joinRoom(t, room, bob)
+	for _, want := range []string{"two", "three"} {
+		if msg := nextFrame(t, bob); msg.Content != want {
+			t.Errorf("replayed %q, want %q", msg.Content, want)
+		}
+	}
+}
+
+// historyReply returns the lines of a /history reply without timestamps,
+// failing the test unless its header counts them.
+func historyReply(t *testing.T, msg Message) []string {
+	t.Helper()
+	header, body, _ := strings.Cut(msg.Content, "\n")
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		_, text, _ := strings.Cut(line, "] ")
+		lines = append(lines, text)
+	}
+	if want := fmt.Sprintf("📜 The last %d messages in this room:", len(lines)); header != want {
+		t.Errorf("header = %q, want %q", header, want)
+	}
+	return lines
+}
+
+func TestHistoryCommand(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.historySize = 15
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("@bob a secret")
+	for i := 1; i <= 20; i++ {
+		alice.say(fmt.Sprintf("m%d", i))
+	}
+	alice.expect("the last message", isChat("alice", "m20"))
+
+	wantLines := func(from, to int) string {
+		var lines []string
+		for i := from; i <= to; i++ {
+			lines = append(lines, fmt.Sprintf("alice: m%d", i))
+		}
+		return fmt.Sprint(lines)
+	}
+	for _, tt := range []struct{ input, want string }{
+		{"/history", wantLines(11, 20)},
+		{"/history 3", wantLines(18, 20)},
+		{"/history 1", wantLines(20, 20)},
+		// Capped at the 15 messages the room keeps
+		{"/history 100", wantLines(6, 20)},
+	} {
+		alice.say(tt.input)
+		reply := alice.expectContent(msgCommand, "📜 The last")
+		if got := fmt.Sprint(historyReply(t, reply)); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+
+	// Only the asker sees the replies
+	alice.say("done")
+	bob.expectNoneBefore("alice's history", func(msg Message) bool {
+		return strings.HasPrefix(msg.Content, "📜")
+	}, isChat("alice", "done"))
+}
+
+func TestHistoryCommandLeavesOutPrivateMessages(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+
+	alice.say("first")
+	alice.say("@bob a secret")
+	alice.say("/me waves")
+	alice.say("/history")
+	reply := alice.expectContent(msgCommand, "📜 The last")
+	if got, want := fmt.Sprint(historyReply(t, reply)), "[alice: first * alice waves]"; got != want {
+		t.Errorf("/history = %s, want %s", got, want)
+	}
+}
+
+func TestHistoryCommandErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	for _, tt := range []struct{ input, want string }{
+		{"/history 0", `⚠️ Invalid count "0". Usage: /history [count], with a count from 1 to 50`},
+		{"/history ten", `⚠️ Invalid count "ten". Usage: /history [count]`},
+		{"/history 1 2", "⚠️ Usage: /history [count]"},
+	} {
+		alice.say(tt.input)
+		alice.expectContent(msgCommand, tt.want)
+	}
+
+	cfg := testConfig(t)
+	cfg.historySize = 0
+	ts = newTestServer(t, cfg)
+	alice = ts.join(t, "/ws?username=alice")
+	alice.say("/history")
+	alice.expectContent(msgCommand, "⚠️ This server keeps no history.")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultRoom is the room used by clients connecting to the bare /ws path.
+const defaultRoom = "general"
+
+// Hub owns every active chat room. Rooms are created lazily on first join
+// and dropped again once their last client has left.
+type Hub struct {
+	rooms  map[string]*Room
+	mutex  sync.Mutex
+	now    func() time.Time // Clock used to timestamp messages; replaceable in tests
+	rates  RateProvider     // Exchange rates shared by every room
+	quotes QuoteProvider    // Stock quotes shared by every room
+	coins  CryptoProvider   // Coin prices shared by every room
+	store  Store            // Persists public messages; nopStore unless -db is set
+	fanout Fanout           // Shares messages with other instances; nil unless -redis is set
+	filter *profanityFilter // Masks listed words in chat; nil unless -profanity-list is set
+	files  *fileStore       // Shared files; nil unless -max-file-size is positive
+	cfg    config
+	conns  sync.WaitGroup // Open WebSocket connections
+	ready  atomic.Bool    // Set while the listener is serving; see /readyz
+
+	connected atomic.Int64 // Clients in a room; read by the health probes without taking the mutex
+
+	unfurler Unfurler // Previews links in chat; nil unless -unfurl is set
+	webhook  *webhook // Mirrors public messages; nil unless -webhook is set
+
+	afterFunc func(time.Duration, func()) timer // Runs a function after a delay by the clock now reads; replaceable in tests
+
+	reminders reminders // Reminders waiting to be sent, for every room
+	started   time.Time // When the hub was created; /stats reports the uptime since
+
+	motd atomic.Pointer[string] // Message of the day sent to joining clients; see -motd and -motd-file
+
+	exports    *exportStore  // Room histories waiting to be downloaded after /export
+	sessions   sessionStore  // Disconnected clients that may resume
+	identities atomic.Uint64 // The last client identity handed out
+
+	ipConns map[string]int  // Open connections per client IP; guarded by mutex
+	banned  map[string]bool // IPs whose connections are refused; guarded by mutex
+	seats   map[string]int  // Connections counted against each room's capacity; guarded by mutex
+
+	bannedNames map[string]bool // Usernames that may not join; guarded by mutex
+
+	sealed *nonceCache[sealedID] // Sealed messages already relayed; see receiveSealed
+
+	upgrader websocket.Upgrader
+}
+
+// timer is a call scheduled by Hub.afterFunc. Stop cancels it, reporting
+// whether it hadn't run yet.
+type timer interface {
+	Stop() bool
+}
+
+func NewHub(cfg config) *Hub {
+	h := &Hub{
+		rooms:   make(map[string]*Room),
+		now:     time.Now,
+		started: time.Now(),
+		rates:   newHTTPRateProvider(defaultRatesURL),
+		quotes:  newCachedQuoteProvider(newHTTPQuoteProvider(defaultQuotesURL), quoteCacheTTL),
+		coins:   newHTTPCryptoProvider(defaultCoinsURL),
+		store:   nopStore{},
+		cfg:     cfg,
+		ipConns: make(map[string]int),
+		banned:  make(map[string]bool),
+		seats:   make(map[string]int),
+		exports: newExportStore(exportTTL),
+
+		bannedNames: make(map[string]bool),
+		sealed:      newNonceCache[sealedID](sealedNonceCacheSize),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  cfg.readBuffer,
+			WriteBufferSize: cfg.writeBuffer,
+			CheckOrigin:     checkOrigin(cfg.allowedOrigins),
+			// Only used when the client offers it too; others get
+			// uncompressed frames as before
+			EnableCompression: cfg.compression,
+		},
+	}
+	h.afterFunc = func(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+	if cfg.webhookURL != "" {
+		h.webhook = newWebhook(cfg.webhookURL)
+	}
+	if cfg.unfurl {
+		h.unfurler = newHTTPUnfurler()
+	}
+	if cfg.maxFileSize > 0 {
+		h.files = newFileStore(cfg.maxFileSize, cfg.maxUploadSize, cfg.fileTTL)
+	}
+	for _, ip := range cfg.bannedIPs {
+		h.banned[ip] = true
+	}
+	h.motd.Store(&cfg.motd)
+	return h
+}
+
+// checkOrigin returns an origin check that accepts only the allowed origins.
+// An empty list allows every origin, which is convenient for local
+// development. Requests without an Origin header don't come from a browser
+// and so can't be cross-site; they are always allowed. A rejected upgrade
+// gets a 403 from the upgrader.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return func(r *http.Request) bool { return true }
+	}
+
+	set := make(map[string]bool, len(allowed))
+	for _, origin := range allowed {
+		set[normalizeOrigin(origin)] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || set[normalizeOrigin(origin)] {
+			return true
+		}
+		warnf("Rejecting upgrade from origin %q", origin)
+		return false
+	}
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+// join adds the client to the named room, creating and starting the room
+// if needed, and renames the client if its username is already taken there.
+// A client resuming a session s gets the messages it missed replayed.
+// Joins and leaves are serialized by the hub lock, so a room can never stop
+// between being looked up and receiving its new client.
+func (h *Hub) join(name string, client *Client, s *session) *Room {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	room, ok := h.rooms[name]
+	if !ok {
+		infof("Creating room: %s", name)
+		room = NewRoom(name)
+		room.now = h.now
+		room.afterFunc = h.afterFunc
+		room.rates = h.rates
+		room.quotes = h.quotes
+		room.coins = h.coins
+		room.bot.savingsMin, room.bot.savingsMax = h.cfg.savingsMin, h.cfg.savingsMax
+		room.bot.name = h.cfg.botName
+		room.bot.lang = h.cfg.lang
+		room.store = h.store
+		room.fanout = h.fanout
+		if h.fanout != nil {
+			room.nextID.Store(h.fanout.Instance() << messageIDBits)
+		}
+		room.filter = h.filter
+		room.files = h.files
+		room.unfurler = h.unfurler
+		room.webhook = h.webhook
+		room.blockLinks = h.cfg.blockLinks
+		room.history = h.loadHistory(name)
+		h.rooms[name] = room
+		go room.run()
+	}
+
+	joined := make(chan struct{})
+	room.register <- registration{client: client, joined: joined, resume: s}
+	<-joined
+
+	client.room = room
+	return room
+}
+
+// loadHistory returns a new room history seeded with the room's latest
+// messages from the store.
+func (h *Hub) loadHistory(name string) *history {
+	hist := newHistory(h.cfg.historySize)
+	if h.cfg.historySize == 0 {
+		return hist
+	}
+
+	messages, err := h.store.Recent(name, h.cfg.historySize)
+	if err != nil {
+		errorf("Loading history for room %s: %v", name, err)
+		return hist
+	}
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			errorf("Marshal error: %v", err)
+			continue
+		}
+		hist.add(0, data) // IDs don't survive restarts
+	}
+	return hist
+}
+
+// deliverRemote hands a frame published by another instance to the named
+// room's local clients. Rooms with no local clients don't exist here, so
+// there is no one to deliver to.
+func (h *Hub) deliverRemote(roomName string, out outbound) {
+	h.mutex.Lock()
+	room := h.rooms[roomName]
+	h.mutex.Unlock()
+	if room == nil {
+		return
+	}
+
+	select {
+	case room.broadcast <- out:
+	case <-room.done:
+	}
+}
+
+// leave removes the client from its room and drops the room when it
+// becomes empty. Unless the client can't resume, its session is kept for
+// sessionTTL.
+func (h *Hub) leave(client *Client) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	room := client.room
+	if room == nil {
+		return
+	}
+
+	s := client.detach(room, h.now())
+	if s != nil {
+		h.sessions.put(s, h.now())
+	}
+	empty := make(chan bool, 1)
+	room.unregister <- departure{client: client, empty: empty, detach: s}
+	if <-empty && h.rooms[room.name] == room {
+		infof("Removing empty room: %s", room.name)
+		delete(h.rooms, room.name)
+	}
+}
+
+// acquireSeat counts a new connection to the named room, unless the room is
+// already at capacity. Seats are taken before the connection joins, under
+// the hub lock, so concurrent joins can't overfill a room.
+func (h *Hub) acquireSeat(name string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.cfg.maxRoomSize > 0 && h.seats[name] >= h.cfg.maxRoomSize {
+		return false
+	}
+	h.seats[name]++
+	return true
+}
+
+// releaseSeat uncounts a connection to the named room once it has closed.
+func (h *Hub) releaseSeat(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.seats[name]--; h.seats[name] <= 0 {
+		delete(h.seats, name)
+	}
+}
+
+// roomCount returns the number of active rooms.
+func (h *Hub) roomCount() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.rooms)
+}
+
+// roomList returns the active rooms. The hub lock is only held while
+// listing them, so callers may then send to each without holding up joins.
+func (h *Hub) roomList() []*Room {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// clients returns every client in every room.
+func (h *Hub) clients() []*Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var clients []*Client
+	for _, room := range h.rooms {
+		clients = append(clients, room.snapshot()...)
+	}
+	return clients
+}
+
+// postTips has each room's finance bot post a savings tip on every tick
+// until ctx is done. Rooms without clients are skipped.
+func (h *Hub) postTips(ctx context.Context, ticks <-chan time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			for _, room := range h.roomList() {
+				if len(room.snapshot()) > 0 {
+					room.bot.SendMessage(room.bot.savingCommand(nil, defaultLocale))
+				}
+			}
+		}
+	}
+}
+
+// shutdown tells every client the server is going away and sends it a close
+// frame, then waits for the connections to finish. Connections still open
+// when ctx expires are closed forcibly.
+func (h *Hub) shutdown(ctx context.Context) {
+	h.reminders.stop()
+	for _, client := range h.clients() {
+		client.send(Message{Type: msgSystem, Content: "Server shutting down"})
+		client.closeWith(websocket.CloseGoingAway, "server shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		warnf("Shutdown timed out, closing remaining connections")
+		for _, client := range h.clients() {
+			client.conn.Close()
+		}
+		<-done
+	}
+}
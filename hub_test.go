@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomsAreIsolated(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws/books?username=alice")
+	bob := ts.join(t, "/ws/films?username=bob")
+	carol := ts.join(t, "/ws/books?username=carol")
+
+	alice.say("anyone read Dune?")
+	carol.expect("alice's message", isChat("alice", "anyone read Dune?"))
+	bob.say("anyone seen Dune?")
+	bob.expect("bob's own message", isChat("bob", "anyone seen Dune?"))
+
+	bob.expectQuiet("a message from another room", func(msg Message) bool {
+		return msg.From == "alice" || msg.Content == "carol joined the chat"
+	}, 200*time.Millisecond)
+	alice.expectQuiet("a message from another room", func(msg Message) bool {
+		return msg.From == "bob"
+	}, 200*time.Millisecond)
+}
+
+func TestBareWSPathJoinsDefaultRoom(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws/"+defaultRoom+"?username=bob")
+
+	alice.say("hi")
+	bob.expect("alice's message", isChat("alice", "hi"))
+}
+
+func TestRoomsAreRemovedWhenEmpty(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws/books?username=alice")
+	if got := ts.hub.roomCount(); got != 1 {
+		t.Fatalf("%d rooms after joining, want 1", got)
+	}
+
+	alice.leave()
+	deadline := time.Now().Add(testTimeout)
+	for ts.hub.roomCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("room still open after its last client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFullRoomRefusesTheNextJoin(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.maxRoomSize = 2
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+
+	carol, _, err := ts.connect(t, "/ws?username=carol", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = carol.expectClosed()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "room is full" {
+		t.Fatalf("carol's connection ended with %v, want a \"room is full\" close", err)
+	}
+	alice.say("done")
+	alice.expectNoneBefore("carol joining", func(msg Message) bool { return msg.Content == "carol joined the chat" }, isChat("alice", "done"))
+
+	// The cap is per room, and a seat frees up when someone leaves
+	ts.join(t, "/ws/other?username=carol")
+	alice.leave()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		ts.hub.mutex.Lock()
+		seats := ts.hub.seats[defaultRoom]
+		ts.hub.mutex.Unlock()
+		if seats < 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("alice's seat was never released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ts.join(t, "/ws?username=dave")
+}
+
+func TestConcurrentJoinsDontOverfillARoom(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.maxRoomSize = 10
+	h := NewHub(cfg)
+
+	var seated atomic.Int64
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.acquireSeat(defaultRoom) {
+				seated.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := seated.Load(); n != 10 {
+		t.Errorf("%d joins seated in a room of 10", n)
+	}
+	h.releaseSeat(defaultRoom)
+	if !h.acquireSeat(defaultRoom) {
+		t.Error("no seat after one was released")
+	}
+	if !h.acquireSeat("other") {
+		t.Error("a full room took the seats of another")
+	}
+}
+
+func TestShutdownNotifiesAndClosesClients(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws/books?username=alice")
+	bob := ts.join(t, "/ws/films?username=bob")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ts.hub.shutdown(ctx)
+		close(done)
+	}()
+
+	for _, c := range []*testClient{alice, bob} {
+		c.expectContent(msgSystem, "Server shutting down")
+		if err := c.expectClosed(); !isCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("%s: connection ended with %v, want a going away close", c.name, err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("shutdown didn't return after every client left")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{nil, "https://evil.example", true},
+		{nil, "", true},
+		{[]string{"https://chat.example"}, "https://chat.example", true},
+		{[]string{"https://chat.example"}, "HTTPS://Chat.Example/", true},
+		{[]string{" https://chat.example/ "}, "https://chat.example", true},
+		{[]string{"https://chat.example"}, "", true},
+		{[]string{"https://chat.example"}, "https://evil.example", false},
+		{[]string{"https://chat.example"}, "http://chat.example", false},
+		{[]string{"https://chat.example"}, "https://chat.example.evil.example", false},
+		{[]string{"https://a.example", "https://b.example"}, "https://b.example", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkOrigin(tt.allowed)(r); got != tt.want {
+			t.Errorf("checkOrigin(%q) for %q = %v, want %v", tt.allowed, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestDisallowedOriginIsRefused(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.allowedOrigins = []string{"https://chat.example"}
+	ts := newTestServer(t, cfg)
+
+	allowed := http.Header{"Origin": {"https://chat.example"}}
+	if _, _, err := ts.connect(t, "/ws?username=alice", allowed); err != nil {
+		t.Errorf("allowed origin: %v", err)
+	}
+
+	disallowed := http.Header{"Origin": {"https://evil.example"}}
+	_, resp, err := ts.connect(t, "/ws?username=mallory", disallowed)
+	if err == nil {
+		t.Fatal("disallowed origin connected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("disallowed origin got %v, want 403", resp)
+	}
+}
+
+func TestPostTips(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws/books?username=alice")
+	bob := ts.join(t, "/ws/films?username=bob")
+
+	ticks := make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ts.hub.postTips(ctx, ticks)
+		close(done)
+	}()
+
+	for range 2 {
+		ticks <- time.Now()
+		for _, c := range []*testClient{alice, bob} {
+			c.expectContent(msgCommand, "💰 Financial Tip:")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("postTips still running after its context was cancelled")
+	}
+}
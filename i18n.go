@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultLang is the language the finance bot speaks unless -lang says
+// otherwise, and the one used for any message missing from a language.
+const defaultLang = "en"
+
+// catalog holds the finance bot's messages as fmt format strings, by
+// language and then by key. Command descriptions in /help are keyed
+// "help.<command>"; English ones come from the command registry instead.
+var catalog = map[string]map[string]string{
+	"en": {
+		"savings.tip":     "💰 Financial Tip: If you save %s kr per month, you'll have %s kr in 10 years!",
+		"saving.usage":    "⚠️ %v. Usage: /saving [monthly amount], e.g. /saving 5000",
+		"amount.invalid":  "invalid amount %q: must be a positive whole number",
+		"amount.tooLarge": "amount %q is too large (max %s)",
+		"help.header":     "Commands %s can help with:",
+		"command.unknown": "Unknown command. Type /help to see available commands.",
+		"command.suggest": "Unknown command /%s. Did you mean /%s? Type /help to see available commands.",
+
+		"compound.usage":      "Usage: /compound <principal> <rate%%> <years>, e.g. /compound 10000 5 20",
+		"mortgage.usage":      "Usage: /mortgage <principal> <rate%%> <years>, e.g. /mortgage 3000000 5 25",
+		"split.usage":         "Usage: /split <total> <people> [tip <pct>], e.g. /split 1200 4 tip 10",
+		"vat.usage":           "Usage: /vat <amount> [rate%%] [-gross], e.g. /vat 1000 or /vat 1250 25%% -gross",
+		"convert.usage":       "Usage: /convert <amount> <from> <to>, e.g. /convert 100 USD NOK",
+		"stock.usage":         "Usage: /stock <symbol>, e.g. /stock AAPL or /stock EQNR.OL",
+		"crypto.usage":        "Usage: /crypto <coin> [currency], e.g. /crypto BTC NOK",
+		"inflation.usage":     "Usage: /inflation <amount> <fromYear> <toYear>, e.g. /inflation 1000 2010 2024",
+		"roll.usage":          "Usage: /roll [count]d<sides>, e.g. /roll 2d6",
+		"time.usage":          "Usage: /time [zone], e.g. /time Europe/Oslo or /time UTC",
+		"principal.invalid":   "⚠️ Invalid principal %q. %s",
+		"rate.invalid":        "⚠️ Invalid rate %q: must be between 0 and %d%%. %s",
+		"years.invalid":       "⚠️ Invalid years %q: must be between 1 and %d. %s",
+		"total.invalid":       "⚠️ Invalid total %q. %s",
+		"people.invalid":      "⚠️ Invalid number of people %q: must be between 1 and %d. %s",
+		"tip.invalid":         "⚠️ Invalid tip %q: must be between 0 and %d%%. %s",
+		"amount.invalidUsage": "⚠️ Invalid amount %q. %s",
+		"year.invalid":        "⚠️ Invalid year %q. %s",
+		"currency.invalid":    "⚠️ Invalid currency %q: use a three-letter code like NOK. %s",
+		"symbol.invalid":      "⚠️ Invalid symbol %q. %s",
+		"coin.invalid":        "⚠️ Invalid coin %q. %s",
+		"zone.unknown":        "⚠️ Unknown time zone %q. %s",
+		"dice.invalid":        "invalid dice %q",
+		"dice.count":          "invalid dice %q: the count must be between 1 and %d",
+		"dice.sides":          "invalid dice %q: dice must have between 2 and %d sides",
+		"rate.unknown":        "⚠️ I don't have a rate for %s to %s.",
+		"rates.unavailable":   "⚠️ Exchange rates are unavailable right now. Please try again later.",
+		"quote.unknown":       "⚠️ I don't have a quote for %s.",
+		"quotes.timeout":      "⚠️ The stock quote service didn't answer in time. Please try again later.",
+		"quotes.unavailable":  "⚠️ Stock quotes are unavailable right now. Please try again later.",
+		"coin.unknown":        "⚠️ I don't know the coin %s.",
+		"coin.noPrice":        "⚠️ I don't have a %s price in %s.",
+		"coins.rateLimited":   "⚠️ Too many price lookups right now. Please try again in a minute.",
+		"coins.unavailable":   "⚠️ Coin prices are unavailable right now. Please try again later.",
+		"cpi.range":           "⚠️ I only have prices for %d to %d.",
+		"time.server":         "server time",
+
+		"compound.result":     "📈 %s kr at %s%% per year grows to %s kr in %d years (%s kr in interest)",
+		"compound.tooLarge":   "⚠️ That projection is too large to calculate.",
+		"mortgage.result":     "🏠 A %s kr loan at %s%% over %d years costs %s kr per month (%s kr in interest)",
+		"split.result":        "🧾 %s kr%s split %d ways: %s",
+		"split.tip":           " (including a %s%% tip)",
+		"list.and":            " and ",
+		"vat.net":             "🧾 %s kr + %s%% VAT (%s kr) = %s kr",
+		"vat.gross":           "🧾 %s kr including %s%% VAT is %s kr net + %s kr VAT",
+		"convert.result":      "💱 %s %s = %s %s",
+		"stock.result":        "📊 %s: %s %s",
+		"crypto.result":       "🪙 %s: %s %s (%s%% 24h)",
+		"inflation.result":    "📉 %s kr in %d is worth about %s kr in %d (%s%%)",
+		"roll.one":            "🎲 %s rolled %dd%d: %d",
+		"roll.many":           "🎲 %s rolled %dd%d: %s = %d",
+		"time.result":         "🕒 %s (%s)",
+		"time.layout":         "Monday 2 January 2006, 15:04 MST",
+		"who.result":          "👥 %d online: %s",
+		"who.away":            "%s (away)",
+		"who.awayWith":        "%s (away: %s)",
+		"stats.result":        "📈 Online here: %s · Open rooms: %s · Messages sent: %s · Uptime: %v",
+		"goal.usage":          "Usage: /savinggoal set <target> | add <amount> | reset, or /savinggoal to see your progress",
+		"goal.progress":       "🎯 %s has saved %s of %s kr (%d%%), %s kr to go",
+		"goal.reached":        "🎉 %s has saved %s of %s kr (%d%%) and reached the goal!",
+		"goal.none":           "🎯 %s has no savings goal. Set one with /savinggoal set <target>",
+		"goal.noneToAdd":      "⚠️ %s has no savings goal. Set one first with /savinggoal set <target>",
+		"goal.noneToReset":    "🎯 %s has no savings goal to reset.",
+		"goal.reset":          "🎯 %s's savings goal has been reset.",
+		"goal.tooMuch":        "⚠️ %s can't put more than %s kr toward a goal.",
+		"dm.usage":            "Usage: /dm <username>[,<username>...] <message>, e.g. /dm alice,bob see you at 5",
+		"private.tooMany":     "⚠️ Private messages can go to at most %d users at once.",
+		"private.usage":       "⚠️ Usage: @<username>[,<username>...] <message>, e.g. @alice see you at 5",
+		"user.notFound":       "⚠️ User %s not found",
+		"users.notFound":      "⚠️ Users %s not found",
+		"private.undelivered": "⚠️ Your message could not be delivered to %s.",
+		"reply.unknown":       "The message you replied to is too old or doesn't exist, so your reply was not delivered.",
+		"ephemeral.usage":     "Usage: /ephemeral <seconds> <message>, e.g. /ephemeral 30 the door code is 1234",
+		"ephemeral.invalid":   "⚠️ Invalid time %q: must be between 1 and %d seconds. %s",
+		"history.usage":       "Usage: /history [count], with a count from 1 to %d",
+		"history.invalid":     "⚠️ Invalid count %q. %s",
+		"history.off":         "⚠️ This server keeps no history.",
+		"history.empty":       "📜 There is no history in this room yet.",
+		"history.result":      "📜 The last %d messages in this room:\n%s",
+		"reminder.usage":      "Usage: /reminder <delay> <message>, e.g. /reminder 10m check the oven",
+		"reminder.invalid":    "⚠️ Invalid delay %q: use a duration like 90s, 10m or 2h30m, up to %v. %s",
+		"reminder.tooMany":    "⚠️ You already have %d reminders waiting.",
+		"reminder.set":        "⏰ I'll remind you in %v.",
+		"reminder.due":        "⏰ Reminder: %s",
+		"poll.started":        "%s\nStarted by %s. Vote with /vote <number>.",
+		"poll.closed":         "Poll closed.\n%s",
+		"poll.none":           "There is no open poll. Start one with /poll.",
+		"poll.vote":           "\n%d. %s: %d vote",
+		"poll.votes":          "\n%d. %s: %d votes",
+
+		"back.notAway":             "You aren't away.",
+		"away.set":                 "%s is away",
+		"away.setWith":             "%s is away: %s",
+		"away.back":                "%s is back",
+		"me.usage":                 "Usage: /me <action>, e.g. /me waves",
+		"nick.usage":               "Usage: /nick <newname>, e.g. /nick alice",
+		"nick.same":                "You are already known as %s.",
+		"nick.invalid":             "Can't change your name: %v",
+		"nick.banned":              "Can't change your name: the name %s is banned",
+		"mute.usage":               "Usage: /mute <username>, e.g. /mute bob",
+		"mute.self":                "You can't mute yourself.",
+		"mute.done":                "Muted %s. Use /unmute %s to undo.",
+		"unmute.usage":             "Usage: /unmute <username>, e.g. /unmute bob",
+		"unmute.notMuted":          "%s isn't muted.",
+		"unmute.done":              "Unmuted %s.",
+		"block.usage":              "Usage: /block <username>, e.g. /block bob",
+		"block.self":               "You can't block yourself.",
+		"block.done":               "Blocked private messages from %s. Use /unblock %s to undo.",
+		"unblock.usage":            "Usage: /unblock <username>, e.g. /unblock bob",
+		"unblock.notBlocked":       "%s isn't blocked.",
+		"unblock.done":             "Unblocked %s.",
+		"mod.only":                 "Only moderators can use /%s.",
+		"mod.usage":                "Usage: /%s <username>",
+		"mod.self":                 "You can't /%s yourself.",
+		"mod.protected":            "%s is a moderator and can't be removed.",
+		"kick.you":                 "You were kicked by %s.",
+		"kick.done":                "%s was kicked by %s",
+		"ban.you":                  "You were banned by %s.",
+		"ban.done":                 "%s was banned by %s",
+		"clear.usage":              "Usage: /clear [all]",
+		"clear.failed":             "The saved messages could not be deleted.",
+		"clear.done":               "History cleared by %s",
+		"export.empty":             "There is no history in this room to export.",
+		"export.busy":              "The server is busy with other exports. Please try again later.",
+		"export.failed":            "The history could not be exported.",
+		"export.ready":             "📦 Download this room's last %d messages within %v: /export/%s (JSON) or /export/%s?format=text",
+		"files.disabled":           "File sharing is disabled on this server.",
+		"files.type":               "Files of type %s can't be shared.",
+		"files.tooLarge":           "Files sent in one frame can be at most %s bytes.",
+		"files.full":               "The server can't take more files right now. Please try again later.",
+		"files.busy":               "The server is busy with other uploads. Please try again later.",
+		"files.failed":             "Your file could not be shared.",
+		"private.notEncrypted":     "A private message to you could not be encrypted and was not delivered.",
+		"private.notEncryptedFrom": "A private message from %s could not be encrypted for you and was not delivered.",
+		"private.ownCopy":          "Your private message was delivered, but your own copy could not be encrypted.",
+		"private.replay":           "That private message was already delivered.",
+		"private.unverified":       "Your private message could not be verified and was not delivered.",
+		"sealed.oneUser":           "End-to-end private messages go to one user at a time.",
+		"sealed.invalid":           "Your private message is not a valid ciphertext and was not delivered.",
+	},
+	"no": {
+		"savings.tip":     "💰 Sparetips: Sparer du %s kr i måneden, har du %s kr om 10 år!",
+		"saving.usage":    "⚠️ %v. Bruk: /saving [månedlig beløp], f.eks. /saving 5000",
+		"amount.invalid":  "ugyldig beløp %q: må være et positivt heltall",
+		"amount.tooLarge": "beløpet %q er for stort (maks %s)",
+		"help.header":     "Kommandoer %s kan hjelpe med:",
+		"command.unknown": "Ukjent kommando. Skriv /help for å se tilgjengelige kommandoer.",
+		"command.suggest": "Ukjent kommando /%s. Mente du /%s? Skriv /help for å se tilgjengelige kommandoer.",
+
+		"compound.usage":      "Bruk: /compound <beløp> <rente%%> <år>, f.eks. /compound 10000 5 20",
+		"mortgage.usage":      "Bruk: /mortgage <lånebeløp> <rente%%> <år>, f.eks. /mortgage 3000000 5 25",
+		"split.usage":         "Bruk: /split <totalt> <personer> [tip <prosent>], f.eks. /split 1200 4 tip 10",
+		"vat.usage":           "Bruk: /vat <beløp> [sats%%] [-gross], f.eks. /vat 1000 eller /vat 1250 25%% -gross",
+		"convert.usage":       "Bruk: /convert <beløp> <fra> <til>, f.eks. /convert 100 USD NOK",
+		"stock.usage":         "Bruk: /stock <ticker>, f.eks. /stock AAPL eller /stock EQNR.OL",
+		"crypto.usage":        "Bruk: /crypto <mynt> [valuta], f.eks. /crypto BTC NOK",
+		"inflation.usage":     "Bruk: /inflation <beløp> <fraÅr> <tilÅr>, f.eks. /inflation 1000 2010 2024",
+		"roll.usage":          "Bruk: /roll [antall]d<sider>, f.eks. /roll 2d6",
+		"time.usage":          "Bruk: /time [sone], f.eks. /time Europe/Oslo eller /time UTC",
+		"principal.invalid":   "⚠️ Ugyldig beløp %q. %s",
+		"rate.invalid":        "⚠️ Ugyldig rente %q: må være mellom 0 og %d%%. %s",
+		"years.invalid":       "⚠️ Ugyldig antall år %q: må være mellom 1 og %d. %s",
+		"total.invalid":       "⚠️ Ugyldig totalbeløp %q. %s",
+		"people.invalid":      "⚠️ Ugyldig antall personer %q: må være mellom 1 og %d. %s",
+		"tip.invalid":         "⚠️ Ugyldig tips %q: må være mellom 0 og %d%%. %s",
+		"amount.invalidUsage": "⚠️ Ugyldig beløp %q. %s",
+		"year.invalid":        "⚠️ Ugyldig år %q. %s",
+		"currency.invalid":    "⚠️ Ugyldig valuta %q: bruk en kode på tre bokstaver, som NOK. %s",
+		"symbol.invalid":      "⚠️ Ugyldig ticker %q. %s",
+		"coin.invalid":        "⚠️ Ugyldig mynt %q. %s",
+		"zone.unknown":        "⚠️ Ukjent tidssone %q. %s",
+		"dice.invalid":        "ugyldige terninger %q",
+		"dice.count":          "ugyldige terninger %q: antallet må være mellom 1 og %d",
+		"dice.sides":          "ugyldige terninger %q: terningene må ha mellom 2 og %d sider",
+		"rate.unknown":        "⚠️ Jeg har ingen kurs fra %s til %s.",
+		"rates.unavailable":   "⚠️ Valutakursene er ikke tilgjengelige akkurat nå. Prøv igjen senere.",
+		"quote.unknown":       "⚠️ Jeg har ingen kurs for %s.",
+		"quotes.timeout":      "⚠️ Aksjekurstjenesten svarte ikke i tide. Prøv igjen senere.",
+		"quotes.unavailable":  "⚠️ Aksjekursene er ikke tilgjengelige akkurat nå. Prøv igjen senere.",
+		"coin.unknown":        "⚠️ Jeg kjenner ikke mynten %s.",
+		"coin.noPrice":        "⚠️ Jeg har ingen %s-pris i %s.",
+		"coins.rateLimited":   "⚠️ For mange prisoppslag akkurat nå. Prøv igjen om et minutt.",
+		"coins.unavailable":   "⚠️ Kryptokursene er ikke tilgjengelige akkurat nå. Prøv igjen senere.",
+		"cpi.range":           "⚠️ Jeg har bare priser fra %d til %d.",
+		"time.server":         "servertid",
+
+		"compound.result":     "📈 %s kr med %s%% rente i året vokser til %s kr på %d år (%s kr i renter)",
+		"compound.tooLarge":   "⚠️ Den fremskrivningen er for stor til å regne ut.",
+		"mortgage.result":     "🏠 Et lån på %s kr med %s%% rente over %d år koster %s kr i måneden (%s kr i renter)",
+		"split.result":        "🧾 %s kr%s delt på %d: %s",
+		"split.tip":           " (inkludert %s%% tips)",
+		"list.and":            " og ",
+		"vat.net":             "🧾 %s kr + %s%% mva. (%s kr) = %s kr",
+		"vat.gross":           "🧾 %s kr inkludert %s%% mva. er %s kr netto + %s kr mva.",
+		"convert.result":      "💱 %s %s = %s %s",
+		"stock.result":        "📊 %s: %s %s",
+		"crypto.result":       "🪙 %s: %s %s (%s%% siste døgn)",
+		"inflation.result":    "📉 %s kr i %d er verdt omtrent %s kr i %d (%s%%)",
+		"roll.one":            "🎲 %s kastet %dd%d: %d",
+		"roll.many":           "🎲 %s kastet %dd%d: %s = %d",
+		"time.result":         "🕒 %s (%s)",
+		"time.layout":         "02.01.2006 kl. 15:04 MST",
+		"who.result":          "👥 %d pålogget: %s",
+		"who.away":            "%s (borte)",
+		"who.awayWith":        "%s (borte: %s)",
+		"stats.result":        "📈 Pålogget her: %s · Åpne rom: %s · Sendte meldinger: %s · Oppetid: %v",
+		"goal.usage":          "Bruk: /savinggoal set <mål> | add <beløp> | reset, eller /savinggoal for å se hvor langt du har kommet",
+		"goal.progress":       "🎯 %s har spart %s av %s kr (%d%%), %s kr igjen",
+		"goal.reached":        "🎉 %s har spart %s av %s kr (%d%%) og nådd målet!",
+		"goal.none":           "🎯 %s har ikke noe sparemål. Sett et med /savinggoal set <mål>",
+		"goal.noneToAdd":      "⚠️ %s har ikke noe sparemål. Sett et først med /savinggoal set <mål>",
+		"goal.noneToReset":    "🎯 %s har ikke noe sparemål å nullstille.",
+		"goal.reset":          "🎯 Sparemålet til %s er nullstilt.",
+		"goal.tooMuch":        "⚠️ %s kan ikke sette av mer enn %s kr til et mål.",
+		"dm.usage":            "Bruk: /dm <brukernavn>[,<brukernavn>...] <melding>, f.eks. /dm alice,bob vi ses klokken 5",
+		"private.tooMany":     "⚠️ Private meldinger kan gå til høyst %d brukere om gangen.",
+		"private.usage":       "⚠️ Bruk: @<brukernavn>[,<brukernavn>...] <melding>, f.eks. @alice vi ses klokken 5",
+		"user.notFound":       "⚠️ Fant ikke brukeren %s",
+		"users.notFound":      "⚠️ Fant ikke brukerne %s",
+		"private.undelivered": "⚠️ Meldingen din kunne ikke leveres til %s.",
+		"reply.unknown":       "Meldingen du svarte på er for gammel eller finnes ikke, så svaret ditt ble ikke levert.",
+		"ephemeral.usage":     "Bruk: /ephemeral <sekunder> <melding>, f.eks. /ephemeral 30 dørkoden er 1234",
+		"ephemeral.invalid":   "⚠️ Ugyldig tid %q: må være mellom 1 og %d sekunder. %s",
+		"history.usage":       "Bruk: /history [antall], med et antall fra 1 til %d",
+		"history.invalid":     "⚠️ Ugyldig antall %q. %s",
+		"history.off":         "⚠️ Denne serveren tar ikke vare på historikk.",
+		"history.empty":       "📜 Det er ingen historikk i dette rommet ennå.",
+		"history.result":      "📜 De siste %d meldingene i dette rommet:\n%s",
+		"reminder.usage":      "Bruk: /reminder <ventetid> <melding>, f.eks. /reminder 10m sjekk ovnen",
+		"reminder.invalid":    "⚠️ Ugyldig ventetid %q: bruk en varighet som 90s, 10m eller 2h30m, opptil %v. %s",
+		"reminder.tooMany":    "⚠️ Du har allerede %d påminnelser som venter.",
+		"reminder.set":        "⏰ Jeg minner deg på det om %v.",
+		"reminder.due":        "⏰ Påminnelse: %s",
+		"poll.started":        "%s\nStartet av %s. Stem med /vote <nummer>.",
+		"poll.closed":         "Avstemningen er avsluttet.\n%s",
+		"poll.none":           "Det er ingen åpen avstemning. Start en med /poll.",
+		"poll.vote":           "\n%d. %s: %d stemme",
+		"poll.votes":          "\n%d. %s: %d stemmer",
+
+		"back.notAway":             "Du er ikke borte.",
+		"away.set":                 "%s er borte",
+		"away.setWith":             "%s er borte: %s",
+		"away.back":                "%s er tilbake",
+		"me.usage":                 "Bruk: /me <handling>, f.eks. /me vinker",
+		"nick.usage":               "Bruk: /nick <nyttnavn>, f.eks. /nick alice",
+		"nick.same":                "Du heter allerede %s.",
+		"nick.invalid":             "Kan ikke bytte navn: %v",
+		"nick.banned":              "Kan ikke bytte navn: navnet %s er utestengt",
+		"mute.usage":               "Bruk: /mute <brukernavn>, f.eks. /mute bob",
+		"mute.self":                "Du kan ikke dempe deg selv.",
+		"mute.done":                "Dempet %s. Bruk /unmute %s for å angre.",
+		"unmute.usage":             "Bruk: /unmute <brukernavn>, f.eks. /unmute bob",
+		"unmute.notMuted":          "%s er ikke dempet.",
+		"unmute.done":              "%s er ikke lenger dempet.",
+		"block.usage":              "Bruk: /block <brukernavn>, f.eks. /block bob",
+		"block.self":               "Du kan ikke blokkere deg selv.",
+		"block.done":               "Blokkerte private meldinger fra %s. Bruk /unblock %s for å angre.",
+		"unblock.usage":            "Bruk: /unblock <brukernavn>, f.eks. /unblock bob",
+		"unblock.notBlocked":       "%s er ikke blokkert.",
+		"unblock.done":             "%s er ikke lenger blokkert.",
+		"mod.only":                 "Bare moderatorer kan bruke /%s.",
+		"mod.usage":                "Bruk: /%s <brukernavn>",
+		"mod.self":                 "Du kan ikke bruke /%s på deg selv.",
+		"mod.protected":            "%s er moderator og kan ikke fjernes.",
+		"kick.you":                 "Du ble kastet ut av %s.",
+		"kick.done":                "%s ble kastet ut av %s",
+		"ban.you":                  "Du ble utestengt av %s.",
+		"ban.done":                 "%s ble utestengt av %s",
+		"clear.usage":              "Bruk: /clear [all]",
+		"clear.failed":             "De lagrede meldingene kunne ikke slettes.",
+		"clear.done":               "Historikken ble tømt av %s",
+		"export.empty":             "Det er ingen historikk i dette rommet å eksportere.",
+		"export.busy":              "Serveren er opptatt med andre eksporter. Prøv igjen senere.",
+		"export.failed":            "Historikken kunne ikke eksporteres.",
+		"export.ready":             "📦 Last ned rommets siste %d meldinger innen %v: /export/%s (JSON) eller /export/%s?format=text",
+		"files.disabled":           "Fildeling er slått av på denne serveren.",
+		"files.type":               "Filer av typen %s kan ikke deles.",
+		"files.tooLarge":           "Filer sendt i én ramme kan være på høyst %s byte.",
+		"files.full":               "Serveren kan ikke ta imot flere filer akkurat nå. Prøv igjen senere.",
+		"files.busy":               "Serveren er opptatt med andre opplastinger. Prøv igjen senere.",
+		"files.failed":             "Filen din kunne ikke deles.",
+		"private.notEncrypted":     "En privat melding til deg kunne ikke krypteres og ble ikke levert.",
+		"private.notEncryptedFrom": "En privat melding fra %s kunne ikke krypteres for deg og ble ikke levert.",
+		"private.ownCopy":          "Den private meldingen din ble levert, men din egen kopi kunne ikke krypteres.",
+		"private.replay":           "Den private meldingen er allerede levert.",
+		"private.unverified":       "Den private meldingen din kunne ikke bekreftes og ble ikke levert.",
+		"sealed.oneUser":           "Ende-til-ende-krypterte private meldinger går til én bruker om gangen.",
+		"sealed.invalid":           "Den private meldingen din er ikke gyldig kryptert og ble ikke levert.",
+
+		"help." + cmdSaving:   "💰 Regn ut hva du kan spare på 10 år (eventuelt for et gitt månedlig beløp)",
+		"help." + cmdGoal:     "🎯 Følg med på hvor nær du er et sparemål: /savinggoal set <mål> | add <beløp> | reset",
+		"help." + cmdCompound: "📈 Renters rente: /compound <beløp> <rente%> <år>",
+		"help." + cmdMortgage: "🏠 Månedlig lånebetaling: /mortgage <lånebeløp> <rente%> <år>",
+		"help." + cmdSplit:    "🧾 Del en regning: /split <totalt> <personer> [tip <prosent>]",
+		"help." + cmdVAT:      "🧾 Legg mva. til et nettobeløp, eller trekk den ut av et bruttobeløp med -gross: /vat <beløp> [sats%] [-gross]",
+		"help." + cmdConvert:  "💱 Veksle valuta: /convert <beløp> <fra> <til>",
+		"help." + cmdStock:    "📊 Siste aksjekurs: /stock <ticker>, f.eks. /stock AAPL",
+		"help." + cmdCrypto:   "🪙 Kryptokurs og endring siste døgn: /crypto <mynt> [valuta], f.eks. /crypto BTC NOK",
+		"help." + cmdInflate:  "📉 Juster kroner for inflasjon: /inflation <beløp> <fraÅr> <tilÅr>",
+		"help." + cmdWho:      "👥 Vis brukerne i dette rommet",
+		"help." + cmdStats:    "📈 Vis hvem som er pålogget, antall åpne rom, sendte meldinger og serverens oppetid",
+		"help." + cmdMe:       "✨ Beskriv en handling: /me <handling>",
+		"help." + cmdDM:       "✉️ Send en privat melding til én eller flere: /dm <brukernavn>[,<brukernavn>...] <melding>",
+		"help." + cmdNick:     "🏷️ Bytt navn: /nick <nyttnavn>",
+		"help." + cmdRoll:     "🎲 Kast terninger: /roll [antall]d<sider>, f.eks. /roll 2d6",
+		"help." + cmdTime:     "🕒 Klokken nå, eventuelt i en tidssone: /time [sone], f.eks. /time Europe/Oslo",
+		"help." + cmdPoll:     `📊 Start en avstemning: /poll "<spørsmål>" <valg> <valg>...`,
+		"help." + cmdVote:     "🗳️ Stem i den åpne avstemningen: /vote <nummer>",
+		"help." + cmdResults:  "📋 Vis resultatene i den åpne avstemningen",
+		"help." + cmdEndPoll:  "🏁 Avslutt avstemningen du startet",
+		"help." + cmdEphem:    "⏳ Send en melding som slettes etter en stund: /ephemeral <sekunder> <melding>",
+		"help." + cmdExport:   "📦 Få en lenke for å laste ned rommets siste historikk",
+		"help." + cmdHistory:  "📜 Vis rommets siste meldinger bare for deg: /history [antall]",
+		"help." + cmdReminder: "⏰ Få en privat påminnelse senere: /reminder <ventetid> <melding>, f.eks. /reminder 10m sjekk ovnen",
+		"help." + cmdLocale:   "🌐 Velg hvordan tall skrives for deg: /locale [locale], f.eks. /locale en-US",
+		"help." + cmdAway:     "💤 Merk deg som borte: /away [melding]",
+		"help." + cmdBack:     "👋 Merk deg som tilbake",
+		"help." + cmdMute:     "🔇 Slutt å se meldinger fra en bruker: /mute <brukernavn>",
+		"help." + cmdUnmute:   "🔊 Se meldingene til en dempet bruker igjen: /unmute <brukernavn>",
+		"help." + cmdBlock:    "⛔ Avvis private meldinger fra en bruker: /block <brukernavn>",
+		"help." + cmdUnblock:  "✅ Ta imot private meldinger fra en blokkert bruker igjen: /unblock <brukernavn>",
+		"help." + cmdKick:     "👢 Koble fra en bruker (kun moderatorer): /kick <brukernavn>",
+		"help." + cmdBan:      "🚫 Koble fra og utesteng en bruker (kun moderatorer): /ban <brukernavn>",
+		"help." + cmdClear:    "🧹 Tøm rommets historikk, og med \"all\" de lagrede meldingene (kun moderatorer): /clear [all]",
+		"help." + cmdHelp:     "📖 Vis alle tilgjengelige kommandoer",
+	},
+}
+
+// catalogMessage returns the format string for key in lang, falling back
+// to defaultLang.
+func catalogMessage(lang, key string) (string, bool) {
+	if format, ok := catalog[lang][key]; ok {
+		return format, true
+	}
+	format, ok := catalog[defaultLang][key]
+	return format, ok
+}
+
+// translate formats the message for key in lang with args. A key missing
+// from every language is returned as is, so the gap shows up in chat
+// rather than as an empty message.
+func translate(lang, key string, args ...any) string {
+	format, ok := catalogMessage(lang, key)
+	if !ok {
+		warnf("No message %q in language %s", key, lang)
+		return key
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// locale says how numbers are written for a client: what goes between
+// groups of thousands and what goes before the decimals.
+type locale struct {
+	name      string
+	thousands byte
+	decimal   byte
+}
+
+// defaultLocale writes numbers Norwegian style, e.g. 1.234.567,90. It is
+// used for clients that haven't chosen a locale and for the bot's own tips.
+var defaultLocale = locale{name: "nb-NO", thousands: '.', decimal: ','}
+
+// locales are the number formats clients can choose, by name.
+var locales = []locale{
+	defaultLocale,
+	{name: "en-US", thousands: ',', decimal: '.'},
+	{name: "en-GB", thousands: ',', decimal: '.'},
+	{name: "de-DE", thousands: '.', decimal: ','},
+}
+
+// findLocale returns the locale with the given name, ignoring case.
+func findLocale(name string) (locale, bool) {
+	for _, loc := range locales {
+		if strings.EqualFold(loc.name, name) {
+			return loc, true
+		}
+	}
+	return locale{}, false
+}
+
+// localeCommand shows or changes how numbers in replies to sender's
+// commands are written, e.g. "/locale en-US".
+func localeCommand(sender *Client, args []string) {
+	names := make([]string, len(locales))
+	for i, loc := range locales {
+		names[i] = loc.name
+	}
+	if len(args) == 0 {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Your numbers are written %s style, e.g. %s. Choose from: %s",
+			sender.locale.name, formatDecimal(1234567.9, 2, sender.locale), strings.Join(names, ", "))})
+		return
+	}
+
+	loc, ok := findLocale(args[0])
+	if len(args) != 1 || !ok {
+		sender.send(Message{Type: msgSystem, Content: "Usage: /locale <locale>, one of " + strings.Join(names, ", ")})
+		return
+	}
+	sender.locale = loc
+	sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Numbers are now written %s style, e.g. %s.", loc.name, formatDecimal(1234567.9, 2, loc))})
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestFindLocale(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+		ok         bool
+	}{
+		{"en-US", "en-US", true},
+		{"EN-us", "en-US", true},
+		{"nb-no", "nb-NO", true},
+		{"fr-FR", "", false},
+		{"", "", false},
+	} {
+		if loc, ok := findLocale(tt.name); ok != tt.ok || loc.name != tt.want {
+			t.Errorf("findLocale(%q) = %q, %v; want %q, %v", tt.name, loc.name, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLocaleCommand(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/locale")
+	alice.expectContent(msgSystem, "Your numbers are written nb-NO style, e.g. 1.234.567,90. Choose from: nb-NO, en-US, en-GB, de-DE")
+	alice.say("/locale fr-FR")
+	alice.expectContent(msgSystem, "Usage: /locale <locale>, one of nb-NO, en-US, en-GB, de-DE")
+	alice.say("/locale en-us")
+	alice.expectContent(msgSystem, "Numbers are now written en-US style, e.g. 1,234,567.90.")
+
+	// Only replies to alice's own commands change
+	alice.say("/mortgage 3000000 5 25")
+	bob.expectContent(msgCommand, "🏠 A 3,000,000 kr loan at 5% over 25 years costs 17,537.70 kr per month")
+	bob.say("/mortgage 3000000 5 25")
+	alice.expectContent(msgCommand, "🏠 A 3.000.000 kr loan at 5% over 25 years costs 17.537,70 kr per month")
+}
+
+func TestLocaleFromTheConnectQuery(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice&locale=en-GB")
+	bob := ts.join(t, "/ws?username=bob&locale=klingon")
+
+	alice.say("/locale")
+	alice.expectContent(msgSystem, "Your numbers are written en-GB style")
+	bob.say("/locale")
+	bob.expectContent(msgSystem, "Your numbers are written nb-NO style")
+}
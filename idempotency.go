@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clients on flaky networks may resend a frame they aren't sure arrived. A
+// frame carrying an idempotency Key is handled only the first time its key
+// is seen from the client within idempotencyWindow; repeats are dropped.
+// Keys carry over when a client resumes its session, since a resend is most
+// likely right after reconnecting.
+
+// Limits on idempotency keys.
+const (
+	idempotencyWindow    = 5 * time.Minute
+	maxIdempotencyKeys   = 256 // Keys remembered per client
+	maxIdempotencyKeyLen = 128 // Longest key accepted, in bytes
+)
+
+// keyCache remembers the idempotency keys recently seen from one client.
+// Once full, the oldest key is forgotten first. It is owned by the client's
+// read loop.
+type keyCache struct {
+	seen  map[string]time.Time // When each key in order was last seen
+	order []string             // Ring buffer of the keys in seen, oldest at next
+	next  int
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		seen:  make(map[string]time.Time, size),
+		order: make([]string, 0, size),
+	}
+}
+
+// add records key as seen at now and reports whether it is new, that is not
+// seen within idempotencyWindow before.
+func (c *keyCache) add(key string, now time.Time) bool {
+	if seen, ok := c.seen[key]; ok {
+		if now.Sub(seen) < idempotencyWindow {
+			return false
+		}
+		c.seen[key] = now
+		return true
+	}
+	if len(c.order) < cap(c.order) {
+		c.order = append(c.order, key)
+	} else {
+		delete(c.seen, c.order[c.next])
+		c.order[c.next] = key
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.seen[key] = now
+	return true
+}
+
+// isRepeat reports whether frame repeats one the client already sent, and
+// tells the client if its key can't be used.
+func (c *Client) isRepeat(frame Message, now time.Time) bool {
+	if frame.Key == "" {
+		return false
+	}
+	if len(frame.Key) > maxIdempotencyKeyLen {
+		c.send(Message{Type: msgSystem, Content: fmt.Sprintf("Message keys must be at most %d bytes. Your message was not delivered.", maxIdempotencyKeyLen)})
+		return true
+	}
+	if !c.keys.add(frame.Key, now) {
+		debugf("Dropping repeated %s frame from %s", frame.Type, c.name())
+		return true
+	}
+	return false
+}
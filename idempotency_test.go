@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatedKeyIsBroadcastOnce(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.sendFrame(Message{Type: msgChat, Key: "k1", Content: "lunch?"})
+	alice.sendFrame(Message{Type: msgChat, Key: "k1", Content: "lunch?"})
+	alice.sendFrame(Message{Type: msgChat, Key: "k2", Content: "lunch?"})
+	bob.expect("the first message", isChat("alice", "lunch?"))
+	bob.expect("the newly keyed message", isChat("alice", "lunch?"))
+	alice.sendFrame(Message{Type: msgChat, Content: "done"})
+	bob.expectNoneBefore("the repeat", isChat("alice", "lunch?"), isChat("alice", "done"))
+
+	// Keys are per client, so bob may use alice's
+	bob.sendFrame(Message{Type: msgChat, Key: "k1", Content: "sure"})
+	alice.expect("bob's message", isChat("bob", "sure"))
+
+	// Once the window passes, the key is new again
+	clock.advance(idempotencyWindow)
+	alice.sendFrame(Message{Type: msgChat, Key: "k1", Content: "lunch?"})
+	bob.expect("the message after the window", isChat("alice", "lunch?"))
+}
+
+func TestRepeatedKeyIsDroppedAfterResuming(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.sendFrame(Message{Type: msgChat, Key: "k1", Content: "lunch?"})
+	bob.expect("the message", isChat("alice", "lunch?"))
+	token := ts.disconnect(t, alice)
+
+	alice = ts.join(t, "/ws?username=alice&session="+token)
+	alice.sendFrame(Message{Type: msgChat, Key: "k1", Content: "lunch?"})
+	alice.sendFrame(Message{Type: msgChat, Content: "done"})
+	bob.expectNoneBefore("the resent message", isChat("alice", "lunch?"), isChat("alice", "done"))
+}
+
+func TestOversizedKeyIsRefused(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.sendFrame(Message{Type: msgChat, Key: strings.Repeat("k", maxIdempotencyKeyLen+1), Content: "lunch?"})
+	alice.expectContent(msgSystem, "Message keys must be at most 128 bytes. Your message was not delivered.")
+	alice.sendFrame(Message{Type: msgChat, Content: "done"})
+	bob.expectNoneBefore("the refused message", isChat("alice", "lunch?"), isChat("alice", "done"))
+}
+
+func TestKeyCacheForgetsTheOldestKey(t *testing.T) {
+	now := time.Now()
+	keys := newKeyCache(2)
+	for _, key := range []string{"a", "b", "c"} {
+		if !keys.add(key, now) {
+			t.Fatalf("add(%q) reported a repeat", key)
+		}
+	}
+	if keys.add("b", now) || keys.add("c", now) {
+		t.Error("recent keys weren't remembered")
+	}
+	if !keys.add("a", now) {
+		t.Error("the oldest key wasn't forgotten when the cache filled")
+	}
+	if len(keys.seen) != 2 {
+		t.Errorf("cache holds %d keys, want 2", len(keys.seen))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// norwayCPI is Statistics Norway's consumer price index, annual averages
+// rebased to 2015 = 100.
+var norwayCPI = map[int]float64{
+	2000: 75.5, 2001: 77.7, 2002: 78.7, 2003: 80.8, 2004: 81.1,
+	2005: 82.3, 2006: 84.2, 2007: 84.8, 2008: 88.0, 2009: 89.9,
+	2010: 92.1, 2011: 93.3, 2012: 94.1, 2013: 96.0, 2014: 97.9,
+	2015: 100.0, 2016: 103.6, 2017: 105.5, 2018: 108.4, 2019: 110.8,
+	2020: 112.2, 2021: 116.1, 2022: 122.8, 2023: 129.6, 2024: 133.6,
+}
+
+// adjustForInflation returns what amount in year from is worth in year to,
+// by the ratio of the two years' price index in cpi. to may be earlier
+// than from, which deflates the amount instead.
+func adjustForInflation(amount float64, from, to int, cpi map[int]float64) (float64, error) {
+	fromIndex, ok := cpi[from]
+	if !ok {
+		return 0, fmt.Errorf("no price index for %d", from)
+	}
+	toIndex, ok := cpi[to]
+	if !ok {
+		return 0, fmt.Errorf("no price index for %d", to)
+	}
+	return amount * toIndex / fromIndex, nil
+}
+
+func inflationCommand(lang string, args []string, cpi map[int]float64, loc locale) string {
+	usage := translate(lang, "inflation.usage")
+	if len(args) != 3 {
+		return "⚠️ " + usage
+	}
+
+	amount, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || math.IsNaN(amount) || amount <= 0 || amount > maxAmount {
+		return translate(lang, "amount.invalidUsage", args[0], usage)
+	}
+	from, err := strconv.Atoi(args[1])
+	if err != nil {
+		return translate(lang, "year.invalid", args[1], usage)
+	}
+	to, err := strconv.Atoi(args[2])
+	if err != nil {
+		return translate(lang, "year.invalid", args[2], usage)
+	}
+
+	adjusted, err := adjustForInflation(amount, from, to, cpi)
+	if err != nil {
+		first, last := cpiRange(cpi)
+		return translate(lang, "cpi.range", first, last)
+	}
+
+	return translate(lang, "inflation.result",
+		formatDecimal(amount, 2, loc), from, formatDecimal(adjusted, 2, loc), to, formatChange((adjusted/amount-1)*100, loc))
+}
+
+// cpiRange returns the first and last year in cpi.
+func cpiRange(cpi map[int]float64) (first, last int) {
+	for year := range cpi {
+		if first == 0 || year < first {
+			first = year
+		}
+		if year > last {
+			last = year
+		}
+	}
+	return first, last
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// testCPI is a small price index that doubles from 2000 to 2020.
+var testCPI = map[int]float64{2000: 50, 2010: 80, 2020: 100}
+
+func TestAdjustForInflation(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		from, to int
+		want     float64
+		err      string
+	}{
+		{1000, 2000, 2020, 2000, ""},
+		{1000, 2000, 2010, 1600, ""},
+		{1000, 2020, 2000, 500, ""}, // a reversed range deflates
+		{1000, 2010, 2000, 625, ""},
+		{1000, 2010, 2010, 1000, ""},
+		{1000, 1999, 2020, 0, "no price index for 1999"},
+		{1000, 2000, 2021, 0, "no price index for 2021"},
+		{1000, 2005, 2010, 0, "no price index for 2005"},
+	}
+	for _, tt := range tests {
+		got, err := adjustForInflation(tt.amount, tt.from, tt.to, testCPI)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("adjustForInflation(%v, %d, %d) error = %v, want %q", tt.amount, tt.from, tt.to, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("adjustForInflation(%v, %d, %d) = %v, %v; want %v", tt.amount, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+
+	// There and back again is where we started
+	there, _ := adjustForInflation(1234.56, 2000, 2010, testCPI)
+	back, _ := adjustForInflation(there, 2010, 2000, testCPI)
+	if math.Abs(back-1234.56) > 1e-9 {
+		t.Errorf("round trip gave %v, want 1234.56", back)
+	}
+}
+
+func TestInflationCommand(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"1000 2000 2020", "📉 1.000,00 kr in 2000 is worth about 2.000,00 kr in 2020 (+100,00%)"},
+		{"1000 2020 2010", "📉 1.000,00 kr in 2020 is worth about 800,00 kr in 2010 (-20,00%)"},
+		{"12.5 2010 2010", "📉 12,50 kr in 2010 is worth about 12,50 kr in 2010 (+0,00%)"},
+		{"1000 1990 2020", "⚠️ I only have prices for 2000 to 2020."},
+		{"1000 2000", "⚠️ Usage: /inflation"},
+		{"0 2000 2020", `⚠️ Invalid amount "0"`},
+		{"NaN 2000 2020", `⚠️ Invalid amount "NaN"`},
+		{"1000 twenty 2020", `⚠️ Invalid year "twenty"`},
+		{"1000 2000 2020.5", `⚠️ Invalid year "2020.5"`},
+	}
+	for _, tt := range tests {
+		if got := inflationCommand(defaultLang, strings.Fields(tt.args), testCPI, defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/inflation %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestNorwayCPIIsComplete(t *testing.T) {
+	first, last := cpiRange(norwayCPI)
+	for year := first; year <= last; year++ {
+		if norwayCPI[year] <= 0 {
+			t.Errorf("no price index for %d in %d-%d", year, first, last)
+		}
+	}
+	if norwayCPI[2015] != 100 {
+		t.Errorf("2015 = %v, want the base year's 100", norwayCPI[2015])
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the IP address a request came from. Behind a trusted
+// reverse proxy that is the last X-Forwarded-For entry, the one the proxy
+// itself appended; earlier entries come from the client and can be forged.
+// Proxies that only set X-Real-IP are supported too. Without trustProxy the
+// headers are ignored, since anyone can send them, and a header that doesn't
+// hold a valid IP falls back to the connection's address.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// normalizeIP returns ip in canonical form, or ip unchanged if it doesn't
+// parse.
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// isBanned reports whether connections from ip are refused.
+func (h *Hub) isBanned(ip string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.banned[ip]
+}
+
+// acquireIP counts a new connection from ip, unless ip already has the
+// maximum number of connections open.
+func (h *Hub) acquireIP(ip string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.cfg.maxConnsPerIP > 0 && h.ipConns[ip] >= h.cfg.maxConnsPerIP {
+		return false
+	}
+	h.ipConns[ip]++
+	return true
+}
+
+// releaseIP uncounts a connection from ip once it has closed.
+func (h *Hub) releaseIP(ip string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.ipConns[ip]--; h.ipConns[ip] <= 0 {
+		delete(h.ipConns, ip)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustProxy bool
+		header     http.Header
+		want       string
+	}{
+		{"direct", false, nil, "192.0.2.1"},
+		{"forwarded but untrusted", false, http.Header{"X-Forwarded-For": {"203.0.113.7"}}, "192.0.2.1"},
+		{"real IP but untrusted", false, http.Header{"X-Real-Ip": {"203.0.113.7"}}, "192.0.2.1"},
+		{"trusted, no headers", true, nil, "192.0.2.1"},
+		{"trusted forwarded", true, http.Header{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"last hop wins", true, http.Header{"X-Forwarded-For": {"10.6.6.6, 203.0.113.7"}}, "203.0.113.7"},
+		{"last header wins", true, http.Header{"X-Forwarded-For": {"10.6.6.6", "203.0.113.7"}}, "203.0.113.7"},
+		{"spaces", true, http.Header{"X-Forwarded-For": {" 203.0.113.7 "}}, "203.0.113.7"},
+		{"IPv6", true, http.Header{"X-Forwarded-For": {"2001:DB8::1"}}, "2001:db8::1"},
+		{"real IP", true, http.Header{"X-Real-Ip": {"203.0.113.7"}}, "203.0.113.7"},
+		{"forwarded before real IP", true, http.Header{"X-Forwarded-For": {"203.0.113.7"}, "X-Real-Ip": {"198.51.100.2"}}, "203.0.113.7"},
+		{"garbage forwarded", true, http.Header{"X-Forwarded-For": {"not-an-ip"}}, "192.0.2.1"},
+		{"garbage falls back to real IP", true, http.Header{"X-Forwarded-For": {"not-an-ip"}, "X-Real-Ip": {"198.51.100.2"}}, "198.51.100.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = "192.0.2.1:54321"
+		for name, values := range tt.header {
+			r.Header[name] = values
+		}
+		if got := clientIP(r, tt.trustProxy); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForwardedIPIsBannedOnlyBehindATrustedProxy(t *testing.T) {
+	ban := func(h *Hub) { h.banned["203.0.113.7"] = true }
+	forwarded := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+
+	cfg := testConfig(t)
+	cfg.trustProxy = true
+	trusted := newTestServer(t, cfg, ban)
+	if _, resp, err := trusted.connect(t, "/ws?username=mallory", forwarded); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("banned forwarded IP behind a trusted proxy: %v", err)
+	}
+
+	// Without -trust-proxy the header is ignored, so it can't be used to
+	// get someone else banned or to dodge a ban
+	untrusted := newTestServer(t, testConfig(t), ban)
+	if _, _, err := untrusted.connect(t, "/ws?username=alice", forwarded); err != nil {
+		t.Errorf("header honoured without -trust-proxy: %v", err)
+	}
+}
+
+func TestAcquireIP(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.maxConnsPerIP = 2
+	h := NewHub(cfg)
+
+	if !h.acquireIP("10.0.0.1") || !h.acquireIP("10.0.0.1") {
+		t.Fatal("refused a connection under the limit")
+	}
+	if h.acquireIP("10.0.0.1") {
+		t.Error("accepted a third connection from one IP")
+	}
+	if !h.acquireIP("10.0.0.2") {
+		t.Error("another IP was refused")
+	}
+
+	h.releaseIP("10.0.0.1")
+	if !h.acquireIP("10.0.0.1") {
+		t.Error("refused a connection after one closed")
+	}
+	h.releaseIP("10.0.0.1")
+	h.releaseIP("10.0.0.1")
+	h.releaseIP("10.0.0.2")
+	if len(h.ipConns) != 0 {
+		t.Errorf("ipConns = %v after every connection closed", h.ipConns)
+	}
+}
+
+func TestConnectionsPerIPAreUnlimitedByDefault(t *testing.T) {
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everyone behind one proxy or NAT shares an IP, so a limit must be
+	// asked for
+	h := NewHub(cfg)
+	for i := range 100 {
+		if !h.acquireIP("10.0.0.1") {
+			t.Fatalf("connection %d from one IP refused by default", i+1)
+		}
+	}
+}
+
+func TestTooManyConnectionsFromOneIP(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.maxConnsPerIP = 2
+	ts := newTestServer(t, cfg)
+	ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	_, resp, err := ts.connect(t, "/ws?username=carol", nil)
+	if err == nil {
+		t.Fatal("third connection from one IP accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third connection got %v, want 429", resp)
+	}
+
+	// A slot frees up once a connection has closed
+	bob.leave()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if _, _, err := ts.connect(t, "/ws?username=carol", nil); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("still refused after bob left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBannedIPIsRefused(t *testing.T) {
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.banned["127.0.0.1"] = true
+	})
+	_, resp, err := ts.connect(t, "/ws?username=mallory", nil)
+	if err == nil {
+		t.Fatal("banned IP connected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("banned IP got %v, want 403", resp)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "regexp"
+
+// urlPattern matches http(s) URLs and bare domains such as example.com or
+// www.example.no/path. Bare domains must end in a common top-level domain,
+// so ordinary text with dots ("e.g.", "3.5", "end.Next") doesn't match.
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s/$.?#][^\s]*|\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+(?:com|net|org|info|biz|io|co|me|ly|gg|tv|app|dev|xyz|site|online|shop|link|click|top|ru|cn|uk|de|fr|nl|se|dk|no|eu|us)\b(?:[/?#][^\s]*)?`)
+
+// containsURL reports whether s contains something that looks like a link.
+func containsURL(s string) bool {
+	return urlPattern.MatchString(s)
+}
+
+// linkBlocked tells sender their message wasn't delivered if it contains a
+// link and the room blocks them.
+func (room *Room) linkBlocked(sender *Client, text string) bool {
+	if !room.blockLinks || !containsURL(text) {
+		return false
+	}
+	infof("Blocked a message with a link from %s in room %s", sender.name(), room.name)
+	sender.send(Message{Type: msgSystem, Content: "Links aren't allowed here. Your message was not delivered."})
+	return true
+}
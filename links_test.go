@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestContainsURL(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"see https://example.com", true},
+		{"http://example.com/path?q=1", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"go to example.com now", true},
+		{"www.example.no/path", true},
+		{"sub.domain.example.org", true},
+		{"my-site.dev", true},
+		{"plain text", false},
+		{"e.g. this", false},
+		{"version 3.5", false},
+		{"the end.Next sentence", false},
+		{"file.txt", false},
+		{"http://", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := containsURL(tt.text); got != tt.want {
+			t.Errorf("containsURL(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLinksAreBlocked(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.blockLinks = true
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	for _, text := range []string{"visit example.com", "/me shares https://example.com"} {
+		alice.say(text)
+		alice.expectContent(msgSystem, "Links aren't allowed here. Your message was not delivered.")
+	}
+	alice.sendFrame(Message{Type: msgChat, Content: "www.example.no"})
+	alice.expectContent(msgSystem, "Links aren't allowed here.")
+
+	alice.say("no links here")
+	bob.expectNoneBefore("a message with a link", func(msg Message) bool {
+		return msg.From == "alice" && containsURL(msg.Content)
+	}, isChat("alice", "no links here"))
+}
+
+func TestLinksAreAllowedByDefault(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	alice.say("visit example.com")
+	bob.expect("the link", isChat("alice", "visit example.com"))
+}
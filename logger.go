@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel is the severity of a log line. Lines below the configured level
+// are discarded.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+func (l logLevel) String() string {
+	return strings.ToLower(levelNames[l])
+}
+
+// parseLogLevel parses a level name such as "info", ignoring case.
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+}
+
+// minLogLevel is the least severe level that is logged, as a logLevel. main
+// sets it from -log-level before serving. Message content is only ever
+// logged at debug.
+var minLogLevel atomic.Int32
+
+func init() {
+	minLogLevel.Store(int32(levelInfo))
+}
+
+func logAt(level logLevel, format string, args ...any) {
+	if int32(level) < minLogLevel.Load() {
+		return
+	}
+	log.Printf(levelNames[level]+" "+format, args...)
+}
+
+func debugf(format string, args ...any) { logAt(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logAt(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logAt(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logAt(levelError, format, args...) }
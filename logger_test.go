@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// logBuffer collects log output. The server logs from many goroutines, so
+// reads are locked against writes.
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs logs at level into the returned buffer until the test ends.
+func captureLogs(t *testing.T, level logLevel) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	minLogLevel.Store(int32(level))
+	t.Cleanup(func() {
+		log.SetOutput(io.Discard)
+		minLogLevel.Store(int32(levelInfo))
+	})
+	return logs
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]logLevel{"debug": levelDebug, "INFO": levelInfo, "Warn": levelWarn, "error": levelError} {
+		if got, err := parseLogLevel(name); err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel accepted an unknown level")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	logs := captureLogs(t, levelWarn)
+	debugf("debug line")
+	infof("info line")
+	warnf("warn line")
+	errorf("error line")
+
+	got := logs.String()
+	for _, line := range []string{"DEBUG debug line", "INFO info line"} {
+		if strings.Contains(got, line) {
+			t.Errorf("%q logged at warn level", line)
+		}
+	}
+	for _, line := range []string{"WARN warn line", "ERROR error line"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("%q missing at warn level", line)
+		}
+	}
+}
+
+func TestContentIsNotLoggedAtInfo(t *testing.T) {
+	for _, level := range []logLevel{levelInfo, levelDebug} {
+		t.Run(level.String(), func(t *testing.T) {
+			logs := captureLogs(t, level)
+			ts := newTestServer(t, testConfig(t))
+			alice := ts.join(t, "/ws?username=alice")
+
+			alice.say("my pin is 4321")
+			alice.expect("the message", isChat("alice", "my pin is 4321"))
+			alice.say("/saving 7777")
+			alice.expectContent(msgCommand, "7.777")
+
+			got := logs.String()
+			if !strings.Contains(got, "INFO New client connected: alice") {
+				t.Errorf("join not logged at %v:\n%s", level, got)
+			}
+			if debugLogged := strings.Contains(got, "DEBUG "); debugLogged != (level == levelDebug) {
+				t.Errorf("debug lines logged: %v at %v", debugLogged, level)
+			}
+			for _, content := range []string{"4321", "7777"} {
+				if strings.Contains(got, content) {
+					t.Errorf("message content %q logged at %v:\n%s", content, level, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateMessagesAndKeysAreNotLogged(t *testing.T) {
+	logs := captureLogs(t, levelDebug)
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("@bob the vault code is 8642")
+	bob.expect("the private message", isPrivate("alice", "bob", "the vault code is 8642"))
+	sealed := alice.sealFor("bob", "the alarm code is 1357")
+	alice.sendFrame(Message{Type: msgPrivate, To: "bob", Content: sealed})
+	bob.expect("the private message", isPrivate("alice", "bob", "the alarm code is 1357"))
+
+	got := logs.String()
+	secrets := []string{"8642", "1357", sealed}
+	for _, c := range []*testClient{alice, bob} {
+		key := c.sessionKey()
+		secrets = append(secrets, base64.StdEncoding.EncodeToString(key), fmt.Sprintf("%x", key))
+	}
+	for _, secret := range secrets {
+		if strings.Contains(got, secret) {
+			t.Errorf("%q logged:\n%s", secret, got)
+		}
+	}
+}
+
+func TestClosesAreLoggedByHowTheClientLeft(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		leave func(c *testClient)
+		want  string
+	}{
+		{"normal close", (*testClient).leave, "DEBUG zelda closed the connection: websocket: close 1000"},
+		{"going away", func(c *testClient) { c.closeWith(websocket.CloseGoingAway, "navigating away") }, "DEBUG zelda closed the connection: websocket: close 1001"},
+		{"protocol error", func(c *testClient) { c.closeWith(websocket.CloseProtocolError, "confused") }, "WARN Unexpected close from zelda: websocket: close 1002"},
+		// Half-closing drops the connection without a close frame, and
+		// without the reset closing it outright sends if frames are unread
+		{"dropped", func(c *testClient) { c.conn.NetConn().(*net.TCPConn).CloseWrite() }, "WARN Unexpected close from zelda: websocket: close 1006"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, levelDebug)
+			ts := newTestServer(t, testConfig(t))
+			zelda := ts.join(t, "/ws?username=zelda")
+			bob := ts.join(t, "/ws?username=bob")
+
+			tt.leave(zelda)
+			bob.expectContent(msgSystem, "zelda left the chat")
+			got := logs.String()
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("logs don't have %q:\n%s", tt.want, got)
+			}
+			// Clients of earlier tests may still be logging their way out, so only
+			// zelda's lines count
+			if strings.Contains(got, "WARN Unexpected close from zelda") != strings.HasPrefix(tt.want, "WARN") {
+				t.Errorf("a %s was logged at the wrong level:\n%s", tt.name, got)
+			}
+		})
+	}
+}
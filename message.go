@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Message IDs count up per room from the instance number (see
+// Fanout.Instance) shifted above messageIDBits, so IDs from instances
+// sharing a fanout never collide and an ack or reaction for another
+// instance's message can't resolve to a local one. That leaves room for
+// 2^32 messages per room and maxInstances instances while keeping IDs
+// below 2^53, the largest integer JavaScript clients read exactly.
+const (
+	messageIDBits = 32
+	maxInstances  = 1 << (53 - messageIDBits)
+)
+
+// Message is the JSON envelope for every frame the server sends, so clients
+// can tell message kinds apart without parsing text. Clients mostly send
+// plain text frames, but may also send a Message for structured requests
+// (see handleFrame). Before the envelope the server sent bare
+// "username: message" text; such clients need updating.
+//
+// Private messages are the only frames clients must decrypt. Their Content
+// is base64(nonce || ciphertext || tag): AES-256-GCM with a 12-byte nonce
+// under the receiving client's session key (see agreeKey), with
+// privateAAD(From, To) as additional data. Clients may send private
+// messages encrypted the same way under their own key, which the server
+// accepts only once per nonce. The sender's echo is encrypted with the
+// sender's own key, so each client only ever needs its own key. The msgKey
+// frame completing the key agreement is always the first frame a client
+// receives. Any later msgKey frame replaces the key for the frames that
+// follow it (see keyRing).
+//
+// Every frame sent to the whole room carries a Seq, counting up by one per
+// frame in the order the room sends them. Sequence numbers are per room and
+// per server instance, and start over when a room empties. Frames sent to a
+// single client, such as notices and private messages, have none. Detecting
+// gaps is the client's job, and not every gap is a lost frame: frames from
+// muted users and a client's own typing events are never sent to it, and
+// history replayed on joining skips whatever history doesn't keep.
+type Message struct {
+	ID        uint64         `json:"id,omitempty"` // Per-room ID of a broadcast message, unique across instances; see msgAck
+	Type      string         `json:"type"`
+	From      string         `json:"from,omitempty"`
+	To        string         `json:"to,omitempty"`
+	Content   string         `json:"content"`
+	Emoji     string         `json:"emoji,omitempty"`     // Reaction to message ID; see msgReact
+	Reactions map[string]int `json:"reactions,omitempty"` // Reaction counts by emoji; see msgReactions
+	ReplyTo   uint64         `json:"replyTo,omitempty"`   // ID of the message a chat message replies to
+	File      *FileInfo      `json:"file,omitempty"`      // The file a msgFile links to
+	Preview   *LinkPreview   `json:"preview,omitempty"`   // The link a msgPreview describes
+	TTL       int            `json:"ttl,omitempty"`       // Seconds until an ephemeral message is deleted; see msgDelete
+	Key       string         `json:"key,omitempty"`       // Client's idempotency key for the frame; see idempotency.go
+	PublicKey string         `json:"publicKey,omitempty"` // Base64 X25519 public key of the other client in a msgPeerKey or msgSealed
+	Seq       uint64         `json:"seq,omitempty"`       // Per-room sequence number of frames sent to the whole room; see above
+	TS        time.Time      `json:"ts"`                  // Server time in UTC
+}
+
+// Message types
+const (
+	msgChat      = "chat"       // public chat message
+	msgSystem    = "system"     // join/leave and other server notices
+	msgPrivate   = "private"    // @mention; Content is encrypted, see Message
+	msgKey       = "key"        // the server's base64 X25519 public key
+	msgPeerKey   = "peer-key"   // Client to server: asks for To's public key. Server to client: From's public key is PublicKey
+	msgSealed    = "sealed"     // Private message sealed end to end, relayed unopened; see receiveSealed
+	msgCommand   = "command"    // bot reply to a command
+	msgUsername  = "username"   // the username the server assigned the client
+	msgAction    = "action"     // /me action line, e.g. "* alice waves"
+	msgTyping    = "typing"     // From is typing; sent by clients, relayed to the rest of the room
+	msgAck       = "ack"        // Client to server: message ID was received. Server to the message's author: From received ID
+	msgReact     = "react"      // Client to server: add the reaction Emoji to message ID
+	msgUnreact   = "unreact"    // Client to server: remove the reaction Emoji from message ID
+	msgReactions = "reactions"  // Server to clients: message ID's reaction counts are now Reactions
+	msgFile      = "file"       // From shared File, downloadable at the path in Content
+	msgFileBegin = "file-begin" // Client to server: a chunked upload of File starts; see upload.go
+	msgFileEnd   = "file-end"   // Client to server: the chunked upload is complete
+	msgPreview   = "preview"    // Server to clients: Preview of a link in message ReplyTo
+	msgDelete    = "delete"     // Server to clients: message ID has expired and must be removed
+	msgSession   = "session"    // Server to client: the token to pass as ?session= to resume after a disconnect
+	msgClear     = "clear"      // Server to clients: a moderator cleared the room's history; remove every message shown
+)
+
+// FileInfo describes a shared file. Clients share a file by sending it as a
+// binary frame; everyone in the room then gets a msgFile.
+type FileInfo struct {
+	Name string `json:"name,omitempty"`
+	MIME string `json:"mime"`
+	Size int64  `json:"size"`
+
+	SHA256 string `json:"sha256,omitempty"` // Hex digest; declared by chunked uploads, see upload.go
+}
+
+// send stamps msg with the hub's clock, marshals it and writes it to the
+// client.
+func (c *Client) send(msg Message) error {
+	msg.TS = c.hub.now().UTC()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+// deliver stamps msg with the room's clock and next message ID and hands it
+// to the room's run goroutine to send to every client. Everything but
+// system notices is kept in the room's history, and everything but link
+// previews is also saved to its store and posted to the webhook if there is
+// one. Neither keeps a preview's card or the message it belongs to, so a
+// saved preview would come back empty. With a fanout the message also
+// goes to other instances. Messages for a room that has already stopped are
+// dropped locally.
+//
+// A message with a TTL is ephemeral: it is only kept in this instance's
+// history, never saved or posted, and is deleted everywhere once the TTL
+// has passed.
+func (room *Room) deliver(msg Message) {
+	room.deliverFrom(nil, msg)
+}
+
+// deliverFrom delivers msg written by author, who is told as other clients
+// acknowledge it. Listed words in what clients write are masked first when
+// the profanity filter is on, and links in chat are previewed afterwards
+// when unfurling is.
+func (room *Room) deliverFrom(author *Client, msg Message) {
+	if author != nil && room.filter != nil {
+		msg.Content = room.filter.mask(msg.Content)
+	}
+	msg.ID = room.nextID.Add(1)
+	msg.TS = room.now().UTC()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		errorf("Marshal error: %v", err)
+		return
+	}
+
+	keep := msg.Type != msgSystem
+	if keep && msg.TTL == 0 && msg.Type != msgPreview {
+		if err := room.store.Save(room.name, msg); err != nil {
+			errorf("Saving message in room %s: %v", room.name, err)
+		}
+		if room.webhook != nil {
+			room.webhook.post(room.name, msg)
+		}
+	}
+
+	metrics.messagesBroadcast.Add(1)
+	out := outbound{data: data, history: keep, id: msg.ID, author: author}
+	if room.fanout != nil {
+		// Other instances can't tell which of their history entries to
+		// delete, so they only relay ephemeral messages
+		shared := out
+		shared.history = out.history && msg.TTL == 0
+		if err := room.fanout.Publish(room.name, shared); err != nil {
+			errorf("Publishing message in room %s: %v", room.name, err)
+		}
+	}
+
+	select {
+	case room.broadcast <- out:
+	case <-room.done:
+		return
+	}
+
+	if msg.TTL > 0 {
+		room.expireAfter(msg.ID, time.Duration(msg.TTL)*time.Second)
+		return
+	}
+	if msg.Type == msgChat && author != nil && room.unfurler != nil {
+		go room.unfurl(msg.ID, msg.Content)
+	}
+}
+
+// parseFrame decodes a structured frame from a client. Anything that isn't
+// a JSON object with a type is plain chat text.
+func parseFrame(data []byte) (Message, bool) {
+	var msg Message
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &msg) != nil || msg.Type == "" {
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// isControlFrame reports whether frames of type typ are acks, typing events,
+// reactions or public key lookups, which are rate limited apart from chat.
+func isControlFrame(typ string) bool {
+	switch typ {
+	case msgAck, msgTyping, msgReact, msgUnreact, msgPeerKey:
+		return true
+	}
+	return false
+}
+
+// handleFrame processes a structured frame sent by a client.
+func (room *Room) handleFrame(sender *Client, frame Message) {
+	switch frame.Type {
+	case msgChat:
+		room.receiveChat(sender, frame.Content, frame.ReplyTo)
+	case msgPrivate:
+		room.receivePrivate(sender, frame.To, frame.Content)
+	case msgSealed:
+		room.receiveSealed(sender, frame.To, frame.Content)
+	case msgPeerKey:
+		room.sendPeerKey(sender, frame.To)
+	case msgTyping:
+		room.relayTyping(sender)
+	case msgAck:
+		room.forwardAck(sender, frame.ID)
+	case msgReact, msgUnreact:
+		room.react(sender, frame.ID, frame.Emoji, frame.Type == msgUnreact)
+	case msgFileBegin:
+		room.beginUpload(sender, frame.File)
+	case msgFileEnd:
+		room.endUpload(sender)
+	default:
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Unsupported message type %q", frame.Type)})
+	}
+}
+
+// receiveChat delivers a chat message sent as a frame, which lets the
+// client reply to an earlier message. The content is always chat, never a
+// command or private message.
+func (room *Room) receiveChat(sender *Client, content string, replyTo uint64) {
+	if strings.TrimSpace(content) == "" {
+		sender.send(Message{Type: msgSystem, Content: "Chat messages must not be empty."})
+		return
+	}
+	if replyTo != 0 && !room.isRecent(replyTo) {
+		room.bot.sendTo(sender, translate(room.bot.lang, "reply.unknown"))
+		return
+	}
+	if room.linkBlocked(sender, content) {
+		return
+	}
+	room.markBack(sender)
+	room.deliverFrom(sender, Message{Type: msgChat, From: sender.name(), Content: content, ReplyTo: replyTo})
+}
+
+// typingInterval is the shortest time between typing events relayed for one
+// client; more frequent ones are dropped.
+const typingInterval = 2 * time.Second
+
+// relayTyping tells everyone else in the room that sender is typing. Typing
+// events aren't chat: they are neither kept in history nor saved.
+func (room *Room) relayTyping(sender *Client) {
+	now := room.now()
+	if now.Sub(sender.lastTyping) < typingInterval {
+		return
+	}
+	sender.lastTyping = now
+
+	data, err := json.Marshal(Message{Type: msgTyping, From: sender.name(), TS: now.UTC()})
+	if err != nil {
+		errorf("Marshal error: %v", err)
+		return
+	}
+	select {
+	case room.broadcast <- outbound{data: data, skip: sender, author: sender}:
+	case <-room.done:
+	}
+}
+
+// forwardAck tells the author of message id that sender received it.
+// Acks for unknown or long-gone messages are ignored.
+func (room *Room) forwardAck(sender *Client, id uint64) {
+	select {
+	case room.acks <- ack{from: sender, id: id}:
+	case <-room.done:
+	}
+}
+
+// maxEmojiLength bounds a reaction in bytes. Emoji sequences such as flags
+// and skin tones take several code points.
+const maxEmojiLength = 32
+
+// react adds sender's reaction to message id, or removes it.
+func (room *Room) react(sender *Client, id uint64, emoji string, remove bool) {
+	if !isEmoji(emoji) {
+		sender.send(Message{Type: msgSystem, Content: "Reactions must be a single emoji."})
+		return
+	}
+	select {
+	case room.reactions <- reaction{from: sender, id: id, emoji: emoji, remove: remove}:
+	case <-room.done:
+	}
+}
+
+// isEmoji reports whether s plausibly is one emoji: short, with no letters,
+// digits, spaces or control characters.
+func isEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiLength || !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
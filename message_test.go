@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	for _, msg := range []Message{
+		{Type: msgChat, From: "alice", Content: "hello, world", TS: ts},
+		{Type: msgSystem, Content: "alice joined the chat", TS: ts},
+		{ID: 7, Type: msgChat, From: "bob", Content: "me too", ReplyTo: 3, Seq: 12, TS: ts},
+		{Type: msgPrivate, From: "alice", To: "bob,carol", Content: "c2VjcmV0", TS: ts},
+		{ID: 7, Type: msgReactions, Reactions: map[string]int{"👍": 2}, TS: ts},
+		{Type: msgFile, From: "alice", Content: "/files/abc", File: &FileInfo{Name: "a.txt", MIME: "text/plain", Size: 3}, TS: ts},
+		{Type: msgChat, Content: "quotes \" and \\ and\nnewlines ✓", TS: ts},
+	} {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := parseFrame(data)
+		if !ok {
+			t.Errorf("parseFrame(%s) failed", data)
+			continue
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("round trip of %s = %+v, want %+v", data, got, msg)
+		}
+	}
+}
+
+func TestMessageOmitsEmptyFields(t *testing.T) {
+	data, err := json.Marshal(Message{Type: msgChat, From: "alice", Content: "hi", TS: time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"chat","from":"alice","content":"hi","ts":"2024-05-17T12:00:00Z"}`; string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		data string
+		ok   bool
+		want Message
+	}{
+		{`{"type":"chat","content":"hi"}`, true, Message{Type: msgChat, Content: "hi"}},
+		{`{"type":"typing"}`, true, Message{Type: msgTyping}},
+		{`hello`, false, Message{}},
+		{`{"content":"no type"}`, false, Message{}},
+		{`{"type":"chat"`, false, Message{}},
+		{` {"type":"chat"}`, false, Message{}},
+		{`{not json} at all`, false, Message{}},
+		{``, false, Message{}},
+	}
+	for _, tt := range tests {
+		got, ok := parseFrame([]byte(tt.data))
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFrame(%q) = %+v, %v; want %+v, %v", tt.data, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func FuzzParseFrame(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"chat","content":"hi"}`,
+		`{"type":"private","to":"bob","content":"c2VjcmV0"}`,
+		`{"type":"react","id":42,"emoji":"👍"}`,
+		`{"type":"file-begin","file":{"name":"a.txt","size":5,"sha256":"00"}}`,
+		`{"type":"chat","content":"\ud800"}`,
+		`{"type":""}`,
+		`{"type":"chat"`,
+		`hello`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, ok := parseFrame(data)
+		if !ok {
+			if !reflect.DeepEqual(msg, Message{}) {
+				t.Fatalf("parseFrame(%q) refused the frame but returned %+v", data, msg)
+			}
+			return
+		}
+		if msg.Type == "" || data[0] != '{' || !json.Valid(data) {
+			t.Fatalf("parseFrame(%q) accepted %+v", data, msg)
+		}
+
+		// A frame the server accepted parses the same once sent back
+		again, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("re-encoding %+v: %v", msg, err)
+		}
+		if msg2, ok := parseFrame(again); !ok || msg2.Type != msg.Type || msg2.Content != msg.Content {
+			t.Fatalf("parseFrame(%q) = %+v, %v after parseFrame(%q) = %+v", again, msg2, ok, data, msg)
+		}
+	})
+}
+
+func TestPlainTextAndFramesAreBothChat(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("plain text")
+	bob.expect("the plain text message", isChat("alice", "plain text"))
+
+	alice.sendFrame(Message{Type: msgChat, Content: "a framed /saving"})
+	bob.expect("the framed message", isChat("alice", "a framed /saving"))
+
+	alice.sendFrame(Message{Type: "bogus"})
+	alice.expectContent(msgSystem, `Unsupported message type "bogus"`)
+}
+
+func TestMessagesAreTimestampedWithTheHubClock(t *testing.T) {
+	clock := time.Date(2024, 5, 17, 14, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.now = func() time.Time { return clock }
+	})
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("hello")
+	chat := alice.expect("alice's message", isChat("alice", "hello"))
+	alice.say("/who")
+	reply := alice.expectContent(msgCommand, "online")
+	alice.sendFrame(Message{Type: "bogus"})
+	notice := alice.expectContent(msgSystem, "Unsupported")
+	for _, msg := range []Message{chat, reply, notice} {
+		if !msg.TS.Equal(clock) || msg.TS.Location() != time.UTC {
+			t.Errorf("%s frame stamped %v, want %v in UTC", msg.Type, msg.TS, clock)
+		}
+	}
+}
+
+func TestTypingReachesEveryoneButTheTypist(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws/other?username=carol")
+
+	isTyping := func(msg Message) bool { return msg.Type == msgTyping && msg.From == "alice" }
+	alice.sendFrame(Message{Type: msgTyping})
+	bob.expect("alice typing", isTyping)
+
+	// More typing events within typingInterval are dropped
+	alice.sendFrame(Message{Type: msgTyping})
+	alice.say("done typing")
+	bob.expectNoneBefore("a second typing event", isTyping, isChat("alice", "done typing"))
+
+	clock.advance(typingInterval)
+	alice.sendFrame(Message{Type: msgTyping})
+	bob.expect("alice typing again", isTyping)
+
+	alice.expectQuiet("her own typing event", isTyping, 100*time.Millisecond)
+	carol.expectQuiet("typing in another room", isTyping, 100*time.Millisecond)
+}
+
+func TestTypingIsNotKeptInHistory(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	alice.sendFrame(Message{Type: msgTyping})
+	alice.say("hello")
+	alice.expect("her own message", isChat("alice", "hello"))
+
+	bob := ts.join(t, "/ws?username=bob")
+	for _, msg := range bob.before {
+		if msg.Type == msgTyping {
+			t.Errorf("typing event replayed to a late joiner: %+v", msg)
+		}
+	}
+}
+
+func TestIsEmoji(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"👍", true},
+		{"🎉", true},
+		{"❤️", true},
+		{"🇳🇴", true},
+		{"👍🏽", true},
+		{"👨‍👩‍👧", true},
+		{"", false},
+		{"a", false},
+		{"👍a", false},
+		{"1", false},
+		{"👍 👍", false},
+		{"\n", false},
+		{"\xff", false},
+		{strings.Repeat("👍", 9), false},
+	}
+	for _, tt := range tests {
+		if got := isEmoji(tt.s); got != tt.want {
+			t.Errorf("isEmoji(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestReactions(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	alice.say("lunch?")
+	id := bob.expect("alice's message", isChat("alice", "lunch?")).ID
+
+	// Every change sends everyone the message's counts
+	reactions := func(want string) func(Message) bool {
+		return func(msg Message) bool {
+			return msg.Type == msgReactions && msg.ID == id && fmt.Sprint(msg.Reactions) == want
+		}
+	}
+	bob.sendFrame(Message{Type: msgReact, ID: id, Emoji: "👍"})
+	alice.expect("one 👍", reactions("map[👍:1]"))
+	carol.sendFrame(Message{Type: msgReact, ID: id, Emoji: "👍"})
+	alice.expect("two 👍", reactions("map[👍:2]"))
+
+	// Reacting twice with one emoji counts once
+	bob.sendFrame(Message{Type: msgReact, ID: id, Emoji: "👍"})
+	bob.sendFrame(Message{Type: msgReact, ID: id, Emoji: "🍕"})
+	alice.expectNoneBefore("a third 👍", reactions("map[👍:3]"), reactions("map[🍕:1 👍:2]"))
+
+	bob.sendFrame(Message{Type: msgUnreact, ID: id, Emoji: "👍"})
+	carol.expect("one 👍 left", reactions("map[🍕:1 👍:1]"))
+	carol.sendFrame(Message{Type: msgUnreact, ID: id, Emoji: "👍"})
+	carol.expect("no 👍 left", reactions("map[🍕:1]"))
+}
+
+func TestReactionErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	alice.say("hello")
+	id := alice.expect("her own message", isChat("alice", "hello")).ID
+
+	alice.sendFrame(Message{Type: msgReact, ID: id, Emoji: "yes"})
+	alice.expectContent(msgSystem, "Reactions must be a single emoji.")
+	alice.sendFrame(Message{Type: msgReact, ID: id + 1000, Emoji: "👍"})
+	alice.expectContent(msgSystem, "That message is too old or doesn't exist, so you can't react to it.")
+}
+
+func TestReplies(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("lunch?")
+	id := bob.expect("alice's message", isChat("alice", "lunch?")).ID
+	bob.sendFrame(Message{Type: msgChat, Content: "yes!", ReplyTo: id})
+	reply := alice.expect("bob's reply", isChat("bob", "yes!"))
+	if reply.ReplyTo != id {
+		t.Errorf("reply to %d, want %d", reply.ReplyTo, id)
+	}
+
+	// Late joiners see what each reply answered
+	carol := ts.join(t, "/ws?username=carol")
+	found := false
+	for _, msg := range carol.before {
+		if isChat("bob", "yes!")(msg) {
+			found = msg.ReplyTo == id
+		}
+	}
+	if !found {
+		t.Errorf("reply not replayed with its ReplyTo: %+v", carol.before)
+	}
+}
+
+func TestRepliesToUnknownMessagesAreRefused(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.sendFrame(Message{Type: msgChat, Content: "what?", ReplyTo: 9999})
+	alice.expectContent(msgCommand, "The message you replied to is too old or doesn't exist, so your reply was not delivered.")
+	alice.sendFrame(Message{Type: msgChat, Content: "  "})
+	alice.expectContent(msgSystem, "Chat messages must not be empty.")
+
+	alice.say("hi")
+	bob.expectNoneBefore("the refused reply", isChat("alice", "what?"), isChat("alice", "hi"))
+}
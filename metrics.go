@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// serverMetrics counts what the server is doing, for the /metrics endpoint.
+type serverMetrics struct {
+	connectedClients  atomic.Int64
+	messagesBroadcast atomic.Int64
+	encryptionErrors  atomic.Int64
+	replaysRejected   atomic.Int64
+
+	slowClientsEvicted atomic.Int64
+	writeTimeouts      atomic.Int64
+
+	mutex    sync.Mutex
+	commands map[string]int64 // Processed commands by name
+}
+
+// metrics is the server-wide set of metrics.
+var metrics = &serverMetrics{commands: make(map[string]int64)}
+
+// commandProcessed counts a command. Unregistered names are counted as
+// "unknown" so clients can't create unbounded label values.
+func (m *serverMetrics) commandProcessed(name string) {
+	if !isCommand(name) {
+		name = "unknown"
+	}
+	m.mutex.Lock()
+	m.commands[name]++
+	m.mutex.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintf(w, "# HELP fastchat_connected_clients Number of connected WebSocket clients.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_connected_clients gauge\n")
+	fmt.Fprintf(w, "fastchat_connected_clients %d\n", m.connectedClients.Load())
+
+	fmt.Fprintf(w, "# HELP fastchat_messages_broadcast_total Messages broadcast to a room.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_messages_broadcast_total counter\n")
+	fmt.Fprintf(w, "fastchat_messages_broadcast_total %d\n", m.messagesBroadcast.Load())
+
+	fmt.Fprintf(w, "# HELP fastchat_slow_clients_evicted_total Clients disconnected for reading too slowly.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_slow_clients_evicted_total counter\n")
+	fmt.Fprintf(w, "fastchat_slow_clients_evicted_total %d\n", m.slowClientsEvicted.Load())
+
+	fmt.Fprintf(w, "# HELP fastchat_write_timeouts_total Clients disconnected because a write to them timed out.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_write_timeouts_total counter\n")
+	fmt.Fprintf(w, "fastchat_write_timeouts_total %d\n", m.writeTimeouts.Load())
+
+	fmt.Fprintf(w, "# HELP fastchat_commands_total Bot commands processed, by command.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_commands_total counter\n")
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.commands))
+	for name := range m.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "fastchat_commands_total{command=%q} %d\n", name, m.commands[name])
+	}
+	m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP fastchat_encryption_errors_total Private messages that failed to encrypt or decrypt.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_encryption_errors_total counter\n")
+	fmt.Fprintf(w, "fastchat_encryption_errors_total %d\n", m.encryptionErrors.Load())
+
+	fmt.Fprintf(w, "# HELP fastchat_replayed_private_messages_total Private messages refused because they were already delivered.\n")
+	fmt.Fprintf(w, "# TYPE fastchat_replayed_private_messages_total counter\n")
+	fmt.Fprintf(w, "fastchat_replayed_private_messages_total %d\n", m.replaysRejected.Load())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics fetches /metrics and returns each sample by its name and
+// labels, e.g. `fastchat_commands_total{command="help"}`.
+func scrapeMetrics(t *testing.T, ts *testServer) map[string]int64 {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/metrics: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[name] = n
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.metrics = true
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+
+	// The counters are shared by every server in the process, so only
+	// changes are checked
+	before := scrapeMetrics(t, ts)
+	if got := before["fastchat_connected_clients"]; got < 1 {
+		t.Errorf("fastchat_connected_clients = %d with alice connected", got)
+	}
+
+	alice.say("hello")
+	alice.expect("her own message", isChat("alice", "hello"))
+	alice.say("/help")
+	alice.expectContent(msgCommand, "can help with:")
+	alice.say("/xyzzy")
+	alice.expectContent(msgCommand, "Unknown command")
+
+	after := scrapeMetrics(t, ts)
+	for _, name := range []string{
+		"fastchat_messages_broadcast_total",
+		`fastchat_commands_total{command="help"}`,
+		`fastchat_commands_total{command="unknown"}`,
+	} {
+		if after[name] <= before[name] {
+			t.Errorf("%s went from %d to %d", name, before[name], after[name])
+		}
+	}
+	if _, ok := after[`fastchat_commands_total{command="xyzzy"}`]; ok {
+		t.Error("unregistered command counted under its own name")
+	}
+	for _, name := range []string{"fastchat_slow_clients_evicted_total", "fastchat_write_timeouts_total", "fastchat_encryption_errors_total", "fastchat_replayed_private_messages_total"} {
+		if _, ok := after[name]; !ok {
+			t.Errorf("%s missing", name)
+		}
+	}
+}
+
+func TestConnectedClientsGauge(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.metrics = true
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	connected := scrapeMetrics(t, ts)["fastchat_connected_clients"]
+
+	alice.leave()
+	deadline := time.Now().Add(testTimeout)
+	for scrapeMetrics(t, ts)["fastchat_connected_clients"] >= connected {
+		if time.Now().After(deadline) {
+			t.Fatal("fastchat_connected_clients didn't drop after alice left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsAreOffByDefault(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/metrics without -metrics: %s, want 404", resp.Status)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// isModerator reports whether token, from a client's mod_token query
+// parameter, is the moderator token. Nobody is a moderator when no token is
+// configured.
+func (h *Hub) isModerator(token string) bool {
+	return h.cfg.modToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.modToken)) == 1
+}
+
+// isBannedName reports whether clients may not join as name.
+func (h *Hub) isBannedName(name string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.bannedNames[name]
+}
+
+// ban refuses future connections using name or coming from ip. Bans last
+// until the server restarts; -banned-ips makes an IP ban permanent.
+func (h *Hub) ban(name, ip string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.bannedNames[name] = true
+	h.banned[ip] = true
+}
+
+// kick tells client why it is being removed and closes its connection. The
+// client's read loop then fails and cleans up as for any disconnect.
+func kick(client *Client, reason string) {
+	client.kicked.Store(true)
+	client.send(Message{Type: msgSystem, Content: reason})
+	client.closeWith(websocket.ClosePolicyViolation, reason)
+}
+
+// moderationTarget finds the client a moderator named in a /kick or /ban
+// command, telling the sender what went wrong if there isn't one.
+func (room *Room) moderationTarget(sender *Client, command string, args []string) *Client {
+	if !sender.isMod {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "mod.only", command)})
+		return nil
+	}
+	if len(args) != 1 {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "mod.usage", command)})
+		return nil
+	}
+
+	name := args[0]
+	var target *Client
+	for _, client := range room.snapshot() {
+		if client.name() == name {
+			target = client
+			break
+		}
+	}
+	switch {
+	case target == nil:
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "user.notFound", name)})
+		return nil
+	case target == sender:
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "mod.self", command)})
+		return nil
+	case target.isMod:
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "mod.protected", name)})
+		return nil
+	}
+	return target
+}
+
+// kickCommand disconnects a user. They may reconnect straight away.
+func (room *Room) kickCommand(sender *Client, args []string) {
+	target := room.moderationTarget(sender, cmdKick, args)
+	if target == nil {
+		return
+	}
+
+	name, mod := target.name(), sender.name()
+	infof("Moderator %s kicked %s from %s (room %s)", mod, name, target.ip, room.name)
+	kick(target, translate(room.bot.lang, "kick.you", mod))
+	room.handleMessage([]byte(translate(room.bot.lang, "kick.done", name, mod)), nil)
+}
+
+// banCommand disconnects a user and refuses their name and IP address from
+// then on.
+func (room *Room) banCommand(sender *Client, args []string) {
+	target := room.moderationTarget(sender, cmdBan, args)
+	if target == nil {
+		return
+	}
+
+	name, mod := target.name(), sender.name()
+	infof("Moderator %s banned %s from %s (room %s)", mod, name, target.ip, room.name)
+	sender.hub.ban(name, target.ip)
+	kick(target, translate(room.bot.lang, "ban.you", mod))
+	room.handleMessage([]byte(translate(room.bot.lang, "ban.done", name, mod)), nil)
+}
+
+// clearCommand wipes the room's history, here and on other instances, and
+// tells clients to clear their view. "/clear all" also deletes the room's
+// saved messages, so they don't come back after a restart.
+func (room *Room) clearCommand(sender *Client, args []string) {
+	if !sender.isMod {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "mod.only", cmdClear)})
+		return
+	}
+	all := len(args) == 1 && strings.EqualFold(args[0], "all")
+	if len(args) > 1 || (len(args) == 1 && !all) {
+		sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "clear.usage")})
+		return
+	}
+
+	if all {
+		if err := room.store.Clear(room.name); err != nil {
+			errorf("Clearing saved messages in room %s: %v", room.name, err)
+			sender.send(Message{Type: msgSystem, Content: translate(room.bot.lang, "clear.failed")})
+			return
+		}
+	}
+	room.clearHistory()
+
+	mod := sender.name()
+	infof("Moderator %s cleared the history of room %s (saved messages too: %v)", mod, room.name, all)
+	room.handleMessage([]byte(translate(room.bot.lang, "clear.done", mod)), nil)
+}
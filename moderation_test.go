@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newModServer starts a test server with moderation on and joins a
+// moderator, alice, and a regular user, bob, to the default room.
+func newModServer(t *testing.T) (ts *testServer, alice, bob *testClient) {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.modToken = "m0d"
+	ts = newTestServer(t, cfg)
+	alice = ts.join(t, "/ws?username=alice&mod_token=m0d")
+	bob = ts.join(t, "/ws?username=bob")
+	return ts, alice, bob
+}
+
+func TestKickCommand(t *testing.T) {
+	ts, alice, bob := newModServer(t)
+
+	alice.say("/kick bob")
+	bob.expectContent(msgSystem, "You were kicked by alice.")
+	if err := bob.expectClosed(); !isCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("bob's connection ended with %v, want a policy violation close", err)
+	}
+	alice.expectContent(msgSystem, "bob was kicked by alice")
+
+	// A kick isn't a ban
+	if bob := ts.join(t, "/ws?username=bob"); bob.name != "bob" {
+		t.Errorf("rejoined as %q", bob.name)
+	}
+}
+
+func TestBanCommand(t *testing.T) {
+	ts, alice, bob := newModServer(t)
+
+	alice.say("/ban bob")
+	bob.expectContent(msgSystem, "You were banned by alice.")
+	bob.expectClosed()
+	alice.expectContent(msgSystem, "bob was banned by alice")
+
+	if !ts.hub.isBannedName("bob") || !ts.hub.isBanned("127.0.0.1") {
+		t.Fatal("bob's name and IP aren't banned")
+	}
+	// Every test client shares bob's IP, so lift that to check the name
+	ts.hub.mutex.Lock()
+	delete(ts.hub.banned, "127.0.0.1")
+	ts.hub.mutex.Unlock()
+	_, resp, err := ts.connect(t, "/ws?username=bob", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("banned name rejoining got %v, want 403", err)
+	}
+}
+
+func TestNickCantTakeABannedName(t *testing.T) {
+	ts, alice, bob := newModServer(t)
+	carol := ts.join(t, "/ws?username=carol")
+
+	alice.say("/ban bob")
+	bob.expectClosed()
+	carol.say("/nick bob")
+	carol.expectContent(msgSystem, "Can't change your name: the name bob is banned")
+	carol.say("hi")
+	alice.expect("carol's message under her own name", isChat("carol", "hi"))
+}
+
+func TestModerationIsRefused(t *testing.T) {
+	ts, alice, bob := newModServer(t)
+	mod := ts.join(t, "/ws?username=dave&mod_token=m0d")
+
+	for _, tt := range []struct {
+		client      *testClient
+		input, want string
+	}{
+		{bob, "/kick alice", "Only moderators can use /kick."},
+		{bob, "/ban alice", "Only moderators can use /ban."},
+		{alice, "/kick", "Usage: /kick <username>"},
+		{alice, "/kick nobody", "User nobody not found"},
+		{alice, "/ban alice", "You can't /ban yourself."},
+		{alice, "/kick dave", "dave is a moderator and can't be removed."},
+	} {
+		tt.client.say(tt.input)
+		tt.client.expectContent(msgSystem, tt.want)
+	}
+	mod.say("still here")
+	bob.expect("dave's message", isChat("dave", "still here"))
+}
+
+func TestWrongModTokenIsNoModerator(t *testing.T) {
+	ts, _, bob := newModServer(t)
+	mallory := ts.join(t, "/ws?username=mallory&mod_token=guess")
+	mallory.say("/kick bob")
+	mallory.expectContent(msgSystem, "Only moderators can use /kick.")
+	bob.say("still here")
+	bob.expect("his own message", isChat("bob", "still here"))
+}
+
+// clearingStore records the rooms it is asked to clear, failing with err
+// if it is set.
+type clearingStore struct {
+	nopStore
+	cleared chan string
+	err     error
+}
+
+func (s clearingStore) Clear(roomName string) error {
+	s.cleared <- roomName
+	return s.err
+}
+
+// chatInHistory reports whether the room's history holds a chat message
+// with the given text.
+func chatInHistory(room *Room, text string) bool {
+	for _, msg := range room.historyMessages() {
+		if msg.Type == msgChat && msg.Content == text {
+			return true
+		}
+	}
+	return false
+}
+
+func isClear(msg Message) bool { return msg.Type == msgClear }
+
+func TestClearCommand(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.modToken = "m0d"
+	store := clearingStore{cleared: make(chan string, 1)}
+	ts := newTestServer(t, cfg, func(h *Hub) { h.store = store })
+	alice := ts.join(t, "/ws?username=alice&mod_token=m0d")
+	bob := ts.join(t, "/ws?username=bob")
+	room := ts.room(t, defaultRoom)
+
+	bob.say("old news")
+	alice.expect("bob's message", isChat("bob", "old news"))
+	alice.say("/clear")
+	bob.expect("the clear", isClear)
+	bob.expectContent(msgSystem, "History cleared by alice")
+	if chatInHistory(room, "old news") {
+		t.Error("history still has bob's message")
+	}
+	select {
+	case name := <-store.cleared:
+		t.Errorf("/clear without all cleared the saved messages of %s", name)
+	default:
+	}
+	carol := ts.join(t, "/ws?username=carol")
+	for _, msg := range carol.before {
+		if msg.Content == "old news" {
+			t.Error("carol was sent the cleared message")
+		}
+	}
+
+	alice.say("/clear all")
+	bob.expect("the clear", isClear)
+	if name := <-store.cleared; name != defaultRoom {
+		t.Errorf("cleared the saved messages of %q, want %q", name, defaultRoom)
+	}
+
+	alice.say("/clear everything")
+	alice.expectContent(msgSystem, "Usage: /clear [all]")
+}
+
+func TestClearIsForModeratorsOnly(t *testing.T) {
+	ts, alice, bob := newModServer(t)
+	room := ts.room(t, defaultRoom)
+
+	alice.say("keep this")
+	bob.expect("alice's message", isChat("alice", "keep this"))
+	bob.say("/clear all")
+	bob.expectContent(msgSystem, "Only moderators can use /clear.")
+	bob.say("done")
+	alice.expectNoneBefore("a clear", isClear, isChat("bob", "done"))
+	if !chatInHistory(room, "keep this") {
+		t.Error("a regular user cleared the history")
+	}
+}
+
+func TestClearKeepsHistoryWhenTheStoreFails(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.modToken = "m0d"
+	store := clearingStore{cleared: make(chan string, 1), err: errors.New("database is locked")}
+	ts := newTestServer(t, cfg, func(h *Hub) { h.store = store })
+	alice := ts.join(t, "/ws?username=alice&mod_token=m0d")
+
+	alice.say("keep this")
+	alice.expect("her message", isChat("alice", "keep this"))
+	alice.say("/clear all")
+	alice.expectContent(msgSystem, "The saved messages could not be deleted.")
+	if !chatInHistory(ts.room(t, defaultRoom), "keep this") {
+		t.Error("history was cleared though the saved messages weren't")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxMOTDSize bounds the message of the day, which every joining client is
+// sent.
+const maxMOTDSize = 4096
+
+// loadMOTD reads the message of the day from a file, without trailing
+// whitespace. An empty file means no message.
+func loadMOTD(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxMOTDSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", path, maxMOTDSize)
+	}
+	return strings.TrimRight(string(data), " \t\r\n"), nil
+}
+
+// motdText returns the message of the day, or "" if there is none.
+func (h *Hub) motdText() string {
+	if motd := h.motd.Load(); motd != nil {
+		return *motd
+	}
+	return ""
+}
+
+// reloadMOTD rereads -motd-file. On failure the previous message is kept.
+func (h *Hub) reloadMOTD() error {
+	motd, err := loadMOTD(h.cfg.motdFile)
+	if err != nil {
+		return err
+	}
+	h.motd.Store(&motd)
+	return nil
+}
+
+// watchMOTD reloads -motd-file on every signal, such as SIGHUP, until ctx
+// is done.
+func (h *Hub) watchMOTD(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if err := h.reloadMOTD(); err != nil {
+				errorf("Cannot reload message of the day, keeping the old one: %v", err)
+				continue
+			}
+			infof("Reloaded message of the day from %s", h.cfg.motdFile)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// isMOTD matches the message of the day.
+func isMOTD(text string) func(Message) bool {
+	return func(msg Message) bool { return msg.Type == msgSystem && msg.Content == text }
+}
+
+// sentBefore reports whether the client was sent a frame matching match
+// before its own join notice.
+func sentBefore(c *testClient, match func(Message) bool) bool {
+	for _, msg := range c.before {
+		if match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMOTDIsSentOnJoin(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.motd = "Welcome! Be nice."
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	// Each client gets it privately, before its join is announced
+	for _, c := range []*testClient{alice, bob} {
+		if !sentBefore(c, isMOTD("Welcome! Be nice.")) {
+			t.Errorf("%s wasn't sent the message of the day before joining: %+v", c.name, c.before)
+		}
+	}
+	alice.expectNoneBefore("bob's message of the day", isMOTD("Welcome! Be nice."), func(msg Message) bool {
+		return msg.Content == "bob joined the chat"
+	})
+}
+
+func TestNoMOTDByDefault(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	if sentBefore(alice, func(msg Message) bool { return msg.Type == msgSystem }) {
+		t.Errorf("sent a notice before joining without a message of the day: %+v", alice.before)
+	}
+}
+
+func TestMOTDReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.txt")
+	write := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Welcome!\n\n")
+	cfg := testConfig(t)
+	cfg.motdFile = path
+	hangups := make(chan os.Signal)
+	ts := newTestServer(t, cfg, func(h *Hub) {
+		if err := h.reloadMOTD(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go h.watchMOTD(ctx, hangups)
+	})
+	alice := ts.join(t, "/ws?username=alice")
+	if !sentBefore(alice, isMOTD("Welcome!")) {
+		t.Fatalf("alice wasn't sent the message of the day: %+v", alice.before)
+	}
+
+	// The unbuffered sends return once watchMOTD has taken each signal, and
+	// the second only after the first was handled
+	write("Maintenance at 22:00")
+	hangups <- syscall.SIGHUP
+	hangups <- syscall.SIGHUP
+	bob := ts.join(t, "/ws?username=bob")
+	if !sentBefore(bob, isMOTD("Maintenance at 22:00")) {
+		t.Fatalf("bob wasn't sent the reloaded message of the day: %+v", bob.before)
+	}
+
+	// A file that can't be read keeps the old message
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	hangups <- syscall.SIGHUP
+	hangups <- syscall.SIGHUP
+	if got := ts.hub.motdText(); got != "Maintenance at 22:00" {
+		t.Errorf("message of the day = %q after a failed reload, want the old one", got)
+	}
+}
+
+func TestLoadMOTD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", maxMOTDSize+1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMOTD(path); err == nil {
+		t.Error("loaded a message of the day over the size limit")
+	}
+	if _, err := loadMOTD(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loaded a missing file")
+	}
+	if err := os.WriteFile(path, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if motd, err := loadMOTD(path); err != nil || motd != "" {
+		t.Errorf("blank file = %q, %v; want no message", motd, err)
+	}
+}
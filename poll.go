@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxPollOptions is the most options a poll may have.
+const maxPollOptions = 10
+
+// poll is a room's open poll. Each user has one vote. Users are told
+// apart by client identity, which survives /nick and resumed sessions.
+type poll struct {
+	question string
+	options  []string
+	creator  uint64         // Identity of the client that opened the poll
+	votes    map[uint64]int // Option index by client identity
+}
+
+// results formats the poll's question and current tally in lang.
+func (p *poll) results(lang string) string {
+	counts := make([]int, len(p.options))
+	for _, option := range p.votes {
+		counts[option]++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "📊 %s", p.question)
+	for i, option := range p.options {
+		if counts[i] == 1 {
+			b.WriteString(translate(lang, "poll.vote", i+1, option, counts[i]))
+		} else {
+			b.WriteString(translate(lang, "poll.votes", i+1, option, counts[i]))
+		}
+		if len(p.votes) > 0 && counts[i] > 0 {
+			fmt.Fprintf(&b, " (%d%%)", counts[i]*100/len(p.votes))
+		}
+	}
+	return b.String()
+}
+
+// pollCommand opens a poll from input like `"Lunch?" Pizza Sushi Tacos`.
+// Quotes group words into one question or option.
+func (room *Room) pollCommand(sender *Client, input string) {
+	const usage = `Usage: /poll "<question>" <option> <option>..., e.g. /poll "Lunch?" Pizza Sushi`
+	fields, err := splitQuoted(input)
+	if err != nil {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("%v. %s", err, usage)})
+		return
+	}
+	if len(fields) < 3 || len(fields) > maxPollOptions+1 {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("A poll needs a question and 2 to %d options. %s", maxPollOptions, usage)})
+		return
+	}
+	for _, field := range fields {
+		if strings.TrimSpace(field) == "" {
+			sender.send(Message{Type: msgSystem, Content: "The question and options must not be empty. " + usage})
+			return
+		}
+	}
+
+	p := &poll{question: fields[0], options: fields[1:], creator: sender.identity, votes: make(map[uint64]int)}
+	room.pollMu.Lock()
+	if room.poll != nil {
+		room.pollMu.Unlock()
+		sender.send(Message{Type: msgSystem, Content: "A poll is already open here. Close it with /endpoll first."})
+		return
+	}
+	room.poll = p
+	room.pollMu.Unlock()
+
+	room.bot.SendMessage(translate(room.bot.lang, "poll.started", p.results(room.bot.lang), sender.name()))
+}
+
+// voteCommand records the sender's vote in the open poll, unless they have
+// already voted.
+func (room *Room) voteCommand(sender *Client, args []string) {
+	room.pollMu.Lock()
+	defer room.pollMu.Unlock()
+
+	p := room.poll
+	if p == nil {
+		sender.send(Message{Type: msgSystem, Content: "There is no open poll. Start one with /poll."})
+		return
+	}
+	choice := 0
+	if len(args) == 1 {
+		choice, _ = strconv.Atoi(args[0])
+	}
+	if choice < 1 || choice > len(p.options) {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Usage: /vote <number>, where the number is between 1 and %d", len(p.options))})
+		return
+	}
+
+	if previous, voted := p.votes[sender.identity]; voted {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("You already voted for %s.", p.options[previous])})
+		return
+	}
+	p.votes[sender.identity] = choice - 1
+	sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Your vote for %s is counted.", p.options[choice-1])})
+}
+
+// resultsText returns the open poll's tally.
+func (room *Room) resultsText() string {
+	room.pollMu.Lock()
+	defer room.pollMu.Unlock()
+
+	if room.poll == nil {
+		return translate(room.bot.lang, "poll.none")
+	}
+	return room.poll.results(room.bot.lang)
+}
+
+// endPollCommand closes the open poll and posts its final tally. Only the
+// poll's creator or a moderator may close it.
+func (room *Room) endPollCommand(sender *Client) {
+	room.pollMu.Lock()
+	p := room.poll
+	switch {
+	case p == nil:
+		room.pollMu.Unlock()
+		sender.send(Message{Type: msgSystem, Content: "There is no open poll."})
+		return
+	case p.creator != sender.identity && !sender.isMod:
+		room.pollMu.Unlock()
+		sender.send(Message{Type: msgSystem, Content: "Only the poll's creator or a moderator can close it."})
+		return
+	}
+	room.poll = nil
+	room.pollMu.Unlock()
+
+	room.bot.SendMessage(translate(room.bot.lang, "poll.closed", p.results(room.bot.lang)))
+}
+
+// splitQuoted splits s into words like strings.Fields, except that text in
+// double quotes is kept together as one word.
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if inWord {
+				fields = append(fields, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		fields = append(fields, word.String())
+	}
+	return fields, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+		err   bool
+	}{
+		{`"Lunch?" Pizza Sushi`, []string{"Lunch?", "Pizza", "Sushi"}, false},
+		{`"Where to?" "New York" Oslo`, []string{"Where to?", "New York", "Oslo"}, false},
+		{"  a \t b\nc  ", []string{"a", "b", "c"}, false},
+		{`"" x`, []string{"", "x"}, false},
+		{`half"quoted word" x`, []string{"halfquoted word", "x"}, false},
+		{"", nil, false},
+		{`"unterminated x`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitQuoted(tt.input)
+		if (err != nil) != tt.err || strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("splitQuoted(%q) = %q, %v; want %q", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	alice.say(`/poll "Lunch?" Pizza Sushi "Fish soup"`)
+	bob.expectContent(msgCommand, "📊 Lunch?\n1. Pizza: 0 votes\n2. Sushi: 0 votes\n3. Fish soup: 0 votes\nStarted by alice. Vote with /vote <number>.")
+
+	bob.say("/vote 2")
+	bob.expectContent(msgSystem, "Your vote for Sushi is counted.")
+	carol.say("/vote 2")
+	carol.expectContent(msgSystem, "Your vote for Sushi is counted.")
+	alice.say("/vote 1")
+	alice.expectContent(msgSystem, "Your vote for Pizza is counted.")
+	bob.say("/vote 1")
+	bob.expectContent(msgSystem, "You already voted for Sushi.")
+
+	bob.say("/results")
+	bob.expectContent(msgCommand, "📊 Lunch?\n1. Pizza: 1 vote (33%)\n2. Sushi: 2 votes (66%)\n3. Fish soup: 0 votes")
+
+	alice.say(`/poll "Another?" Yes No`)
+	alice.expectContent(msgSystem, "A poll is already open here.")
+	bob.say("/endpoll")
+	bob.expectContent(msgSystem, "Only the poll's creator or a moderator can close it.")
+
+	alice.say("/endpoll")
+	carol.expectContent(msgCommand, "Poll closed.\n📊 Lunch?\n1. Pizza: 1 vote (33%)\n2. Sushi: 2 votes (66%)")
+	bob.say("/vote 1")
+	bob.expectContent(msgSystem, "There is no open poll.")
+}
+
+func TestPollErrors(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	for _, tt := range []struct{ input, want string }{
+		{"/poll", "A poll needs a question and 2 to 10 options."},
+		{`/poll "Lunch?" Pizza`, "A poll needs a question and 2 to 10 options."},
+		{`/poll "Lunch? Pizza Sushi`, "unterminated quote. Usage: /poll"},
+		{`/poll "Lunch?" "" Sushi`, "The question and options must not be empty."},
+		{"/poll q 1 2 3 4 5 6 7 8 9 10 11", "A poll needs a question and 2 to 10 options."},
+		{"/vote 1", "There is no open poll. Start one with /poll."},
+		{"/results", "There is no open poll."},
+		{"/endpoll", "There is no open poll."},
+	} {
+		alice.say(tt.input)
+		alice.expect(tt.want, func(msg Message) bool { return strings.Contains(msg.Content, tt.want) })
+	}
+
+	alice.say(`/poll "Lunch?" Pizza Sushi`)
+	alice.expectContent(msgCommand, "Started by alice.")
+	for _, vote := range []string{"/vote", "/vote 0", "/vote 3", "/vote pizza", "/vote 1 2"} {
+		alice.say(vote)
+		alice.expectContent(msgSystem, "Usage: /vote <number>, where the number is between 1 and 2")
+	}
+}
+
+func TestRenamingDoesntGiveAnotherVote(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say(`/poll "Lunch?" Pizza Sushi`)
+	bob.expectContent(msgCommand, "Started by alice.")
+	bob.say("/vote 1")
+	bob.expectContent(msgSystem, "Your vote for Pizza is counted.")
+	bob.say("/nick robert")
+	bob.expectContent(msgSystem, "bob is now known as robert")
+	bob.say("/vote 1")
+	bob.expectContent(msgSystem, "You already voted for Pizza.")
+
+	// Nor does reconnecting, when the session is resumed
+	bob = ts.reconnect(t, bob, "/ws?username=robert")
+	bob.say("/vote 2")
+	bob.expectContent(msgSystem, "You already voted for Pizza.")
+	bob.say("/results")
+	bob.expectContent(msgCommand, "1. Pizza: 1 vote (100%)\n2. Sushi: 0 votes")
+}
+
+func TestPollCreatorCanCloseAfterReconnecting(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say(`/poll "Lunch?" Pizza Sushi`)
+	bob.expectContent(msgCommand, "Started by alice.")
+
+	alice = ts.reconnect(t, alice, "/ws?username=alice")
+	if alice.name != "alice" {
+		t.Fatalf("resumed as %q", alice.name)
+	}
+	alice.say("/endpoll")
+	bob.expectContent(msgCommand, "Poll closed.")
+}
+
+func TestModeratorCanClosePoll(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.modToken = "m0d"
+	ts := newTestServer(t, cfg)
+	alice := ts.join(t, "/ws?username=alice")
+	mod := ts.join(t, "/ws?username=mod&mod_token=m0d")
+
+	alice.say(`/poll "Lunch?" Pizza Sushi`)
+	mod.expectContent(msgCommand, "Started by alice.")
+	mod.say("/endpoll")
+	alice.expectContent(msgCommand, "Poll closed.")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// profanityFilter masks listed words in chat. Only whole words match, so a
+// listed word inside a longer one, as in "Scunthorpe", is left alone.
+type profanityFilter struct {
+	words map[string]bool // Lowercased
+}
+
+// loadProfanityList reads a filter from a file with one word per line.
+// Blank lines and lines starting with "#" are ignored.
+func loadProfanityList(path string) (*profanityFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	filter := &profanityFilter{words: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if strings.IndexFunc(word, func(r rune) bool { return !isWordRune(r) }) >= 0 {
+			return nil, fmt.Errorf("%s:%d: %q is not a single word", path, line, word)
+		}
+		filter.words[strings.ToLower(word)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// mask replaces every listed word in text, in any case, with one "*" per
+// letter.
+func (f *profanityFilter) mask(text string) string {
+	var b strings.Builder
+	start := -1 // Start of the word being scanned, or -1 between words
+	flush := func(end int) {
+		word := text[start:end]
+		if f.words[strings.ToLower(word)] {
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(word)))
+		} else {
+			b.WriteString(word)
+		}
+		start = -1
+	}
+
+	for i, r := range text {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			flush(i)
+		}
+		b.WriteRune(r)
+	}
+	if start >= 0 {
+		flush(len(text))
+	}
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeProfanityList writes words to a list file and loads it.
+func writeProfanityList(t *testing.T, lines ...string) (*profanityFilter, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return loadProfanityList(path)
+}
+
+func TestProfanityMask(t *testing.T) {
+	filter, err := writeProfanityList(t, "# Words to mask", "", "darn", "  Heck  ", "fæn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text, want string
+	}{
+		{"darn it", "**** it"},
+		{"DARN it", "**** it"},
+		{"oh heck, darn!", "oh ****, ****!"},
+		{"darndest darned undarn", "darndest darned undarn"},
+		{"Scunthorpe", "Scunthorpe"},
+		{"fæn ta", "*** ta"},
+		{"darn-darn", "****-****"},
+		{"nothing to see", "nothing to see"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := filter.mask(tt.text); got != tt.want {
+			t.Errorf("mask(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLoadProfanityListRejectsPhrases(t *testing.T) {
+	if _, err := writeProfanityList(t, "darn", "oh heck"); err == nil || !strings.Contains(err.Error(), `:2: "oh heck" is not a single word`) {
+		t.Errorf("loading a phrase: %v", err)
+	}
+	if _, err := loadProfanityList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestChatIsMasked(t *testing.T) {
+	filter, err := writeProfanityList(t, "darn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.filter = filter })
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("darn it")
+	bob.expect("the masked message", isChat("alice", "**** it"))
+	alice.sendFrame(Message{Type: msgChat, Content: "Darn again"})
+	bob.expect("the masked frame", isChat("alice", "**** again"))
+
+	// Actions are masked too
+	alice.say("/me says darn")
+	bob.expect("the masked action", func(msg Message) bool { return msg.Type == msgAction && msg.Content == "* alice says ****" })
+}
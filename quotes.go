@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// QuoteProvider looks up stock prices. Quote returns the latest price of
+// symbol and the currency it is quoted in.
+type QuoteProvider interface {
+	Quote(symbol string) (float64, string, error)
+}
+
+// errUnknownSymbol is returned by a QuoteProvider that has no quote for the
+// requested symbol.
+var errUnknownSymbol = errors.New("unknown symbol")
+
+// defaultQuotesURL serves Yahoo Finance charts, whose metadata carries the
+// latest price.
+const defaultQuotesURL = "https://query1.finance.yahoo.com/v8/finance/chart/"
+
+// quoteCacheTTL is how long a quote is reused before asking upstream again.
+const quoteCacheTTL = time.Minute
+
+// httpQuoteProvider fetches quotes from a Yahoo-compatible chart API.
+type httpQuoteProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+func newHTTPQuoteProvider(baseURL string) *httpQuoteProvider {
+	return &httpQuoteProvider{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		baseURL: baseURL,
+	}
+}
+
+func (p *httpQuoteProvider) Quote(symbol string) (float64, string, error) {
+	resp, err := p.client.Get(p.baseURL + url.PathEscape(symbol))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, "", errUnknownSymbol
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("quote lookup failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Chart struct {
+			Result []struct {
+				Meta struct {
+					Currency           string  `json:"currency"`
+					RegularMarketPrice float64 `json:"regularMarketPrice"`
+				} `json:"meta"`
+			} `json:"result"`
+		} `json:"chart"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, "", fmt.Errorf("quote lookup failed: %w", err)
+	}
+	if len(body.Chart.Result) == 0 || body.Chart.Result[0].Meta.RegularMarketPrice <= 0 {
+		return 0, "", errUnknownSymbol
+	}
+	meta := body.Chart.Result[0].Meta
+	return meta.RegularMarketPrice, meta.Currency, nil
+}
+
+// cachedQuoteProvider remembers quotes from another provider for ttl, so a
+// busy room asking for the same symbol doesn't hammer the upstream. Errors
+// aren't cached.
+type cachedQuoteProvider struct {
+	next QuoteProvider
+	ttl  time.Duration
+	now  func() time.Time
+
+	mutex  sync.Mutex
+	quotes map[string]cachedQuote
+}
+
+type cachedQuote struct {
+	price    float64
+	currency string
+	fetched  time.Time
+}
+
+func newCachedQuoteProvider(next QuoteProvider, ttl time.Duration) *cachedQuoteProvider {
+	return &cachedQuoteProvider{
+		next:   next,
+		ttl:    ttl,
+		now:    time.Now,
+		quotes: make(map[string]cachedQuote),
+	}
+}
+
+func (p *cachedQuoteProvider) Quote(symbol string) (float64, string, error) {
+	p.mutex.Lock()
+	quote, ok := p.quotes[symbol]
+	p.mutex.Unlock()
+	if ok && p.now().Sub(quote.fetched) < p.ttl {
+		return quote.price, quote.currency, nil
+	}
+
+	price, currency, err := p.next.Quote(symbol)
+	if err != nil {
+		return 0, "", err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// Drop stale entries as we go so symbols nobody asks for again don't
+	// pile up
+	for s, q := range p.quotes {
+		if p.now().Sub(q.fetched) >= p.ttl {
+			delete(p.quotes, s)
+		}
+	}
+	p.quotes[symbol] = cachedQuote{price: price, currency: currency, fetched: p.now()}
+	return price, currency, nil
+}
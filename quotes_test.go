@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQuotes is a QuoteProvider with fixed prices, in NOK for Oslo Børs
+// symbols (.OL) and USD for the rest. It counts the lookups it answers;
+// with err set every lookup fails with it.
+type fakeQuotes struct {
+	prices map[string]float64
+	err    error
+
+	mutex   sync.Mutex
+	lookups int
+}
+
+func (f *fakeQuotes) Quote(symbol string) (float64, string, error) {
+	f.mutex.Lock()
+	f.lookups++
+	f.mutex.Unlock()
+	if f.err != nil {
+		return 0, "", f.err
+	}
+	price, ok := f.prices[symbol]
+	if !ok {
+		return 0, "", errUnknownSymbol
+	}
+	currency := "USD"
+	if strings.HasSuffix(symbol, ".OL") {
+		currency = "NOK"
+	}
+	return price, currency, nil
+}
+
+func (f *fakeQuotes) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lookups
+}
+
+// timeoutError is a net.Error that timed out, like an http.Client's.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStockCommand(t *testing.T) {
+	quotes := &fakeQuotes{prices: map[string]float64{"AAPL": 189.8412, "EQNR.OL": 1234.5}}
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"AAPL", "📊 AAPL: 189,84 USD"},
+		{"aapl", "📊 AAPL: 189,84 USD"},
+		{"EQNR.OL", "📊 EQNR.OL: 1.234,50 NOK"},
+		{"MSFT", "⚠️ I don't have a quote for MSFT."},
+		{"", "⚠️ Usage: /stock <symbol>"},
+		{"AAPL MSFT", "⚠️ Usage: /stock <symbol>"},
+		{"AA/PL", `⚠️ Invalid symbol "AA/PL"`},
+	}
+	for _, tt := range tests {
+		if got := stockCommand(defaultLang, strings.Fields(tt.args), quotes, defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/stock %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+
+	enUS, _ := findLocale("en-US")
+	if got, want := stockCommand(defaultLang, []string{"EQNR.OL"}, quotes, enUS), "📊 EQNR.OL: 1,234.50 NOK"; got != want {
+		t.Errorf("/stock in en-US = %q, want %q", got, want)
+	}
+
+	slow := &fakeQuotes{err: fmt.Errorf("quote lookup: %w", timeoutError{})}
+	if got := stockCommand(defaultLang, []string{"AAPL"}, slow, defaultLocale); !strings.Contains(got, "didn't answer in time") {
+		t.Errorf("/stock with the provider timing out = %q", got)
+	}
+	down := &fakeQuotes{err: errors.New("connection refused")}
+	if got := stockCommand(defaultLang, []string{"AAPL"}, down, defaultLocale); !strings.Contains(got, "Stock quotes are unavailable") {
+		t.Errorf("/stock with the provider down = %q", got)
+	}
+}
+
+func TestStockCommandInARoom(t *testing.T) {
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.quotes = &fakeQuotes{prices: map[string]float64{"AAPL": 190}}
+	})
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/stock aapl")
+	alice.expectContent(msgCommand, "📊 AAPL: 190,00 USD")
+}
+
+func TestCachedQuoteProvider(t *testing.T) {
+	upstream := &fakeQuotes{prices: map[string]float64{"AAPL": 190, "EQNR.OL": 300}}
+	clock := newFakeClock()
+	cache := newCachedQuoteProvider(upstream, time.Minute)
+	cache.now = clock.now
+
+	for range 3 {
+		if price, currency, err := cache.Quote("AAPL"); err != nil || price != 190 || currency != "USD" {
+			t.Fatalf("Quote(AAPL) = %v, %q, %v", price, currency, err)
+		}
+	}
+	if n := upstream.count(); n != 1 {
+		t.Errorf("%d upstream lookups for three quotes within the TTL, want 1", n)
+	}
+
+	// Each symbol is cached on its own
+	cache.Quote("EQNR.OL")
+	if n := upstream.count(); n != 2 {
+		t.Errorf("%d upstream lookups after a second symbol, want 2", n)
+	}
+
+	// A fresh price is fetched once the TTL has passed
+	upstream.prices["AAPL"] = 195
+	clock.advance(59 * time.Second)
+	if price, _, _ := cache.Quote("AAPL"); price != 190 {
+		t.Errorf("price just inside the TTL = %v, want the cached 190", price)
+	}
+	clock.advance(time.Second)
+	if price, _, _ := cache.Quote("AAPL"); price != 195 {
+		t.Errorf("price after the TTL = %v, want the fresh 195", price)
+	}
+	if n := upstream.count(); n != 3 {
+		t.Errorf("%d upstream lookups after the TTL, want 3", n)
+	}
+	// ... and stale entries for other symbols are dropped on the way
+	cache.mutex.Lock()
+	_, stale := cache.quotes["EQNR.OL"]
+	cache.mutex.Unlock()
+	if stale {
+		t.Error("a stale quote was kept")
+	}
+
+	// Errors aren't cached, so the next lookup asks again
+	for range 2 {
+		if _, _, err := cache.Quote("MSFT"); !errors.Is(err, errUnknownSymbol) {
+			t.Errorf("Quote(MSFT): %v, want errUnknownSymbol", err)
+		}
+	}
+	if n := upstream.count(); n != 5 {
+		t.Errorf("%d upstream lookups after two failures, want 5", n)
+	}
+}
+
+func TestHTTPQuoteProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "XXX":
+			http.Error(w, "not found", http.StatusNotFound)
+		case "ERR":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case "BAD":
+			fmt.Fprint(w, "not json")
+		case "EMPTY":
+			fmt.Fprint(w, `{"chart":{"result":[]}}`)
+		default:
+			fmt.Fprint(w, `{"chart":{"result":[{"meta":{"currency":"USD","regularMarketPrice":189.84}}]}}`)
+		}
+	}))
+	defer srv.Close()
+	p := newHTTPQuoteProvider(srv.URL + "/")
+
+	if price, currency, err := p.Quote("AAPL"); err != nil || price != 189.84 || currency != "USD" {
+		t.Errorf("Quote(AAPL) = %v, %q, %v; want 189.84 USD", price, currency, err)
+	}
+	for _, symbol := range []string{"XXX", "EMPTY"} {
+		if _, _, err := p.Quote(symbol); !errors.Is(err, errUnknownSymbol) {
+			t.Errorf("Quote(%s): %v, want errUnknownSymbol", symbol, err)
+		}
+	}
+	for _, symbol := range []string{"ERR", "BAD"} {
+		if _, _, err := p.Quote(symbol); err == nil || errors.Is(err, errUnknownSymbol) {
+			t.Errorf("Quote(%s): %v, want a lookup failure", symbol, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// rateLimiter is a token bucket: it holds up to burst tokens, refills at
+// rate tokens per second, and each allowed event spends one token. It is not
+// safe for concurrent use; each client's limiter is only used by its read
+// loop.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// allow reports whether an event at time now is within the limit, spending
+// a token if it is.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// controlRateFactor is how many times more control frames than chat
+// messages a client may send per second.
+const controlRateFactor = 10
+
+// newControlLimiter returns the limiter for a client's control frames. Its
+// burst covers acking a whole replayed history at once.
+func newControlLimiter(cfg config, now time.Time) *rateLimiter {
+	return newRateLimiter(cfg.rateLimit*controlRateFactor, cfg.rateBurst+cfg.historySize, now)
+}
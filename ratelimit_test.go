@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, 3, now)
+
+	steps := []struct {
+		wait time.Duration // Since the previous event
+		want bool
+	}{
+		// The full burst, then nothing until tokens refill
+		{0, true}, {0, true}, {0, true}, {0, false},
+		// Half a second refills one token at 2 per second
+		{500 * time.Millisecond, true}, {0, false},
+		{250 * time.Millisecond, false}, {250 * time.Millisecond, true},
+		// A long pause refills no more than the burst
+		{time.Hour, true}, {0, true}, {0, true}, {0, false},
+	}
+	for i, step := range steps {
+		now = now.Add(step.wait)
+		if got := l.allow(now); got != step.want {
+			t.Errorf("event %d: allow = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestBurstIsLimited(t *testing.T) {
+	clock := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	cfg := testConfig(t)
+	cfg.rateLimit, cfg.rateBurst = 1, 3
+	ts := newTestServer(t, cfg, func(h *Hub) {
+		// Time stands still, so no tokens refill during the test
+		h.now = func() time.Time { return clock }
+	})
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	const burst = 10
+	for i := range burst {
+		alice.say(fmt.Sprint("message ", i))
+	}
+	for range burst - cfg.rateBurst {
+		alice.expectContent(msgSystem, "You're sending messages too fast")
+	}
+
+	bob.say("done")
+	received := 0
+	for {
+		msg := carol.next()
+		if isChat("bob", "done")(msg) {
+			break
+		}
+		if msg.Type == msgChat && msg.From == "alice" {
+			received++
+		}
+	}
+	if received != cfg.rateBurst {
+		t.Errorf("%d of a burst of %d broadcast, want %d", received, burst, cfg.rateBurst)
+	}
+}
+
+func TestAcksRoundTrip(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("did you get this?")
+	msg := bob.expect("alice's message", isChat("alice", "did you get this?"))
+	if msg.ID == 0 {
+		t.Fatalf("chat message without an ID: %+v", msg)
+	}
+	bob.sendFrame(Message{Type: msgAck, ID: msg.ID})
+	ack := alice.expect("bob's ack", func(m Message) bool { return m.Type == msgAck })
+	if ack.ID != msg.ID || ack.From != "bob" {
+		t.Errorf("ack = %+v, want ID %d from bob", ack, msg.ID)
+	}
+}
+
+// A client joining a busy room acks every replayed message at once. That
+// mustn't use up the budget for chat.
+func TestAckingHistoryDoesntUseTheChatBudget(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.rateLimit, cfg.rateBurst = 1, 3
+	ts := newTestServer(t, cfg)
+	ts.join(t, "/ws?username=alice")
+	room := ts.room(t, defaultRoom)
+	for i := range cfg.historySize {
+		room.deliver(Message{Type: msgChat, From: "alice", Content: fmt.Sprint("message ", i)})
+	}
+
+	bob := ts.join(t, "/ws?username=bob")
+	acked := 0
+	for _, msg := range bob.before {
+		if msg.Type == msgChat {
+			bob.sendFrame(Message{Type: msgAck, ID: msg.ID})
+			acked++
+		}
+	}
+	if acked != cfg.historySize {
+		t.Fatalf("bob was replayed %d messages, want %d", acked, cfg.historySize)
+	}
+	bob.sendFrame(Message{Type: msgTyping})
+
+	for i := range cfg.rateBurst {
+		text := fmt.Sprint("hello ", i)
+		bob.say(text)
+		bob.expect("his own message", isChat("bob", text))
+	}
+	bob.say("one too many")
+	bob.expectContent(msgSystem, "You're sending messages too fast")
+}
+
+func TestControlFramesAreLimitedToo(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.rateLimit, cfg.rateBurst, cfg.historySize = 1, 1, 0
+	l := newControlLimiter(cfg, time.Now())
+	allowed := 0
+	now := time.Now()
+	for range 100 {
+		if l.allow(now) {
+			allowed++
+		}
+	}
+	if allowed != cfg.rateBurst+cfg.historySize {
+		t.Errorf("%d control frames allowed in a burst, want %d", allowed, cfg.rateBurst+cfg.historySize)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RateProvider looks up exchange rates. Rate returns how many units of the
+// currency to one unit of from is worth.
+type RateProvider interface {
+	Rate(from, to string) (float64, error)
+}
+
+// errUnknownCurrency is returned by a RateProvider that has no rate for one
+// of the requested currencies.
+var errUnknownCurrency = errors.New("unknown currency")
+
+// defaultRatesURL serves the European Central Bank's daily reference rates.
+const defaultRatesURL = "https://api.frankfurter.app/latest"
+
+// httpRateProvider fetches rates from a Frankfurter-compatible HTTP API.
+type httpRateProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+func newHTTPRateProvider(baseURL string) *httpRateProvider {
+	return &httpRateProvider{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		baseURL: baseURL,
+	}
+}
+
+func (p *httpRateProvider) Rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+
+	query := url.Values{"from": {from}, "to": {to}}
+	resp, err := p.client.Get(p.baseURL + "?" + query.Encode())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// The API answers 404 for currency codes it doesn't know
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity {
+		return 0, errUnknownCurrency
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("rate lookup failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("rate lookup failed: %w", err)
+	}
+	rate, ok := body.Rates[to]
+	if !ok {
+		return 0, errUnknownCurrency
+	}
+	return rate, nil
+}
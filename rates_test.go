@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeRates is a RateProvider with fixed rates keyed "FROM/TO". With err
+// set every lookup fails with it.
+type fakeRates struct {
+	rates map[string]float64
+	err   error
+}
+
+func (f fakeRates) Rate(from, to string) (float64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	rate, ok := f.rates[from+"/"+to]
+	if !ok {
+		return 0, errUnknownCurrency
+	}
+	return rate, nil
+}
+
+func TestConvertCommand(t *testing.T) {
+	rates := fakeRates{rates: map[string]float64{"USD/NOK": 10.5, "EUR/USD": 1.0843}}
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"100 USD NOK", "💱 100,00 USD = 1.050,00 NOK"},
+		{"100 usd nok", "💱 100,00 USD = 1.050,00 NOK"},
+		{"12.5 EUR USD", "💱 12,50 EUR = 13,55 USD"},
+		{"100 USD SEK", "⚠️ I don't have a rate for USD to SEK."},
+		{"100 USD", "⚠️ Usage: /convert"},
+		{"-5 USD NOK", `⚠️ Invalid amount "-5"`},
+		{"abc USD NOK", `⚠️ Invalid amount "abc"`},
+		{"100 DOLLARS NOK", `⚠️ Invalid currency "DOLLARS"`},
+		{"100 US1 NOK", `⚠️ Invalid currency "US1"`},
+	}
+	for _, tt := range tests {
+		if got := convertCommand(defaultLang, strings.Fields(tt.args), rates, defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/convert %s = %q, want prefix %q", tt.args, got, tt.want)
+		}
+	}
+
+	down := fakeRates{err: errors.New("connection refused")}
+	if got := convertCommand(defaultLang, []string{"100", "USD", "NOK"}, down, defaultLocale); !strings.Contains(got, "Exchange rates are unavailable") {
+		t.Errorf("/convert with the provider down = %q", got)
+	}
+}
+
+func TestConvertCommandInARoom(t *testing.T) {
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.rates = fakeRates{rates: map[string]float64{"USD/NOK": 10}}
+	})
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/convert 3 usd nok")
+	alice.expectContent(msgCommand, "💱 3,00 USD = 30,00 NOK")
+}
+
+func TestHTTPRateProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+		switch {
+		case from == "XXX":
+			http.Error(w, "not found", http.StatusNotFound)
+		case from == "ERR":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case from == "BAD":
+			fmt.Fprint(w, "not json")
+		case to == "SEK":
+			fmt.Fprint(w, `{"rates":{}}`)
+		default:
+			fmt.Fprintf(w, `{"amount":1,"base":%q,"rates":{%q:10.5}}`, from, to)
+		}
+	}))
+	defer srv.Close()
+	p := newHTTPRateProvider(srv.URL)
+
+	if rate, err := p.Rate("USD", "NOK"); err != nil || rate != 10.5 {
+		t.Errorf("Rate(USD, NOK) = %v, %v; want 10.5", rate, err)
+	}
+	if rate, err := p.Rate("NOK", "NOK"); err != nil || rate != 1 {
+		t.Errorf("Rate(NOK, NOK) = %v, %v; want 1", rate, err)
+	}
+	if _, err := p.Rate("XXX", "NOK"); !errors.Is(err, errUnknownCurrency) {
+		t.Errorf("Rate(XXX, NOK): %v, want errUnknownCurrency", err)
+	}
+	if _, err := p.Rate("USD", "SEK"); !errors.Is(err, errUnknownCurrency) {
+		t.Errorf("Rate with the currency missing from the reply: %v, want errUnknownCurrency", err)
+	}
+	for _, from := range []string{"ERR", "BAD"} {
+		if _, err := p.Rate(from, "NOK"); err == nil || errors.Is(err, errUnknownCurrency) {
+			t.Errorf("Rate(%s, NOK): %v, want a lookup failure", from, err)
+		}
+	}
+}
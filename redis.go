@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fanout shares room messages between server instances. Without one, each
+// instance only reaches its own clients.
+type Fanout interface {
+	// Publish sends a frame delivered in the named room to the other
+	// instances.
+	Publish(roomName string, out outbound) error
+	// Ping checks that the other instances can be reached.
+	Ping() error
+	// Instance returns a number no other instance sharing the fanout has,
+	// which keeps their message IDs apart.
+	Instance() uint64
+	Close() error
+}
+
+// redisChannelPrefix namespaces the pub/sub channel of each room.
+const redisChannelPrefix = "fastchat:room:"
+
+// redisInstanceKey counts the instances that have connected, giving each
+// its instance number.
+const redisInstanceKey = "fastchat:instances"
+
+// redisTimeout bounds each command on the publishing connection, so a
+// stalled Redis server can't hold up the rooms publishing through it for
+// longer than that.
+const redisTimeout = 5 * time.Second
+
+// redisFanout shares room messages over Redis pub/sub, one channel per
+// room. Every instance subscribes to all room channels and hands messages
+// from other instances to deliver; its own messages are recognised by
+// origin and skipped, since they were already delivered locally.
+type redisFanout struct {
+	addr     string
+	origin   string
+	instance uint64
+	timeout  time.Duration // Deadline for each command on pub
+	deliver  func(roomName string, out outbound)
+
+	mutex     sync.Mutex // Guards the connections
+	pub       *redisConn // Lazily redialled after an error
+	sub       *redisConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// redisEnvelope is what travels over the pub/sub channel.
+type redisEnvelope struct {
+	Origin  string          `json:"origin"`
+	Author  string          `json:"author,omitempty"` // Who wrote the frame, so mutes apply to it
+	History bool            `json:"history"`
+	Clear   bool            `json:"clear,omitempty"`
+	Frame   json.RawMessage `json:"frame"`
+}
+
+// newRedisFanout connects to the Redis server at addr and starts relaying
+// other instances' messages to deliver.
+func newRedisFanout(addr string, deliver func(roomName string, out outbound)) (*redisFanout, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	pub, err := dialRedis(addr)
+	if err != nil {
+		return nil, err
+	}
+	pub.SetDeadline(time.Now().Add(redisTimeout))
+	reply, err := pub.do("INCR", redisInstanceKey)
+	if err != nil {
+		pub.Close()
+		return nil, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		pub.Close()
+		return nil, fmt.Errorf("redis: unexpected INCR reply %v", reply)
+	}
+
+	f := &redisFanout{
+		addr:     addr,
+		origin:   hex.EncodeToString(id),
+		instance: uint64(count) % maxInstances,
+		timeout:  redisTimeout,
+		deliver:  deliver,
+		pub:      pub,
+		done:     make(chan struct{}),
+	}
+	go f.subscribe()
+	return f, nil
+}
+
+func (f *redisFanout) Publish(roomName string, out outbound) error {
+	env := redisEnvelope{Origin: f.origin, Author: out.authorName(), History: out.history, Clear: out.clear, Frame: out.data}
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return f.do("PUBLISH", redisChannelPrefix+roomName, string(payload))
+}
+
+func (f *redisFanout) Ping() error {
+	return f.do("PING")
+}
+
+func (f *redisFanout) Instance() uint64 {
+	return f.instance
+}
+
+// do runs a command on the publishing connection, redialling it if an
+// earlier command failed. Each command must finish within f.timeout, which
+// also bounds how long other publishers wait for the connection.
+func (f *redisFanout) do(args ...string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.pub == nil {
+		var err error
+		if f.pub, err = dialRedis(f.addr); err != nil {
+			return err
+		}
+	}
+	f.pub.SetDeadline(time.Now().Add(f.timeout))
+	if _, err := f.pub.do(args...); err != nil {
+		f.pub.Close()
+		f.pub = nil
+		return err
+	}
+	return nil
+}
+
+// subscribe relays messages from every room channel until Close,
+// reconnecting with a growing delay when the connection fails. The delay
+// starts over once a connection subscribes, so one that drops after a long
+// outage is retried quickly.
+func (f *redisFanout) subscribe() {
+	backoff := time.Second
+	for {
+		err := f.listen(func() { backoff = time.Second })
+		select {
+		case <-f.done:
+			return
+		default:
+		}
+
+		warnf("Redis subscription lost: %v; reconnecting in %v", err, backoff)
+		select {
+		case <-f.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// listen subscribes on a new connection and relays messages until the
+// connection fails. It calls subscribed once Redis confirms the
+// subscription.
+func (f *redisFanout) listen(subscribed func()) error {
+	conn, err := dialRedis(f.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.mutex.Lock()
+	select {
+	case <-f.done:
+		f.mutex.Unlock()
+		return nil
+	default:
+	}
+	f.sub = conn
+	f.mutex.Unlock()
+
+	if err := conn.send("PSUBSCRIBE", redisChannelPrefix+"*"); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		// Messages arrive as [pmessage, pattern, channel, payload], after
+		// a [psubscribe, pattern, count] confirmation
+		parts, ok := reply.([]any)
+		if ok && len(parts) == 3 && parts[0] == "psubscribe" {
+			subscribed()
+			continue
+		}
+		if !ok || len(parts) != 4 || parts[0] != "pmessage" {
+			continue
+		}
+		channel, _ := parts[2].(string)
+		payload, _ := parts[3].(string)
+
+		var env redisEnvelope
+		if err := json.Unmarshal([]byte(payload), &env); err != nil {
+			warnf("Ignoring malformed Redis message on %s: %v", channel, err)
+			continue
+		}
+		if env.Origin == f.origin {
+			continue
+		}
+		f.deliver(strings.TrimPrefix(channel, redisChannelPrefix), outbound{data: env.Frame, history: env.History, from: env.Author, clear: env.Clear})
+	}
+}
+
+func (f *redisFanout) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Only the first Close has anything to do, and a second close(f.done)
+	// would panic
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.done)
+		if f.sub != nil {
+			f.sub.Close()
+		}
+		if f.pub != nil {
+			err = f.pub.Close()
+		}
+	})
+	return err
+}
+
+// redisConn speaks just enough of the Redis protocol (RESP) for pub/sub.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialRedis(addr string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// do sends a command and returns its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *redisConn) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.Conn, b.String())
+	return err
+}
+
+// read parses one reply. Simple and bulk strings become string, integers
+// int64, arrays []any and nil bulk strings or arrays nil. Error replies are
+// returned as errors.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2) // Including the trailing \r\n
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process Redis server that understands just the
+// commands redisFanout sends: PING, INCR, PUBLISH and PSUBSCRIBE. INCR
+// counts on a single key.
+type fakeRedis struct {
+	addr string
+	ln   net.Listener
+
+	mutex       sync.Mutex
+	conns       map[net.Conn]bool
+	subscribers map[*redisConn]string // Pattern prefix of each subscription
+	counter     int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{addr: ln.Addr().String(), ln: ln, conns: make(map[net.Conn]bool), subscribers: make(map[*redisConn]string)}
+	t.Cleanup(func() {
+		ln.Close()
+		r.dropConnections()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.mutex.Lock()
+			r.conns[conn] = true
+			r.mutex.Unlock()
+			go r.serve(&redisConn{Conn: conn, r: bufio.NewReader(conn)})
+		}
+	}()
+	return r
+}
+
+// serve answers one connection's commands until it is closed.
+func (r *fakeRedis) serve(c *redisConn) {
+	defer func() {
+		r.mutex.Lock()
+		delete(r.conns, c.Conn)
+		delete(r.subscribers, c)
+		r.mutex.Unlock()
+		c.Close()
+	}()
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]any)
+		if len(args) == 0 {
+			return
+		}
+		switch cmd, _ := args[0].(string); strings.ToUpper(cmd) {
+		case "PING":
+			c.Write([]byte("+PONG\r\n"))
+		case "INCR":
+			r.mutex.Lock()
+			r.counter++
+			n := r.counter
+			r.mutex.Unlock()
+			c.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+		case "PUBLISH":
+			channel, _ := args[1].(string)
+			payload, _ := args[2].(string)
+			n := r.publish(channel, payload)
+			c.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+		case "PSUBSCRIBE":
+			pattern, _ := args[1].(string)
+			r.mutex.Lock()
+			// Under the lock, so the reply can't interleave with a
+			// message published meanwhile
+			r.subscribers[c] = strings.TrimSuffix(pattern, "*")
+			c.send("psubscribe", pattern, "1")
+			r.mutex.Unlock()
+		default:
+			c.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+// publish sends payload to every subscriber whose pattern matches channel
+// and returns how many there were.
+func (r *fakeRedis) publish(channel, payload string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for sub, prefix := range r.subscribers {
+		if strings.HasPrefix(channel, prefix) {
+			sub.send("pmessage", prefix+"*", channel, payload)
+			n++
+		}
+	}
+	return n
+}
+
+// waitForSubscribers waits until n connections have subscribed.
+func (r *fakeRedis) waitForSubscribers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		r.mutex.Lock()
+		got := len(r.subscribers)
+		r.mutex.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// dropConnections closes every client connection, as a restarting Redis
+// server would.
+func (r *fakeRedis) dropConnections() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// newFanoutServer starts a test server sharing its rooms through redis.
+func newFanoutServer(t *testing.T, redis *fakeRedis) *testServer {
+	t.Helper()
+	return newTestServer(t, testConfig(t), func(h *Hub) {
+		fanout, err := newRedisFanout(redis.addr, h.deliverRemote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { fanout.Close() })
+		h.fanout = fanout
+	})
+}
+
+func TestRedisFanoutSharesRoomsBetweenInstances(t *testing.T) {
+	redis := newFakeRedis(t)
+	first := newFanoutServer(t, redis)
+	second := newFanoutServer(t, redis)
+	redis.waitForSubscribers(t, 2)
+
+	alice := first.join(t, "/ws/lobby?username=alice")
+	bob := second.join(t, "/ws/lobby?username=bob")
+	carol := second.join(t, "/ws/other?username=carol")
+
+	alice.say("hello from the first instance")
+	bob.expect("alice's message", isChat("alice", "hello from the first instance"))
+	bob.say("hello from the second")
+	alice.expect("bob's message", isChat("bob", "hello from the second"))
+
+	// Each instance skips its own messages coming back from Redis
+	alice.expectQuiet("her own message twice", isChat("alice", "hello from the first instance"), 200*time.Millisecond)
+	carol.expectQuiet("a message from another room", func(msg Message) bool {
+		return msg.From == "alice" || msg.From == "bob"
+	}, 200*time.Millisecond)
+}
+
+func TestMutesApplyToOtherInstancesUsers(t *testing.T) {
+	redis := newFakeRedis(t)
+	first := newFanoutServer(t, redis)
+	second := newFanoutServer(t, redis)
+	redis.waitForSubscribers(t, 2)
+
+	alice := first.join(t, "/ws/lobby?username=alice")
+	dave := first.join(t, "/ws/lobby?username=dave")
+	bob := second.join(t, "/ws/lobby?username=bob")
+
+	bob.say("/mute alice")
+	bob.expectContent(msgSystem, "Muted alice.")
+	alice.say("you can't hear me")
+	dave.expect("alice's message", isChat("alice", "you can't hear me"))
+	dave.say("but you can hear me")
+	bob.expectNoneBefore("a muted user's message", isChat("alice", "you can't hear me"), isChat("dave", "but you can hear me"))
+
+	bob.say("/unmute alice")
+	bob.expectContent(msgSystem, "Unmuted alice.")
+	alice.say("hello again")
+	bob.expect("alice's message after unmuting", isChat("alice", "hello again"))
+}
+
+func TestMessageIDsAreUniqueAcrossInstances(t *testing.T) {
+	redis := newFakeRedis(t)
+	first := newFanoutServer(t, redis)
+	second := newFanoutServer(t, redis)
+	redis.waitForSubscribers(t, 2)
+
+	alice := first.join(t, "/ws/lobby?username=alice")
+	bob := second.join(t, "/ws/lobby?username=bob")
+	carol := second.join(t, "/ws/lobby?username=carol")
+
+	// Each instance counts its own messages, notices included; find
+	// alice's message that was counted the same as carol's
+	carol.say("hello from here")
+	local := bob.expect("carol's message", isChat("carol", "hello from here")).ID
+	var remote uint64
+	for i := 0; remote&(1<<messageIDBits-1) != local&(1<<messageIDBits-1); i++ {
+		if i == 10 {
+			t.Fatalf("no message from alice counted like carol's %d", local)
+		}
+		text := fmt.Sprintf("hello from there %d", i)
+		alice.say(text)
+		remote = bob.expect("alice's message", isChat("alice", text)).ID
+	}
+	if local == remote {
+		t.Fatalf("messages from both instances have ID %d", local)
+	}
+
+	// Acks and reactions for alice's message can't reach her from here,
+	// and mustn't land on carol's message instead
+	bob.sendFrame(Message{Type: msgAck, ID: remote})
+	bob.sendFrame(Message{Type: msgReact, ID: remote, Emoji: "👍"})
+	bob.expectContent(msgSystem, "That message is too old or doesn't exist")
+	bob.sendFrame(Message{Type: msgAck, ID: local})
+	carol.expectNoneBefore("an ack or reaction meant for alice's message", func(msg Message) bool {
+		return msg.Type == msgReactions || (msg.Type == msgAck && msg.ID == remote)
+	}, func(msg Message) bool {
+		return msg.Type == msgAck && msg.ID == local && msg.From == "bob"
+	})
+}
+
+func TestRedisCommandsTimeOut(t *testing.T) {
+	// A server that answers the first command on each connection, the
+	// INCR giving the instance its number, then stalls
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+				if _, err := c.read(); err == nil {
+					c.Write([]byte(":1\r\n"))
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	fanout, err := newRedisFanout(ln.Addr().String(), func(string, outbound) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fanout.Close()
+	fanout.timeout = 50 * time.Millisecond
+
+	errs := make(chan error)
+	go func() { errs <- fanout.Publish("lobby", outbound{data: []byte(`{}`)}) }()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Publish succeeded on a stalled server")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Publish still waiting on a stalled server")
+	}
+}
+
+func TestRedisFanoutRedialsAfterAnError(t *testing.T) {
+	redis := newFakeRedis(t)
+	fanout, err := newRedisFanout(redis.addr, func(string, outbound) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fanout.Close()
+	if err := fanout.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	redis.dropConnections()
+	deadline := time.Now().Add(testTimeout)
+	for fanout.Ping() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Ping still failing after Redis came back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisFanoutClosesTwice(t *testing.T) {
+	redis := newFakeRedis(t)
+	fanout, err := newRedisFanout(redis.addr, func(string, outbound) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis.waitForSubscribers(t, 1)
+	if err := fanout.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fanout.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestNewRedisFanoutFailsWithoutAServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := newRedisFanout(addr, func(string, outbound) {}); err == nil {
+		t.Error("connected to a closed port")
+	}
+}
+
+func TestRedisConnRead(t *testing.T) {
+	tests := []struct {
+		input string
+		want  any
+		err   string
+	}{
+		{"+OK\r\n", "OK", ""},
+		{"-ERR wrong type\r\n", nil, "redis: ERR wrong type"},
+		{":42\r\n", int64(42), ""},
+		{"$5\r\nhello\r\n", "hello", ""},
+		{"$0\r\n\r\n", "", ""},
+		{"$-1\r\n", nil, ""},
+		{"*2\r\n$3\r\nfoo\r\n:1\r\n", []any{"foo", int64(1)}, ""},
+		{"*-1\r\n", nil, ""},
+		{"?what\r\n", nil, `redis: unexpected reply "?what"`},
+		{"\r\n", nil, "redis: empty reply"},
+	}
+	for _, tt := range tests {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(tt.input))}
+		got, err := c.read()
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("read(%q) error = %v, want %q", tt.input, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+			t.Errorf("read(%q) = %#v, %v; want %#v", tt.input, got, err, tt.want)
+		}
+	}
+}
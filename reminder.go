@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds for /reminder.
+const (
+	maxReminderDelay = 24 * time.Hour
+	maxReminders     = 10 // Pending reminders per client and room
+)
+
+// reminderKey says whose a reminder is: the client, by the identity it
+// keeps when it resumes a session, in the room where it set the reminder.
+// Usernames won't do, since anyone can take a name once its owner has left.
+type reminderKey struct {
+	identity uint64
+	room     string
+}
+
+// reminder is a note the finance bot sends a client privately once it is
+// due.
+type reminder struct {
+	key   reminderKey
+	text  string
+	due   time.Time
+	timer timer // Delivers the reminder when it falls due
+}
+
+// reminders holds the reminders not yet delivered. A reminder that falls
+// due while its client is disconnected waits for it to resume its session,
+// for up to maxReminderDelay. Reminders only live as long as the server.
+type reminders struct {
+	mutex   sync.Mutex
+	pending map[reminderKey][]*reminder
+}
+
+// reminderCommand schedules a private reminder for sender, e.g.
+// "/reminder 10m check the oven".
+func (room *Room) reminderCommand(sender *Client, args []string) {
+	usage := translate(room.bot.lang, "reminder.usage")
+	if len(args) < 2 {
+		room.bot.sendTo(sender, "⚠️ "+usage)
+		return
+	}
+	delay, err := time.ParseDuration(args[0])
+	if err != nil || delay <= 0 || delay > maxReminderDelay {
+		room.bot.sendTo(sender, translate(room.bot.lang, "reminder.invalid", args[0], maxReminderDelay, usage))
+		return
+	}
+
+	hub := sender.hub
+	key := reminderKey{identity: sender.identity, room: room.name}
+	r := &reminder{key: key, text: strings.Join(args[1:], " "), due: hub.now().Add(delay)}
+	scheduled := hub.reminders.add(r, hub.now(), func() timer {
+		return hub.afterFunc(delay, func() { hub.deliverReminders(key) })
+	})
+	if !scheduled {
+		room.bot.sendTo(sender, translate(room.bot.lang, "reminder.tooMany", maxReminders))
+		return
+	}
+	room.bot.sendTo(sender, translate(room.bot.lang, "reminder.set", delay))
+}
+
+// add keeps r and starts its timer with schedule, unless its client
+// already has too many reminders waiting. Reminders left undelivered for
+// too long are dropped on the way.
+func (rs *reminders) add(r *reminder, now time.Time, schedule func() timer) bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if rs.pending == nil {
+		rs.pending = make(map[reminderKey][]*reminder)
+	}
+	for key, list := range rs.pending {
+		kept := list[:0]
+		for _, old := range list {
+			if now.Sub(old.due) < maxReminderDelay {
+				kept = append(kept, old)
+			}
+		}
+		if len(kept) == 0 {
+			delete(rs.pending, key)
+		} else {
+			rs.pending[key] = kept
+		}
+	}
+
+	if len(rs.pending[r.key]) >= maxReminders {
+		return false
+	}
+	r.timer = schedule()
+	rs.pending[r.key] = append(rs.pending[r.key], r)
+	return true
+}
+
+// takeDue removes and returns the reminders under key that are due at now.
+func (rs *reminders) takeDue(key reminderKey, now time.Time) []*reminder {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	var due, waiting []*reminder
+	for _, r := range rs.pending[key] {
+		if now.Before(r.due) {
+			waiting = append(waiting, r)
+		} else {
+			due = append(due, r)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(rs.pending, key)
+	} else {
+		rs.pending[key] = waiting
+	}
+	return due
+}
+
+// stop cancels the timers of every pending reminder and drops them, as
+// the server shuts down.
+func (rs *reminders) stop() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	for _, list := range rs.pending {
+		for _, r := range list {
+			r.timer.Stop()
+		}
+	}
+	rs.pending = nil
+}
+
+// deliverReminders sends the client with key's identity its due reminders
+// for key's room, if it is connected there. Otherwise the reminders wait
+// for it to resume its session.
+func (h *Hub) deliverReminders(key reminderKey) {
+	room := h.room(key.room)
+	if room == nil {
+		return
+	}
+	var targets []*Client
+	for _, client := range room.snapshot() {
+		if client.identity == key.identity {
+			targets = append(targets, client)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	for _, r := range h.reminders.takeDue(key, h.now()) {
+		for _, client := range targets {
+			if err := room.bot.sendPrivate(client, translate(room.bot.lang, "reminder.due", r.text)); err != nil {
+				errorf("Sending a reminder to %s: %v", client.name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newReminderServer starts a test server whose clock and timers only move
+// when the test advances them.
+func newReminderServer(t *testing.T) (*testServer, *fakeClock) {
+	t.Helper()
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) {
+		h.now = clock.now
+		h.afterFunc = clock.afterFunc
+	})
+	return ts, clock
+}
+
+func isReminder(to, text string) func(Message) bool {
+	return isPrivate(defaultBotName, to, "⏰ Reminder: "+text)
+}
+
+func TestReminder(t *testing.T) {
+	ts, clock := newReminderServer(t)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/reminder 10m check the oven")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 10m0s.")
+	alice.say("/remind 90s stir")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 1m30s.")
+
+	clock.advance(9 * time.Minute)
+	alice.expect("the first reminder", isReminder("alice", "stir"))
+	alice.say("not yet")
+	alice.expectNoneBefore("the oven reminder", isReminder("alice", "check the oven"), isChat("alice", "not yet"))
+
+	clock.advance(time.Minute)
+	alice.expect("the oven reminder", isReminder("alice", "check the oven"))
+	if clock.pending() != 0 {
+		t.Errorf("%d timers left after every reminder was sent", clock.pending())
+	}
+
+	// Only alice was reminded
+	bob.say("done")
+	bob.expectNoneBefore("alice's reminder", func(msg Message) bool { return msg.Type == msgPrivate }, isChat("bob", "done"))
+}
+
+func TestReminderErrors(t *testing.T) {
+	ts, _ := newReminderServer(t)
+	alice := ts.join(t, "/ws?username=alice")
+
+	for _, tt := range []struct{ input, want string }{
+		{"/reminder", "⚠️ Usage: /reminder <delay> <message>"},
+		{"/reminder 10m", "⚠️ Usage: /reminder <delay> <message>"},
+		{"/reminder soon check the oven", `⚠️ Invalid delay "soon"`},
+		{"/reminder 0s check the oven", `⚠️ Invalid delay "0s"`},
+		{"/reminder -5m check the oven", `⚠️ Invalid delay "-5m"`},
+		{"/reminder 25h check the oven", `⚠️ Invalid delay "25h": use a duration like 90s, 10m or 2h30m, up to 24h0m0s.`},
+	} {
+		alice.say(tt.input)
+		alice.expectContent(msgCommand, tt.want)
+	}
+
+	for i := range maxReminders {
+		alice.say(fmt.Sprintf("/reminder 1h note %d", i))
+		alice.expectContent(msgCommand, "⏰ I'll remind you in 1h0m0s.")
+	}
+	alice.say("/reminder 1h one too many")
+	alice.expectContent(msgCommand, "⚠️ You already have 10 reminders waiting.")
+}
+
+func TestReminderWaitsForTheSessionToResume(t *testing.T) {
+	ts, clock := newReminderServer(t)
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/reminder 1m check the oven")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 1m0s.")
+	token := ts.disconnect(t, alice)
+
+	// Falling due while alice is away, the reminder waits for her
+	clock.advance(time.Minute)
+	alice = ts.join(t, "/ws?username=alice&session="+token)
+	alice.expect("the reminder", isReminder("alice", "check the oven"))
+}
+
+func TestRemindersArentSentToWhoeverTakesTheName(t *testing.T) {
+	ts, clock := newReminderServer(t)
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/reminder 1m transfer the rent")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 1m0s.")
+	alice.leave()
+	bob.expectContent(msgSystem, "alice left the chat")
+
+	// Without alice's session, a new "alice" is someone else
+	mallory := ts.join(t, "/ws?username=alice")
+	bob.say("/nick alice2")
+	bob.expectContent(msgSystem, "bob is now known as alice2")
+	clock.advance(time.Minute)
+	mallory.say("done")
+	mallory.expectNoneBefore("alice's reminder", isReminder("alice", "transfer the rent"), isChat("alice", "done"))
+
+	// Nor is a reminder sent to the same client in another room
+	carol := ts.join(t, "/ws?username=carol")
+	carol.say("/reminder 1m stretch")
+	carol.expectContent(msgCommand, "⏰ I'll remind you in 1m0s.")
+	ts.hub.deliverReminders(reminderKey{identity: ts.serverClient(t, defaultRoom, "carol").identity, room: "elsewhere"})
+	clock.advance(time.Minute)
+	carol.expect("her reminder", isReminder("carol", "stretch"))
+}
+
+func TestShutdownStopsReminders(t *testing.T) {
+	ts, clock := newReminderServer(t)
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/reminder 1h check the oven")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 1h0m0s.")
+	alice.say("/reminder 2h check it again")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 2h0m0s.")
+	if n := clock.pending(); n != 2 {
+		t.Fatalf("%d timers pending, want 2", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	ts.hub.shutdown(ctx)
+	if n := clock.pending(); n != 0 {
+		t.Errorf("%d timers still pending after shutdown", n)
+	}
+}
+
+func TestHubSchedulesRemindersWithRealTimers(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	alice.say("/reminder 50ms check the oven")
+	alice.expectContent(msgCommand, "⏰ I'll remind you in 50ms.")
+	alice.expect("the reminder", isReminder("alice", "check the oven"))
+}
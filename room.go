@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Room is a single chat room. Its clients are owned by the run goroutine;
+// everything else joins, leaves, broadcasts and lists clients by sending
+// on the room's channels, so the client map needs no lock.
+type Room struct {
+	name   string
+	bot    *Bot
+	now    func() time.Time
+	rates  RateProvider     // Exchange rates for /convert
+	quotes QuoteProvider    // Stock prices for /stock
+	coins  CryptoProvider   // Coin prices for /crypto
+	store  Store            // Where public messages are persisted
+	fanout Fanout           // Shares messages with other instances; nil when standalone
+	filter *profanityFilter // Masks listed words in chat; nil when disabled
+	files  *fileStore       // Where shared files are kept; nil when file sharing is disabled
+
+	unfurler Unfurler // Previews links in chat; nil when disabled
+	webhook  *webhook // Mirrors public messages; nil when disabled
+
+	blockLinks bool // Refuse chat and actions containing links
+
+	poll   *poll // The open poll, if any; guarded by pollMu
+	pollMu sync.Mutex
+
+	afterFunc  func(time.Duration, func()) timer // Schedules deletions by the room's clock; replaceable in tests
+	expiring   map[uint64]timer                  // Pending deletions of ephemeral messages, by ID; guarded by expiringMu
+	expiringMu sync.Mutex
+
+	clients map[*Client]bool // Owned by run
+	users   map[string]bool  // Usernames in the room; owned by run
+	history *history         // Recent public messages; owned by run
+	recent  *messageLog      // Authors and reactions of recent messages; owned by run
+	nextID  atomic.Uint64    // ID of the last message delivered; see messageIDBits
+	seq     uint64           // Sequence number of the last frame sent to the room; owned by run
+
+	detached map[*session]bool // Sessions of clients that left and may resume; owned by run
+
+	register   chan registration
+	unregister chan departure
+	renames    chan rename
+	acks       chan ack
+	reactions  chan reaction
+	lookups    chan lookup
+	broadcast  chan outbound       // Frames for every client
+	snapshots  chan chan []*Client // Requests for the current clients
+	histories  chan chan [][]byte  // Requests for the history's frames, for /export
+	deletions  chan deletion       // Ephemeral messages whose time is up
+	done       chan struct{}       // Closed when run returns
+}
+
+// registration asks run to add client to the room. run renames the client
+// if its username is taken and closes joined once it is a member. A client
+// resuming a session detached from this room is sent the messages it
+// missed instead of the history.
+type registration struct {
+	client *Client
+	joined chan struct{}
+	resume *session
+}
+
+// departure asks run to remove client from the room. run reports on empty
+// whether that was the last client, and stops if so. Otherwise a detach
+// session starts keeping the messages the client misses.
+type departure struct {
+	client *Client
+	empty  chan bool
+	detach *session
+}
+
+// outbound is an encoded frame for every client in the room except skip.
+// Frames marked for history are also replayed to clients that join later.
+// A frame with an author has a message ID that clients can acknowledge, and
+// isn't sent to clients that have muted the author. A frame relayed from
+// another instance has no local author, only the author's name in from,
+// which mutes apply to just the same. A clear frame empties the history
+// before it is sent.
+type outbound struct {
+	data    []byte
+	history bool
+	skip    *Client
+	id      uint64
+	author  *Client
+	from    string
+	clear   bool
+}
+
+// authorName returns the name of whoever wrote the frame, here or on
+// another instance, or "" for frames no user wrote.
+func (out outbound) authorName() string {
+	if out.author != nil {
+		return out.author.name()
+	}
+	return out.from
+}
+
+// ack reports that from received message id.
+type ack struct {
+	from *Client
+	id   uint64
+}
+
+// reaction asks run to add from's emoji reaction to message id, or to remove
+// it.
+type reaction struct {
+	from   *Client
+	id     uint64
+	emoji  string
+	remove bool
+}
+
+// lookup asks run whether message id is recent enough to be replied to.
+type lookup struct {
+	id    uint64
+	found chan bool
+}
+
+// deletion asks run to drop message id, whose time is up, and send every
+// client the msgDelete frame data.
+type deletion struct {
+	id   uint64
+	data []byte
+}
+
+// rename asks run to change client's username to name. run reports on
+// done whether the name was free.
+type rename struct {
+	client *Client
+	name   string
+	done   chan error
+}
+
+func NewRoom(name string) *Room {
+	room := &Room{
+		name:       name,
+		now:        time.Now,
+		afterFunc:  func(d time.Duration, f func()) timer { return time.AfterFunc(d, f) },
+		store:      nopStore{},
+		clients:    make(map[*Client]bool),
+		users:      make(map[string]bool),
+		detached:   make(map[*session]bool),
+		register:   make(chan registration),
+		unregister: make(chan departure),
+		renames:    make(chan rename),
+		acks:       make(chan ack),
+		reactions:  make(chan reaction),
+		lookups:    make(chan lookup),
+		history:    newHistory(0),
+		recent:     newMessageLog(messageLogSize),
+		broadcast:  make(chan outbound),
+		snapshots:  make(chan chan []*Client),
+		histories:  make(chan chan [][]byte),
+		deletions:  make(chan deletion),
+		done:       make(chan struct{}),
+	}
+	// Each room gets its own finance bot
+	room.bot = &Bot{
+		name: defaultBotName,
+		room: room,
+		rand: mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+
+		savingsMin: defaultSavingsMin,
+		savingsMax: defaultSavingsMax,
+		lang:       defaultLang,
+	}
+	return room
+}
+
+// run serves the room's channels until its last client leaves.
+func (room *Room) run() {
+	defer close(room.done)
+	defer room.stopExpiring()
+
+	for {
+		select {
+		case reg := <-room.register:
+			name := room.uniqueName(reg.client.name())
+			reg.client.setName(name)
+			room.clients[reg.client] = true
+			room.users[name] = true
+			// Replay history here so no broadcast can slip in between
+			// the replay and the client's first live message
+			replay := room.history.all()
+			if reg.resume != nil && room.detached[reg.resume] {
+				delete(room.detached, reg.resume)
+				replay = reg.resume.missed.all()
+			}
+			for _, data := range replay {
+				if reg.client.write(data) != nil {
+					break
+				}
+			}
+			close(reg.joined)
+
+		case dep := <-room.unregister:
+			if room.clients[dep.client] {
+				delete(room.clients, dep.client)
+				delete(room.users, dep.client.name())
+			}
+			empty := len(room.clients) == 0
+			if dep.detach != nil && !empty {
+				room.detached[dep.detach] = true
+			}
+			dep.empty <- empty
+			if empty {
+				return
+			}
+
+		case rn := <-room.renames:
+			if room.users[rn.name] {
+				rn.done <- fmt.Errorf("the name %s is already taken", rn.name)
+				break
+			}
+			delete(room.users, rn.client.name())
+			rn.client.setName(rn.name)
+			room.users[rn.name] = true
+			rn.done <- nil
+
+		case out := <-room.broadcast:
+			out.data = room.sequenced(out.data)
+			if out.clear {
+				room.history.clear()
+				for s := range room.detached {
+					s.missed.clear()
+				}
+			}
+			if out.history {
+				room.history.add(out.id, out.data)
+			}
+			if out.id != 0 && out.author != nil {
+				room.recent.add(out.id, out.author)
+			}
+			room.writeAll(out)
+			room.keepMissed(out)
+
+		case a := <-room.acks:
+			msg := room.recent.get(a.id)
+			if msg == nil || msg.author == a.from || !room.clients[msg.author] {
+				break
+			}
+			msg.author.send(Message{Type: msgAck, ID: a.id, From: a.from.name()})
+
+		case r := <-room.reactions:
+			room.applyReaction(r)
+
+		case l := <-room.lookups:
+			l.found <- room.history.has(l.id) || room.recent.get(l.id) != nil
+
+		case reply := <-room.snapshots:
+			clients := make([]*Client, 0, len(room.clients))
+			for client := range room.clients {
+				clients = append(clients, client)
+			}
+			reply <- clients
+
+		case reply := <-room.histories:
+			reply <- room.history.all()
+
+		case d := <-room.deletions:
+			room.history.remove(d.id)
+			room.recent.remove(d.id)
+			for s := range room.detached {
+				s.missed.remove(d.id)
+			}
+			room.writeAll(outbound{data: room.sequenced(d.data)})
+		}
+	}
+}
+
+// writeAll writes out's frame to every client it is meant for. Only run may
+// call it.
+func (room *Room) writeAll(out outbound) {
+	name := out.authorName()
+	for client := range room.clients {
+		if client == out.skip || (name != "" && client.hasMuted(name)) {
+			continue
+		}
+		// Never blocks; a client too slow to keep up is disconnected
+		client.write(out.data)
+	}
+}
+
+// sequenced returns frame, an encoded Message, stamped with the room's next
+// sequence number (see Message.Seq). Frames are numbered as run sends them,
+// which is the order every client receives them in. Only run may call it.
+func (room *Room) sequenced(frame []byte) []byte {
+	room.seq++
+	if len(frame) < 2 || frame[0] != '{' {
+		return frame
+	}
+	stamped := make([]byte, 0, len(frame)+len(`"seq":,`)+20)
+	stamped = append(stamped, `{"seq":`...)
+	stamped = strconv.AppendUint(stamped, room.seq, 10)
+	if frame[1] != '}' {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, frame[1:]...)
+}
+
+// applyReaction adds or removes a reaction and, if that changed anything,
+// sends the message's new reaction counts to the room. Only run may call
+// it.
+func (room *Room) applyReaction(r reaction) {
+	msg := room.recent.get(r.id)
+	if msg == nil {
+		r.from.send(Message{Type: msgSystem, Content: "That message is too old or doesn't exist, so you can't react to it."})
+		return
+	}
+
+	name := r.from.name()
+	users := msg.reactions[r.emoji]
+	if r.remove == !users[name] {
+		return // Already reacted, or nothing to remove
+	}
+	if r.remove {
+		delete(users, name)
+		if len(users) == 0 {
+			delete(msg.reactions, r.emoji)
+		}
+	} else {
+		if users == nil {
+			users = make(map[string]bool)
+			msg.reactions[r.emoji] = users
+		}
+		users[name] = true
+	}
+
+	counts := make(map[string]int, len(msg.reactions))
+	for emoji, users := range msg.reactions {
+		counts[emoji] = len(users)
+	}
+	data, err := json.Marshal(Message{Type: msgReactions, ID: r.id, Reactions: counts, TS: room.now().UTC()})
+	if err != nil {
+		errorf("Marshal error: %v", err)
+		return
+	}
+	room.writeAll(outbound{data: room.sequenced(data)})
+}
+
+// clearHistory empties the room's history on this and every other instance
+// and tells clients to clear their view.
+func (room *Room) clearHistory() {
+	data, err := json.Marshal(Message{Type: msgClear, TS: room.now().UTC()})
+	if err != nil {
+		errorf("Marshal error: %v", err)
+		return
+	}
+	out := outbound{data: data, clear: true}
+	if room.fanout != nil {
+		if err := room.fanout.Publish(room.name, out); err != nil {
+			errorf("Publishing clear in room %s: %v", room.name, err)
+		}
+	}
+	select {
+	case room.broadcast <- out:
+	case <-room.done:
+	}
+}
+
+// snapshot returns the room's current clients, or none once the room has
+// stopped.
+func (room *Room) snapshot() []*Client {
+	reply := make(chan []*Client, 1)
+	select {
+	case room.snapshots <- reply:
+		return <-reply
+	case <-room.done:
+		return nil
+	}
+}
+
+// clientNamed returns the room's client with the given name, or nil.
+func (room *Room) clientNamed(name string) *Client {
+	for _, client := range room.snapshot() {
+		if client.name() == name {
+			return client
+		}
+	}
+	return nil
+}
+
+// isRecent reports whether message id is still in the room's recent
+// history.
+func (room *Room) isRecent(id uint64) bool {
+	found := make(chan bool, 1)
+	select {
+	case room.lookups <- lookup{id: id, found: found}:
+		return <-found
+	case <-room.done:
+		return false
+	}
+}
+
+// rename changes client's username to name unless another client in the
+// room already uses it.
+func (room *Room) rename(client *Client, name string) error {
+	done := make(chan error, 1)
+	select {
+	case room.renames <- rename{client: client, name: name, done: done}:
+		return <-done
+	case <-room.done:
+		return fmt.Errorf("the room has closed")
+	}
+}
+
+// uniqueName returns name, or name with the lowest numeric suffix (starting
+// at 2) that isn't in use in the room. Long names are shortened to make room
+// for the suffix, so the result is never longer than maxUsernameLength.
+// Only run may call it.
+func (room *Room) uniqueName(name string) string {
+	if !room.users[name] {
+		return name
+	}
+	base := []rune(name)
+	for i := 2; ; i++ {
+		suffix := strconv.Itoa(i)
+		candidate := string(base[:min(len(base), maxUsernameLength-len(suffix))]) + suffix
+		if !room.users[candidate] {
+			return candidate
+		}
+	}
+}
+
+// messageLogSize is how many recent messages can still be acknowledged or
+// reacted to.
+const messageLogSize = 256
+
+// loggedMessage is what a room remembers about a recent message.
+type loggedMessage struct {
+	author    *Client
+	reactions map[string]map[string]bool // Usernames by reaction emoji
+}
+
+// messageLog remembers the most recent messages' authors, so acks can be
+// forwarded to them, and their reactions. Once full, the oldest message is
+// forgotten first.
+type messageLog struct {
+	messages map[uint64]*loggedMessage
+	order    []uint64 // Ring buffer of the IDs in messages, oldest at next
+	next     int
+}
+
+func newMessageLog(size int) *messageLog {
+	return &messageLog{
+		messages: make(map[uint64]*loggedMessage, size),
+		order:    make([]uint64, 0, size),
+	}
+}
+
+func (l *messageLog) add(id uint64, author *Client) {
+	if len(l.order) < cap(l.order) {
+		l.order = append(l.order, id)
+	} else {
+		delete(l.messages, l.order[l.next])
+		l.order[l.next] = id
+		l.next = (l.next + 1) % len(l.order)
+	}
+	l.messages[id] = &loggedMessage{author: author, reactions: make(map[string]map[string]bool)}
+}
+
+// remove forgets the message with the given ID before its time.
+func (l *messageLog) remove(id uint64) {
+	delete(l.messages, id)
+}
+
+// get returns the message with the given ID, or nil if it has been
+// forgotten.
+func (l *messageLog) get(id uint64) *loggedMessage {
+	return l.messages[id]
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BenchmarkBroadcast measures delivering a chat message to a room of 20
+// readers, with and without clients that never read. A stalled client must
+// not hold up the others: its frames queue in its own outbox until it is
+// disconnected.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, stalled := range []int{0, 1} {
+		b.Run(fmt.Sprintf("stalled=%d", stalled), func(b *testing.B) {
+			benchmarkBroadcast(b, 20, stalled)
+		})
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, readers, stalled int) {
+	ts := newTestServer(b, testConfig(b))
+	got := make(chan struct{}, readers)
+	lost := make(chan error, readers)
+	for range readers {
+		conn := ts.dialBench(b, "/ws")
+		go func() {
+			// Only chat frames are counted; the key, username and join
+			// notices come first
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					lost <- err
+					return
+				}
+				if bytes.Contains(data, []byte(`"type":"chat"`)) {
+					got <- struct{}{}
+				}
+			}
+		}()
+	}
+	for range stalled {
+		ts.dialBench(b, "/ws")
+	}
+
+	deadline := time.Now().Add(testTimeout)
+	for ts.hub.roomCount() == 0 || len(ts.room(b, defaultRoom).snapshot()) < readers+stalled {
+		if time.Now().After(deadline) {
+			b.Fatal("timed out waiting for clients to join")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	room := ts.room(b, defaultRoom)
+
+	// Every reader gets each message before the next is sent, so none is
+	// disconnected for falling behind
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		room.deliver(Message{Type: msgChat, From: "alice", Content: "hello everyone"})
+		for range readers {
+			select {
+			case <-got:
+			case err := <-lost:
+				b.Fatalf("reader disconnected: %v", err)
+			}
+		}
+	}
+	b.StopTimer()
+}
+
+// dialBench connects a client that reads raw frames, without decrypting
+// anything.
+func (ts *testServer) dialBench(b *testing.B, path string) *websocket.Conn {
+	b.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, _, err := ts.dial(b, path, private, websocket.DefaultDialer, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+func TestUniqueName(t *testing.T) {
+	long := strings.Repeat("a", maxUsernameLength)
+	tests := []struct {
+		taken []string
+		name  string
+		want  string
+	}{
+		{nil, "alice", "alice"},
+		{[]string{"alice"}, "alice", "alice2"},
+		{[]string{"alice", "alice2", "alice3"}, "alice", "alice4"},
+		{[]string{"alice", "alice3"}, "alice", "alice2"},
+		{[]string{long}, long, long[:maxUsernameLength-1] + "2"},
+		{[]string{"ååå"}, "ååå", "ååå2"},
+		{[]string{strings.Repeat("å", maxUsernameLength)}, strings.Repeat("å", maxUsernameLength), strings.Repeat("å", maxUsernameLength-1) + "2"},
+	}
+	for _, tt := range tests {
+		room := NewRoom("test")
+		for _, name := range tt.taken {
+			room.users[name] = true
+		}
+		got := room.uniqueName(tt.name)
+		if got != tt.want {
+			t.Errorf("uniqueName(%q) with %q taken = %q, want %q", tt.name, tt.taken, got, tt.want)
+		}
+		if err := validateUsername(got); err != nil {
+			t.Errorf("uniqueName(%q) = %q: %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestUniqueNameAtTenSuffixes(t *testing.T) {
+	long := strings.Repeat("a", maxUsernameLength)
+	room := NewRoom("test")
+	room.users[long] = true
+	for i := 2; i < 10; i++ {
+		room.users[room.uniqueName(long)] = true
+	}
+	if got, want := room.uniqueName(long), long[:maxUsernameLength-2]+"10"; got != want {
+		t.Errorf("tenth %q = %q, want %q", long, got, want)
+	}
+}
+
+func TestDuplicateUsernamesAreRenamed(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	first := ts.join(t, "/ws?username=alice")
+	second := ts.join(t, "/ws?username=alice")
+	if first.name != "alice" || second.name != "alice2" {
+		t.Fatalf("names %q and %q, want alice and alice2", first.name, second.name)
+	}
+
+	second.say("hi")
+	first.expect("the second alice's message", isChat("alice2", "hi"))
+}
+
+func TestBroadcastDeliversMessagesUnchanged(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	for _, text := range []string{
+		"hello",
+		"æøå 🎉 日本語",
+		`quotes " and \ backslashes`,
+		"<script>alert(1)</script>",
+		"  leading and trailing spaces  ",
+		"tab\tand\nnewline",
+		"not a /command",
+	} {
+		alice.say(text)
+		bob.expect(fmt.Sprintf("%q unchanged", text), isChat("alice", text))
+	}
+}
+
+// newOfflineClient returns a client without a connection, whose frames
+// stay queued in its outbox for the test to read.
+func newOfflineClient(name string) *Client {
+	return &Client{username: name, outbox: make(chan outFrame, 64), done: make(chan struct{})}
+}
+
+// joinRoom registers client with room through its register channel.
+func joinRoom(t *testing.T, room *Room, client *Client) {
+	t.Helper()
+	joined := make(chan struct{})
+	room.register <- registration{client: client, joined: joined}
+	select {
+	case <-joined:
+	case <-time.After(testTimeout):
+		t.Fatalf("%s never joined", client.name())
+	}
+}
+
+// leaveRoom unregisters client and reports whether the room is now empty.
+func leaveRoom(room *Room, client *Client) bool {
+	empty := make(chan bool, 1)
+	room.unregister <- departure{client: client, empty: empty}
+	return <-empty
+}
+
+// nextFrame returns the next frame queued for client, decoded.
+func nextFrame(t *testing.T, client *Client) Message {
+	t.Helper()
+	select {
+	case frame := <-client.outbox:
+		var msg Message
+		if err := json.Unmarshal(frame.data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatalf("nothing queued for %s", client.name())
+		return Message{}
+	}
+}
+
+func TestRoomChannels(t *testing.T) {
+	room := NewRoom("test")
+	go room.run()
+	alice, bob := newOfflineClient("alice"), newOfflineClient("bob")
+	joinRoom(t, room, alice)
+	joinRoom(t, room, bob)
+
+	if got := len(room.snapshot()); got != 2 {
+		t.Fatalf("%d clients after two joins", got)
+	}
+
+	room.deliver(Message{Type: msgChat, From: "alice", Content: "hello"})
+	for _, c := range []*Client{alice, bob} {
+		if msg := nextFrame(t, c); msg.Content != "hello" || msg.Seq != 1 {
+			t.Errorf("%s got %+v, want hello with seq 1", c.name(), msg)
+		}
+	}
+
+	if leaveRoom(room, alice) {
+		t.Fatal("room empty with bob still in it")
+	}
+	room.deliver(Message{Type: msgChat, From: "bob", Content: "bye"})
+	if msg := nextFrame(t, bob); msg.Content != "bye" {
+		t.Errorf("bob got %+v", msg)
+	}
+	select {
+	case frame := <-alice.outbox:
+		t.Errorf("alice got %s after leaving", frame.data)
+	default:
+	}
+
+	if !leaveRoom(room, bob) {
+		t.Fatal("room not empty after its last client left")
+	}
+	select {
+	case <-room.done:
+	case <-time.After(testTimeout):
+		t.Fatal("room still running after its last client left")
+	}
+	// Deliveries to a stopped room are dropped rather than blocking
+	room.deliver(Message{Type: msgChat, From: "bob", Content: "anyone?"})
+}
+
+func TestSeqIncreasesUnderConcurrentSends(t *testing.T) {
+	const senders, each = 4, 25
+	ts := newTestServer(t, testConfig(t))
+	carol := ts.join(t, "/ws?username=carol")
+	clients := make([]*testClient, senders)
+	for i := range clients {
+		clients[i] = ts.join(t, fmt.Sprintf("/ws?username=user%d", i))
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range each {
+				if err := c.conn.WriteMessage(websocket.TextMessage, fmt.Appendf(nil, "message %d", j)); err != nil {
+					t.Errorf("user%d: %v", i, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every frame to the room is numbered one past the last, and each
+	// sender's messages keep their order
+	var last uint64
+	next := make(map[string]int)
+	for chats := 0; chats < senders*each; {
+		msg := carol.next()
+		if msg.Seq == 0 {
+			continue
+		}
+		if last != 0 && msg.Seq != last+1 {
+			t.Fatalf("seq %d after %d: %+v", msg.Seq, last, msg)
+		}
+		last = msg.Seq
+		if msg.Type != msgChat {
+			continue
+		}
+		if want := fmt.Sprintf("message %d", next[msg.From]); msg.Content != want {
+			t.Fatalf("%s's message %q arrived in place of %q", msg.From, msg.Content, want)
+		}
+		next[msg.From]++
+		chats++
+	}
+}
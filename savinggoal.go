@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// savingsGoal is a user's target for /savinggoal and what they have put
+// toward it so far.
+type savingsGoal struct {
+	target int
+	saved  int
+}
+
+// maxGoalSaved bounds what can be added toward a goal in total, so the
+// total fits in an int on 32-bit platforms too.
+const maxGoalSaved = maxAmount
+
+// goalCommand sets, adds to, shows or resets the sender's savings goal,
+// kept by the bot in memory, e.g. "/savinggoal set 50000" then
+// "/savinggoal add 5000". Goals are kept by client identity, so they
+// follow /nick and resumed sessions but not whoever takes the name next.
+func (b *Bot) goalCommand(sender *Client, args []string, loc locale) string {
+	usage := translate(b.lang, "goal.usage")
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+
+	name := sender.name()
+	b.goalsMu.Lock()
+	defer b.goalsMu.Unlock()
+	goal := b.goals[sender.identity]
+	switch strings.ToLower(args[0]) {
+	case "set":
+		if len(args) != 2 {
+			return "⚠️ " + usage
+		}
+		target, err := parseAmount(b.lang, loc, args[1])
+		if err != nil {
+			return fmt.Sprintf("⚠️ %v. %s", err, usage)
+		}
+		if b.goals == nil {
+			b.goals = make(map[uint64]*savingsGoal)
+		}
+		if goal == nil {
+			goal = &savingsGoal{}
+			b.goals[sender.identity] = goal
+		}
+		goal.target = target
+		return goal.progress(b.lang, name, loc)
+	case "add":
+		if len(args) != 2 {
+			return "⚠️ " + usage
+		}
+		if goal == nil {
+			return translate(b.lang, "goal.noneToAdd", name)
+		}
+		amount, err := parseAmount(b.lang, loc, args[1])
+		if err != nil {
+			return fmt.Sprintf("⚠️ %v. %s", err, usage)
+		}
+		if goal.saved+amount > maxGoalSaved {
+			return translate(b.lang, "goal.tooMuch", name, formatNumber(maxGoalSaved, loc))
+		}
+		goal.saved += amount
+		return goal.progress(b.lang, name, loc)
+	case "show", "status":
+		if len(args) != 1 {
+			return "⚠️ " + usage
+		}
+		if goal == nil {
+			return translate(b.lang, "goal.none", name)
+		}
+		return goal.progress(b.lang, name, loc)
+	case "reset":
+		if len(args) != 1 {
+			return "⚠️ " + usage
+		}
+		if goal == nil {
+			return translate(b.lang, "goal.noneToReset", name)
+		}
+		delete(b.goals, sender.identity)
+		return translate(b.lang, "goal.reset", name)
+	default:
+		return "⚠️ " + usage
+	}
+}
+
+// progress reports how far name has come toward the goal, in lang with
+// numbers written for loc. The percentage is rounded down, so 100% means the goal
+// is reached, and keeps counting past it.
+func (g *savingsGoal) progress(lang, name string, loc locale) string {
+	percent := int64(g.saved) * 100 / int64(g.target)
+	if g.saved >= g.target {
+		return translate(lang, "goal.reached",
+			name, formatNumber(g.saved, loc), formatNumber(g.target, loc), percent)
+	}
+	return translate(lang, "goal.progress",
+		name, formatNumber(g.saved, loc), formatNumber(g.target, loc), percent, formatNumber(g.target-g.saved, loc))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoalCommand(t *testing.T) {
+	bot := NewRoom("test").bot
+	alice := newOfflineClient("alice")
+	alice.identity = 1
+	for _, tt := range []struct{ input, want string }{
+		{"", "🎯 alice has no savings goal. Set one with /savinggoal set <target>"},
+		{"add 500", "⚠️ alice has no savings goal. Set one first with /savinggoal set <target>"},
+		{"set 50000", "🎯 alice has saved 0 of 50.000 kr (0%), 50.000 kr to go"},
+		{"add 12500", "🎯 alice has saved 12.500 of 50.000 kr (25%), 37.500 kr to go"},
+		{"add 100", "🎯 alice has saved 12.600 of 50.000 kr (25%), 37.400 kr to go"},
+		{"status", "🎯 alice has saved 12.600 of 50.000 kr (25%), 37.400 kr to go"},
+		// Lowering the target keeps what was saved
+		{"set 20000", "🎯 alice has saved 12.600 of 20.000 kr (63%), 7.400 kr to go"},
+		{"add 7400", "🎉 alice has saved 20.000 of 20.000 kr (100%) and reached the goal!"},
+		// Past the target the percentage keeps counting
+		{"add 10000", "🎉 alice has saved 30.000 of 20.000 kr (150%) and reached the goal!"},
+		{"reset", "🎯 alice's savings goal has been reset."},
+		{"reset", "🎯 alice has no savings goal to reset."},
+		{"show", "🎯 alice has no savings goal. Set one with /savinggoal set <target>"},
+	} {
+		if got := bot.goalCommand(alice, strings.Fields(tt.input), defaultLocale); got != tt.want {
+			t.Errorf("/savinggoal %s = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestGoalCommandErrors(t *testing.T) {
+	bot := NewRoom("test").bot
+	alice := newOfflineClient("alice")
+	alice.identity = 1
+	bot.goalCommand(alice, []string{"set", "1000"}, defaultLocale)
+	for _, tt := range []struct{ input, want string }{
+		{"set", "⚠️ Usage: /savinggoal set <target>"},
+		{"set 0", `⚠️ invalid amount "0"`},
+		{"set lots", `⚠️ invalid amount "lots"`},
+		{"add", "⚠️ Usage: /savinggoal set <target>"},
+		{"add -5", `⚠️ invalid amount "-5"`},
+		{"add 5 6", "⚠️ Usage: /savinggoal set <target>"},
+		{"show all", "⚠️ Usage: /savinggoal set <target>"},
+		{"withdraw 500", "⚠️ Usage: /savinggoal set <target>"},
+	} {
+		if got := bot.goalCommand(alice, strings.Fields(tt.input), defaultLocale); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("/savinggoal %s = %q, want prefix %q", tt.input, got, tt.want)
+		}
+	}
+	bot.goalCommand(alice, []string{"add", "1000000000"}, defaultLocale)
+	if got, want := bot.goalCommand(alice, []string{"add", "1"}, defaultLocale), "⚠️ alice can't put more than 1.000.000.000 kr toward a goal."; got != want {
+		t.Errorf("adding past the limit = %q, want %q", got, want)
+	}
+	bot.goalCommand(alice, []string{"reset"}, defaultLocale)
+	bot.goalCommand(alice, []string{"set", "1000"}, defaultLocale)
+
+	// Failed commands leave the goal as it was
+	if got, want := bot.goalCommand(alice, nil, defaultLocale), "🎯 alice has saved 0 of 1.000 kr (0%), 1.000 kr to go"; got != want {
+		t.Errorf("goal after errors = %q, want %q", got, want)
+	}
+}
+
+func TestGoalsArePerUser(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/savinggoal set 1000")
+	alice.expectContent(msgCommand, "🎯 alice has saved 0 of 1.000 kr (0%)")
+	bob.say("/goal add 500")
+	bob.expectContent(msgCommand, "⚠️ bob has no savings goal.")
+	alice.say("/goal add 500")
+	alice.expectContent(msgCommand, "🎯 alice has saved 500 of 1.000 kr (50%), 500 kr to go")
+
+	// Nobody else sees someone's goal
+	alice.say("done")
+	bob.expectNoneBefore("alice's goal", func(msg Message) bool {
+		return strings.Contains(msg.Content, "🎯 alice")
+	}, isChat("alice", "done"))
+}
+
+func TestGoalsFollowTheClientNotTheName(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.say("/savinggoal set 1000")
+	alice.expectContent(msgCommand, "🎯 alice has saved 0 of 1.000 kr (0%)")
+	alice.say("/nick alicia")
+	alice.expectContent(msgSystem, "alice is now known as alicia")
+	alice.say("/goal add 100")
+	alice.expectContent(msgCommand, "🎯 alicia has saved 100 of 1.000 kr (10%)")
+
+	// Resuming the session keeps the goal
+	alice = ts.reconnect(t, alice, "/ws?username=alicia")
+	bob.expectContent(msgSystem, "alicia joined the chat")
+	alice.say("/goal")
+	alice.expectContent(msgCommand, "🎯 alicia has saved 100 of 1.000 kr (10%)")
+
+	// Someone new taking the name after alicia leaves starts without one
+	alice.leave()
+	bob.expectContent(msgSystem, "alicia left the chat")
+	mallory := ts.join(t, "/ws?username=alicia")
+	mallory.say("/goal")
+	mallory.expectContent(msgCommand, "🎯 alicia has no savings goal.")
+}
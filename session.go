@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Sessions let a client whose connection drops pick up where it left off.
+// Every client is sent a session token (msgSession) when it joins. If it
+// reconnects to the same room with ?session= set to that token within
+// sessionTTL, it gets back its identity, username, mutes, blocks, away
+// status, locale and idempotency keys, and is sent the public messages it
+// missed in place of the room's history. Private messages are never kept
+// for it, since they were encrypted under the old connection's key. Each
+// token resumes once; the new connection is sent a fresh one.
+
+// Limits on resuming sessions.
+const (
+	sessionTTL        = 2 * time.Minute
+	maxMissedMessages = 100 // Public messages kept for a disconnected client
+)
+
+// session is what is kept of a disconnected client until it resumes or the
+// session expires.
+type session struct {
+	token    string
+	identity uint64
+	username string
+	room     *Room
+	muted    map[string]bool
+	blocked  map[string]bool
+	away     bool
+	awayMsg  string
+	locale   locale
+	keys     *keyCache // Idempotency keys, so frames resent after reconnecting are still dropped
+	expires  time.Time
+	missed   *history // Public messages sent since the client left; owned by room's run goroutine
+}
+
+// sessionStore holds the sessions of disconnected clients by token.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+// newSessionToken returns a random token for a client to resume its
+// session with.
+func newSessionToken() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// detach captures the client's state as it leaves room, so that it can
+// resume later. It returns nil for clients that have no session to resume,
+// such as those that were kicked.
+func (c *Client) detach(room *Room, now time.Time) *session {
+	if c.session == "" || c.kicked.Load() {
+		return nil
+	}
+	c.muteMu.Lock()
+	muted := maps.Clone(c.muted)
+	c.muteMu.Unlock()
+	c.blockMu.Lock()
+	blocked := maps.Clone(c.blocked)
+	c.blockMu.Unlock()
+	awayMsg, away := c.awayStatus()
+
+	return &session{
+		token:    c.session,
+		identity: c.identity,
+		username: c.name(),
+		room:     room,
+		muted:    muted,
+		blocked:  blocked,
+		away:     away,
+		awayMsg:  awayMsg,
+		locale:   c.locale,
+		keys:     c.keys,
+		expires:  now.Add(sessionTTL),
+		missed:   newHistory(maxMissedMessages),
+	}
+}
+
+// resume gives a new client, before it joins, the state kept in s.
+func (c *Client) resume(s *session) {
+	c.identity = s.identity
+	c.username = s.username
+	c.muted = s.muted
+	c.blocked = s.blocked
+	c.away, c.awayMsg = s.away, s.awayMsg
+	c.locale = s.locale
+	c.keys = s.keys
+}
+
+// put keeps s until it is taken or expires.
+func (st *sessionStore) put(s *session, now time.Time) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.sessions == nil {
+		st.sessions = make(map[string]*session)
+	}
+	for token, old := range st.sessions {
+		if !now.Before(old.expires) {
+			delete(st.sessions, token)
+		}
+	}
+	st.sessions[s.token] = s
+}
+
+// take removes and returns the session with the given token in the named
+// room, or nil if there is none or it has expired. A session from another
+// room is left in place, so a client that connects to the wrong room can
+// still resume in the right one.
+func (st *sessionStore) take(token, roomName string, now time.Time) *session {
+	if token == "" {
+		return nil
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	s := st.sessions[token]
+	if s == nil || s.room.name != roomName {
+		return nil
+	}
+	delete(st.sessions, token)
+	if !now.Before(s.expires) {
+		return nil
+	}
+	return s
+}
+
+// keepMissed adds out to the missed messages of each session detached from
+// the room, unless its client had muted the author. Like history, only
+// public messages are kept, not notices or typing events. Only run may call
+// it.
+func (room *Room) keepMissed(out outbound) {
+	if !out.history {
+		return
+	}
+	now := room.now()
+	name := out.authorName()
+	for s := range room.detached {
+		if !now.Before(s.expires) {
+			delete(room.detached, s)
+			continue
+		}
+		if name != "" && s.muted[name] {
+			continue
+		}
+		s.missed.add(out.id, out.data)
+	}
+}
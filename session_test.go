@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// chatBefore returns the content of the chat messages c was sent before
+// its join notice.
+func chatBefore(c *testClient) []string {
+	var chat []string
+	for _, msg := range c.before {
+		if msg.Type == msgChat {
+			chat = append(chat, msg.From+": "+msg.Content)
+		}
+	}
+	return chat
+}
+
+func TestSessionResume(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+	carol := ts.join(t, "/ws?username=carol")
+
+	alice.say("/nick ally")
+	bob.expectContent(msgSystem, "alice is now known as ally")
+	alice.say("/mute carol")
+	alice.expectContent(msgSystem, "Muted carol.")
+	alice.say("/locale en-US")
+	alice.expectContent(msgSystem, "Numbers are now written en-US style")
+	alice.say("/away lunch")
+	bob.expectContent(msgSystem, "ally is away: lunch")
+	identity := ts.serverClient(t, defaultRoom, "ally").identity
+	token := ts.disconnect(t, alice)
+
+	bob.say("you missed this")
+	carol.say("and this, but you muted me")
+	bob.expect("carol's message", isChat("carol", "and this, but you muted me"))
+
+	// The username asked for is ignored in favour of the session's
+	ally := ts.join(t, "/ws?username=someone&session="+token)
+	if ally.name != "ally" {
+		t.Fatalf("resumed as %q, want ally", ally.name)
+	}
+	if got := chatBefore(ally); len(got) != 1 || got[0] != "bob: you missed this" {
+		t.Errorf("sent %q on resuming, want only bob's missed message", got)
+	}
+	if ts.serverClient(t, defaultRoom, "ally").identity != identity {
+		t.Error("resumed with a new identity")
+	}
+	if ally.sessionToken() == token {
+		t.Error("resumed session wasn't given a fresh token")
+	}
+
+	ally.say("/locale")
+	ally.expectContent(msgSystem, "Your numbers are written en-US style")
+	bob.say("/who")
+	bob.expectContent(msgCommand, "ally (away: lunch)")
+	carol.say("still muted?")
+	bob.expect("carol's message", isChat("carol", "still muted?"))
+	ally.say("done")
+	ally.expectNoneBefore("carol's message", isChat("carol", "still muted?"), isChat("ally", "done"))
+}
+
+func TestSessionResumesOnlyOnce(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	token := ts.disconnect(t, alice)
+
+	alice = ts.join(t, "/ws?username=x&session="+token)
+	if alice.name != "alice" {
+		t.Fatalf("resumed as %q, want alice", alice.name)
+	}
+	// A second use of the token is a new client with the name it asked for
+	if again := ts.join(t, "/ws?username=mallory&session="+token); again.name != "mallory" {
+		t.Errorf("token reused as %q, want a fresh mallory", again.name)
+	}
+}
+
+func TestSessionResumesOnlyInItsRoom(t *testing.T) {
+	ts := newTestServer(t, testConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+	token := ts.disconnect(t, alice)
+
+	// Another room doesn't resume the session, nor use the token up
+	if other := ts.join(t, "/ws/other?username=x&session="+token); other.name != "x" {
+		t.Errorf("resumed as %q in another room, want a fresh x", other.name)
+	}
+	if alice = ts.join(t, "/ws?username=x&session="+token); alice.name != "alice" {
+		t.Errorf("resumed as %q after a wrong-room attempt, want alice", alice.name)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	clock := newFakeClock()
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.now = clock.now })
+	alice := ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+
+	alice.say("/nick ally")
+	alice.expectContent(msgSystem, "alice is now known as ally")
+	token := ts.disconnect(t, alice)
+
+	clock.advance(sessionTTL)
+	if fresh := ts.join(t, "/ws?username=alice&session="+token); fresh.name != "alice" {
+		t.Errorf("expired session resumed as %q, want a fresh alice", fresh.name)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	var st sessionStore
+	now := time.Now()
+	room := NewRoom("test")
+	st.put(&session{token: "old", room: room, expires: now.Add(time.Minute)}, now)
+	st.put(&session{token: "new", room: room, expires: now.Add(2 * time.Minute)}, now)
+
+	if s := st.take("old", "test", now.Add(time.Minute)); s != nil {
+		t.Errorf("took an expired session %+v", s)
+	}
+	if s := st.take("", "test", now); s != nil {
+		t.Errorf("took %+v for no token", s)
+	}
+	if s := st.take("new", "other", now); s != nil {
+		t.Errorf("took %+v for another room", s)
+	}
+	if s := st.take("new", "test", now); s == nil || s.token != "new" {
+		t.Fatalf("take(new) = %+v", s)
+	}
+	if s := st.take("new", "test", now); s != nil {
+		t.Error("took the same session twice")
+	}
+
+	// Putting a session drops the expired ones
+	st.put(&session{token: "stale", room: room, expires: now}, now)
+	st.put(&session{token: "fresh", room: room, expires: now.Add(time.Hour)}, now.Add(time.Second))
+	if _, kept := st.sessions["stale"]; kept || len(st.sessions) != 1 {
+		t.Errorf("kept %d sessions, want only the fresh one", len(st.sessions))
+	}
+}
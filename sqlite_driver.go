@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// Registers the pure-Go "sqlite" database/sql driver used by -db. Build
+// with -tags sqlite to include it.
+import _ "modernc.org/sqlite"
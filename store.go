@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Store persists public room messages so history survives a restart.
+type Store interface {
+	// Save records msg as sent in the named room.
+	Save(roomName string, msg Message) error
+	// Recent returns up to n of the room's latest messages, oldest first.
+	Recent(roomName string, n int) ([]Message, error)
+	// Clear deletes every message saved for the room.
+	Clear(roomName string) error
+	// Ping checks that the store is reachable.
+	Ping() error
+	Close() error
+}
+
+// nopStore keeps nothing. It is the default, leaving only the in-memory
+// history of each room.
+type nopStore struct{}
+
+func (nopStore) Save(string, Message) error            { return nil }
+func (nopStore) Recent(string, int) ([]Message, error) { return nil, nil }
+func (nopStore) Clear(string) error                    { return nil }
+func (nopStore) Ping() error                           { return nil }
+func (nopStore) Close() error                          { return nil }
+
+// sqliteDriver is the database/sql driver name used for -db. The driver is
+// only linked into builds made with -tags sqlite (see sqlite_driver.go).
+const sqliteDriver = "sqlite"
+
+// sqlStore keeps messages in a SQLite database.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// openSQLStore opens the SQLite database at path, creating it and its
+// schema if needed.
+func openSQLStore(path string) (*sqlStore, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("%v (build with -tags sqlite to enable -db)", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		room      TEXT    NOT NULL,
+		type      TEXT    NOT NULL,
+		sender    TEXT    NOT NULL,
+		content   TEXT    NOT NULL,
+		ts        INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS messages_room_id ON messages (room, id)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) Save(roomName string, msg Message) error {
+	_, err := s.db.Exec(`INSERT INTO messages (room, type, sender, content, ts) VALUES (?, ?, ?, ?, ?)`,
+		roomName, msg.Type, msg.From, msg.Content, msg.TS.UnixNano())
+	return err
+}
+
+func (s *sqlStore) Recent(roomName string, n int) ([]Message, error) {
+	rows, err := s.db.Query(`SELECT type, sender, content, ts FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?`,
+		roomName, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var ts int64
+		if err := rows.Scan(&msg.Type, &msg.From, &msg.Content, &ts); err != nil {
+			return nil, err
+		}
+		msg.TS = time.Unix(0, ts).UTC()
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first from the query; callers want oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *sqlStore) Clear(roomName string) error {
+	_, err := s.db.Exec(`DELETE FROM messages WHERE room = ?`, roomName)
+	return err
+}
+
+func (s *sqlStore) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,134 @@
+//go:build sqlite
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a SQLite store in a temporary file.
+func openTestStore(t *testing.T) (*sqlStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	store, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, path
+}
+
+func TestSQLStoreRoundTrip(t *testing.T) {
+	store, _ := openTestStore(t)
+	ts := time.Date(2024, 5, 17, 12, 0, 0, 123456789, time.UTC)
+	want := []Message{
+		{Type: msgChat, From: "alice", Content: "hello", TS: ts},
+		{Type: msgAction, From: "bob", Content: "* bob waves", TS: ts.Add(time.Second)},
+		{Type: msgCommand, From: defaultBotName, Content: "æøå 🎉 \"quoted\"", TS: ts.Add(2 * time.Second)},
+	}
+	for _, msg := range want {
+		if err := store.Save("lobby", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := store.Recent("lobby", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Recent = %+v, want %+v", got, want)
+	}
+	if err := store.Ping(); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func TestSQLStoreRecentOrderAndLimit(t *testing.T) {
+	store, _ := openTestStore(t)
+	ts := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		// Saved out of timestamp order: Recent goes by the order saved
+		msg := Message{Type: msgChat, From: "alice", Content: fmt.Sprint(i), TS: ts.Add(-time.Duration(i) * time.Minute)}
+		if err := store.Save("lobby", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Save("other", Message{Type: msgChat, From: "bob", Content: "elsewhere", TS: ts})
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{3, "[3 4 5]"},
+		{5, "[1 2 3 4 5]"},
+		{50, "[1 2 3 4 5]"},
+		{1, "[5]"},
+		{0, "[]"},
+	}
+	for _, tt := range tests {
+		messages, err := store.Recent("lobby", tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contents []string
+		for _, msg := range messages {
+			contents = append(contents, msg.Content)
+		}
+		if got := fmt.Sprint(contents); got != tt.want {
+			t.Errorf("Recent(lobby, %d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+
+	if messages, err := store.Recent("empty", 10); err != nil || len(messages) != 0 {
+		t.Errorf("Recent of a room with nothing saved = %v, %v", messages, err)
+	}
+}
+
+func TestSQLStoreClear(t *testing.T) {
+	store, _ := openTestStore(t)
+	store.Save("lobby", Message{Type: msgChat, Content: "gone"})
+	store.Save("other", Message{Type: msgChat, Content: "kept"})
+	if err := store.Clear("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := store.Recent("lobby", 10); len(messages) != 0 {
+		t.Errorf("lobby still has %v after Clear", messages)
+	}
+	if messages, _ := store.Recent("other", 10); len(messages) != 1 {
+		t.Errorf("Clear of lobby removed other's messages: %v", messages)
+	}
+}
+
+func TestSQLStoreSurvivesReopening(t *testing.T) {
+	store, path := openTestStore(t)
+	store.Save("lobby", Message{Type: msgChat, From: "alice", Content: "still here"})
+	store.Close()
+
+	reopened, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	messages, err := reopened.Recent("lobby", 10)
+	if err != nil || len(messages) != 1 || messages[0].Content != "still here" {
+		t.Errorf("after reopening: %v, %v", messages, err)
+	}
+}
+
+func TestHistoryIsLoadedFromTheStore(t *testing.T) {
+	store, _ := openTestStore(t)
+	store.Save("lobby", Message{Type: msgChat, From: "alice", Content: "from before the restart"})
+
+	ts := newTestServer(t, testConfig(t), func(h *Hub) { h.store = store })
+	bob := ts.join(t, "/ws/lobby?username=bob")
+	for _, msg := range bob.before {
+		if isChat("alice", "from before the restart")(msg) {
+			return
+		}
+	}
+	t.Errorf("saved message not replayed: %+v", bob.before)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LinkPreview is what a shared link's page says about itself.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+// Unfurler fetches previews of links shared in chat.
+type Unfurler interface {
+	Unfurl(link string) (LinkPreview, error)
+}
+
+var (
+	// errNoPreview is returned for pages that have nothing to preview,
+	// such as images or pages without a title.
+	errNoPreview = errors.New("nothing to preview")
+
+	// errBlockedAddress is returned for links to loopback, private and
+	// other internal addresses, so chat can't be used to probe the
+	// server's network.
+	errBlockedAddress = errors.New("address not allowed")
+)
+
+// Limits on fetching link previews. Only the start of a page is read, since
+// the tags a preview needs are in its head.
+const (
+	unfurlTimeout      = 5 * time.Second
+	unfurlMaxBody      = 512 << 10
+	unfurlMaxRedirects = 3
+	unfurlRate         = 1 // Pages fetched per second across the server
+	unfurlBurst        = 5
+	maxPreviewLength   = 300 // Longest title or description kept, in runes
+)
+
+// httpUnfurler fetches previews from the pages links point to. It refuses
+// to connect to internal addresses, whatever a link's host resolves to, and
+// rate-limits fetches so busy rooms can't turn the server into a crawler.
+type httpUnfurler struct {
+	client *http.Client
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	limiter *rateLimiter
+}
+
+func newHTTPUnfurler() *httpUnfurler {
+	dialer := &net.Dialer{Timeout: unfurlTimeout, Control: refuseInternal}
+	return &httpUnfurler{
+		client: &http.Client{
+			Timeout: unfurlTimeout,
+			Transport: &http.Transport{
+				Proxy:       nil,
+				DialContext: dialer.DialContext,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= unfurlMaxRedirects {
+					return errors.New("too many redirects")
+				}
+				return checkUnfurlURL(req.URL)
+			},
+		},
+		now:     time.Now,
+		limiter: newRateLimiter(unfurlRate, unfurlBurst, time.Now()),
+	}
+}
+
+// internalPrefixes are the internal ranges refuseInternal blocks beyond
+// those net.IP has predicates for.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // Shared address space, used inside cloud and carrier networks
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, which reaches any IPv4 address through a gateway
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+}
+
+// refuseInternal is a dialer Control function that refuses connections to
+// internal addresses. It runs after DNS resolution, so a public name that
+// resolves to a private address is refused too.
+func refuseInternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", errBlockedAddress, host)
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return fmt.Errorf("%w: %s", errBlockedAddress, host)
+		}
+	}
+	return nil
+}
+
+// checkUnfurlURL refuses links that aren't plain http(s) URLs.
+func checkUnfurlURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("%w: %s", errBlockedAddress, u.Redacted())
+	}
+	return nil
+}
+
+func (u *httpUnfurler) Unfurl(link string) (LinkPreview, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	if err := checkUnfurlURL(parsed); err != nil {
+		return LinkPreview{}, err
+	}
+
+	u.mutex.Lock()
+	allowed := u.limiter.allow(u.now())
+	u.mutex.Unlock()
+	if !allowed {
+		return LinkPreview{}, errRateLimited
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "fastchat-unfurler/1.0")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return LinkPreview{}, fmt.Errorf("fetching preview: %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return LinkPreview{}, errNoPreview
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, unfurlMaxBody))
+	if err != nil {
+		return LinkPreview{}, err
+	}
+
+	preview := parsePreview(string(page))
+	if preview.Title == "" {
+		return LinkPreview{}, errNoPreview
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+var (
+	metaTagPattern    = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern   = regexp.MustCompile(`(?is)\b(property|name|content)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titleTagPattern   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// parsePreview picks a page's Open Graph title, description and image,
+// falling back to its <title> and meta description.
+func parsePreview(page string) LinkPreview {
+	meta := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		var key, content string
+		for _, attr := range metaAttrPattern.FindAllStringSubmatch(tag, -1) {
+			value := attr[2] + attr[3]
+			if strings.EqualFold(attr[1], "content") {
+				content = value
+			} else {
+				key = strings.ToLower(value)
+			}
+		}
+		if _, seen := meta[key]; key != "" && !seen {
+			meta[key] = content
+		}
+	}
+
+	preview := LinkPreview{
+		Title:       cleanPreviewText(meta["og:title"]),
+		Description: cleanPreviewText(meta["og:description"]),
+	}
+	if preview.Title == "" {
+		if m := titleTagPattern.FindStringSubmatch(page); m != nil {
+			preview.Title = cleanPreviewText(m[1])
+		}
+	}
+	if preview.Description == "" {
+		preview.Description = cleanPreviewText(meta["description"])
+	}
+	if image, err := url.Parse(html.UnescapeString(meta["og:image"])); err == nil && (image.Scheme == "http" || image.Scheme == "https") {
+		preview.Image = image.String()
+	}
+	return preview
+}
+
+// cleanPreviewText unescapes text from a page, collapses its whitespace and
+// shortens it to maxPreviewLength runes.
+func cleanPreviewText(s string) string {
+	s = strings.TrimSpace(whitespacePattern.ReplaceAllString(html.UnescapeString(s), " "))
+	if runes := []rune(s); len(runes) > maxPreviewLength {
+		s = string(runes[:maxPreviewLength-1]) + "…"
+	}
+	return s
+}
+
+// firstLink returns the first http(s) URL in text, or "" if there is none.
+// Bare domains aren't unfurled, since they might not be meant as links.
+func firstLink(text string) string {
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		lower := strings.ToLower(match)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+			// Trailing punctuation usually ends the sentence, not the link
+			return strings.TrimRight(match, ".,;:!?)'\"")
+		}
+	}
+	return ""
+}
+
+// unfurl posts a preview of the first link in message id's text, if the
+// linked page has one. It runs in its own goroutine, so a slow page never
+// holds up chat.
+func (room *Room) unfurl(id uint64, text string) {
+	link := firstLink(text)
+	if link == "" {
+		return
+	}
+
+	preview, err := room.unfurler.Unfurl(link)
+	if err != nil {
+		if !errors.Is(err, errNoPreview) {
+			debugf("No preview for a link in room %s: %v", room.name, err)
+		}
+		return
+	}
+	room.deliver(Message{Type: msgPreview, ReplyTo: id, Preview: &preview})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chunked uploads let clients share files too big for a single frame:
+//
+//  1. The client sends {"type": "file-begin", "file": {"name", "size",
+//     "sha256"}}, declaring the file's size in bytes and the hex SHA-256 of
+//     its contents.
+//  2. It sends the contents as binary frames, each starting with its 4-byte
+//     big-endian sequence number, counting from 0.
+//  3. It sends {"type": "file-end"}. The file is shared if its size and
+//     hash match what was declared.
+//
+// While an upload is open every binary frame is one of its chunks. Once an
+// upload fails, the client is told why and further chunks are dropped until
+// its file-end, so they can't be mistaken for files of their own.
+
+// maxFileNameLength bounds a declared file name in bytes.
+const maxFileNameLength = 255
+
+// upload is a file being received in chunks. It is only used by its
+// client's read loop.
+type upload struct {
+	info     FileInfo
+	data     []byte
+	next     uint32 // Sequence number of the next chunk
+	reserved int64  // Bytes reserved in the file store; 0 once released
+	failed   bool
+}
+
+// beginUpload starts a chunked upload described by info, replacing any
+// upload sender left unfinished.
+func (room *Room) beginUpload(sender *Client, info *FileInfo) {
+	room.abandonUpload(sender)
+	// Until the upload is accepted its chunks must still be dropped
+	sender.upload = &upload{failed: true}
+
+	if room.files == nil || room.files.maxUpload == 0 {
+		sender.send(Message{Type: msgSystem, Content: "Chunked uploads are disabled on this server."})
+		return
+	}
+	if info == nil || info.Size <= 0 {
+		sender.send(Message{Type: msgSystem, Content: "A file-begin must give the file's size in bytes."})
+		return
+	}
+	if info.Size > room.files.maxUpload {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Files can be at most %s bytes.", formatNumber(int(room.files.maxUpload), sender.locale))})
+		return
+	}
+	if hash, err := hex.DecodeString(info.SHA256); err != nil || len(hash) != sha256.Size {
+		sender.send(Message{Type: msgSystem, Content: "A file-begin must give the file's SHA-256 as 64 hex digits."})
+		return
+	}
+	if !validFileName(info.Name) {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("File names must be at most %d bytes of printable text.", maxFileNameLength)})
+		return
+	}
+	if err := room.files.reserve(info.Size); err != nil {
+		room.refuseFile(sender, int(info.Size), err)
+		return
+	}
+
+	debugf("Upload of %d bytes started by %s in room %s", info.Size, sender.name(), room.name)
+	sender.upload = &upload{
+		info:     FileInfo{Name: info.Name, Size: info.Size, SHA256: strings.ToLower(info.SHA256)},
+		data:     make([]byte, 0, info.Size),
+		reserved: info.Size,
+	}
+}
+
+// receiveChunk adds a chunk to sender's open upload.
+func (room *Room) receiveChunk(sender *Client, chunk []byte) {
+	up := sender.upload
+	if len(chunk) < 4 {
+		room.failUpload(sender, "A chunk was missing its sequence number.")
+		return
+	}
+	if seq := binary.BigEndian.Uint32(chunk); seq != up.next {
+		room.failUpload(sender, fmt.Sprintf("Chunk %d arrived when chunk %d was expected.", seq, up.next))
+		return
+	}
+	if int64(len(up.data)+len(chunk)-4) > up.info.Size {
+		room.failUpload(sender, "The upload is bigger than the size it declared.")
+		return
+	}
+	up.data = append(up.data, chunk[4:]...)
+	up.next++
+}
+
+// endUpload finishes sender's upload, sharing the file if it arrived
+// intact.
+func (room *Room) endUpload(sender *Client) {
+	up := sender.upload
+	if up == nil {
+		sender.send(Message{Type: msgSystem, Content: "There is no upload to finish."})
+		return
+	}
+	room.abandonUpload(sender)
+	if up.failed {
+		return
+	}
+
+	if int64(len(up.data)) != up.info.Size {
+		sender.send(Message{Type: msgSystem, Content: fmt.Sprintf("Your upload ended after %s of %s bytes and was not shared.",
+			formatNumber(len(up.data), sender.locale), formatNumber(int(up.info.Size), sender.locale))})
+		return
+	}
+	sum := sha256.Sum256(up.data)
+	if want, _ := hex.DecodeString(up.info.SHA256); !bytes.Equal(sum[:], want) {
+		warnf("Upload from %s in room %s failed its integrity check", sender.name(), room.name)
+		sender.send(Message{Type: msgSystem, Content: "Your upload doesn't match its SHA-256 and was not shared."})
+		return
+	}
+	room.storeFile(sender, up.data, up.info)
+}
+
+// failUpload stops sender's upload with a notice saying why. Its remaining
+// chunks are charged to the rate limiter and dropped until the client ends
+// it.
+func (room *Room) failUpload(sender *Client, reason string) {
+	room.abandonUpload(sender)
+	sender.upload = &upload{failed: true}
+	sender.send(Message{Type: msgSystem, Content: reason + " Your upload was stopped."})
+}
+
+// abandonUpload drops sender's upload, if any, and gives back its room in
+// the file store.
+func (room *Room) abandonUpload(sender *Client) {
+	if up := sender.upload; up != nil && up.reserved > 0 {
+		room.files.release(up.reserved)
+		up.reserved = 0
+	}
+	sender.upload = nil
+}
+
+// validFileName reports whether name is fit to show as a file's name. The
+// name is only ever displayed, so any printable text short of a path will
+// do; the empty name is fine too.
+func validFileName(name string) bool {
+	if len(name) > maxFileNameLength || !utf8.ValidString(name) || strings.ContainsAny(name, `/\`) {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
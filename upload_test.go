@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadConfig is a test config with chunked uploads on for files up to
+// 2 KB.
+func uploadConfig(t *testing.T) config {
+	cfg := fileConfig(t)
+	cfg.maxUploadSize = 2048
+	return cfg
+}
+
+// chunk numbers data as chunk seq of an upload.
+func chunk(seq uint32, data string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, seq), data...)
+}
+
+// beginUpload starts a chunked upload of a file with the given contents,
+// or declaring hash instead of theirs if it isn't empty.
+func (c *testClient) beginUpload(name, contents, hash string) {
+	c.t.Helper()
+	if hash == "" {
+		sum := sha256.Sum256([]byte(contents))
+		hash = hex.EncodeToString(sum[:])
+	}
+	c.sendFrame(Message{Type: msgFileBegin, File: &FileInfo{Name: name, Size: int64(len(contents)), SHA256: hash}})
+}
+
+// uploadsInProgress returns the uploads the hub's file store is holding
+// room for, and the bytes set aside for them.
+func uploadsInProgress(ts *testServer) (int, int64) {
+	ts.hub.files.mutex.Lock()
+	defer ts.hub.files.mutex.Unlock()
+	return ts.hub.files.uploads, ts.hub.files.reserved
+}
+
+func TestChunkedUpload(t *testing.T) {
+	ts := newTestServer(t, uploadConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	// Bigger than a single frame may be
+	contents := strings.Repeat("all work and no play\n", 80)
+	alice.beginUpload("notes.txt", contents, "")
+	for i := 0; i*700 < len(contents); i++ {
+		alice.sendBinary(chunk(uint32(i), contents[i*700:min((i+1)*700, len(contents))]))
+	}
+	alice.sendFrame(Message{Type: msgFileEnd})
+
+	msg := bob.expect("the uploaded file", isFile)
+	sum := sha256.Sum256([]byte(contents))
+	want := FileInfo{Name: "notes.txt", MIME: "text/plain; charset=utf-8", Size: int64(len(contents)), SHA256: hex.EncodeToString(sum[:])}
+	if msg.From != "alice" || msg.File == nil || *msg.File != want {
+		t.Fatalf("got %+v with file %+v, want %+v from alice", msg, msg.File, want)
+	}
+	resp, body := download(t, ts, msg.Content)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte(contents)) {
+		t.Errorf("download got %s and %d bytes, want the %d bytes uploaded", resp.Status, len(body), len(contents))
+	}
+	if n, reserved := uploadsInProgress(ts); n != 0 || reserved != 0 {
+		t.Errorf("%d uploads holding %d bytes after the upload ended", n, reserved)
+	}
+
+	// Binary frames are files of their own again once the upload is over
+	alice.sendBinary([]byte("a note"))
+	if msg := bob.expect("the single-frame file", isFile); msg.File.Size != 6 {
+		t.Errorf("single-frame file = %+v", msg.File)
+	}
+}
+
+func TestChunkedUploadWithTheWrongHash(t *testing.T) {
+	ts := newTestServer(t, uploadConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.beginUpload("notes.txt", "hello world", strings.Repeat("ab", 32))
+	alice.sendBinary(chunk(0, "hello "))
+	alice.sendBinary(chunk(1, "world"))
+	alice.sendFrame(Message{Type: msgFileEnd})
+	alice.expectContent(msgSystem, "Your upload doesn't match its SHA-256 and was not shared.")
+
+	alice.say("done")
+	bob.expectNoneBefore("a file failing its hash", isFile, isChat("alice", "done"))
+	if n, reserved := uploadsInProgress(ts); n != 0 || reserved != 0 {
+		t.Errorf("%d uploads holding %d bytes after the upload failed", n, reserved)
+	}
+}
+
+func TestChunkedUploadIsStopped(t *testing.T) {
+	ts := newTestServer(t, uploadConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	for _, tt := range []struct {
+		name   string
+		chunks [][]byte
+		want   string
+	}{
+		{"out of order", [][]byte{chunk(0, "hello "), chunk(2, "world")}, "Chunk 2 arrived when chunk 1 was expected. Your upload was stopped."},
+		{"repeated", [][]byte{chunk(0, "hello "), chunk(0, "hello ")}, "Chunk 0 arrived when chunk 1 was expected."},
+		{"no sequence number", [][]byte{{0, 0}}, "A chunk was missing its sequence number."},
+		{"too big", [][]byte{chunk(0, "hello world!")}, "The upload is bigger than the size it declared."},
+	} {
+		alice.beginUpload("notes.txt", "hello world", "")
+		for _, c := range tt.chunks {
+			alice.sendBinary(c)
+		}
+		alice.expectContent(msgSystem, tt.want)
+		// The rest of a stopped upload is dropped, not shared as files
+		alice.sendBinary(chunk(1, "world"))
+		alice.sendFrame(Message{Type: msgFileEnd})
+	}
+	alice.beginUpload("notes.txt", "hello world", "")
+	alice.sendBinary(chunk(0, "hello"))
+	alice.sendFrame(Message{Type: msgFileEnd})
+	alice.expectContent(msgSystem, "Your upload ended after 5 of 11 bytes and was not shared.")
+
+	alice.say("done")
+	bob.expectNoneBefore("a stopped upload", isFile, isChat("alice", "done"))
+	if n, reserved := uploadsInProgress(ts); n != 0 || reserved != 0 {
+		t.Errorf("%d uploads holding %d bytes after every upload ended", n, reserved)
+	}
+}
+
+func TestChunksOfAStoppedUploadAreRateLimited(t *testing.T) {
+	clock := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	cfg := uploadConfig(t)
+	cfg.rateLimit, cfg.rateBurst = 1, 3
+	ts := newTestServer(t, cfg, func(h *Hub) {
+		// Time stands still, so no tokens refill during the test
+		h.now = func() time.Time { return clock }
+	})
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	// The file-begin takes one of the three tokens; the upload's own
+	// chunks take none
+	alice.beginUpload("notes.txt", "hello world", "")
+	alice.sendBinary(chunk(0, "hello "))
+	alice.sendBinary(chunk(2, "world"))
+	alice.expectContent(msgSystem, "Chunk 2 arrived when chunk 1 was expected.")
+
+	// Once it has stopped, each chunk takes a token like a message
+	const chunks = 5
+	for i := range chunks {
+		alice.sendBinary(chunk(uint32(3+i), "x"))
+	}
+	for range chunks - (cfg.rateBurst - 1) {
+		alice.expectContent(msgSystem, "You're sending messages too fast")
+	}
+	bob.say("done")
+	bob.expectNoneBefore("a chunk shared as a file", isFile, isChat("bob", "done"))
+}
+
+func TestChunkedUploadIsRefused(t *testing.T) {
+	ts := newTestServer(t, uploadConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+
+	for _, tt := range []struct {
+		file *FileInfo
+		want string
+	}{
+		{nil, "A file-begin must give the file's size in bytes."},
+		{&FileInfo{Size: 0, SHA256: strings.Repeat("0", 64)}, "A file-begin must give the file's size in bytes."},
+		{&FileInfo{Size: 4096, SHA256: strings.Repeat("0", 64)}, "Files can be at most 2.048 bytes."},
+		{&FileInfo{Size: 10, SHA256: "abc"}, "A file-begin must give the file's SHA-256 as 64 hex digits."},
+		{&FileInfo{Size: 10, SHA256: strings.Repeat("zz", 32)}, "A file-begin must give the file's SHA-256 as 64 hex digits."},
+		{&FileInfo{Name: "../etc/passwd", Size: 10, SHA256: strings.Repeat("0", 64)}, "File names must be at most 255 bytes of printable text."},
+		{&FileInfo{Name: "bell\a.txt", Size: 10, SHA256: strings.Repeat("0", 64)}, "File names must be at most 255 bytes of printable text."},
+	} {
+		alice.sendFrame(Message{Type: msgFileBegin, File: tt.file})
+		alice.expectContent(msgSystem, tt.want)
+		// Until the next file-begin, chunks are still dropped
+		alice.sendBinary(chunk(0, "hello"))
+		alice.sendFrame(Message{Type: msgFileEnd})
+	}
+
+	alice.sendFrame(Message{Type: msgFileEnd})
+	alice.expectContent(msgSystem, "There is no upload to finish.")
+	if n, _ := uploadsInProgress(ts); n != 0 {
+		t.Errorf("%d refused uploads still in progress", n)
+	}
+
+	off := newTestServer(t, fileConfig(t))
+	bob := off.join(t, "/ws?username=bob")
+	bob.beginUpload("notes.txt", "hello", "")
+	bob.expectContent(msgSystem, "Chunked uploads are disabled on this server.")
+}
+
+func TestUnfinishedUploadIsReleasedOnLeaving(t *testing.T) {
+	ts := newTestServer(t, uploadConfig(t))
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	alice.beginUpload("notes.txt", "hello world", "")
+	alice.sendBinary(chunk(0, "hello "))
+	alice.say("brb")
+	bob.expect("alice's message", isChat("alice", "brb"))
+	if n, reserved := uploadsInProgress(ts); n != 1 || reserved != 11 {
+		t.Fatalf("%d uploads holding %d bytes, want alice's 11", n, reserved)
+	}
+
+	alice.leave()
+	bob.expectContent(msgSystem, "alice left the chat")
+	if n, reserved := uploadsInProgress(ts); n != 0 || reserved != 0 {
+		t.Errorf("%d uploads holding %d bytes after alice left", n, reserved)
+	}
+}
+
+func TestConcurrentUploadsAreCapped(t *testing.T) {
+	s := newFileStore(1024, 2048, time.Minute)
+	for range maxConcurrentUploads {
+		if err := s.reserve(100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.reserve(100); !errors.Is(err, errTooManyUploads) {
+		t.Errorf("reserve past the cap: %v, want errTooManyUploads", err)
+	}
+	s.release(100)
+	if err := s.reserve(100); err != nil {
+		t.Errorf("reserve after one ended: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Limits on webhook delivery. Events that arrive while the queue is full are
+// dropped, so a slow or broken receiver never holds up chat.
+const (
+	webhookQueueSize = 1024
+	webhookAttempts  = 4
+	webhookTimeout   = 5 * time.Second
+	webhookBackoff   = time.Second // Doubled after each failed attempt
+)
+
+// webhookEvent is the JSON body POSTed to the webhook for each public
+// message.
+type webhookEvent struct {
+	Room    string    `json:"room"`
+	ID      uint64    `json:"id"`
+	Type    string    `json:"type"`
+	From    string    `json:"from,omitempty"`
+	Content string    `json:"content"`
+	TS      time.Time `json:"ts"`
+}
+
+// webhook mirrors public messages to an external URL. Messages are queued
+// and POSTed one at a time by run, retrying failures with backoff.
+type webhook struct {
+	url     string
+	client  *http.Client
+	queue   chan webhookEvent
+	backoff time.Duration
+}
+
+func newWebhook(url string) *webhook {
+	return &webhook{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan webhookEvent, webhookQueueSize),
+		backoff: webhookBackoff,
+	}
+}
+
+// post queues msg from the named room for delivery. Private messages are
+// never sent.
+func (w *webhook) post(roomName string, msg Message) {
+	if msg.Type == msgPrivate {
+		return
+	}
+	event := webhookEvent{Room: roomName, ID: msg.ID, Type: msg.Type, From: msg.From, Content: msg.Content, TS: msg.TS}
+	select {
+	case w.queue <- event:
+	default:
+		warnf("Webhook queue full, dropping message %d from room %s", msg.ID, roomName)
+	}
+}
+
+// run delivers queued events until ctx is done.
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queue:
+			w.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver POSTs event, retrying failed attempts after a growing delay.
+// Receivers that answer 4xx other than 429 have rejected the event, so it
+// isn't retried.
+func (w *webhook) deliver(ctx context.Context, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		errorf("Marshal error: %v", err)
+		return
+	}
+
+	delay := w.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(ctx, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			errorf("Webhook delivery of message %d from room %s failed after %d attempts: %v", event.ID, event.Room, attempt, err)
+			return
+		}
+		debugf("Webhook attempt %d failed, retrying in %v: %v", attempt, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// send makes a single delivery attempt and reports whether a failure is
+// worth retrying.
+func (w *webhook) send(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
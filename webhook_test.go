@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the events POSTed to it. Each attempt is
+// answered with the next status in statuses, then 200 once they run out.
+type webhookReceiver struct {
+	*httptest.Server
+	events   chan map[string]any
+	attempts atomic.Int64
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	r := &webhookReceiver{events: make(chan map[string]any, 100)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := int(r.attempts.Add(1))
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with Content-Type %q", req.Method, req.Header.Get("Content-Type"))
+		}
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		var event map[string]any
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("webhook body %q: %v", body, err)
+		}
+		r.events <- event
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// next returns the next event delivered.
+func (r *webhookReceiver) next(t *testing.T) map[string]any {
+	t.Helper()
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a webhook event")
+		return nil
+	}
+}
+
+// runWebhook delivers w's events until the test ends, retrying quickly.
+func runWebhook(t *testing.T, w *webhook) {
+	w.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.run(ctx)
+}
+
+func TestWebhookMirrorsPublicMessages(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	cfg := testConfig(t)
+	cfg.webhookURL = receiver.URL
+	ts := newTestServer(t, cfg, func(h *Hub) { runWebhook(t, h.webhook) })
+	alice := ts.join(t, "/ws?username=alice")
+	ts.join(t, "/ws?username=bob")
+
+	alice.say("hello webhook")
+	msg := alice.expect("her message", isChat("alice", "hello webhook"))
+	event := receiver.next(t)
+	var keys []string
+	for key := range event {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "content,from,id,room,ts,type" {
+		t.Errorf("event has fields %s", got)
+	}
+	if event["room"] != defaultRoom || event["type"] != msgChat || event["from"] != "alice" || event["content"] != "hello webhook" || event["id"] != float64(msg.ID) {
+		t.Errorf("got event %v for message %+v", event, msg)
+	}
+	if stamp, err := time.Parse(time.RFC3339Nano, fmt.Sprint(event["ts"])); err != nil || !stamp.Equal(msg.TS) {
+		t.Errorf("event ts %v, want %v", event["ts"], msg.TS)
+	}
+
+	// Private messages and join notices aren't mirrored
+	alice.say("@bob just between us")
+	alice.say("/me waves")
+	if event := receiver.next(t); event["type"] != msgAction || event["content"] != "* alice waves" {
+		t.Errorf("got event %v, want alice's action", event)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		statuses  []int
+		attempts  int64
+		delivered bool
+	}{
+		{"recovers", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, true},
+		{"gives up", []int{500, 500, 500, 500, 500}, webhookAttempts, false},
+		{"rejected", []int{http.StatusBadRequest}, 1, false},
+	} {
+		receiver := newWebhookReceiver(t, tt.statuses...)
+		w := newWebhook(receiver.URL)
+		w.backoff = time.Millisecond
+		w.deliver(context.Background(), webhookEvent{Room: defaultRoom, ID: 1, Type: msgChat, Content: "hi"})
+
+		if n := receiver.attempts.Load(); n != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, n, tt.attempts)
+		}
+		if delivered := len(receiver.events) == 1; delivered != tt.delivered {
+			t.Errorf("%s: delivered %v, want %v", tt.name, delivered, tt.delivered)
+		}
+	}
+}
+
+func TestWebhookDoesntBlockChat(t *testing.T) {
+	// A receiver that never answers in time
+	stuck := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stuck:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	t.Cleanup(func() { close(stuck) })
+
+	cfg := testConfig(t)
+	cfg.webhookURL = receiver.URL
+	ts := newTestServer(t, cfg, func(h *Hub) { runWebhook(t, h.webhook) })
+	alice := ts.join(t, "/ws?username=alice")
+	bob := ts.join(t, "/ws?username=bob")
+
+	start := time.Now()
+	for i := range 50 {
+		text := fmt.Sprint("message ", i)
+		alice.say(text)
+		bob.expect("alice's message", isChat("alice", text))
+	}
+	if elapsed := time.Since(start); elapsed > webhookTimeout {
+		t.Errorf("chat took %v with the webhook stuck", elapsed)
+	}
+}
+
+func TestWebhookQueueDropsWhenFull(t *testing.T) {
+	w := newWebhook("http://192.0.2.1/hook") // Never run, so nothing is delivered
+	done := make(chan struct{})
+	go func() {
+		for i := range webhookQueueSize + 10 {
+			w.post(defaultRoom, Message{ID: uint64(i), Type: msgChat})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("posting to a full queue blocked")
+	}
+	if len(w.queue) != webhookQueueSize {
+		t.Errorf("%d events queued, want the queue's %d", len(w.queue), webhookQueueSize)
+	}
+	if first := <-w.queue; first.ID != 0 {
+		t.Errorf("first queued event is %d, want the oldest kept", first.ID)
+	}
+}
+
+func TestWebhookSkipsPrivateMessages(t *testing.T) {
+	w := newWebhook("http://192.0.2.1/hook")
+	w.post(defaultRoom, Message{ID: 1, Type: msgPrivate, From: "alice", To: "bob", Content: "secret"})
+	if len(w.queue) != 0 {
+		t.Error("a private message was queued")
+	}
+}